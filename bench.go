@@ -0,0 +1,161 @@
+package olua
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// ============================================================================
+// 基准测试：在内置虚拟机中比较优化前后的执行时间和内存分配
+// ============================================================================
+
+// BenchOptions 控制基准测试。
+type BenchOptions struct {
+	// Count 每段代码执行的次数，小于 1 时按 1 处理。
+	Count int
+	// PerFunction 为 true 时分别测量每个全局函数（以及 M.f 这样的模块函数），
+	// 否则测量整个文件的执行。
+	PerFunction bool
+}
+
+// BenchStat 是一段代码执行 Count 次的平均开销。
+type BenchStat struct {
+	Time   time.Duration // 每次执行的平均耗时
+	Allocs uint64        // 每次执行的平均分配次数
+	Bytes  uint64        // 每次执行的平均分配字节数
+	Failed bool          // 执行出错（出错前的开销仍计入统计）
+}
+
+// BenchResult 是一个文件或函数优化前后的基准测试结果。
+type BenchResult struct {
+	Name   string
+	Before BenchStat
+	After  BenchStat
+}
+
+// Speedup 返回优化前耗时与优化后耗时之比，大于 1 表示优化后更快。
+func (r BenchResult) Speedup() float64 {
+	if r.After.Time <= 0 {
+		return 0
+	}
+	return float64(r.Before.Time) / float64(r.After.Time)
+}
+
+// Bench 分别执行 original 和 optimized 并返回每个文件或函数的结果。
+// filename 只用于结果名和错误信息。代码无法加载时返回错误。
+func Bench(filename string, original, optimized []byte, opts BenchOptions) ([]BenchResult, error) {
+	if opts.Count < 1 {
+		opts.Count = 1
+	}
+	if !opts.PerFunction {
+		before, err := benchChunk(filename, original, opts.Count)
+		if err != nil {
+			return nil, err
+		}
+		after, err := benchChunk(filename, optimized, opts.Count)
+		if err != nil {
+			return nil, fmt.Errorf("%v optimized code: %v", filename, err)
+		}
+		return []BenchResult{{Name: filename, Before: before, After: after}}, nil
+	}
+
+	before, err := benchFunctions(filename, original, opts.Count)
+	if err != nil {
+		return nil, err
+	}
+	after, err := benchFunctions(filename, optimized, opts.Count)
+	if err != nil {
+		return nil, fmt.Errorf("%v optimized code: %v", filename, err)
+	}
+	var results []BenchResult
+	for _, name := range before.names {
+		stat, ok := after.stats[name]
+		if !ok {
+			continue
+		}
+		results = append(results, BenchResult{Name: filename + ":" + name, Before: before.stats[name], After: stat})
+	}
+	return results, nil
+}
+
+// benchChunk 每次在新的虚拟机中执行整个文件，只统计执行部分，不含编译。
+func benchChunk(filename string, src []byte, count int) (BenchStat, error) {
+	var m benchMeter
+	for i := 0; i < count; i++ {
+		l := newDeterministicState(nil)
+		if err := l.LoadText(strings.NewReader(string(src)), filename, 0); err != nil {
+			return BenchStat{}, err
+		}
+		m.start()
+		err := l.PCall(0, 0)
+		m.stop(err != nil)
+	}
+	return m.stat(count), nil
+}
+
+type functionBench struct {
+	names []string
+	stats map[string]BenchStat
+}
+
+// benchFunctions 执行一次文件后，把每个全局函数不带参数调用 count 次。
+func benchFunctions(filename string, src []byte, count int) (*functionBench, error) {
+	l := newDeterministicState(nil)
+	baseline := snapshotGlobals(l)
+	if err := l.LoadText(strings.NewReader(string(src)), filename, 0); err != nil {
+		return nil, err
+	}
+	l.PCall(0, 0)
+
+	fb := &functionBench{names: entryFunctions(l, baseline), stats: map[string]BenchStat{}}
+	for _, name := range fb.names {
+		var m benchMeter
+		for i := 0; i < count; i++ {
+			pushPath(l, name)
+			m.start()
+			err := l.PCall(0, 0)
+			m.stop(err != nil)
+		}
+		fb.stats[name] = m.stat(count)
+	}
+	return fb, nil
+}
+
+// benchMeter 累计多次执行的耗时和内存分配。
+type benchMeter struct {
+	begin   time.Time
+	ms      runtime.MemStats
+	mallocs uint64
+	total   uint64
+
+	elapsed time.Duration
+	allocs  uint64
+	bytes   uint64
+	failed  bool
+}
+
+func (m *benchMeter) start() {
+	runtime.ReadMemStats(&m.ms)
+	m.mallocs, m.total = m.ms.Mallocs, m.ms.TotalAlloc
+	m.begin = time.Now()
+}
+
+func (m *benchMeter) stop(failed bool) {
+	m.elapsed += time.Since(m.begin)
+	runtime.ReadMemStats(&m.ms)
+	m.allocs += m.ms.Mallocs - m.mallocs
+	m.bytes += m.ms.TotalAlloc - m.total
+	m.failed = m.failed || failed
+}
+
+func (m *benchMeter) stat(count int) BenchStat {
+	n := uint64(count)
+	return BenchStat{
+		Time:   m.elapsed / time.Duration(count),
+		Allocs: m.allocs / n,
+		Bytes:  m.bytes / n,
+		Failed: m.failed,
+	}
+}
@@ -0,0 +1,76 @@
+package olua
+
+import (
+	"strings"
+	"testing"
+)
+
+// ============================================================================
+// 基准测试 API 测试
+// ============================================================================
+
+const benchSource = `
+local t = {a = {b = {}}}
+function fill()
+    for i = 1, 100 do
+        t.a.b[i] = {i}
+    end
+end
+M = {}
+function M.sum()
+    local s = 0
+    for i = 1, 100 do
+        s = s + i
+    end
+    return s
+end
+function broken()
+    error("x")
+end
+fill()
+`
+
+func TestBenchChunk(t *testing.T) {
+	results, err := Bench("bench.lua", []byte(benchSource), []byte(benchSource), BenchOptions{Count: 3})
+	if err != nil {
+		t.Fatalf("Bench failed: %v", err)
+	}
+	if len(results) != 1 || results[0].Name != "bench.lua" {
+		t.Fatalf("results = %+v, want one result for the file", results)
+	}
+	r := results[0]
+	if r.Before.Time <= 0 || r.After.Time <= 0 {
+		t.Errorf("times should be positive: %+v", r)
+	}
+	if r.Before.Allocs == 0 || r.Before.Failed {
+		t.Errorf("filling a table should allocate without failing: %+v", r.Before)
+	}
+	if r.Speedup() <= 0 {
+		t.Errorf("Speedup = %v, want > 0", r.Speedup())
+	}
+}
+
+func TestBenchPerFunction(t *testing.T) {
+	results, err := Bench("bench.lua", []byte(benchSource), []byte(benchSource), BenchOptions{Count: 2, PerFunction: true})
+	if err != nil {
+		t.Fatalf("Bench failed: %v", err)
+	}
+	var names []string
+	for _, r := range results {
+		names = append(names, r.Name)
+		if strings.HasSuffix(r.Name, ":broken") != r.Before.Failed {
+			t.Errorf("%s: Failed = %v", r.Name, r.Before.Failed)
+		}
+	}
+	want := "bench.lua:M.sum,bench.lua:broken,bench.lua:fill"
+	if strings.Join(names, ",") != want {
+		t.Errorf("benchmarked %v, want %v", names, want)
+	}
+}
+
+func TestBenchLoadError(t *testing.T) {
+	_, err := Bench("bench.lua", []byte(benchSource), []byte("function f("), BenchOptions{})
+	if err == nil || !strings.Contains(err.Error(), "optimized code") {
+		t.Errorf("Bench = %v, want a load error for the optimized code", err)
+	}
+}
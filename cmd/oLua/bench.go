@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"oLua"
+)
+
+// bench 实现 bench 子命令：对每个文件（没有参数时使用 -inputpath 或 -input）
+// 应用已启用的优化，在虚拟机中分别执行优化前后的代码并输出对比表格。
+//
+//	oLua bench -opt_table_access -bench_count 10 a.lua b.lua
+func bench(files []string) {
+	if len(files) == 0 {
+		if *inputpath != "" {
+			files = append(files, *inputpath)
+		} else {
+			files = append(files, *input)
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "name\tbefore\tafter\tspeedup\tallocs before\tallocs after\tbytes before\tbytes after\t")
+	for _, file := range files {
+		filepath.Walk(file, func(path string, f os.FileInfo, err error) error {
+			if err != nil {
+				log.Fatal(err)
+			}
+			if f.IsDir() || !strings.HasSuffix(path, ".lua") {
+				return nil
+			}
+			if config != nil && !config.Includes(path) {
+				return nil
+			}
+			bench_file(w, path)
+			return nil
+		})
+	}
+	w.Flush()
+}
+
+func bench_file(w *tabwriter.Writer, path string) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	opts := options(path)
+	opts.Logger = nil
+	out, _, err := olua.Optimize(src, opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	results, err := olua.Bench(path, src, out, olua.BenchOptions{Count: *bench_count, PerFunction: *bench_per_func})
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, r := range results {
+		name := r.Name
+		if r.Before.Failed || r.After.Failed {
+			name += " (error)"
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%.2fx\t%v\t%v\t%v\t%v\t\n", name, r.Before.Time, r.After.Time, r.Speedup(),
+			r.Before.Allocs, r.After.Allocs, r.Before.Bytes, r.After.Bytes)
+	}
+}
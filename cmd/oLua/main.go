@@ -0,0 +1,515 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"oLua"
+)
+
+var input = flag.String("input", "input.lua", "Input file")
+var inputpath = flag.String("inputpath", "", "Input path")
+var output = flag.String("output", "output.lua", "Output file")
+
+var opt_const_fold = flag.Bool("opt_const_fold", false, "Fold constant expressions (60 * 60 * 24, \"a\" .. \"b\") and simplify boolean expressions")
+var opt_table_access = flag.Bool("opt_table_access", false, "Optimize table access")
+var opt_table_access_threshold = flag.Int("opt_table_access_threshold", 2, "Minimum read count to trigger table access optimization")
+var opt_table_access_pure_funcs = flag.String("opt_table_access_pure_funcs", "log_.*", "Comma-separated regex patterns for pure functions that don't modify arguments (in addition to built-in whitelist)")
+var opt_table_access_global = flag.Bool("opt_table_access_global", false, "Also optimize _G.xxx access (disabled by default for readability)")
+var opt_table_access_hoist = flag.Bool("opt_table_access_hoist", false, "With -opt_table_access, cache paths that are not modified inside a loop before the loop")
+var opt_table_constructor = flag.Bool("opt_table_constructor", false, "Optimize table constructor")
+var opt_method_cache = flag.Bool("opt_method_cache", false, "Hoist method lookups of obj:method() calls out of loops")
+var opt_method_cache_stable_methods = flag.String("opt_method_cache_stable_methods", "", "Comma-separated regex patterns for method names that never replace method fields; calling them in a loop does not prevent -opt_method_cache")
+var opt_localize = flag.Bool("opt_localize", false, "Cache frequently used globals and standard library functions (pairs, math.floor, ...) in locals")
+var opt_localize_threshold = flag.Int("opt_localize_threshold", 3, "Minimum use count to trigger localization")
+var opt_localize_function_scope = flag.Bool("opt_localize_function_scope", false, "Declare localized names at the top of each function instead of the top of the file")
+var opt_table_insert = flag.Bool("opt_table_insert", false, "Rewrite table.insert(t, v) to t[#t + 1] = v")
+var opt_table_insert_counter = flag.Bool("opt_table_insert_counter", false, "With -opt_table_insert, take the length once for consecutive appends to the same table (assumes non-nil values)")
+var opt_table_prealloc = flag.Bool("opt_table_prealloc", false, "Preallocate tables whose size is known from a constant loop bound or field assignments (requires -dialect)")
+var dialect = flag.String("dialect", "", "Target Lua dialect for dialect-specific optimizations: luajit or 5.4")
+var opt_inline = flag.Bool("opt_inline", false, "Inline calls to small non-recursive local functions")
+var opt_inline_max_cost = flag.Int("opt_inline_max_cost", 12, "Maximum function body size (AST nodes) to inline at a call site outside loops")
+var opt_inline_loop_max_cost = flag.Int("opt_inline_loop_max_cost", 24, "Maximum function body size (AST nodes) to inline at a call site inside a loop")
+var opt_dead_code = flag.Bool("opt_dead_code", false, "Remove unused locals and assignments overwritten before being read when the right-hand side has no side effects")
+var opt_dead_code_warn_only = flag.Bool("opt_dead_code_warn_only", false, "With -opt_dead_code, only report unused locals and dead assignments without changing the code")
+var opt_cse = flag.Bool("opt_cse", false, "Cache repeated pure function calls (string.len(s), math.floor(x / 32)) and length expressions (#list) of a block in a local")
+var opt_ipairs = flag.Bool("opt_ipairs", false, "Rewrite for i, v in ipairs(t) loops to numeric for loops when the body does not change t")
+var opt_concat_buffer = flag.Bool("opt_concat_buffer", false, "Rewrite s = s .. piece in loops to a buffer table and a single table.concat after the loop")
+
+var verify = flag.Bool("verify", false, "Run original and optimized code in a Lua VM and refuse to write output that behaves differently")
+var verify_entry = flag.String("verify_entry", "", "Lua script run after loading the code when verifying (default: call every top-level function)")
+
+var bench_count = flag.Int("bench_count", 5, "Number of runs per file or function in bench mode")
+var bench_per_func = flag.Bool("bench_per_func", false, "Benchmark each top-level function instead of the whole file in bench mode")
+
+var diff = flag.Bool("diff", false, "Print a unified diff per changed file to stdout instead of writing files")
+var patch = flag.String("patch", "", "Write one .patch file per changed file into this directory instead of writing files")
+
+var check = flag.Bool("check", false, "Only report pending optimizations as file:line target and exit non-zero if there are any; nothing is written")
+
+var report_file = flag.String("report", "", "Write a machine-readable report of applied rewrites to this file")
+var report_format = flag.String("report_format", "", "Report format: json or sarif (default: sarif for .sarif files, otherwise json)")
+
+var jobs = flag.Int("j", 1, "Number of files optimized in parallel in -inputpath mode")
+
+var config_file = flag.String("config", "", "Config file (default: nearest .olua.json or .olua.toml found upward from the input path)")
+var no_config = flag.Bool("no_config", false, "Do not look for a config file")
+
+// config 是生效的项目配置，没有配置文件时为 nil
+var config *olua.Config
+
+// set_flags 记录命令行中显式指定的参数，它们优先于配置文件
+var set_flags = map[string]bool{}
+
+// failed 记录是否有文件优化或校验失败，用于设置退出码
+var failed = false
+
+// verify_opts 是由 -verify_entry 生成的校验选项，在 main 中初始化一次
+var verify_opts olua.VerifyOptions
+
+// revert_mode 表示运行 revert 子命令：撤销 oLua 改写而不是优化
+var revert_mode = false
+
+func main() {
+	log.SetFlags(log.Lshortfile)
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		flag.CommandLine.Parse(os.Args[2:])
+		if flag.NArg() > 0 {
+			load_config(flag.Arg(0))
+		} else {
+			load_config(input_root())
+		}
+		bench(flag.Args())
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "revert" {
+		revert_mode = true
+		flag.CommandLine.Parse(os.Args[2:])
+	} else {
+		flag.Parse()
+	}
+	if !olua.IsValidDialect(*dialect) {
+		log.Fatalf("unknown dialect %q, expected luajit or 5.4", *dialect)
+	}
+	load_config(input_root())
+	if *verify {
+		verify_opts = verify_options()
+	}
+
+	if *inputpath != "" {
+		opt_path(*inputpath)
+	} else {
+		opt(*input, *output)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// input_root 返回本次运行的输入路径，用于查找配置文件。
+func input_root() string {
+	if *inputpath != "" {
+		return *inputpath
+	}
+	return *input
+}
+
+// load_config 加载 -config 指定的配置文件，或从 path 向上查找配置文件。
+func load_config(path string) {
+	flag.Visit(func(f *flag.Flag) {
+		set_flags[f.Name] = true
+	})
+	if *no_config {
+		return
+	}
+	var err error
+	if *config_file != "" {
+		config, err = olua.LoadConfig(*config_file)
+	} else {
+		config, err = olua.FindConfig(path)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if config != nil {
+		log.Println("use config:", config.Filename)
+	}
+}
+
+// options 把配置文件和命令行参数转换为 olua.Options。
+// 先应用配置文件中作用于 filename 的设置，再应用命令行中显式指定的参数；
+// 没有配置文件时等同于直接使用命令行参数（包括默认值）。
+func options(filename string) olua.Options {
+	opts := olua.DefaultOptions()
+	opts.Filename = filename
+	if config != nil {
+		config.Apply(filename, &opts)
+	}
+	use := func(name string) bool {
+		return config == nil || set_flags[name]
+	}
+	if use("opt_const_fold") {
+		opts.ConstFold = *opt_const_fold
+	}
+	if use("opt_table_access") {
+		opts.TableAccess = *opt_table_access
+	}
+	if use("opt_table_access_threshold") {
+		opts.TableAccessThreshold = *opt_table_access_threshold
+	}
+	if use("opt_table_access_pure_funcs") {
+		opts.TableAccessPureFuncs = strings.Split(*opt_table_access_pure_funcs, ",")
+	}
+	if use("opt_table_access_global") {
+		opts.TableAccessGlobal = *opt_table_access_global
+	}
+	if use("opt_table_access_hoist") {
+		opts.TableAccessHoist = *opt_table_access_hoist
+	}
+	if use("opt_table_constructor") {
+		opts.TableConstructor = *opt_table_constructor
+	}
+	if use("opt_method_cache") {
+		opts.MethodCache = *opt_method_cache
+	}
+	if use("opt_method_cache_stable_methods") {
+		opts.MethodCacheStableMethods = strings.Split(*opt_method_cache_stable_methods, ",")
+	}
+	if use("opt_localize") {
+		opts.Localize = *opt_localize
+	}
+	if use("opt_localize_threshold") {
+		opts.LocalizeThreshold = *opt_localize_threshold
+	}
+	if use("opt_localize_function_scope") {
+		opts.LocalizeFunctionScope = *opt_localize_function_scope
+	}
+	if use("opt_table_insert") {
+		opts.TableInsert = *opt_table_insert
+	}
+	if use("opt_table_insert_counter") {
+		opts.TableInsertCounter = *opt_table_insert_counter
+	}
+	if use("opt_table_prealloc") {
+		opts.TablePrealloc = *opt_table_prealloc
+	}
+	if use("dialect") {
+		opts.Dialect = *dialect
+	}
+	if use("opt_inline") {
+		opts.Inline = *opt_inline
+	}
+	if use("opt_inline_max_cost") {
+		opts.InlineMaxCost = *opt_inline_max_cost
+	}
+	if use("opt_inline_loop_max_cost") {
+		opts.InlineLoopMaxCost = *opt_inline_loop_max_cost
+	}
+	if use("opt_dead_code") {
+		opts.DeadCode = *opt_dead_code
+	}
+	if use("opt_dead_code_warn_only") {
+		opts.DeadCodeWarnOnly = *opt_dead_code_warn_only
+	}
+	if use("opt_concat_buffer") {
+		opts.ConcatBuffer = *opt_concat_buffer
+	}
+	if use("opt_cse") {
+		opts.CSE = *opt_cse
+	}
+	if use("opt_ipairs") {
+		opts.Ipairs = *opt_ipairs
+	}
+	opts.Logger = log.Default()
+	return opts
+}
+
+// transform 按运行模式优化或还原源码。
+func transform(src []byte, filename string) ([]byte, olua.Report, error) {
+	if revert_mode {
+		return olua.Revert(src, options(filename))
+	}
+	return olua.Optimize(src, options(filename))
+}
+
+// verify_options 读取 -verify_entry 指定的入口脚本。
+func verify_options() olua.VerifyOptions {
+	opts := olua.VerifyOptions{}
+	if *verify_entry != "" {
+		entry, err := os.ReadFile(*verify_entry)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts.Entry = string(entry)
+		opts.EntryName = *verify_entry
+	}
+	return opts
+}
+
+// verify_file 在开启 -verify 时校验优化前后的行为是否一致。
+func verify_file(filename string, src []byte, out []byte) error {
+	if !*verify {
+		return nil
+	}
+	return olua.Verify(filename, src, out, verify_opts)
+}
+
+// dry_run 表示只输出 diff、patch 或检查结果，不修改源文件
+func dry_run() bool {
+	return *diff || *patch != "" || *check
+}
+
+// print_pending 在 -check 模式下输出尚未应用的优化，有待优化项时设置失败退出码。
+func print_pending(report olua.Report) {
+	rewrites := append([]olua.Rewrite(nil), report.Rewrites...)
+	sort.SliceStable(rewrites, func(i, j int) bool { return rewrites[i].Line < rewrites[j].Line })
+	for _, rw := range rewrites {
+		fmt.Printf("%s:%d %s\n", report.Filename, rw.Line, rw.Target)
+	}
+	if report.OptCount > 0 {
+		failed = true
+	}
+}
+
+// write_patch 把 diff 写到 -patch 目录下的 name.patch。
+func write_patch(name string, content string) error {
+	filename := filepath.Join(*patch, name+".patch")
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+	return write_file(filename, []byte(content))
+}
+
+// file_result 是目录模式下单个文件的处理结果。
+type file_result struct {
+	path      string
+	opt_count int
+	diff      string
+	report    olua.Report
+	err       error
+}
+
+// opt_path 优化目录下的所有 lua 文件并原地替换。-j 大于 1 时多个文件并行处理，
+// 每个文件使用独立的优化状态，最后输出汇总。
+func opt_path(inputpath string) {
+	var files []string
+	var results []file_result
+	filepath.Walk(inputpath, func(path string, f os.FileInfo, err error) error {
+		if err != nil {
+			results = append(results, file_result{path: path, err: err})
+			return nil
+		}
+		if f.IsDir() {
+			return nil
+		}
+		if !strings.HasSuffix(path, ".lua") {
+			return nil
+		}
+		if config != nil && !config.Includes(path) {
+			return nil
+		}
+		files = append(files, path)
+		return nil
+	})
+
+	n := *jobs
+	if n < 1 {
+		n = 1
+	}
+	file_results := make([]file_result, len(files))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < n; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				file_results[i] = opt_file(inputpath, files[i])
+			}
+		}()
+	}
+	for i := range files {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	results = append(results, file_results...)
+
+	var reports []olua.Report
+	for _, r := range file_results {
+		if r.err == nil {
+			reports = append(reports, r.report)
+		}
+		if *diff {
+			os.Stdout.WriteString(r.diff)
+		}
+		if *check {
+			print_pending(r.report)
+		}
+	}
+
+	changed, opt_count := 0, 0
+	var failures []file_result
+	for _, r := range results {
+		if r.err != nil {
+			failures = append(failures, r)
+			continue
+		}
+		if r.opt_count > 0 {
+			changed++
+			opt_count += r.opt_count
+		}
+	}
+	log.Printf("opt_path done: %d files, %d changed, %d optimizations, %d failures", len(files), changed, opt_count, len(failures))
+	for _, r := range failures {
+		log.Printf("failed: %v: %v", r.path, r.err)
+	}
+	if len(failures) > 0 {
+		failed = true
+	}
+	write_report(reports)
+}
+
+// opt_file 优化单个文件，有改写且通过校验时原地替换（dry run 时只生成 diff/patch）。
+func opt_file(inputpath string, path string) file_result {
+	log.Println("start opt_path:", path)
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return file_result{path: path, err: err}
+	}
+	out, report, err := transform(src, path)
+	if err != nil {
+		return file_result{path: path, err: err}
+	}
+	if report.OptCount == 0 {
+		return file_result{path: path, report: report}
+	}
+	if *check {
+		return file_result{path: path, opt_count: report.OptCount, report: report}
+	}
+	if err := verify_file(path, src, out); err != nil {
+		return file_result{path: path, err: err}
+	}
+	if dry_run() {
+		d := olua.UnifiedDiff(filepath.ToSlash(path), src, out)
+		if *patch != "" {
+			rel, err := filepath.Rel(inputpath, path)
+			if err != nil || rel == "." {
+				rel = filepath.Base(path)
+			}
+			if err := write_patch(rel, d); err != nil {
+				return file_result{path: path, err: err}
+			}
+		}
+		return file_result{path: path, opt_count: report.OptCount, diff: d, report: report}
+	}
+	if err := write_file(path, out); err != nil {
+		return file_result{path: path, err: err}
+	}
+	return file_result{path: path, opt_count: report.OptCount, report: report}
+}
+
+func opt(input string, output string) {
+	src, err := os.ReadFile(input)
+	if err != nil {
+		log.Fatal(err)
+	}
+	out, report, err := transform(src, input)
+	if err != nil {
+		log.Fatal(err)
+	}
+	write_report([]olua.Report{report})
+	if *check {
+		print_pending(report)
+		return
+	}
+	if report.OptCount > 0 {
+		if err := verify_file(input, src, out); err != nil {
+			log.Println(err)
+			failed = true
+			return
+		}
+	}
+	if dry_run() {
+		d := olua.UnifiedDiff(filepath.ToSlash(input), src, out)
+		if d == "" {
+			return
+		}
+		if *diff {
+			os.Stdout.WriteString(d)
+		}
+		if *patch != "" {
+			if err := write_patch(filepath.Base(input), d); err != nil {
+				log.Fatal(err)
+			}
+		}
+		return
+	}
+	if err := write_file(output, out); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// write_report 在指定 -report 时写出优化报告。
+func write_report(reports []olua.Report) {
+	if *report_file == "" {
+		return
+	}
+	format := *report_format
+	if format == "" {
+		format = "json"
+		if strings.HasSuffix(*report_file, ".sarif") {
+			format = "sarif"
+		}
+	}
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case "json":
+		err = olua.WriteJSONReport(&buf, reports)
+	case "sarif":
+		err = olua.WriteSARIFReport(&buf, reports)
+	default:
+		log.Fatalf("unknown report format %q", format)
+	}
+	if err == nil {
+		err = write_file(*report_file, buf.Bytes())
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// write_file 先写入目标文件所在目录下的临时文件，再重命名覆盖目标，
+// 避免中途失败留下写了一半的文件。
+func write_file(filename string, content []byte) error {
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(filename); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(content)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), mode)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
@@ -1,9 +1,8 @@
-package main
+package olua
 
 import (
 	"github.com/milochristiansen/lua/ast"
 	"math"
-	"strings"
 )
 
 type lua_visitor struct {
@@ -24,60 +23,6 @@ func (lv *lua_visitor) Visit(n ast.Node) ast.Visitor {
 	}
 }
 
-func find_end_line(block []ast.Stmt, stmt ast.Stmt) int {
-
-	var next_stmt ast.Stmt
-	var next_index int
-	for i, s := range block {
-		if s == stmt {
-			next_index = i
-		}
-	}
-
-	for i := next_index + 1; i < len(block); i++ {
-		empty := false
-		switch block[i].(type) {
-		case *ast.DoBlock:
-			if len(block[i].(*ast.DoBlock).Block) == 0 {
-				empty = true
-			}
-			break
-		}
-		if !empty {
-			next_stmt = block[i]
-			break
-		}
-	}
-
-	if next_stmt == nil {
-		start_line := stmt.Line()
-		cur := 0
-		for i := start_line; i < len(gfilecontent); i++ {
-			line := gfilecontent[i-1]
-			left := strings.Count(line, "{")
-			cur += left
-			right := strings.Count(line, "}")
-			cur -= right
-			if cur == 0 {
-				return i + 1
-			}
-		}
-		return len(gfilecontent) + 1
-	} else {
-		minline := math.MaxInt32
-		f := lua_visitor{f: func(n ast.Node, ok *bool) {
-			if n != nil {
-				line := n.Line()
-				if line < minline {
-					minline = line
-				}
-			}
-		}}
-		ast.Walk(&f, next_stmt)
-		return minline
-	}
-}
-
 func check_expr_same(left ast.Expr, right ast.Expr) bool {
 	switch left.(type) {
 	case *ast.ConstIdent:
@@ -103,6 +48,12 @@ func check_expr_same(left ast.Expr, right ast.Expr) bool {
 		switch right.(type) {
 		case *ast.FuncCall:
 			right_call := right.(*ast.FuncCall)
+			if (left_call.Receiver == nil) != (right_call.Receiver == nil) {
+				return false
+			}
+			if left_call.Receiver != nil && !check_expr_same(left_call.Receiver, right_call.Receiver) {
+				return false
+			}
 			if check_expr_same(left_call.Function, right_call.Function) {
 				if len(left_call.Args) == len(right_call.Args) {
 					for i := 0; i < len(left_call.Args); i++ {
@@ -172,6 +123,26 @@ func check_expr_same(left ast.Expr, right ast.Expr) bool {
 		case *ast.ConstNil:
 			return true
 		}
+	case *ast.Operator:
+		left_op := left.(*ast.Operator)
+		switch right.(type) {
+		case *ast.Operator:
+			right_op := right.(*ast.Operator)
+			if left_op.Op != right_op.Op || (left_op.Left == nil) != (right_op.Left == nil) {
+				return false
+			}
+			if left_op.Left != nil && !check_expr_same(left_op.Left, right_op.Left) {
+				return false
+			}
+			return check_expr_same(left_op.Right, right_op.Right)
+		}
+	case *ast.Parens:
+		left_parens := left.(*ast.Parens)
+		switch right.(type) {
+		case *ast.Parens:
+			right_parens := right.(*ast.Parens)
+			return check_expr_same(left_parens.Inner, right_parens.Inner)
+		}
 	}
 
 	return false
@@ -186,211 +157,14 @@ func get_content_space(content string) string {
 	return ""
 }
 
-func expr_to_string(expr ast.Expr) string {
-	expr_str := ""
-	switch expr.(type) {
-	case *ast.ConstIdent:
-		expr_str = expr.(*ast.ConstIdent).Value
-	case *ast.TableAccessor:
-		switch expr.(*ast.TableAccessor).Key.(type) {
-		case *ast.ConstString:
-			expr_str = expr_to_string(expr.(*ast.TableAccessor).Obj) + "." + expr.(*ast.TableAccessor).Key.(*ast.ConstString).Value
-		default:
-			expr_str = expr_to_string(expr.(*ast.TableAccessor).Obj) + "[" + expr_to_string(expr.(*ast.TableAccessor).Key) + "]"
-		}
-	case *ast.FuncCall:
-		if expr.(*ast.FuncCall).Receiver != nil {
-			expr_str = expr_to_string(expr.(*ast.FuncCall).Receiver) + ":"
-		}
-		switch expr.(*ast.FuncCall).Function.(type) {
-		case *ast.ConstString:
-			expr_str += expr.(*ast.FuncCall).Function.(*ast.ConstString).Value
-		default:
-			expr_str += expr_to_string(expr.(*ast.FuncCall).Function)
-		}
-		expr_str += "("
-		for i, arg := range expr.(*ast.FuncCall).Args {
-			if i > 0 {
-				expr_str += ","
-			}
-			expr_str += expr_to_string(arg)
-		}
-		expr_str += ")"
-	case *ast.TableConstructor:
-		expr_str = "{"
-		for i, field := range expr.(*ast.TableConstructor).Keys {
-			if i > 0 {
-				expr_str += ","
-			}
-			if field != nil {
-				switch field.(type) {
-				case *ast.ConstIdent:
-					expr_str += "[" + field.(*ast.ConstIdent).Value + "]"
-				case *ast.ConstString:
-					expr_str += field.(*ast.ConstString).Value
-				case *ast.ConstInt:
-					expr_str += "[" + field.(*ast.ConstInt).Value + "]"
-				}
-				expr_str += "="
-			}
-			expr_str += expr_to_string(expr.(*ast.TableConstructor).Vals[i])
-		}
-		expr_str += "}"
-	case *ast.ConstString:
-		expr_str = "'" + expr.(*ast.ConstString).Value + "'"
-	case *ast.ConstInt:
-		expr_str = expr.(*ast.ConstInt).Value
-	case *ast.ConstFloat:
-		expr_str = expr.(*ast.ConstFloat).Value
-	case *ast.ConstNil:
-		expr_str = "nil"
-	case *ast.ConstBool:
-		if expr.(*ast.ConstBool).Value {
-			expr_str = "true"
-		} else {
-			expr_str = "false"
-		}
-	case *ast.Operator:
-		op := expr.(*ast.Operator).Op
-		switch op {
-		case ast.OpAdd:
-			expr_str = expr_to_string(expr.(*ast.Operator).Left) + "+" + expr_to_string(expr.(*ast.Operator).Right)
-		case ast.OpSub:
-			expr_str = expr_to_string(expr.(*ast.Operator).Left) + "-" + expr_to_string(expr.(*ast.Operator).Right)
-		case ast.OpMul:
-			expr_str = expr_to_string(expr.(*ast.Operator).Left) + "*" + expr_to_string(expr.(*ast.Operator).Right)
-		case ast.OpMod:
-			expr_str = expr_to_string(expr.(*ast.Operator).Left) + "%" + expr_to_string(expr.(*ast.Operator).Right)
-		case ast.OpPow:
-			expr_str = expr_to_string(expr.(*ast.Operator).Left) + "^" + expr_to_string(expr.(*ast.Operator).Right)
-		case ast.OpDiv:
-			expr_str = expr_to_string(expr.(*ast.Operator).Left) + ".." + expr_to_string(expr.(*ast.Operator).Right)
-		case ast.OpBinAND:
-			expr_str = expr_to_string(expr.(*ast.Operator).Left) + "&" + expr_to_string(expr.(*ast.Operator).Right)
-		case ast.OpBinOR:
-			expr_str = expr_to_string(expr.(*ast.Operator).Left) + "|" + expr_to_string(expr.(*ast.Operator).Right)
-		case ast.OpBinXOR:
-			expr_str = expr_to_string(expr.(*ast.Operator).Left) + "~" + expr_to_string(expr.(*ast.Operator).Right)
-		case ast.OpBinShiftL:
-			expr_str = expr_to_string(expr.(*ast.Operator).Left) + "<<" + expr_to_string(expr.(*ast.Operator).Right)
-		case ast.OpBinShiftR:
-			expr_str = expr_to_string(expr.(*ast.Operator).Left) + ">>" + expr_to_string(expr.(*ast.Operator).Right)
-		case ast.OpUMinus:
-			expr_str = "-" + expr_to_string(expr.(*ast.Operator).Right)
-		case ast.OpBinNot:
-			expr_str = "~" + expr_to_string(expr.(*ast.Operator).Right)
-		case ast.OpNot:
-			expr_str = "not " + expr_to_string(expr.(*ast.Operator).Left)
-		case ast.OpLength:
-			expr_str = "#" + expr_to_string(expr.(*ast.Operator).Left)
-		case ast.OpConcat:
-			expr_str = expr_to_string(expr.(*ast.Operator).Left) + ".." + expr_to_string(expr.(*ast.Operator).Right)
-		case ast.OpEqual:
-			expr_str = expr_to_string(expr.(*ast.Operator).Left) + "==" + expr_to_string(expr.(*ast.Operator).Right)
-		case ast.OpNotEqual:
-			expr_str = expr_to_string(expr.(*ast.Operator).Left) + "~=" + expr_to_string(expr.(*ast.Operator).Right)
-		case ast.OpLessThan:
-			expr_str = expr_to_string(expr.(*ast.Operator).Left) + "<" + expr_to_string(expr.(*ast.Operator).Right)
-		case ast.OpGreaterThan:
-			expr_str = expr_to_string(expr.(*ast.Operator).Left) + ">" + expr_to_string(expr.(*ast.Operator).Right)
-		case ast.OpLessOrEqual:
-			expr_str = expr_to_string(expr.(*ast.Operator).Left) + "<=" + expr_to_string(expr.(*ast.Operator).Right)
-		case ast.OpGreaterOrEqual:
-			expr_str = expr_to_string(expr.(*ast.Operator).Left) + ">=" + expr_to_string(expr.(*ast.Operator).Right)
-		case ast.OpAnd:
-			expr_str = expr_to_string(expr.(*ast.Operator).Left) + " and " + expr_to_string(expr.(*ast.Operator).Right)
-		case ast.OpOr:
-			expr_str = expr_to_string(expr.(*ast.Operator).Left) + " or " + expr_to_string(expr.(*ast.Operator).Right)
-		}
-	case *ast.Parens:
-		expr_str = "(" + expr_to_string(expr.(*ast.Parens).Inner) + ")"
-	}
-	return expr_str
-}
-
-func can_expr_to_string(expr ast.Expr) bool {
-	ret := true
-	switch expr.(type) {
-	case *ast.ConstIdent:
-		ret = true
-	case *ast.TableAccessor:
-		ret = can_expr_to_string(expr.(*ast.TableAccessor).Obj) && can_expr_to_string(expr.(*ast.TableAccessor).Key)
-	case *ast.FuncCall:
-		if expr.(*ast.FuncCall).Receiver != nil {
-			ret = can_expr_to_string(expr.(*ast.FuncCall).Receiver)
-		}
-		ret = ret && can_expr_to_string(expr.(*ast.FuncCall).Function)
-		for _, arg := range expr.(*ast.FuncCall).Args {
-			ret = ret && can_expr_to_string(arg)
-		}
-	case *ast.TableConstructor:
-		for i, field := range expr.(*ast.TableConstructor).Keys {
-			if field != nil {
-				switch field.(type) {
-				case *ast.ConstIdent:
-				case *ast.ConstString:
-				case *ast.ConstInt:
-				default:
-					return false
-				}
-			}
-			ret = ret && can_expr_to_string(expr.(*ast.TableConstructor).Vals[i])
-		}
-	case *ast.ConstString:
-		ret = true
-	case *ast.ConstInt:
-		ret = true
-	case *ast.ConstFloat:
-		ret = true
-	case *ast.ConstNil:
-		ret = true
-	case *ast.ConstBool:
-		ret = true
-	case *ast.Operator:
-		op := expr.(*ast.Operator).Op
-		switch op {
-		case ast.OpAdd:
-		case ast.OpSub:
-		case ast.OpMul:
-		case ast.OpMod:
-		case ast.OpPow:
-		case ast.OpDiv:
-		case ast.OpBinAND:
-		case ast.OpBinOR:
-		case ast.OpBinXOR:
-		case ast.OpBinShiftL:
-		case ast.OpBinShiftR:
-		case ast.OpUMinus:
-		case ast.OpBinNot:
-		case ast.OpNot:
-		case ast.OpLength:
-		case ast.OpConcat:
-		case ast.OpEqual:
-		case ast.OpNotEqual:
-		case ast.OpLessThan:
-		case ast.OpGreaterThan:
-		case ast.OpLessOrEqual:
-		case ast.OpGreaterOrEqual:
-		case ast.OpAnd:
-		case ast.OpOr:
-		default:
-			ret = false
-		}
-	case *ast.Parens:
-		ret = can_expr_to_string(expr.(*ast.Parens).Inner)
-	default:
-		ret = false
-	}
-	return ret
-}
-
-func find_stmt_line_range(stmt ast.Node) (int, int) {
+func (o *optimizer) find_stmt_line_range(stmt ast.Node) (int, int) {
 
 	min_line := math.MaxInt32
 	max_line := -1
 
 	f := lua_visitor{f: func(n ast.Node, ok *bool) {
-		if n != nil {
+		// 行号为 0 的是改写时新建的节点，没有位置信息
+		if n != nil && n.Line() > 0 {
 			line := n.Line()
 			if line > max_line {
 				max_line = line
@@ -408,29 +182,40 @@ func find_stmt_line_range(stmt ast.Node) (int, int) {
 	}
 
 	switch stmt.(type) {
-	case *ast.FuncCall:
-		// find last )
-		num := 0
-		for i := min_line; i <= len(gfilecontent); i++ {
-			num += strings.Count(gfilecontent[i-1], "(")
-			num -= strings.Count(gfilecontent[i-1], ")")
-			if num == 0 {
-				max_line = i
-				break
-			}
-		}
-	case *ast.TableConstructor:
-		// find last }
-		num := 0
-		for i := min_line; i <= len(gfilecontent); i++ {
-			num += strings.Count(gfilecontent[i-1], "{")
-			num -= strings.Count(gfilecontent[i-1], "}")
-			if num == 0 {
-				max_line = i
-				break
-			}
+	case *ast.FuncCall, *ast.TableConstructor:
+		// 最后一个节点之后可能还有跨行的 ) 或 }，用试解析找到真正的结束行
+		if end_line, ok := o.find_stmts_end_line(min_line, max_line, 0); ok {
+			max_line = end_line
 		}
 	}
 
 	return min_line, max_line
 }
+
+// maxStmtTailLines 是语句最后一个 AST 节点之后最多还能跨越的行数。
+const maxStmtTailLines = 200
+
+// find_stmts_end_line 查找从 start_line 开始的语句的结束行。
+// 依次尝试解析 [start_line, end] 行（end 从 min_end 开始递增），
+// 第一个能完整解析的 end 即为结束行。count > 0 时还要求恰好解析出
+// count 条语句，用于保证这些行中没有混入其他语句。
+// 与按括号计数不同，这种方式不会被字符串和注释中的括号干扰。
+func (o *optimizer) find_stmts_end_line(start_line int, min_end int, count int) (int, bool) {
+	if start_line < 1 || start_line > len(o.filecontent) {
+		return -1, false
+	}
+	if min_end < start_line {
+		min_end = start_line
+	}
+	for end := min_end; end <= len(o.filecontent) && end <= min_end+maxStmtTailLines; end++ {
+		block, err := ast.Parse(joinSource(o.filecontent[start_line-1:end]), start_line)
+		if err != nil {
+			continue
+		}
+		if count > 0 && len(block) != count {
+			return -1, false
+		}
+		return end, true
+	}
+	return -1, false
+}
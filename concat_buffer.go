@@ -0,0 +1,367 @@
+package olua
+
+import (
+	"github.com/milochristiansen/lua/ast"
+)
+
+// ============================================================================
+// 循环中的字符串拼接改写为 table.concat 缓冲区
+// ============================================================================
+//
+// 循环中 s = s .. piece 每次都会创建一个新字符串并复制之前的全部内容，总开销是平方级的。
+// 当 s 是以字符串字面量初始化的局部变量，并且在循环中只被这样追加时，改写为：
+//
+//	local s_buf = {s} -- opt by oLua (concat_buffer)
+//	for i = 1, n do
+//	    s_buf[#s_buf + 1] = piece
+//	end
+//	s = table.concat(s_buf) -- opt by oLua (concat_buffer)
+//
+// 以下情况不改写，并在报告中记录原因：
+//   - s 不是以字符串字面量初始化的局部变量，或在函数中被赋值为其他值（此时无法保证循环开始时 s 是字符串）
+//   - s 在循环中（包括条件）被读取、被重新声明，或者被函数捕获（函数可能在循环中被调用并读取 s）
+//   - 循环中有 goto（跳出循环时会跳过 table.concat）
+//   - table 在文件中被重新声明或赋值
+//   - 循环或追加语句与其他语句共享一行
+//
+// 注意：piece 为 nil 时原代码在拼接时出错，改写后 nil 不会被加入缓冲区。
+
+// concatBufferMarker 是缓冲区声明行和 table.concat 行的标记
+const concatBufferMarker = "-- opt by oLua (concat_buffer)"
+
+// concatScope 表示 block[idx] 是包含当前代码的语句
+type concatScope struct {
+	block []ast.Stmt
+	idx   int
+}
+
+// opt_block_concat_buffer 在函数体或主代码块 block 的循环中改写一个拼接变量。
+func (o *optimizer) opt_block_concat_buffer(block []ast.Stmt) {
+	o.concatBufferBlock(block, nil)
+}
+
+func (o *optimizer) concatBufferBlock(block []ast.Stmt, chain []concatScope) bool {
+	for i, stmt := range block {
+		if o.hasOpt {
+			return true
+		}
+		here := append(chain[:len(chain):len(chain)], concatScope{block: block, idx: i})
+		var children [][]ast.Stmt
+		switch s := stmt.(type) {
+		case *ast.ForLoopNumeric, *ast.ForLoopGeneric, *ast.WhileLoop, *ast.RepeatUntilLoop:
+			if o.concatBufferLoop(here) {
+				return true
+			}
+			children = loop_body(stmt)
+		case *ast.DoBlock:
+			children = [][]ast.Stmt{s.Block}
+		case *ast.If:
+			children = [][]ast.Stmt{s.Then, s.Else}
+		}
+		for _, child := range children {
+			if o.concatBufferBlock(child, here) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// concatAppend 判断 stmt 是否是 name = name .. piece，返回 piece。
+func concatAppend(stmt ast.Node, name string) (ast.Expr, bool) {
+	assign, ok := stmt.(*ast.Assign)
+	if !ok || assign.LocalDecl || len(assign.Targets) != 1 || len(assign.Values) != 1 {
+		return nil, false
+	}
+	if ident, ok := assign.Targets[0].(*ast.ConstIdent); !ok || ident.Value != name {
+		return nil, false
+	}
+	op, ok := assign.Values[0].(*ast.Operator)
+	if !ok || op.Op != ast.OpConcat {
+		return nil, false
+	}
+	if left, ok := op.Left.(*ast.ConstIdent); !ok || left.Value != name {
+		return nil, false
+	}
+	return op.Right, true
+}
+
+// concatAppendTargets 返回循环中（不含函数体）所有 x = x .. piece 语句追加的变量名，按首次出现排序。
+func concatAppendTargets(loop ast.Stmt) []string {
+	var names []string
+	seen := map[string]bool{}
+	f := lua_visitor{f: func(n ast.Node, ok *bool) {
+		switch e := n.(type) {
+		case *ast.FuncDecl:
+			*ok = false
+		case *ast.Assign:
+			if len(e.Targets) != 1 {
+				return
+			}
+			ident, is_ident := e.Targets[0].(*ast.ConstIdent)
+			if !is_ident || seen[ident.Value] {
+				return
+			}
+			if _, is_append := concatAppend(e, ident.Value); is_append {
+				seen[ident.Value] = true
+				names = append(names, ident.Value)
+			}
+		}
+	}}
+	ast.Walk(&f, loop)
+	return names
+}
+
+// concatBufferLoop 尝试改写 chain 最内层语句（一个循环）中的一个拼接变量，成功时返回 true。
+func (o *optimizer) concatBufferLoop(chain []concatScope) bool {
+	inner := chain[len(chain)-1]
+	block, idx := inner.block, inner.idx
+	loop := block[idx]
+	names := concatAppendTargets(loop)
+	if len(names) == 0 {
+		return false
+	}
+	loop_start, last_line := o.find_stmt_line_range(loop)
+	loop_end, ok := o.find_stmts_end_line(loop_start, last_line, 1)
+	if !ok {
+		loop_end = last_line
+	}
+	if o.isDisabled("concat_buffer", loop_start, loop_end) {
+		return false
+	}
+
+	for _, name := range names {
+		reason := o.concatBufferSkipReason(chain, name, loop_start, loop_end, ok)
+		if reason != "" {
+			o.addSkip(Skip{Pass: "concat_buffer", Line: o.origLine(loop_start), Target: name, Reason: reason})
+			continue
+		}
+		o.applyConcatBuffer(chain, name, loop_start, loop_end)
+		return true
+	}
+	return false
+}
+
+// concatBufferSkipReason 返回 name 不能改写的原因，可以改写时返回空串。
+func (o *optimizer) concatBufferSkipReason(chain []concatScope, name string, loop_start int, loop_end int, has_end bool) string {
+	inner := chain[len(chain)-1]
+	block, idx := inner.block, inner.idx
+	loop := block[idx]
+
+	if o.isGlobalShadowed("table") {
+		return "table is shadowed or assigned in this file"
+	}
+	decl_block, decl_idx, reason := findStringLocal(chain, name)
+	if reason != "" {
+		return reason
+	}
+	if loopLocalNames(loop)[name] {
+		return "redeclared inside the loop"
+	}
+
+	// 声明之后的所有赋值都必须保持 name 是字符串，函数不能捕获 name
+	scope := decl_block[decl_idx+1:]
+	captured, non_string := false, false
+	f := lua_visitor{f: func(n ast.Node, ok *bool) {
+		switch e := n.(type) {
+		case *ast.FuncDecl:
+			if collectIdentifiers(e.Block)[name] || containsString(e.Params, name) {
+				captured = true
+			}
+			*ok = false
+		case *ast.Assign:
+			if e.LocalDecl {
+				return
+			}
+			for i, t := range e.Targets {
+				ident, is_ident := t.(*ast.ConstIdent)
+				if !is_ident || ident.Value != name {
+					continue
+				}
+				if _, is_append := concatAppend(e, name); is_append {
+					continue
+				}
+				if len(e.Targets) != 1 || i >= len(e.Values) {
+					non_string = true
+				} else if _, is_str := e.Values[i].(*ast.ConstString); !is_str {
+					non_string = true
+				}
+			}
+		}
+	}}
+	for _, stmt := range scope {
+		ast.Walk(&f, stmt)
+	}
+	if captured {
+		return "captured by a closure"
+	}
+	if non_string {
+		return "assigned a value that may not be a string"
+	}
+
+	// 循环中 name 只能出现在追加语句的目标和左操作数中
+	appends, refs, has_goto := 0, 0, false
+	g := lua_visitor{f: func(n ast.Node, ok *bool) {
+		switch e := n.(type) {
+		case *ast.ConstIdent:
+			if e.Value == name {
+				refs++
+			}
+		case *ast.Goto:
+			if !e.IsBreak {
+				has_goto = true
+			}
+		case *ast.Assign:
+			if piece, is_append := concatAppend(e, name); is_append && !collectIdentifiers([]ast.Stmt{&ast.Return{Items: []ast.Expr{piece}}})[name] {
+				appends++
+			}
+		}
+	}}
+	ast.Walk(&g, loop)
+	if refs != 2*appends {
+		return "read inside the loop"
+	}
+	if has_goto {
+		return "loop contains goto"
+	}
+
+	// 结构：循环独占起止行，追加语句各自独占一行
+	if !has_end {
+		return "loop does not end on its own line"
+	}
+	if idx > 0 {
+		if _, prev_end := o.find_stmt_line_range(block[idx-1]); prev_end >= loop_start {
+			return "loop shares its first line with another statement"
+		}
+	}
+	if idx+1 < len(block) && block[idx+1].Line() <= loop_end {
+		return "loop shares its last line with another statement"
+	}
+	for _, line := range o.concatAppendLines(loop, name) {
+		if line < 0 {
+			return "append statement shares its line with other code"
+		}
+	}
+	return ""
+}
+
+// findStringLocal 在 chain 的各层语句块中由内向外查找 name 的局部变量声明，
+// 声明必须以字符串字面量初始化。返回声明所在的语句块和下标，找不到或不满足时返回原因。
+func findStringLocal(chain []concatScope, name string) ([]ast.Stmt, int, string) {
+	for c := len(chain) - 1; c >= 0; c-- {
+		block := chain[c].block
+		for j := chain[c].idx - 1; j >= 0; j-- {
+			assign, ok := block[j].(*ast.Assign)
+			if !ok || !assign.LocalDecl {
+				continue
+			}
+			for k, t := range assign.Targets {
+				if ident, is_ident := t.(*ast.ConstIdent); !is_ident || ident.Value != name {
+					continue
+				}
+				if k < len(assign.Values) {
+					if _, is_str := assign.Values[k].(*ast.ConstString); is_str && !assign.LocalFunc {
+						return block, j, ""
+					}
+				}
+				return nil, 0, "not initialized with a string literal"
+			}
+		}
+		if c > 0 {
+			// 外层循环变量
+			container := chain[c-1].block[chain[c-1].idx]
+			if loopLocalNames(&ast.DoBlock{Block: []ast.Stmt{headerOnly(container)}})[name] {
+				return nil, 0, "not a local string variable"
+			}
+		}
+	}
+	return nil, 0, "not a local string variable"
+}
+
+// headerOnly 返回只保留循环变量声明的循环（不含循环体），用于检查循环变量名。
+func headerOnly(stmt ast.Stmt) ast.Stmt {
+	switch s := stmt.(type) {
+	case *ast.ForLoopNumeric:
+		return &ast.ForLoopNumeric{Counter: s.Counter}
+	case *ast.ForLoopGeneric:
+		return &ast.ForLoopGeneric{Locals: s.Locals}
+	}
+	return &ast.DoBlock{}
+}
+
+// concatAppendLines 返回循环中 name 的追加语句所在的行，语句不独占一行时对应的值为 -1。
+func (o *optimizer) concatAppendLines(loop ast.Stmt, name string) []int {
+	var lines []int
+	f := lua_visitor{f: func(n ast.Node, ok *bool) {
+		assign, is_assign := n.(*ast.Assign)
+		if !is_assign {
+			return
+		}
+		if _, is_append := concatAppend(assign, name); !is_append {
+			return
+		}
+		start, end := o.find_stmt_line_range(assign)
+		if start != end {
+			lines = append(lines, -1)
+			return
+		}
+		// 单独解析这一行必须恰好得到这条追加语句
+		code, _, split_ok := splitLineComment(o.filecontent[start-1])
+		parsed, err := ast.Parse(code, start)
+		if !split_ok || err != nil || len(parsed) != 1 {
+			lines = append(lines, -1)
+			return
+		}
+		if _, same := concatAppend(parsed[0], name); !same {
+			lines = append(lines, -1)
+			return
+		}
+		lines = append(lines, start)
+	}}
+	ast.Walk(&f, loop)
+	return lines
+}
+
+// applyConcatBuffer 在循环前后插入缓冲区声明和 table.concat，并把循环中的追加改写为写入缓冲区。
+func (o *optimizer) applyConcatBuffer(chain []concatScope, name string, loop_start int, loop_end int) {
+	buf := getUniqueLocalName(o.scopeBlock(chain[0].block), name+"_buf")
+	loop := chain[len(chain)-1].block[chain[len(chain)-1].idx]
+	lines := o.concatAppendLines(loop, name)
+
+	rw := Rewrite{Pass: "concat_buffer", Target: name, Local: buf, GroupSize: len(lines), Replaced: len(lines)}
+	rw.Line, rw.EndLine = o.origRange(loop_start, loop_end)
+
+	buf_expr := &ast.ConstIdent{Value: buf}
+	for _, line := range lines {
+		content := o.filecontent[line-1]
+		code, comment, _ := splitLineComment(content)
+		parsed, _ := ast.Parse(code, line)
+		piece, _ := concatAppend(parsed[0], name)
+		push := &ast.Assign{
+			Targets: []ast.Expr{&ast.TableAccessor{Obj: buf_expr, Key: &ast.Operator{Op: ast.OpAdd,
+				Left: &ast.Operator{Op: ast.OpLength, Right: buf_expr}, Right: &ast.ConstInt{Value: "1"}}}},
+			Values: []ast.Expr{piece},
+		}
+		new_line := stmt_to_lines(push, get_content_space(content))[0]
+		if comment != "" {
+			new_line += " " + comment
+		}
+		o.filecontent[line-1] = new_line
+	}
+
+	indent := get_content_space(o.filecontent[loop_start-1])
+	decl := &ast.Assign{
+		LocalDecl: true,
+		Targets:   []ast.Expr{buf_expr},
+		Values:    []ast.Expr{&ast.TableConstructor{Keys: []ast.Expr{nil}, Vals: []ast.Expr{&ast.ConstIdent{Value: name}}}},
+	}
+	concat := &ast.Assign{
+		Targets: []ast.Expr{&ast.ConstIdent{Value: name}},
+		Values:  []ast.Expr{&ast.FuncCall{Function: pathToExpr("table.concat"), Args: []ast.Expr{buf_expr}}},
+	}
+	o.spliceLines(loop_end+1, loop_end, []string{stmt_to_lines(concat, indent)[0] + " " + concatBufferMarker})
+	o.spliceLines(loop_start, loop_start-1, []string{stmt_to_lines(decl, indent)[0] + " " + concatBufferMarker})
+
+	o.logf("opt concat_buffer at: %s:%d target=%s", o.filename, loop_start, name)
+	o.addRewrite(rw)
+}
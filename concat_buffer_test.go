@@ -0,0 +1,82 @@
+package olua
+
+import (
+	"strings"
+	"testing"
+)
+
+// ============================================================================
+// 集成测试：对比优化器输出与期望文件
+// ============================================================================
+
+// concatBufferOptions 返回只启用拼接缓冲区优化的测试选项。
+func concatBufferOptions() Options {
+	opts := DefaultOptions()
+	opts.ConcatBuffer = true
+	return opts
+}
+
+func TestConcatBuffer(t *testing.T) {
+	compareOptOutputWith(t, concatBufferOptions(), "input/concat_buffer.lua", "output/concat_buffer.lua")
+}
+
+// ============================================================================
+// 单元测试：跳过的候选及原因
+// ============================================================================
+
+func TestConcatBufferSkips(t *testing.T) {
+	tests := []struct {
+		name   string
+		src    string
+		reason string
+	}{
+		{"read in loop", "function f(list)\n    local s = \"\"\n    for i = 1, #list do\n        s = s .. list[i]\n        print(s)\n    end\n    return s\nend\n", "read inside the loop"},
+		{"read in piece", "function f(list)\n    local s = \"\"\n    for i = 1, #list do\n        s = s .. s\n    end\n    return s\nend\n", "read inside the loop"},
+		{"read in condition", "function f()\n    local s = \"\"\n    while #s < 10 do\n        s = s .. \"x\"\n    end\n    return s\nend\n", "read inside the loop"},
+		{"parameter", "function f(s, list)\n    for i = 1, #list do\n        s = s .. list[i]\n    end\n    return s\nend\n", "not a local string variable"},
+		{"global", "function f(list)\n    for i = 1, #list do\n        s = s .. list[i]\n    end\nend\n", "not a local string variable"},
+		{"non string init", "function f(list)\n    local s = g()\n    for i = 1, #list do\n        s = s .. list[i]\n    end\n    return s\nend\n", "not initialized with a string literal"},
+		{"non string assign", "function f(list)\n    local s = \"\"\n    s = g()\n    for i = 1, #list do\n        s = s .. list[i]\n    end\n    return s\nend\n", "assigned a value that may not be a string"},
+		{"closure", "function f(list)\n    local s = \"\"\n    local get = function() return s end\n    for i = 1, #list do\n        s = s .. list[i]\n    end\n    return get()\nend\n", "captured by a closure"},
+		{"goto", "function f(list)\n    local s = \"\"\n    for i = 1, #list do\n        s = s .. list[i]\n        if i > 3 then goto done end\n    end\n    ::done::\n    return s\nend\n", "loop contains goto"},
+		{"redeclared", "function f(list)\n    local s = \"\"\n    for i = 1, #list do\n        local s = \"\"\n        s = s .. list[i]\n    end\n    return s\nend\n", "redeclared inside the loop"},
+		{"table shadowed", "local table = {}\nfunction f(list)\n    local s = \"\"\n    for i = 1, #list do\n        s = s .. list[i]\n    end\n    return s\nend\n", "table is shadowed or assigned in this file"},
+		{"shared line", "function f(list)\n    local s = \"\"\n    for i = 1, #list do\n        s = s .. list[i]; n = i\n    end\n    return s\nend\n", "append statement shares its line with other code"},
+		{"one line loop", "function f(list)\n    local s = \"\"\n    for i = 1, #list do s = s .. list[i] end\n    return s\nend\n", "append statement shares its line with other code"},
+	}
+	for _, tt := range tests {
+		out, report, err := Optimize([]byte(tt.src), concatBufferOptions())
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if string(out) != tt.src {
+			t.Errorf("%s: expected no rewrite, got:\n%s", tt.name, out)
+		}
+		if len(report.Skipped) != 1 || report.Skipped[0].Pass != "concat_buffer" || report.Skipped[0].Reason != tt.reason {
+			t.Errorf("%s: skipped = %+v, want reason %q", tt.name, report.Skipped, tt.reason)
+		}
+	}
+}
+
+func TestConcatBufferDisabled(t *testing.T) {
+	src := "function f(list)\n    local s = \"\"\n    -- olua:disable-next-line concat_buffer\n    for i = 1, #list do\n        s = s .. list[i]\n    end\n    return s\nend\n"
+	out, report, err := Optimize([]byte(src), concatBufferOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != src || len(report.Skipped) != 0 {
+		t.Errorf("disabled loop was rewritten or reported: %+v\n%s", report.Skipped, out)
+	}
+}
+
+func TestConcatBufferSkippedOnce(t *testing.T) {
+	// 其他候选改写后重新解析，同一个跳过的候选不应重复记录
+	src := "function f(list)\n    local s = \"\"\n    local t = \"\"\n    for i = 1, #list do\n        s = s .. list[i]\n        t = t .. s\n    end\n    return t\nend\n"
+	out, report, err := Optimize([]byte(src), concatBufferOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), "t_buf[#t_buf + 1] = s") || len(report.Rewrites) != 1 || len(report.Skipped) != 1 {
+		t.Errorf("report = %+v\n%s", report, out)
+	}
+}
@@ -0,0 +1,329 @@
+package olua
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// ============================================================================
+// 项目配置文件 .olua.json / .olua.toml
+// ============================================================================
+//
+// 配置文件从输入路径开始向上查找，最近的一个生效。顶层设置作用于所有文件，
+// overrides 按顺序匹配文件路径（相对于配置文件所在目录），后面的覆盖前面的。
+// 命令行中显式指定的参数优先于配置文件。
+//
+//	opt_table_access = true
+//	exclude = ["third_party/**"]
+//
+//	[[overrides]]
+//	path = "battle/"
+//	opt_table_access_threshold = 3
+//
+//	[[overrides]]
+//	path = "ui/**/*.lua"
+//	opt_table_access_pure_funcs = ["ui_log_.*"]
+
+// ConfigFileNames 是按优先级排列的配置文件名。
+var ConfigFileNames = []string{".olua.json", ".olua.toml"}
+
+// Settings 是配置文件中可以设置的优化选项，nil 表示未设置，沿用上一级的值。
+type Settings struct {
+	ConstFold            *bool `json:"opt_const_fold" toml:"opt_const_fold"`
+	TableAccess          *bool `json:"opt_table_access" toml:"opt_table_access"`
+	TableAccessThreshold *int  `json:"opt_table_access_threshold" toml:"opt_table_access_threshold"`
+	// TableAccessPureFuncs 追加到已有的纯函数正则列表中，而不是替换
+	TableAccessPureFuncs []string `json:"opt_table_access_pure_funcs" toml:"opt_table_access_pure_funcs"`
+	TableAccessGlobal    *bool    `json:"opt_table_access_global" toml:"opt_table_access_global"`
+	TableAccessHoist     *bool    `json:"opt_table_access_hoist" toml:"opt_table_access_hoist"`
+	TableConstructor     *bool    `json:"opt_table_constructor" toml:"opt_table_constructor"`
+	MethodCache          *bool    `json:"opt_method_cache" toml:"opt_method_cache"`
+	// MethodCacheStableMethods 同样追加到已有的列表中
+	MethodCacheStableMethods []string `json:"opt_method_cache_stable_methods" toml:"opt_method_cache_stable_methods"`
+	Localize                 *bool    `json:"opt_localize" toml:"opt_localize"`
+	LocalizeThreshold        *int     `json:"opt_localize_threshold" toml:"opt_localize_threshold"`
+	LocalizeFunctionScope    *bool    `json:"opt_localize_function_scope" toml:"opt_localize_function_scope"`
+	ConcatBuffer             *bool    `json:"opt_concat_buffer" toml:"opt_concat_buffer"`
+	TableInsert              *bool    `json:"opt_table_insert" toml:"opt_table_insert"`
+	TableInsertCounter       *bool    `json:"opt_table_insert_counter" toml:"opt_table_insert_counter"`
+	TablePrealloc            *bool    `json:"opt_table_prealloc" toml:"opt_table_prealloc"`
+	Dialect                  *string  `json:"dialect" toml:"dialect"`
+	DeadCode                 *bool    `json:"opt_dead_code" toml:"opt_dead_code"`
+	DeadCodeWarnOnly         *bool    `json:"opt_dead_code_warn_only" toml:"opt_dead_code_warn_only"`
+	Inline                   *bool    `json:"opt_inline" toml:"opt_inline"`
+	InlineMaxCost            *int     `json:"opt_inline_max_cost" toml:"opt_inline_max_cost"`
+	InlineLoopMaxCost        *int     `json:"opt_inline_loop_max_cost" toml:"opt_inline_loop_max_cost"`
+	CSE                      *bool    `json:"opt_cse" toml:"opt_cse"`
+	Ipairs                   *bool    `json:"opt_ipairs" toml:"opt_ipairs"`
+}
+
+// Override 是按目录或 glob 匹配的覆盖设置。
+type Override struct {
+	// Path 以 / 结尾时匹配该目录下的所有文件，否则按 glob 匹配（支持 **）
+	Path string `json:"path" toml:"path"`
+	Settings
+}
+
+// Config 是一个项目配置文件的内容。
+type Config struct {
+	Settings
+	// Include 非空时只处理匹配的文件，Exclude 匹配的文件总是跳过
+	Include   []string   `json:"include" toml:"include"`
+	Exclude   []string   `json:"exclude" toml:"exclude"`
+	Overrides []Override `json:"overrides" toml:"overrides"`
+
+	// Filename 是配置文件的路径，其所在目录是匹配路径的基准
+	Filename string `json:"-" toml:"-"`
+}
+
+// LoadConfig 读取配置文件，按扩展名选择 JSON 或 TOML 格式。
+func LoadConfig(filename string) (*Config, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	c := &Config{}
+	if strings.HasSuffix(filename, ".toml") {
+		var md toml.MetaData
+		md, err = toml.Decode(string(data), c)
+		if err == nil && len(md.Undecoded()) > 0 {
+			err = fmt.Errorf("unknown keys %v", md.Undecoded())
+		}
+	} else {
+		dec := json.NewDecoder(strings.NewReader(string(data)))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(c)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%v %v", filename, err)
+	}
+	abs, err := filepath.Abs(filename)
+	if err != nil {
+		return nil, err
+	}
+	c.Filename = abs
+	for _, d := range c.dialects() {
+		if !IsValidDialect(d) {
+			return nil, fmt.Errorf("%v unknown dialect %q", filename, d)
+		}
+	}
+	for _, pattern := range c.patterns() {
+		if _, err := path.Match(strings.ReplaceAll(pattern, "**", "*"), ""); err != nil {
+			return nil, fmt.Errorf("%v bad pattern %q: %v", filename, pattern, err)
+		}
+	}
+	return c, nil
+}
+
+// FindConfig 从 p（文件或目录）所在目录开始向上查找配置文件，没有找到时返回 nil。
+func FindConfig(p string) (*Config, error) {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return nil, err
+	}
+	dir := abs
+	if fi, err := os.Stat(abs); err != nil || !fi.IsDir() {
+		dir = filepath.Dir(abs)
+	}
+	for {
+		for _, name := range ConfigFileNames {
+			filename := filepath.Join(dir, name)
+			if _, err := os.Stat(filename); err == nil {
+				return LoadConfig(filename)
+			}
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return nil, nil
+		}
+		dir = parent
+	}
+}
+
+// Apply 把配置中作用于 filename 的设置依次应用到 opts：先顶层设置，再按顺序应用匹配的 overrides。
+func (c *Config) Apply(filename string, opts *Options) {
+	c.Settings.apply(opts)
+	rel, ok := c.rel(filename)
+	if !ok {
+		return
+	}
+	for _, o := range c.Overrides {
+		if matchPath(o.Path, rel) {
+			o.Settings.apply(opts)
+		}
+	}
+}
+
+// Includes 判断 filename 是否应该被处理。
+func (c *Config) Includes(filename string) bool {
+	rel, ok := c.rel(filename)
+	if !ok {
+		return true
+	}
+	for _, pattern := range c.Exclude {
+		if matchPath(pattern, rel) {
+			return false
+		}
+	}
+	if len(c.Include) == 0 {
+		return true
+	}
+	for _, pattern := range c.Include {
+		if matchPath(pattern, rel) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Settings) apply(opts *Options) {
+	if s.ConstFold != nil {
+		opts.ConstFold = *s.ConstFold
+	}
+	if s.TableAccess != nil {
+		opts.TableAccess = *s.TableAccess
+	}
+	if s.TableAccessThreshold != nil {
+		opts.TableAccessThreshold = *s.TableAccessThreshold
+	}
+	if len(s.TableAccessPureFuncs) > 0 {
+		opts.TableAccessPureFuncs = append(append([]string(nil), opts.TableAccessPureFuncs...), s.TableAccessPureFuncs...)
+	}
+	if s.TableAccessGlobal != nil {
+		opts.TableAccessGlobal = *s.TableAccessGlobal
+	}
+	if s.TableAccessHoist != nil {
+		opts.TableAccessHoist = *s.TableAccessHoist
+	}
+	if s.TableConstructor != nil {
+		opts.TableConstructor = *s.TableConstructor
+	}
+	if s.MethodCache != nil {
+		opts.MethodCache = *s.MethodCache
+	}
+	if len(s.MethodCacheStableMethods) > 0 {
+		opts.MethodCacheStableMethods = append(append([]string(nil), opts.MethodCacheStableMethods...), s.MethodCacheStableMethods...)
+	}
+	if s.Localize != nil {
+		opts.Localize = *s.Localize
+	}
+	if s.LocalizeThreshold != nil {
+		opts.LocalizeThreshold = *s.LocalizeThreshold
+	}
+	if s.LocalizeFunctionScope != nil {
+		opts.LocalizeFunctionScope = *s.LocalizeFunctionScope
+	}
+	if s.ConcatBuffer != nil {
+		opts.ConcatBuffer = *s.ConcatBuffer
+	}
+	if s.TableInsert != nil {
+		opts.TableInsert = *s.TableInsert
+	}
+	if s.TableInsertCounter != nil {
+		opts.TableInsertCounter = *s.TableInsertCounter
+	}
+	if s.TablePrealloc != nil {
+		opts.TablePrealloc = *s.TablePrealloc
+	}
+	if s.Dialect != nil {
+		opts.Dialect = *s.Dialect
+	}
+	if s.DeadCode != nil {
+		opts.DeadCode = *s.DeadCode
+	}
+	if s.DeadCodeWarnOnly != nil {
+		opts.DeadCodeWarnOnly = *s.DeadCodeWarnOnly
+	}
+	if s.Inline != nil {
+		opts.Inline = *s.Inline
+	}
+	if s.InlineMaxCost != nil {
+		opts.InlineMaxCost = *s.InlineMaxCost
+	}
+	if s.InlineLoopMaxCost != nil {
+		opts.InlineLoopMaxCost = *s.InlineLoopMaxCost
+	}
+	if s.CSE != nil {
+		opts.CSE = *s.CSE
+	}
+	if s.Ipairs != nil {
+		opts.Ipairs = *s.Ipairs
+	}
+}
+
+func (c *Config) patterns() []string {
+	patterns := append(append([]string(nil), c.Include...), c.Exclude...)
+	for _, o := range c.Overrides {
+		patterns = append(patterns, o.Path)
+	}
+	return patterns
+}
+
+func (c *Config) dialects() []string {
+	var dialects []string
+	if c.Dialect != nil {
+		dialects = append(dialects, *c.Dialect)
+	}
+	for _, o := range c.Overrides {
+		if o.Dialect != nil {
+			dialects = append(dialects, *o.Dialect)
+		}
+	}
+	return dialects
+}
+
+// rel 返回 filename 相对于配置文件所在目录的路径（使用 / 分隔），
+// 不在该目录下时返回 false。
+func (c *Config) rel(filename string) (string, bool) {
+	abs, err := filepath.Abs(filename)
+	if err != nil {
+		return "", false
+	}
+	rel, err := filepath.Rel(filepath.Dir(c.Filename), abs)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
+
+// matchPath 判断相对路径 rel 是否匹配 pattern：
+//   - 以 / 结尾的 pattern 匹配该目录下的所有文件
+//   - 不含 / 的 pattern 匹配任意一级的文件名，如 "*_test.lua"
+//   - 其他 pattern 从配置目录开始按段匹配，** 匹配任意多级目录
+func matchPath(pattern string, rel string) bool {
+	if strings.HasSuffix(pattern, "/") {
+		return strings.HasPrefix(rel, pattern)
+	}
+	if !strings.Contains(pattern, "/") {
+		ok, _ := path.Match(pattern, path.Base(rel))
+		return ok
+	}
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(rel, "/"))
+}
+
+func matchSegments(pattern []string, segs []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(segs); i++ {
+				if matchSegments(pattern[1:], segs[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(segs) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], segs[0]); !ok {
+			return false
+		}
+		pattern, segs = pattern[1:], segs[1:]
+	}
+	return len(segs) == 0
+}
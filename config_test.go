@@ -0,0 +1,147 @@
+package olua
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// ============================================================================
+// 配置文件测试
+// ============================================================================
+
+func writeTestFile(t *testing.T, filename string, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMatchPath(t *testing.T) {
+	tests := []struct {
+		pattern string
+		rel     string
+		want    bool
+	}{
+		{"battle/", "battle/skill.lua", true},
+		{"battle/", "battle/sub/skill.lua", true},
+		{"battle/", "battlefield/skill.lua", false},
+		{"*_test.lua", "a/b/x_test.lua", true},
+		{"*_test.lua", "x.lua", false},
+		{"ui/*.lua", "ui/main.lua", true},
+		{"ui/*.lua", "ui/sub/main.lua", false},
+		{"ui/**/*.lua", "ui/main.lua", true},
+		{"ui/**/*.lua", "ui/a/b/main.lua", true},
+		{"**/gen/*.lua", "x/y/gen/a.lua", true},
+		{"third_party/**", "third_party/a/b.lua", true},
+		{"third_party/**", "other/a.lua", false},
+	}
+	for _, tt := range tests {
+		if got := matchPath(tt.pattern, tt.rel); got != tt.want {
+			t.Errorf("matchPath(%q, %q) = %v, want %v", tt.pattern, tt.rel, got, tt.want)
+		}
+	}
+}
+
+func TestConfigJSON(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, ".olua.json"), `{
+    "opt_table_access": true,
+    "opt_table_access_threshold": 2,
+    "exclude": ["third_party/"],
+    "overrides": [
+        {"path": "battle/", "opt_table_access_threshold": 3, "opt_table_constructor": true},
+        {"path": "ui/**/*.lua", "opt_table_access_pure_funcs": ["ui_log_.*"], "opt_method_cache_stable_methods": ["on_.*"]}
+    ]
+}`)
+	c, err := FindConfig(filepath.Join(dir, "battle", "skill.lua"))
+	if err != nil || c == nil {
+		t.Fatalf("FindConfig = %v, %v", c, err)
+	}
+
+	opts := DefaultOptions()
+	c.Apply(filepath.Join(dir, "battle", "skill.lua"), &opts)
+	if !opts.TableAccess || opts.TableAccessThreshold != 3 || !opts.TableConstructor {
+		t.Errorf("battle options = %+v", opts)
+	}
+
+	opts = DefaultOptions()
+	c.Apply(filepath.Join(dir, "ui", "bag", "view.lua"), &opts)
+	if opts.TableAccessThreshold != 2 || opts.TableConstructor {
+		t.Errorf("ui options = %+v", opts)
+	}
+	if want := []string{"log_.*", "ui_log_.*"}; !reflect.DeepEqual(opts.TableAccessPureFuncs, want) {
+		t.Errorf("ui pure funcs = %v, want %v", opts.TableAccessPureFuncs, want)
+	}
+	if want := []string{"on_.*"}; !reflect.DeepEqual(opts.MethodCacheStableMethods, want) {
+		t.Errorf("ui stable methods = %v, want %v", opts.MethodCacheStableMethods, want)
+	}
+	if defaults := DefaultOptions(); len(defaults.TableAccessPureFuncs) != 1 {
+		t.Errorf("Apply must not modify the default pure funcs: %v", defaults.TableAccessPureFuncs)
+	}
+
+	if c.Includes(filepath.Join(dir, "third_party", "json.lua")) {
+		t.Error("third_party should be excluded")
+	}
+	if !c.Includes(filepath.Join(dir, "battle", "skill.lua")) {
+		t.Error("battle should be included")
+	}
+}
+
+func TestConfigTOMLNearestWins(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, ".olua.json"), `{"opt_table_access": true}`)
+	writeTestFile(t, filepath.Join(dir, "game", ".olua.toml"), `
+opt_table_constructor = true
+include = ["*.lua"]
+exclude = ["*_gen.lua"]
+
+[[overrides]]
+path = "hot/"
+opt_table_access = false
+`)
+	c, err := FindConfig(filepath.Join(dir, "game", "hot"))
+	if err != nil || c == nil {
+		t.Fatalf("FindConfig = %v, %v", c, err)
+	}
+	if filepath.Base(c.Filename) != ".olua.toml" {
+		t.Fatalf("found %v, want the nearest .olua.toml", c.Filename)
+	}
+	opts := DefaultOptions()
+	opts.TableAccess = true
+	c.Apply(filepath.Join(dir, "game", "hot", "reload.lua"), &opts)
+	if opts.TableAccess || !opts.TableConstructor {
+		t.Errorf("hot options = %+v", opts)
+	}
+	if c.Includes(filepath.Join(dir, "game", "proto_gen.lua")) || c.Includes(filepath.Join(dir, "game", "readme.txt")) {
+		t.Error("include/exclude patterns not applied")
+	}
+	if !c.Includes(filepath.Join(dir, "game", "main.lua")) {
+		t.Error("main.lua should be included")
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "a", ".olua.json"), `{"opt_table_acces": true}`)
+	if _, err := FindConfig(filepath.Join(dir, "a", "x.lua")); err == nil || !strings.Contains(err.Error(), "opt_table_acces") {
+		t.Errorf("unknown JSON key should be an error, got %v", err)
+	}
+	writeTestFile(t, filepath.Join(dir, "b", ".olua.toml"), "opt_table_acces = true\n")
+	if _, err := FindConfig(filepath.Join(dir, "b", "x.lua")); err == nil {
+		t.Error("unknown TOML key should be an error")
+	}
+	writeTestFile(t, filepath.Join(dir, "c", ".olua.json"), `{"exclude": ["[a-"]}`)
+	if _, err := FindConfig(filepath.Join(dir, "c")); err == nil {
+		t.Error("bad pattern should be an error")
+	}
+	writeTestFile(t, filepath.Join(dir, "d", ".olua.toml"), "[[overrides]]\npath = \"jit/\"\ndialect = \"5.5\"\n")
+	if _, err := FindConfig(filepath.Join(dir, "d")); err == nil || !strings.Contains(err.Error(), "5.5") {
+		t.Errorf("unknown dialect should be an error, got %v", err)
+	}
+}
@@ -0,0 +1,966 @@
+package olua
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/milochristiansen/lua/ast"
+)
+
+// ============================================================================
+// 常量折叠和表达式化简
+// ============================================================================
+//
+// 把只由常量组成的运算在优化时算出结果，并做几种不改变语义的化简：
+//
+//	local day = 60 * 60 * 24          →  local day = 86400
+//	local key = "prefix_" .. "name"   →  local key = "prefix_name"
+//	if not not flag then              →  if flag then
+//	if (a < b) == true then           →  if a < b then
+//	x = not (a == b)                  →  x = a ~= b
+//
+// 运算按 Lua 5.3 的规则进行：整数运算回绕，/ 和 ^ 的结果总是浮点数，
+// 算术和位运算中的字符串按数字字面量的规则转换为数字，拼接时数字按 %.14g 转换为字符串。
+// 以下情况不折叠，保留原表达式在运行时求值：
+//   - 会出错的运算（整数除以 0、对不能转换为数字的字符串做算术等）
+//   - 结果无法写成字面量（inf、nan、最小整数）
+//   - 字符串的大小比较（结果取决于运行时的 locale）
+//
+// x == true、-(-x) 这样的化简只在 x 已知是布尔值或数字常量时进行，因为对其他类型的值
+// 它们并不等价（如 1 == true 为 false）。not not x 只在条件（if、while、until）中
+// 或 x 一定是布尔值时化简为 x。
+//
+// 改写按语句重新打印：简单语句必须独占一行，if、elseif、while、for 和 until 只改写头部所在的行，
+// 行末的注释会保留。折叠后的代码与手写的代码没有区别，因此不加标记，revert 也不会还原。
+
+// constKind 是常量值的类型
+type constKind int
+
+const (
+	constNil constKind = iota
+	constBool
+	constInt
+	constFloat
+	constString
+)
+
+// constValue 是一个编译期可以确定的 Lua 值
+type constValue struct {
+	kind constKind
+	b    bool
+	i    int64
+	f    float64
+	s    string
+}
+
+func (v constValue) isNumber() bool {
+	return v.kind == constInt || v.kind == constFloat
+}
+
+// truthy 按 Lua 规则判断值的真假：只有 nil 和 false 为假。
+func (v constValue) truthy() bool {
+	switch v.kind {
+	case constNil:
+		return false
+	case constBool:
+		return v.b
+	}
+	return true
+}
+
+func (v constValue) toFloat() float64 {
+	if v.kind == constInt {
+		return float64(v.i)
+	}
+	return v.f
+}
+
+// parseLuaNumeral 按 Lua 5.3 词法解析数字字面量：十六进制整数溢出时回绕，
+// 十进制整数溢出时转换为浮点数。
+func parseLuaNumeral(s string) (constValue, bool) {
+	if s == "" {
+		return constValue{}, false
+	}
+	lower := strings.ToLower(s)
+	if strings.HasPrefix(lower, "0x") {
+		digits := lower[2:]
+		if !strings.ContainsAny(digits, ".p") {
+			if digits == "" {
+				return constValue{}, false
+			}
+			var n uint64
+			for _, c := range digits {
+				d := strings.IndexRune("0123456789abcdef", c)
+				if d < 0 {
+					return constValue{}, false
+				}
+				n = n<<4 | uint64(d)
+			}
+			return constValue{kind: constInt, i: int64(n)}, true
+		}
+		if !strings.Contains(digits, "p") {
+			lower += "p0"
+		}
+		if strings.Trim(lower[2:], "0123456789abcdef.p+-") != "" {
+			return constValue{}, false
+		}
+		f, err := strconv.ParseFloat(lower, 64)
+		if err != nil && !isRangeError(err) {
+			return constValue{}, false
+		}
+		return constValue{kind: constFloat, f: f}, true
+	}
+	if strings.Trim(lower, "0123456789") == "" {
+		if n, err := strconv.ParseInt(lower, 10, 64); err == nil {
+			return constValue{kind: constInt, i: n}, true
+		}
+	}
+	if strings.Trim(lower, "0123456789.e+-") != "" {
+		return constValue{}, false
+	}
+	f, err := strconv.ParseFloat(lower, 64)
+	if err != nil && !isRangeError(err) {
+		return constValue{}, false
+	}
+	return constValue{kind: constFloat, f: f}, true
+}
+
+func isRangeError(err error) bool {
+	ne, ok := err.(*strconv.NumError)
+	return ok && ne.Err == strconv.ErrRange
+}
+
+// stringToNumber 按 Lua 5.3 的规则把字符串转换为数字：允许首尾空白和正负号。
+func stringToNumber(s string) (constValue, bool) {
+	s = strings.Trim(s, " \f\n\r\t\v")
+	neg := false
+	if strings.HasPrefix(s, "-") {
+		neg = true
+		s = s[1:]
+	} else if strings.HasPrefix(s, "+") {
+		s = s[1:]
+	}
+	if s == "" || s[0] == '+' || s[0] == '-' {
+		return constValue{}, false
+	}
+	if neg && s == "9223372036854775808" {
+		return constValue{kind: constInt, i: math.MinInt64}, true
+	}
+	v, ok := parseLuaNumeral(s)
+	if !ok || !neg {
+		return v, ok
+	}
+	if v.kind == constInt {
+		v.i = -v.i
+	} else {
+		v.f = -v.f
+	}
+	return v, true
+}
+
+// toNumber 返回算术运算中 v 对应的数字，字符串会被转换。
+func toNumber(v constValue) (constValue, bool) {
+	switch v.kind {
+	case constInt, constFloat:
+		return v, true
+	case constString:
+		return stringToNumber(v.s)
+	}
+	return constValue{}, false
+}
+
+// toInteger 返回位运算中 v 对应的整数：浮点数必须有精确的整数表示。
+func toInteger(v constValue) (int64, bool) {
+	n, ok := toNumber(v)
+	if !ok {
+		return 0, false
+	}
+	if n.kind == constInt {
+		return n.i, true
+	}
+	if n.f != math.Floor(n.f) || n.f < -(1<<63) || n.f >= 1<<63 {
+		return 0, false
+	}
+	return int64(n.f), true
+}
+
+// numberToString 按 Lua 5.3 的规则把数字转换为拼接时的字符串。
+func numberToString(v constValue) (string, bool) {
+	if v.kind == constInt {
+		return strconv.FormatInt(v.i, 10), true
+	}
+	if math.IsInf(v.f, 0) || math.IsNaN(v.f) {
+		return "", false
+	}
+	s := fmt.Sprintf("%.14g", v.f)
+	if strings.Trim(s, "-0123456789") == "" {
+		// 看起来像整数的浮点数加上 .0
+		s += ".0"
+	}
+	return s, true
+}
+
+// compareNumbers 精确比较两个数字（整数和浮点数混合时不损失精度），
+// 有 nan 时返回 false。
+func compareNumbers(a constValue, b constValue) (int, bool) {
+	if a.kind == constInt && b.kind == constInt {
+		switch {
+		case a.i < b.i:
+			return -1, true
+		case a.i > b.i:
+			return 1, true
+		}
+		return 0, true
+	}
+	if math.IsNaN(a.toFloat()) || math.IsNaN(b.toFloat()) {
+		return 0, false
+	}
+	toBig := func(v constValue) *big.Float {
+		if v.kind == constInt {
+			return new(big.Float).SetInt64(v.i)
+		}
+		return big.NewFloat(v.f)
+	}
+	return toBig(a).Cmp(toBig(b)), true
+}
+
+// rawEqual 按 Lua 规则比较两个常量是否相等（数字按数学值比较）。
+func rawEqual(a constValue, b constValue) bool {
+	if a.isNumber() && b.isNumber() {
+		c, ok := compareNumbers(a, b)
+		return ok && c == 0
+	}
+	if a.kind != b.kind {
+		return false
+	}
+	switch a.kind {
+	case constBool:
+		return a.b == b.b
+	case constString:
+		return a.s == b.s
+	}
+	return true
+}
+
+// evalArith 计算算术运算，运算会出错时返回 false。
+func evalArith(op ast.Operator, a constValue, b constValue) (constValue, bool) {
+	x, ok := toNumber(a)
+	if !ok {
+		return constValue{}, false
+	}
+	y, ok := toNumber(b)
+	if !ok {
+		return constValue{}, false
+	}
+	ints := x.kind == constInt && y.kind == constInt
+	switch op.Op {
+	case ast.OpAdd, ast.OpSub, ast.OpMul:
+		if ints {
+			switch op.Op {
+			case ast.OpAdd:
+				return constValue{kind: constInt, i: x.i + y.i}, true
+			case ast.OpSub:
+				return constValue{kind: constInt, i: x.i - y.i}, true
+			}
+			return constValue{kind: constInt, i: x.i * y.i}, true
+		}
+		switch op.Op {
+		case ast.OpAdd:
+			return constValue{kind: constFloat, f: x.toFloat() + y.toFloat()}, true
+		case ast.OpSub:
+			return constValue{kind: constFloat, f: x.toFloat() - y.toFloat()}, true
+		}
+		return constValue{kind: constFloat, f: x.toFloat() * y.toFloat()}, true
+	case ast.OpDiv:
+		return constValue{kind: constFloat, f: x.toFloat() / y.toFloat()}, true
+	case ast.OpPow:
+		return constValue{kind: constFloat, f: math.Pow(x.toFloat(), y.toFloat())}, true
+	case ast.OpIDiv:
+		if ints {
+			if y.i == 0 {
+				return constValue{}, false
+			}
+			q := x.i / y.i
+			if x.i%y.i != 0 && (x.i < 0) != (y.i < 0) {
+				q--
+			}
+			return constValue{kind: constInt, i: q}, true
+		}
+		return constValue{kind: constFloat, f: math.Floor(x.toFloat() / y.toFloat())}, true
+	case ast.OpMod:
+		if ints {
+			if y.i == 0 {
+				return constValue{}, false
+			}
+			m := x.i % y.i
+			if m != 0 && (m^y.i) < 0 {
+				m += y.i
+			}
+			return constValue{kind: constInt, i: m}, true
+		}
+		fx, fy := x.toFloat(), y.toFloat()
+		m := math.Mod(fx, fy)
+		if (m > 0 && fy < 0) || (m < 0 && fy > 0) {
+			m += fy
+		}
+		return constValue{kind: constFloat, f: m}, true
+	}
+	return constValue{}, false
+}
+
+// evalBitwise 计算位运算，操作数不能转换为整数时返回 false。
+func evalBitwise(op ast.Operator, a constValue, b constValue) (constValue, bool) {
+	x, ok := toInteger(a)
+	if !ok {
+		return constValue{}, false
+	}
+	y, ok := toInteger(b)
+	if !ok {
+		return constValue{}, false
+	}
+	var r int64
+	switch op.Op {
+	case ast.OpBinAND:
+		r = x & y
+	case ast.OpBinOR:
+		r = x | y
+	case ast.OpBinXOR:
+		r = x ^ y
+	case ast.OpBinShiftL:
+		r = shiftLeft(x, y)
+	case ast.OpBinShiftR:
+		r = shiftLeft(x, -y)
+	default:
+		return constValue{}, false
+	}
+	return constValue{kind: constInt, i: r}, true
+}
+
+// shiftLeft 按 Lua 规则做逻辑移位：n 为负时右移，移动 64 位及以上时结果为 0。
+func shiftLeft(x int64, n int64) int64 {
+	if n <= -64 || n >= 64 {
+		return 0
+	}
+	if n >= 0 {
+		return int64(uint64(x) << uint(n))
+	}
+	return int64(uint64(x) >> uint(-n))
+}
+
+// evalConst 计算只由常量组成的表达式的值，无法在编译期确定或运算会出错时返回 false。
+func evalConst(expr ast.Expr) (constValue, bool) {
+	switch e := expr.(type) {
+	case *ast.ConstNil:
+		return constValue{kind: constNil}, true
+	case *ast.ConstBool:
+		return constValue{kind: constBool, b: e.Value}, true
+	case *ast.ConstInt:
+		return parseLuaNumeral(e.Value)
+	case *ast.ConstFloat:
+		return parseLuaNumeral(e.Value)
+	case *ast.ConstString:
+		return constValue{kind: constString, s: e.Value}, true
+	case *ast.Parens:
+		return evalConst(e.Inner)
+	case *ast.Operator:
+		return evalOperator(e)
+	}
+	return constValue{}, false
+}
+
+func evalOperator(e *ast.Operator) (constValue, bool) {
+	if isUnaryOp(*e) {
+		v, ok := evalConst(e.Right)
+		if !ok {
+			return constValue{}, false
+		}
+		switch e.Op {
+		case ast.OpNot:
+			return constValue{kind: constBool, b: !v.truthy()}, true
+		case ast.OpLength:
+			if v.kind != constString {
+				return constValue{}, false
+			}
+			return constValue{kind: constInt, i: int64(len(v.s))}, true
+		case ast.OpUMinus:
+			n, ok := toNumber(v)
+			if !ok {
+				return constValue{}, false
+			}
+			if n.kind == constInt {
+				return constValue{kind: constInt, i: -n.i}, true
+			}
+			return constValue{kind: constFloat, f: -n.f}, true
+		case ast.OpBinNot:
+			n, ok := toInteger(v)
+			if !ok {
+				return constValue{}, false
+			}
+			return constValue{kind: constInt, i: ^n}, true
+		}
+		return constValue{}, false
+	}
+
+	left, ok := evalConst(e.Left)
+	if !ok {
+		return constValue{}, false
+	}
+	// and/or 短路：左操作数决定结果时不需要右操作数是常量
+	switch e.Op {
+	case ast.OpAnd:
+		if !left.truthy() {
+			return left, true
+		}
+		return evalConst(e.Right)
+	case ast.OpOr:
+		if left.truthy() {
+			return left, true
+		}
+		return evalConst(e.Right)
+	}
+	right, ok := evalConst(e.Right)
+	if !ok {
+		return constValue{}, false
+	}
+	switch e.Op {
+	case ast.OpAdd, ast.OpSub, ast.OpMul, ast.OpDiv, ast.OpIDiv, ast.OpMod, ast.OpPow:
+		return evalArith(*e, left, right)
+	case ast.OpBinAND, ast.OpBinOR, ast.OpBinXOR, ast.OpBinShiftL, ast.OpBinShiftR:
+		return evalBitwise(*e, left, right)
+	case ast.OpConcat:
+		ls, ok := concatString(left)
+		if !ok {
+			return constValue{}, false
+		}
+		rs, ok := concatString(right)
+		if !ok {
+			return constValue{}, false
+		}
+		return constValue{kind: constString, s: ls + rs}, true
+	case ast.OpEqual:
+		return constValue{kind: constBool, b: rawEqual(left, right)}, true
+	case ast.OpNotEqual:
+		return constValue{kind: constBool, b: !rawEqual(left, right)}, true
+	case ast.OpLessThan, ast.OpGreaterThan, ast.OpLessOrEqual, ast.OpGreaterOrEqual:
+		if !left.isNumber() || !right.isNumber() {
+			return constValue{}, false
+		}
+		c, ok := compareNumbers(left, right)
+		var r bool
+		if ok {
+			switch e.Op {
+			case ast.OpLessThan:
+				r = c < 0
+			case ast.OpGreaterThan:
+				r = c > 0
+			case ast.OpLessOrEqual:
+				r = c <= 0
+			case ast.OpGreaterOrEqual:
+				r = c >= 0
+			}
+		}
+		return constValue{kind: constBool, b: r}, true
+	}
+	return constValue{}, false
+}
+
+// concatString 返回拼接运算中 v 对应的字符串。
+func concatString(v constValue) (string, bool) {
+	switch v.kind {
+	case constString:
+		return v.s, true
+	case constInt, constFloat:
+		return numberToString(v)
+	}
+	return "", false
+}
+
+// constToExpr 把常量值转换为字面量表达式，负数表示为一元负号作用于字面量，
+// 这样打印时会按优先级加括号（(-3) ^ 2）。值无法写成字面量时返回 false。
+func constToExpr(v constValue) (ast.Expr, bool) {
+	switch v.kind {
+	case constNil:
+		return &ast.ConstNil{}, true
+	case constBool:
+		return &ast.ConstBool{Value: v.b}, true
+	case constString:
+		return &ast.ConstString{Value: v.s}, true
+	case constInt:
+		if v.i == math.MinInt64 {
+			// 9223372036854775808 会被解析为浮点数
+			return nil, false
+		}
+		if v.i < 0 {
+			return &ast.Operator{Op: ast.OpUMinus, Right: &ast.ConstInt{Value: strconv.FormatInt(-v.i, 10)}}, true
+		}
+		return &ast.ConstInt{Value: strconv.FormatInt(v.i, 10)}, true
+	case constFloat:
+		if math.IsInf(v.f, 0) || math.IsNaN(v.f) {
+			return nil, false
+		}
+		s := strconv.FormatFloat(math.Abs(v.f), 'g', -1, 64)
+		if !strings.ContainsAny(s, ".e") {
+			s += ".0"
+		}
+		if math.Signbit(v.f) {
+			return &ast.Operator{Op: ast.OpUMinus, Right: &ast.ConstFloat{Value: s}}, true
+		}
+		return &ast.ConstFloat{Value: s}, true
+	}
+	return nil, false
+}
+
+// isLiteralExpr 判断 expr 是否已经是字面量（包括负数字面量），无需再折叠。
+func isLiteralExpr(expr ast.Expr) bool {
+	switch e := expr.(type) {
+	case *ast.ConstNil, *ast.ConstBool, *ast.ConstInt, *ast.ConstFloat, *ast.ConstString:
+		return true
+	case *ast.Operator:
+		if e.Op == ast.OpUMinus {
+			switch e.Right.(type) {
+			case *ast.ConstInt, *ast.ConstFloat:
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isBoolExpr 判断 expr 的值是否一定是布尔值。
+func isBoolExpr(expr ast.Expr) bool {
+	switch e := expr.(type) {
+	case *ast.ConstBool:
+		return true
+	case *ast.Parens:
+		return isBoolExpr(e.Inner)
+	case *ast.Operator:
+		switch e.Op {
+		case ast.OpNot, ast.OpEqual, ast.OpNotEqual, ast.OpLessThan, ast.OpGreaterThan, ast.OpLessOrEqual, ast.OpGreaterOrEqual:
+			return true
+		case ast.OpAnd, ast.OpOr:
+			return isBoolExpr(e.Left) && isBoolExpr(e.Right)
+		}
+	}
+	return false
+}
+
+// constFolder 折叠一条语句中的表达式，并记录被折叠的原表达式。
+type constFolder struct {
+	folded []string
+}
+
+// fold 返回折叠后的表达式。cond 表示表达式只用作条件（只关心真假）。
+func (c *constFolder) fold(expr ast.Expr, cond bool) ast.Expr {
+	if expr == nil || isLiteralExpr(expr) {
+		return expr
+	}
+	switch expr.(type) {
+	case *ast.Operator, *ast.Parens:
+		if v, ok := evalConst(expr); ok {
+			if lit, ok := constToExpr(v); ok {
+				c.folded = append(c.folded, expr_to_string(expr))
+				return lit
+			}
+		}
+	}
+
+	switch e := expr.(type) {
+	case *ast.Parens:
+		e.Inner = c.fold(e.Inner, cond)
+		return e
+	case *ast.TableAccessor:
+		e.Obj = c.fold(e.Obj, false)
+		e.Key = c.fold(e.Key, false)
+	case *ast.FuncCall:
+		e.Receiver = c.fold(e.Receiver, false)
+		e.Function = c.fold(e.Function, false)
+		for i, arg := range e.Args {
+			e.Args[i] = c.fold(arg, false)
+		}
+	case *ast.TableConstructor:
+		for i := range e.Vals {
+			e.Keys[i] = c.fold(e.Keys[i], false)
+			e.Vals[i] = c.fold(e.Vals[i], false)
+		}
+	case *ast.Operator:
+		return c.foldOperator(e, cond)
+	}
+	return expr
+}
+
+func (c *constFolder) foldOperator(e *ast.Operator, cond bool) ast.Expr {
+	if isUnaryOp(*e) {
+		e.Right = c.fold(e.Right, e.Op == ast.OpNot)
+		if e.Op == ast.OpNot {
+			return c.simplifyNot(e, cond)
+		}
+		return e
+	}
+
+	operandCond := cond && (e.Op == ast.OpAnd || e.Op == ast.OpOr)
+	e.Left = c.fold(e.Left, operandCond)
+	e.Right = c.fold(e.Right, operandCond)
+
+	switch e.Op {
+	case ast.OpAnd, ast.OpOr:
+		// 左操作数是常量时结果就是其中一个操作数：true and x → x，nil or x → x
+		if v, ok := evalConst(e.Left); ok {
+			c.folded = append(c.folded, expr_to_string(e))
+			if v.truthy() == (e.Op == ast.OpOr) {
+				return e.Left
+			}
+			return singleValue(e.Right)
+		}
+	case ast.OpEqual, ast.OpNotEqual:
+		// x == true → x，x == false → not x（x 一定是布尔值时）
+		for _, pair := range [][2]ast.Expr{{e.Left, e.Right}, {e.Right, e.Left}} {
+			b, ok := pair[1].(*ast.ConstBool)
+			if !ok || !isBoolExpr(pair[0]) {
+				continue
+			}
+			c.folded = append(c.folded, expr_to_string(e))
+			if b.Value == (e.Op == ast.OpEqual) {
+				return stripParens(pair[0])
+			}
+			return c.simplifyNot(&ast.Operator{Op: ast.OpNot, Right: pair[0]}, cond)
+		}
+	}
+	return e
+}
+
+// simplifyNot 化简 not 表达式：not (a == b) → a ~= b，条件中 not not x → x。
+func (c *constFolder) simplifyNot(e *ast.Operator, cond bool) ast.Expr {
+	inner := e.Right
+	for {
+		parens, ok := inner.(*ast.Parens)
+		if !ok {
+			break
+		}
+		inner = parens.Inner
+	}
+	op, ok := inner.(*ast.Operator)
+	if !ok {
+		return e
+	}
+	switch op.Op {
+	case ast.OpEqual, ast.OpNotEqual:
+		c.folded = append(c.folded, expr_to_string(e))
+		flipped := ast.OpEqual
+		if op.Op == ast.OpEqual {
+			flipped = ast.OpNotEqual
+		}
+		return &ast.Operator{Op: flipped, Left: op.Left, Right: op.Right}
+	case ast.OpNot:
+		if cond || isBoolExpr(op.Right) {
+			c.folded = append(c.folded, expr_to_string(e))
+			return stripParens(op.Right)
+		}
+	}
+	return e
+}
+
+// stripParens 去掉不影响语义的括号（函数调用和 ... 的括号会截断多返回值，保留）。
+func stripParens(expr ast.Expr) ast.Expr {
+	for {
+		parens, ok := expr.(*ast.Parens)
+		if !ok {
+			return expr
+		}
+		switch parens.Inner.(type) {
+		case *ast.FuncCall, *ast.ConstVariadic:
+			return expr
+		}
+		expr = parens.Inner
+	}
+}
+
+// singleValue 保证表达式只产生一个值：函数调用和 ... 替换 and/or 后需要加括号截断多返回值。
+func singleValue(expr ast.Expr) ast.Expr {
+	switch expr.(type) {
+	case *ast.FuncCall, *ast.ConstVariadic:
+		return &ast.Parens{Inner: expr}
+	}
+	return expr
+}
+
+// ============================================================================
+// 语句改写
+// ============================================================================
+
+// foldSite 是一处可以改写的源码行：独占一行的简单语句，或复合语句的头部。
+type foldSite struct {
+	line int
+	// owners 是允许与这一行重叠的语句（语句本身，以及 if/elseif 链中的其他节点）
+	owners []ast.Stmt
+	// keyword、suffix 是头部行去掉注释后必须的开头和结尾关键字，简单语句为空
+	keyword string
+	suffix  string
+	// exprs 是要折叠的表达式，cond 表示它们只用作条件
+	exprs []*ast.Expr
+	cond  bool
+	// render 打印改写后这一行的代码（不含缩进和注释）
+	render func() string
+}
+
+// opt_const_fold 在文件中找到第一处可以折叠的代码并改写。
+func (o *optimizer) opt_const_fold() {
+	sites := o.collectFoldSites()
+	if len(sites) == 0 {
+		return
+	}
+	starts := o.stmtStarts()
+	for _, site := range sites {
+		if o.applyFoldSite(site, starts) {
+			return
+		}
+	}
+}
+
+// collectFoldSites 按源码顺序收集文件中所有可能改写的行。
+func (o *optimizer) collectFoldSites() []*foldSite {
+	var sites []*foldSite
+	o.for_each_block(func(block []ast.Stmt) bool {
+		for _, stmt := range block {
+			sites = append(sites, o.stmtFoldSites(stmt)...)
+		}
+		return true
+	})
+	return sites
+}
+
+func (o *optimizer) stmtFoldSites(stmt ast.Stmt) []*foldSite {
+	switch s := stmt.(type) {
+	case *ast.Assign:
+		site := &foldSite{line: s.Line(), owners: []ast.Stmt{s}}
+		for i := range s.Targets {
+			site.exprs = append(site.exprs, &s.Targets[i])
+		}
+		for i := range s.Values {
+			site.exprs = append(site.exprs, &s.Values[i])
+		}
+		site.render = func() string { return renderSingleLine(s) }
+		return []*foldSite{site}
+	case *ast.FuncCall:
+		site := &foldSite{line: s.Line(), owners: []ast.Stmt{s}}
+		site.exprs = append(site.exprs, &s.Receiver, &s.Function)
+		for i := range s.Args {
+			site.exprs = append(site.exprs, &s.Args[i])
+		}
+		site.render = func() string { return renderSingleLine(s) }
+		return []*foldSite{site}
+	case *ast.Return:
+		site := &foldSite{line: s.Line(), owners: []ast.Stmt{s}}
+		for i := range s.Items {
+			site.exprs = append(site.exprs, &s.Items[i])
+		}
+		site.render = func() string { return renderSingleLine(s) }
+		return []*foldSite{site}
+	case *ast.If:
+		var sites []*foldSite
+		chain := []ast.Stmt{s}
+		keyword := "if"
+		for cur := s; cur != nil; {
+			node, kw := cur, keyword
+			sites = append(sites, &foldSite{line: node.Cond.Line(), owners: chain, keyword: kw, suffix: "then",
+				exprs: []*ast.Expr{&node.Cond}, cond: true, render: func() string {
+					return kw + " " + expr_to_string(node.Cond) + " then"
+				}})
+			cur = nil
+			if len(node.Else) == 1 {
+				if elseif, ok := node.Else[0].(*ast.If); ok && elseif.Line() > 0 {
+					chain = append(chain, elseif)
+					cur, keyword = elseif, "elseif"
+				}
+			}
+		}
+		return sites
+	case *ast.WhileLoop:
+		return []*foldSite{{line: s.Cond.Line(), owners: []ast.Stmt{s}, keyword: "while", suffix: "do",
+			exprs: []*ast.Expr{&s.Cond}, cond: true, render: func() string {
+				return "while " + expr_to_string(s.Cond) + " do"
+			}}}
+	case *ast.RepeatUntilLoop:
+		return []*foldSite{{line: s.Cond.Line(), owners: []ast.Stmt{s}, keyword: "until",
+			exprs: []*ast.Expr{&s.Cond}, cond: true, render: func() string {
+				return "until " + expr_to_string(s.Cond)
+			}}}
+	case *ast.ForLoopNumeric:
+		return []*foldSite{{line: s.Line(), owners: []ast.Stmt{s}, keyword: "for", suffix: "do",
+			exprs: []*ast.Expr{&s.Init, &s.Limit, &s.Step}, render: func() string {
+				header := "for " + s.Counter + " = " + expr_to_string(s.Init) + ", " + expr_to_string(s.Limit)
+				if step, ok := s.Step.(*ast.ConstInt); !ok || step.Value != "1" {
+					header += ", " + expr_to_string(s.Step)
+				}
+				return header + " do"
+			}}}
+	}
+	return nil
+}
+
+// renderSingleLine 打印一条简单语句，打印结果跨行（包含函数体）时返回空串。
+func renderSingleLine(stmt ast.Stmt) string {
+	lines := stmt_to_lines(stmt, "")
+	if len(lines) != 1 {
+		return ""
+	}
+	return lines[0]
+}
+
+// stmtStarts 返回每一行上开始的语句。
+// 在这一行结束的前一条语句（或 end）会让这一行的代码无法单独解析，由 applyFoldSite 检查。
+func (o *optimizer) stmtStarts() map[int][]ast.Stmt {
+	starts := map[int][]ast.Stmt{}
+	o.for_each_block(func(block []ast.Stmt) bool {
+		for _, stmt := range block {
+			starts[stmt.Line()] = append(starts[stmt.Line()], stmt)
+		}
+		return true
+	})
+	return starts
+}
+
+// applyFoldSite 尝试折叠一处代码，有改动时改写这一行并返回 true。
+func (o *optimizer) applyFoldSite(site *foldSite, starts map[int][]ast.Stmt) bool {
+	content, comment, ok := o.checkFoldSite(site, starts, "const_fold")
+	if !ok {
+		return false
+	}
+
+	c := &constFolder{}
+	for _, p := range site.exprs {
+		if *p != nil {
+			*p = c.fold(*p, site.cond)
+		}
+	}
+	if len(c.folded) == 0 {
+		return false
+	}
+	new_line, ok := renderFoldSite(site, content, comment)
+	if !ok {
+		return false
+	}
+
+	line := site.line
+	rw := Rewrite{Pass: "const_fold", Target: strings.Join(c.folded, ", "), GroupSize: 1, Replaced: len(c.folded)}
+	rw.Line, rw.EndLine = o.origRange(line, line)
+	o.spliceLines(line, line, []string{new_line})
+
+	o.logf("opt const_fold at: %s:%d target=%s", o.filename, line, rw.Target)
+	o.addRewrite(rw)
+	return true
+}
+
+// checkFoldSite 检查 site 所在的行可以按语句重新打印，并且没有被 pass 的 olua:disable 关闭，
+// 返回这一行的内容和行末注释。
+func (o *optimizer) checkFoldSite(site *foldSite, starts map[int][]ast.Stmt, pass string) (string, string, bool) {
+	line := site.line
+	if line < 1 || line > len(o.filecontent) || o.isDisabled(pass, line, line) {
+		return "", "", false
+	}
+	for _, p := range site.exprs {
+		if *p != nil && !can_expr_to_string(*p) {
+			return "", "", false
+		}
+	}
+	// 这一行上不能有其他语句开始
+	for _, stmt := range starts[line] {
+		owned := false
+		for _, owner := range site.owners {
+			if stmt == owner {
+				owned = true
+			}
+		}
+		if !owned {
+			return "", "", false
+		}
+	}
+	content := o.filecontent[line-1]
+	code, comment, ok := splitLineComment(content)
+	if !ok {
+		return "", "", false
+	}
+	code = strings.TrimSpace(code)
+	if site.keyword == "" {
+		// 简单语句必须恰好占据这一行
+		if start, end := o.find_stmt_line_range(site.owners[0]); start != line || end != line {
+			return "", "", false
+		}
+		if end, ok := o.find_stmts_end_line(line, line, 1); !ok || end != line {
+			return "", "", false
+		}
+	} else {
+		fields := strings.Fields(code)
+		if len(fields) < 2 || fields[0] != site.keyword || (site.suffix != "" && fields[len(fields)-1] != site.suffix) {
+			return "", "", false
+		}
+		if site.suffix == "" {
+			// until 行之后可能还有外层代码块的 end 等，必须恰好是一个条件
+			if _, err := ast.Parse("repeat "+code, line); err != nil {
+				return "", "", false
+			}
+		}
+		for _, p := range site.exprs {
+			if *p == nil {
+				continue
+			}
+			// 头部已经确认在这一行结束，函数调用不需要再试解析查找 ) 所在的行
+			if start, end := o.find_stmt_line_range(&ast.Parens{Inner: *p}); start != line || end != line {
+				return "", "", false
+			}
+		}
+	}
+
+	return content, comment, true
+}
+
+// renderFoldSite 打印改写后的一行（保留缩进和行末注释），没有变化时返回 false。
+func renderFoldSite(site *foldSite, content string, comment string) (string, bool) {
+	rendered := site.render()
+	if rendered == "" {
+		return "", false
+	}
+	new_line := get_content_space(content) + rendered
+	if comment != "" {
+		new_line += " " + comment
+	}
+	return new_line, new_line != content
+}
+
+// splitLineComment 把一行分为代码和行末注释（不含注释前的空白）。
+// 行中有长字符串或长注释（[[、[=[）时无法可靠地拆分，返回 false。
+func splitLineComment(content string) (string, string, bool) {
+	var quote byte
+	for i := 0; i < len(content); i++ {
+		ch := content[i]
+		if quote != 0 {
+			if ch == '\\' {
+				i++
+			} else if ch == quote {
+				quote = 0
+			}
+			continue
+		}
+		switch ch {
+		case '"', '\'':
+			quote = ch
+		case '[':
+			if i+1 < len(content) && (content[i+1] == '[' || content[i+1] == '=') {
+				return "", "", false
+			}
+		case '-':
+			if i+1 < len(content) && content[i+1] == '-' {
+				if strings.HasPrefix(content[i+2:], "[") {
+					return "", "", false
+				}
+				return strings.TrimRight(content[:i], " \t"), content[i:], true
+			}
+		}
+	}
+	if quote != 0 {
+		return "", "", false
+	}
+	return content, "", true
+}
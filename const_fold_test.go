@@ -0,0 +1,185 @@
+package olua
+
+import (
+	"testing"
+
+	"github.com/milochristiansen/lua/ast"
+)
+
+// ============================================================================
+// 集成测试：对比优化器输出与期望文件
+// ============================================================================
+
+// constFoldOptions 返回只启用常量折叠的测试选项。
+func constFoldOptions() Options {
+	opts := DefaultOptions()
+	opts.ConstFold = true
+	return opts
+}
+
+func TestConstFold(t *testing.T) {
+	compareOptOutputWith(t, constFoldOptions(), "input/const_fold.lua", "output/const_fold.lua")
+}
+
+// ============================================================================
+// 单元测试：Lua 5.3 求值规则
+// ============================================================================
+
+// parseExpr 把 src 解析为单个表达式。
+func parseExpr(t *testing.T, src string) ast.Expr {
+	t.Helper()
+	block, err := ast.Parse("return "+src, 1)
+	if err != nil {
+		t.Fatalf("parse %q: %v", src, err)
+	}
+	return block[0].(*ast.Return).Items[0]
+}
+
+func TestFoldExpr(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		// 整数和浮点数
+		{"60 * 60 * 24", "86400"},
+		{"10 / 2", "5.0"},
+		{"7 // 2", "3"},
+		{"-7 // 2", "-4"},
+		{"7 // 2.0", "3.0"},
+		{"-7 % 3", "2"},
+		{"7 % -3", "-2"},
+		{"-5.5 % 2", "0.5"},
+		{"2 ^ 10", "1024.0"},
+		{"0x7fffffffffffffff * 2", "-2"},
+		{"9223372036854775808", "9223372036854775808"},
+		{"9223372036854775807 + 0", "9223372036854775807"},
+		{"0xff + 0", "255"},
+		{"1e2 + 0", "100.0"},
+		{"1 == 1.0", "true"},
+		{"2 ^ 53 == 9007199254740992", "true"},
+		{"(2 - 5) ^ 2", "9.0"},
+		{"-(2 ^ 2)", "-4.0"},
+		{"0.0 * -1", "-0.0"},
+		// 位运算
+		{"1 << 4 | 0x0f", "31"},
+		{"1 << 64", "0"},
+		{"-1 >> 63", "1"},
+		{"1 << -1", "0"},
+		{"~0", "-1"},
+		{"3.0 & 1", "1"},
+		// 字符串转换
+		{`"10" + 1`, "11"},
+		{`" 0x10 " * 2`, "32"},
+		{`"1.5" * 2`, "3.0"},
+		{`-"2"`, "-2"},
+		{`"a" .. 1 .. 2.5`, `"a12.5"`},
+		{`"a" .. 10 / 2`, `"a5.0"`},
+		{`"a" .. 2 ^ 53`, `"a9.007199254741e+15"`},
+		{`#"abc"`, "3"},
+		{`"a\n" .. "b"`, `"a\nb"`},
+		// 布尔运算和化简
+		{"not nil", "true"},
+		{"nil and x", "nil"},
+		{"false or x", "x"},
+		{"true and f()", "(f())"},
+		{"1 and ...", "(...)"},
+		{"x and (1 + 1)", "x and 2"},
+		{"not (a == b)", "a ~= b"},
+		{"not (a ~= b)", "a == b"},
+		{"(a < b) == true", "a < b"},
+		{"(a < b) == false", "not (a < b)"},
+		{"true ~= (a == b)", "a ~= b"},
+		{"not not (a < b)", "a < b"},
+		{"1 / 0 > 5", "true"},
+		// 不折叠
+		{"1 // 0", "1 // 0"},
+		{"1 % 0", "1 % 0"},
+		{"1 / 0", "1 / 0"},
+		{`"abc" + 1`, `"abc" + 1`},
+		{`"a" < "b"`, `"a" < "b"`},
+		{"1.5 | 0", "1.5 | 0"},
+		{"x == true", "x == true"},
+		{"- -x", "- -x"},
+		{"not not x", "not not x"},
+		{"0x7fffffffffffffff + 1", "0x7fffffffffffffff + 1"},
+		{"{} == {}", "{} == {}"},
+	}
+	for _, tt := range tests {
+		c := &constFolder{}
+		got := expr_to_string(c.fold(parseExpr(t, tt.src), false))
+		if got != tt.want {
+			t.Errorf("fold(%s) = %s, want %s", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestFoldExprCond(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{"not not x", "x"},
+		{"not not x and not not y", "x and y"},
+		{"true and x", "x"},
+		{"f(not not x)", "f(not not x)"},
+	}
+	for _, tt := range tests {
+		c := &constFolder{}
+		got := expr_to_string(c.fold(parseExpr(t, tt.src), true))
+		if got != tt.want {
+			t.Errorf("fold(%s) as condition = %s, want %s", tt.src, got, tt.want)
+		}
+	}
+}
+
+// ============================================================================
+// 单元测试：语句改写
+// ============================================================================
+
+func TestSplitLineComment(t *testing.T) {
+	tests := []struct {
+		content string
+		code    string
+		comment string
+		ok      bool
+	}{
+		{"x = 1 + 1", "x = 1 + 1", "", true},
+		{"x = 1 + 1 -- two", "x = 1 + 1", "-- two", true},
+		{`x = "--" .. "a" -- c`, `x = "--" .. "a"`, "-- c", true},
+		{`x = 'it\'s' -- c`, `x = 'it\'s'`, "-- c", true},
+		{"x = [[a]] .. b", "", "", false},
+		{"x = 1 --[[ a ]] + 1", "", "", false},
+		{`x = "unterminated`, "", "", false},
+	}
+	for _, tt := range tests {
+		code, comment, ok := splitLineComment(tt.content)
+		if code != tt.code || comment != tt.comment || ok != tt.ok {
+			t.Errorf("splitLineComment(%q) = %q, %q, %v", tt.content, code, comment, ok)
+		}
+	}
+}
+
+func TestConstFoldSkips(t *testing.T) {
+	tests := []string{
+		// 与其他语句共享一行
+		"x = 1 + 1; y = 2\n",
+		"if c then x = 1 + 1 end\n",
+		// 跨行
+		"x = 1 +\n    1\n",
+		// 包含函数体
+		"f(1 + 1, function() end)\n",
+		// 被指令关闭
+		"x = 1 + 1 -- olua:disable-line const_fold\n",
+		// until 之后还有外层代码块的 end
+		"while c do repeat\n    f()\nuntil not not x end\n",
+	}
+	for _, src := range tests {
+		out, _, err := Optimize([]byte(src), constFoldOptions())
+		if err != nil {
+			t.Fatalf("%q: %v", src, err)
+		}
+		if string(out) != src {
+			t.Errorf("expected %q unchanged, got %q", src, out)
+		}
+	}
+}
@@ -0,0 +1,486 @@
+package olua
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/milochristiansen/lua/ast"
+)
+
+// ============================================================================
+// 公共子表达式消除
+// ============================================================================
+//
+// table 访问优化只缓存 a.b.c 这样的路径。同一语句块中重复计算的纯函数调用和取长度
+// 也可以缓存到局部变量中：
+//
+//	local list_len = #list -- opt by oLua (cse)
+//	local last = list[list_len]
+//	if list_len > 10 then
+//
+// 可以缓存的表达式：
+//   - 内置纯函数白名单中返回单个确定值的函数调用（string.len(name)、math.floor(x / 32)），
+//     参数中只有常量、变量、路径、运算符和可以缓存的调用
+//   - 取长度 #x
+//
+// 用户配置的纯函数（如 log_.*）只保证不修改参数，不保证返回相同的值，不缓存。
+//
+// 表达式用 check_expr_same 比较，在同一语句块中（不含嵌套语句块和函数体）出现至少两次时缓存，
+// 对其输入（表达式中读取的变量和路径）的写会结束一个读组：
+//   - table 访问优化的写分析认为会修改输入的赋值和函数调用
+//   - 对输入的字段的写（t[i] = v 会改变 #t），以及把输入或其字段传给非纯函数的调用（table.insert(t, v)）
+//
+// 只替换独占一行的简单语句和复合语句头部（if 的条件、while 的条件、数值 for 的范围）中的表达式。
+// and/or 右侧的表达式是按条件求值的，读组的第一条语句中必须至少有一处无条件的求值，
+// 提前求值才不会引入新的错误。语句块中有标签时不处理（goto 可能跳回读组中间）。
+
+// cseMarker 是公共子表达式缓存声明行的标记
+const cseMarker = "-- opt by oLua (cse)"
+
+// cseExcluded 是纯函数白名单中不能缓存的函数：有可见效果、结果不确定、返回多个值或新的迭代器
+var cseExcluded = map[string]bool{
+	"print":         true,
+	"error":         true,
+	"warn":          true,
+	"assert":        true,
+	"math.random":   true,
+	"os.clock":      true,
+	"os.time":       true,
+	"os.date":       true,
+	"select":        true,
+	"unpack":        true,
+	"next":          true,
+	"pairs":         true,
+	"ipairs":        true,
+	"string.find":   true,
+	"string.match":  true,
+	"string.byte":   true,
+	"string.gmatch": true,
+}
+
+// cseRead 是读组中的一条语句
+type cseRead struct {
+	site    *foldSite
+	content string
+	comment string
+}
+
+// opt_block_cse 在函数体或主代码块 block 中缓存一个重复计算的表达式。
+func (o *optimizer) opt_block_cse(block []ast.Stmt) {
+	o.cseBlock(block, o.stmtStarts())
+}
+
+// cseBlock 先尝试当前层级，没有可以缓存的表达式时再进入嵌套语句块，成功时返回 true。
+func (o *optimizer) cseBlock(block []ast.Stmt, starts map[int][]ast.Stmt) bool {
+	if o.cseBlockLevel(block, starts) {
+		return true
+	}
+	for _, stmt := range block {
+		var children [][]ast.Stmt
+		switch s := stmt.(type) {
+		case *ast.ForLoopNumeric, *ast.ForLoopGeneric, *ast.WhileLoop, *ast.RepeatUntilLoop:
+			children = loop_body(stmt)
+		case *ast.DoBlock:
+			children = [][]ast.Stmt{s.Block}
+		case *ast.If:
+			children = [][]ast.Stmt{s.Then, s.Else}
+		}
+		for _, child := range children {
+			if o.cseBlock(child, starts) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// cseBlockLevel 在 block 的顶层语句中缓存一个表达式，成功时返回 true。
+func (o *optimizer) cseBlockLevel(block []ast.Stmt, starts map[int][]ast.Stmt) bool {
+	if o.isMainChunk(block) && countLocalDecls(block) >= maxChunkLocals {
+		return false
+	}
+	for _, stmt := range block {
+		if _, ok := stmt.(*ast.Label); ok {
+			return false
+		}
+	}
+
+	// 每条语句中可以改写的行
+	reads := make([]*cseRead, len(block))
+	var candidates []ast.Expr
+	for i, stmt := range block {
+		site := cseSite(o.stmtFoldSites(stmt), stmt)
+		if site == nil || strings.Contains(o.filecontent[site.line-1], "-- opt by oLua") || site.render() == "" {
+			continue
+		}
+		content, comment, ok := o.checkFoldSite(site, starts, "cse")
+		if !ok {
+			continue
+		}
+		reads[i] = &cseRead{site: site, content: content, comment: comment}
+		for _, p := range site.exprs {
+			walkExprSlots(p, func(p *ast.Expr) bool {
+				if o.isCSECandidate(*p) && !containsSameExpr(candidates, *p) {
+					candidates = append(candidates, *p)
+				}
+				return true
+			})
+		}
+	}
+	// 较长的表达式优先，缓存之后其中的子表达式可能不再重复
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return len(expr_to_string(candidates[i])) > len(expr_to_string(candidates[j]))
+	})
+
+	for _, expr := range candidates {
+		if group := o.cseGroup(block, reads, expr); group != nil {
+			o.applyCSE(block, expr, group)
+			return true
+		}
+	}
+	return false
+}
+
+// cseSite 返回语句 stmt 中只求值一次、在语句开始时求值的行：简单语句、if 的第一个条件、
+// while 的条件和数值 for 的范围，其他语句返回 nil。
+func cseSite(sites []*foldSite, stmt ast.Stmt) *foldSite {
+	if len(sites) == 0 {
+		return nil
+	}
+	switch stmt.(type) {
+	case *ast.Assign, *ast.FuncCall, *ast.Return, *ast.If, *ast.WhileLoop, *ast.ForLoopNumeric:
+		return sites[0]
+	}
+	return nil
+}
+
+// cseGroup 返回 block 中 expr 第一个出现至少两次的读组，没有时返回 nil。
+func (o *optimizer) cseGroup(block []ast.Stmt, reads []*cseRead, expr ast.Expr) []*cseRead {
+	inputs := cseInputs(expr)
+	var group []*cseRead
+	count := 0
+	flush := func() bool {
+		if count >= 2 && o.cseGroupStart(block, group[0]) {
+			return true
+		}
+		group, count = nil, 0
+		return false
+	}
+	for i, stmt := range block {
+		target_write, call_write := o.cseStmtWrites(stmt, inputs)
+		if call_write || (target_write && !isSimpleStmt(stmt)) {
+			// 函数调用可能在表达式求值之前修改输入，复合语句中的写在条件之后
+			if flush() {
+				return group
+			}
+			continue
+		}
+		if read := reads[i]; read != nil {
+			n, unconditional := countSameExpr(read.site, expr)
+			if n > 0 && (len(group) > 0 || unconditional) {
+				group = append(group, read)
+				count += n
+			}
+		}
+		if target_write {
+			// 赋值语句先求值右侧和目标中的表达式，再赋值
+			if flush() {
+				return group
+			}
+		}
+	}
+	if flush() {
+		return group
+	}
+	return nil
+}
+
+// cseGroupStart 判断读组的第一条语句独占起始行，缓存声明可以插在它之前。
+func (o *optimizer) cseGroupStart(block []ast.Stmt, first *cseRead) bool {
+	for i, stmt := range block {
+		if stmt != first.site.owners[0] {
+			continue
+		}
+		if i > 0 {
+			if _, prev_end := o.find_stmt_line_range(block[i-1]); prev_end >= first.site.line {
+				return false
+			}
+		}
+		return !o.isDisabled("cse", first.site.line, first.site.line)
+	}
+	return false
+}
+
+func isSimpleStmt(stmt ast.Stmt) bool {
+	switch stmt.(type) {
+	case *ast.Assign, *ast.FuncCall, *ast.Return:
+		return true
+	}
+	return false
+}
+
+// isCSECandidate 判断 expr 是可以缓存的纯函数调用或取长度。
+func (o *optimizer) isCSECandidate(expr ast.Expr) bool {
+	switch e := expr.(type) {
+	case *ast.Operator:
+		return e.Op == ast.OpLength && o.isCSEOperand(e.Right)
+	case *ast.FuncCall:
+		if e.Receiver != nil {
+			return false
+		}
+		name, ok := constPath(e.Function)
+		if !ok || !builtinPureFuncs[name] || cseExcluded[name] {
+			return false
+		}
+		for _, arg := range e.Args {
+			if !o.isCSEOperand(arg) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// isCSEOperand 判断 expr 可以作为被缓存表达式的一部分：求值没有副作用，并且输入不变时结果不变。
+func (o *optimizer) isCSEOperand(expr ast.Expr) bool {
+	switch e := expr.(type) {
+	case *ast.ConstIdent, *ast.ConstString, *ast.ConstInt, *ast.ConstFloat, *ast.ConstBool, *ast.ConstNil:
+		return true
+	case *ast.TableAccessor:
+		return o.isCSEOperand(e.Obj) && o.isCSEOperand(e.Key)
+	case *ast.Parens:
+		return o.isCSEOperand(e.Inner)
+	case *ast.Operator:
+		return (e.Left == nil || o.isCSEOperand(e.Left)) && o.isCSEOperand(e.Right)
+	case *ast.FuncCall:
+		return o.isCSECandidate(e)
+	}
+	return false
+}
+
+// cseInputs 返回 expr 读取的变量和路径（包括被调用的函数）。
+func cseInputs(expr ast.Expr) []string {
+	var inputs []string
+	walkExprSlots(&expr, func(p *ast.Expr) bool {
+		switch e := (*p).(type) {
+		case *ast.ConstIdent:
+			inputs = append(inputs, e.Value)
+		case *ast.TableAccessor:
+			if path, ok := constPath(e); ok {
+				inputs = append(inputs, path)
+				return false
+			}
+		}
+		return true
+	})
+	return inputs
+}
+
+// constPath 与 getExprPath 相同，但只接受常量字符串 key：t[k] 的 key 是变量，不是路径 t.k。
+func constPath(expr ast.Expr) (string, bool) {
+	switch e := expr.(type) {
+	case *ast.ConstIdent:
+		return e.Value, true
+	case *ast.TableAccessor:
+		key, ok := e.Key.(*ast.ConstString)
+		if !ok {
+			return "", false
+		}
+		obj, ok := constPath(e.Obj)
+		return obj + "." + key.Value, ok
+	}
+	return "", false
+}
+
+// basePath 返回赋值目标或参数 expr 所在的最长点分路径：t[i] 返回 t，a.b[k].c 返回 a.b。
+func basePath(expr ast.Expr) (string, bool) {
+	for {
+		if path, ok := constPath(expr); ok {
+			return path, true
+		}
+		switch e := expr.(type) {
+		case *ast.TableAccessor:
+			expr = e.Obj
+		case *ast.Parens:
+			expr = e.Inner
+		default:
+			return "", false
+		}
+	}
+}
+
+// cseStmtWrites 判断 stmt（包括嵌套语句块，不含函数体）是否可能改变 inputs 中的值，
+// 分别返回赋值目标的写和函数调用的写。
+func (o *optimizer) cseStmtWrites(stmt ast.Stmt, inputs []string) (bool, bool) {
+	written := false
+	for _, input := range inputs {
+		if o.stmtContainsWrite(stmt, input) {
+			written = true
+		}
+	}
+
+	related := func(expr ast.Expr) bool {
+		path, ok := basePath(expr)
+		if !ok {
+			return false
+		}
+		for _, input := range inputs {
+			if pathsRelated(path, input) {
+				return true
+			}
+		}
+		return false
+	}
+	target_write, call_write := false, false
+	f := lua_visitor{f: func(n ast.Node, ok *bool) {
+		switch e := n.(type) {
+		case *ast.FuncDecl:
+			*ok = false
+		case *ast.Assign:
+			for _, t := range e.Targets {
+				if related(t) {
+					target_write = true
+				}
+			}
+		case *ast.FuncCall:
+			if name, name_ok := getFuncCallName(e); name_ok && e.Receiver == nil && o.isPureFunction(name) {
+				return
+			}
+			if e.Receiver != nil && related(e.Receiver) {
+				call_write = true
+			}
+			for _, arg := range e.Args {
+				if related(arg) {
+					call_write = true
+				}
+			}
+		}
+	}}
+	ast.Walk(&f, stmt)
+	if written && !target_write {
+		call_write = true
+	}
+	return target_write, call_write
+}
+
+// walkExprSlots 按先序对 *p 及其子表达式所在的位置调用 f（不进入函数定义），f 返回 false 时不进入子表达式。
+func walkExprSlots(p *ast.Expr, f func(p *ast.Expr) bool) {
+	if *p == nil || !f(p) {
+		return
+	}
+	switch e := (*p).(type) {
+	case *ast.FuncCall:
+		walkExprSlots(&e.Receiver, f)
+		walkExprSlots(&e.Function, f)
+		for i := range e.Args {
+			walkExprSlots(&e.Args[i], f)
+		}
+	case *ast.Operator:
+		walkExprSlots(&e.Left, f)
+		walkExprSlots(&e.Right, f)
+	case *ast.Parens:
+		walkExprSlots(&e.Inner, f)
+	case *ast.TableAccessor:
+		walkExprSlots(&e.Obj, f)
+		walkExprSlots(&e.Key, f)
+	case *ast.TableConstructor:
+		for i := range e.Vals {
+			walkExprSlots(&e.Keys[i], f)
+			walkExprSlots(&e.Vals[i], f)
+		}
+	}
+}
+
+func containsSameExpr(exprs []ast.Expr, expr ast.Expr) bool {
+	for _, e := range exprs {
+		if check_expr_same(e, expr) {
+			return true
+		}
+	}
+	return false
+}
+
+// countSameExpr 统计 site 中与 expr 相同的表达式个数，并判断其中是否有不在 and/or 右侧的。
+func countSameExpr(site *foldSite, expr ast.Expr) (int, bool) {
+	n, unconditional := 0, false
+	var visit func(e ast.Expr, cond bool)
+	visit = func(e ast.Expr, cond bool) {
+		if e == nil {
+			return
+		}
+		if check_expr_same(e, expr) {
+			n++
+			unconditional = unconditional || !cond
+			return
+		}
+		switch e := e.(type) {
+		case *ast.Operator:
+			visit(e.Left, cond)
+			visit(e.Right, cond || e.Op == ast.OpAnd || e.Op == ast.OpOr)
+		default:
+			walkExprSlots(&e, func(p *ast.Expr) bool {
+				if *p == e {
+					return true
+				}
+				visit(*p, cond)
+				return false
+			})
+		}
+	}
+	for _, p := range site.exprs {
+		visit(*p, false)
+	}
+	return n, unconditional
+}
+
+// cseLocalName 根据表达式生成局部变量名：第一个读取的变量或路径加上函数名，如 name_len、x_floor。
+func cseLocalName(expr ast.Expr) string {
+	var args []ast.Expr
+	suffix := "len"
+	if call, ok := expr.(*ast.FuncCall); ok {
+		name, _ := constPath(call.Function)
+		suffix = name[strings.LastIndex(name, ".")+1:]
+		args = call.Args
+	} else {
+		args = []ast.Expr{expr.(*ast.Operator).Right}
+	}
+	for _, arg := range args {
+		if inputs := cseInputs(arg); len(inputs) > 0 {
+			return table_access_to_local_name(inputs[0]) + "_" + suffix
+		}
+	}
+	return suffix
+}
+
+// applyCSE 在读组之前插入 expr 的缓存，并把读组中的 expr 替换为局部变量。
+func (o *optimizer) applyCSE(block []ast.Stmt, expr ast.Expr, group []*cseRead) {
+	target := expr_to_string(expr)
+	name := getUniqueLocalName(o.scopeBlock(block), cseLocalName(expr))
+	first, last := group[0].site.line, group[len(group)-1].site.line
+	rw := Rewrite{Pass: "cse", Target: target, Local: name, GroupSize: len(group)}
+	rw.Line, rw.EndLine = o.origRange(first, last)
+
+	for _, read := range group {
+		for _, p := range read.site.exprs {
+			walkExprSlots(p, func(p *ast.Expr) bool {
+				if check_expr_same(*p, expr) {
+					*p = &ast.ConstIdent{Value: name}
+					rw.Replaced++
+					return false
+				}
+				return true
+			})
+		}
+		if new_line, ok := renderFoldSite(read.site, read.content, read.comment); ok {
+			o.filecontent[read.site.line-1] = new_line
+		}
+	}
+
+	decl := &ast.Assign{LocalDecl: true, Targets: []ast.Expr{&ast.ConstIdent{Value: name}}, Values: []ast.Expr{expr}}
+	indent := get_content_space(o.filecontent[first-1])
+	o.spliceLines(first, first-1, []string{stmt_to_lines(decl, indent)[0] + " " + cseMarker})
+
+	o.logf("opt cse at: %s:%d target=%s", o.filename, rw.Line, target)
+	o.addRewrite(rw)
+}
@@ -0,0 +1,118 @@
+package olua
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/milochristiansen/lua/ast"
+)
+
+// ============================================================================
+// 集成测试：对比优化器输出与期望文件
+// ============================================================================
+
+// cseOptions 返回只启用公共子表达式消除的测试选项。
+func cseOptions() Options {
+	opts := DefaultOptions()
+	opts.CSE = true
+	return opts
+}
+
+func TestCSE(t *testing.T) {
+	compareOptOutputWith(t, cseOptions(), "input/cse.lua", "output/cse.lua")
+}
+
+func TestCSERevert(t *testing.T) {
+	lines, err := readFileLines("output/cse.lua")
+	if err != nil {
+		t.Fatal(err)
+	}
+	optimized := strings.Join(lines, "\n") + "\n"
+	reverted, report, err := Revert([]byte(optimized), DefaultOptions())
+	if err != nil {
+		t.Fatalf("Revert failed: %v", err)
+	}
+	if strings.Contains(string(reverted), "opt by oLua") || len(report.Rewrites) != 7 || report.Rewrites[0].Pass != "cse" {
+		t.Fatalf("revert = %+v:\n%s", report.Rewrites, reverted)
+	}
+	again, _, err := Optimize(reverted, cseOptions())
+	if err != nil {
+		t.Fatalf("Optimize failed: %v", err)
+	}
+	if string(again) != optimized {
+		t.Errorf("re-optimized output differs:\n%s", again)
+	}
+}
+
+// ============================================================================
+// 单元测试：候选表达式和失效
+// ============================================================================
+
+func TestCSECandidates(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"user pure funcs are not cached", "local a = log_info(x)\nlocal b = log_info(x)\n", ""},
+		{"method calls are not cached", "local a = s:len()\nlocal b = s:len()\n", ""},
+		{"multiple results are not cached", "local a = string.find(s, \"a\")\nlocal b = string.find(s, \"a\")\n", ""},
+		{"impure arguments are not cached", "local a = math.floor(f(x))\nlocal b = math.floor(f(x))\n", ""},
+		{"different arguments", "local a = #t.a\nlocal b = #t.b\n", ""},
+		{"nested candidate", "local a = tostring(#t)\nlocal b = tostring(#t)\n", "tostring(#t)"},
+		{"unrelated call", "local a = #t\nfoo(u)\nlocal b = #t\n", "#t"},
+		{"related call", "local a = #t\nfoo(t)\nlocal b = #t\n", ""},
+		{"parent write", "local a = #t.a\nt = {}\nlocal b = #t.a\n", ""},
+		{"dynamic key write", "local a = string.len(t.a)\nt[k] = 1\nlocal b = string.len(t.a)\n", ""},
+		{"index variable write", "local a = #t[k]\nk = 2\nlocal b = #t[k]\n", ""},
+		{"index variable", "local a = #t[k]\nlocal b = #t[k]\n", "#t[k]"},
+		{"compound write", "local a = #t\nif a then t[1] = 1 end\nlocal b = #t\n", ""},
+		{"conditional first read", "local a = x and #t\nlocal b = #t\n", ""},
+		{"conditional later read", "local a = #t\nlocal b = x and #t\n", "#t"},
+		{"label", "::top::\nlocal a = #t\nlocal b = #t\n", ""},
+		{"disabled", "local a = #t -- olua:disable-line cse\nlocal b = #t\nlocal c = #t\n", "#t"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := cseOptions()
+			_, report, err := Optimize([]byte(tt.src), opts)
+			if err != nil {
+				t.Fatalf("Optimize failed: %v", err)
+			}
+			got := ""
+			if len(report.Rewrites) > 0 {
+				got = report.Rewrites[0].Target
+			}
+			if got != tt.want {
+				t.Errorf("target = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckExprSameOperators(t *testing.T) {
+	parse := func(src string) ast.Expr {
+		block, err := ast.Parse("return "+src, 1)
+		if err != nil {
+			t.Fatalf("parse %q: %v", src, err)
+		}
+		return block[0].(*ast.Return).Items[0]
+	}
+	tests := []struct {
+		left, right string
+		want        bool
+	}{
+		{"math.floor(x / 32)", "math.floor(x / 32)", true},
+		{"math.floor(x / 32)", "math.floor(x // 32)", false},
+		{"#list", "#list", true},
+		{"#list", "-list", false},
+		{"(a + b)", "(a + b)", true},
+		{"a:len()", "b:len()", false},
+		{"a:len()", "a.len()", false},
+	}
+	for _, tt := range tests {
+		if got := check_expr_same(parse(tt.left), parse(tt.right)); got != tt.want {
+			t.Errorf("check_expr_same(%s, %s) = %v, want %v", tt.left, tt.right, got, tt.want)
+		}
+	}
+}
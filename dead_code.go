@@ -0,0 +1,313 @@
+package olua
+
+import (
+	"sort"
+
+	"github.com/milochristiansen/lua/ast"
+)
+
+// ============================================================================
+// 删除未使用的局部变量和无效赋值
+// ============================================================================
+//
+// 多轮优化和手工修改之后，代码中常常留下从未被读取的局部变量（包括 oLua 生成的缓存）
+// 和在读取之前就被覆盖的赋值：
+//
+//	local a_b = a.b -- opt by oLua       （删除：a_b 没有被读取）
+//	local count = 0                      → local count
+//	count = #list                        （count = 0 在读取之前被覆盖）
+//
+// 只有右侧求值既没有副作用也不会出错时才删除：常量、局部变量、函数定义，以及只由它们构成的 table 构造表达式。
+// table 访问、#、运算符可能触发元方法或出错（如 a.b 中 a 为 nil），函数调用（包括内置纯函数，
+// 如 string.len(nil)）也可能出错，删除后会改变程序的行为，都不删除。
+// 右侧不满足条件的未使用局部变量不删除，在报告中记录原因。
+//
+// 无效赋值只在同一个语句块中查找：两次赋值之间没有读取该变量，也没有 goto、break 或标签，
+// 并且变量没有被函数捕获（函数可能在两次赋值之间被调用）。
+//
+// 只报告模式下不修改代码，所有发现都记录在报告的 skipped 中。
+
+// 报告中的发现
+const (
+	deadCodeUnused      = "unused local"
+	deadCodeOverwritten = "value overwritten before read"
+)
+
+// opt_dead_code 在整个文件中删除一个未使用的局部变量或一处无效赋值。
+func (o *optimizer) opt_dead_code() {
+	info := analyzeScopes(o.block)
+	locals := localIdents(info)
+	reads := map[*localBinding]int{}
+	writes := map[*localBinding][]*ast.Assign{}
+	captured := map[*localBinding]bool{}
+	stmt_refs := map[ast.Stmt][]scopeRef{}
+	for _, ref := range info.refs {
+		stmt_refs[ref.stmt] = append(stmt_refs[ref.stmt], ref)
+		if ref.binding == nil {
+			continue
+		}
+		if ref.fn != ref.binding.fn {
+			captured[ref.binding] = true
+		}
+		if ref.write {
+			writes[ref.binding] = append(writes[ref.binding], ref.stmt.(*ast.Assign))
+		} else {
+			reads[ref.binding]++
+		}
+	}
+
+	for _, b := range info.bindings {
+		decl, ok := b.decl.(*ast.Assign)
+		if !ok || reads[b] > 0 || len(decl.Targets) != 1 {
+			continue
+		}
+		if o.removeUnusedLocal(b, decl, writes[b], locals) {
+			return
+		}
+	}
+
+	by_decl := map[ast.Stmt]*localBinding{}
+	for _, b := range info.bindings {
+		if decl, ok := b.decl.(*ast.Assign); ok && len(decl.Targets) == 1 {
+			by_decl[decl] = b
+		}
+	}
+	o.for_each_block(func(block []ast.Stmt) bool {
+		for i := range block {
+			if o.removeDeadStore(block, i, stmt_refs, by_decl, captured, locals) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// isSideEffectFree 判断 expr 求值既没有副作用也不会出错，可以删除：只有常量、局部变量（locals 中的名字）、
+// 函数定义，以及只由它们构成、键都是非 nil 常量的 table 构造表达式。
+func isSideEffectFree(expr ast.Expr, locals map[*ast.ConstIdent]bool) bool {
+	switch e := expr.(type) {
+	case *ast.ConstNil, *ast.ConstBool, *ast.ConstInt, *ast.ConstFloat, *ast.ConstString, *ast.ConstVariadic:
+		return true
+	case *ast.FuncDecl:
+		// 定义函数不执行函数体
+		return true
+	case *ast.ConstIdent:
+		return locals[e]
+	case *ast.Parens:
+		return isSideEffectFree(e.Inner, locals)
+	case *ast.TableConstructor:
+		for i, key := range e.Keys {
+			switch key.(type) {
+			case nil, *ast.ConstBool, *ast.ConstInt, *ast.ConstFloat, *ast.ConstString:
+			default:
+				// nil 键会出错，变量作为键可能是 nil
+				return false
+			}
+			if !isSideEffectFree(e.Vals[i], locals) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// localIdents 返回 info 中解析到局部变量的名字。
+func localIdents(info *scopeInfo) map[*ast.ConstIdent]bool {
+	locals := map[*ast.ConstIdent]bool{}
+	for _, ref := range info.refs {
+		if ref.binding != nil {
+			locals[ref.node] = true
+		}
+	}
+	return locals
+}
+
+// ownedStmtLines 返回 block[idx] 的行范围，语句与其他语句或外层语句共享行时返回 false。
+func (o *optimizer) ownedStmtLines(block []ast.Stmt, idx int) (int, int, bool) {
+	stmt := block[idx]
+	start, last := o.find_stmt_line_range(stmt)
+	end, ok := o.find_stmts_end_line(start, last, 1)
+	if !ok {
+		return 0, 0, false
+	}
+	if idx > 0 {
+		if _, prev_end := o.find_stmt_line_range(block[idx-1]); prev_end >= start {
+			return 0, 0, false
+		}
+	}
+	if idx+1 < len(block) && block[idx+1].Line() <= end {
+		return 0, 0, false
+	}
+	// 单独解析这几行必须得到同一条赋值语句（而不是与外层语句的头部拼在一起）
+	parsed, err := ast.Parse(joinSource(o.filecontent[start-1:end]), start)
+	if err != nil || len(parsed) != 1 {
+		return 0, 0, false
+	}
+	orig, ok := stmt.(*ast.Assign)
+	got, got_ok := parsed[0].(*ast.Assign)
+	if !ok || !got_ok || orig.LocalDecl != got.LocalDecl || orig.LocalFunc != got.LocalFunc || len(orig.Targets) != len(got.Targets) {
+		return 0, 0, false
+	}
+	for i := range orig.Targets {
+		if expr_to_string(orig.Targets[i]) != expr_to_string(got.Targets[i]) {
+			return 0, 0, false
+		}
+	}
+	return start, end, true
+}
+
+// stmtIndex 返回 stmt 所在的语句块和下标。
+func (o *optimizer) stmtIndex(stmt ast.Stmt) ([]ast.Stmt, int) {
+	var found []ast.Stmt
+	idx := -1
+	o.for_each_block(func(block []ast.Stmt) bool {
+		for i, s := range block {
+			if s == stmt {
+				found, idx = block, i
+				return false
+			}
+		}
+		return true
+	})
+	return found, idx
+}
+
+// removeUnusedLocal 删除从未被读取的局部变量 b 的声明及对它的所有赋值，成功时返回 true。
+func (o *optimizer) removeUnusedLocal(b *localBinding, decl *ast.Assign, writes []*ast.Assign, locals map[*ast.ConstIdent]bool) bool {
+	stmts := append([]*ast.Assign{decl}, writes...)
+	var ranges [][2]int
+	for _, stmt := range stmts {
+		if len(stmt.Targets) != 1 {
+			return false
+		}
+		for _, value := range stmt.Values {
+			if !isSideEffectFree(value, locals) {
+				o.addSkip(Skip{Pass: "dead_code", Line: o.origLine(decl.Line()), Target: b.name,
+					Reason: deadCodeUnused + ", but the right-hand side may have side effects"})
+				return false
+			}
+		}
+		block, idx := o.stmtIndex(stmt)
+		if idx < 0 {
+			return false
+		}
+		start, end, ok := o.ownedStmtLines(block, idx)
+		if !ok || o.isDisabled("dead_code", start, end) {
+			return false
+		}
+		ranges = append(ranges, [2]int{start, end})
+	}
+	if o.opts.DeadCodeWarnOnly {
+		o.addSkip(Skip{Pass: "dead_code", Line: o.origLine(ranges[0][0]), Target: b.name, Reason: deadCodeUnused})
+		return false
+	}
+
+	rw := Rewrite{Pass: "dead_code", Target: b.name, GroupSize: len(ranges), Replaced: len(ranges)}
+	rw.Line, rw.EndLine = o.origRange(ranges[0][0], ranges[0][1])
+	// 从后往前删除，前面的行号不受影响
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i][0] > ranges[j][0] })
+	for _, r := range ranges {
+		o.spliceLines(r[0], r[1], nil)
+	}
+	o.logf("opt dead_code at: %s:%d unused local %s", o.filename, rw.Line, b.name)
+	o.addRewrite(rw)
+	return true
+}
+
+// removeDeadStore 判断 block[idx] 对局部变量的赋值是否在读取之前被同一语句块中之后的赋值覆盖，
+// 是时删除这次赋值（local 声明只保留声明），成功时返回 true。
+func (o *optimizer) removeDeadStore(block []ast.Stmt, idx int, stmt_refs map[ast.Stmt][]scopeRef, by_decl map[ast.Stmt]*localBinding, captured map[*localBinding]bool, locals map[*ast.ConstIdent]bool) bool {
+	assign, ok := block[idx].(*ast.Assign)
+	if !ok || assign.LocalFunc || len(assign.Targets) != 1 || len(assign.Values) != 1 {
+		return false
+	}
+	b := by_decl[assign]
+	if !assign.LocalDecl {
+		b = nil
+		for _, ref := range stmt_refs[assign] {
+			if ref.write {
+				b = ref.binding
+			}
+		}
+	}
+	if b == nil || captured[b] || !isSideEffectFree(assign.Values[0], locals) {
+		return false
+	}
+
+	// 之后第一条对 b 的赋值
+	next := -1
+	for j := idx + 1; j < len(block) && next < 0; j++ {
+		if a, is_assign := block[j].(*ast.Assign); is_assign && !a.LocalDecl && len(a.Targets) == 1 {
+			for _, ref := range stmt_refs[a] {
+				if ref.write && ref.binding == b {
+					next = j
+				}
+			}
+		}
+		if next < 0 && (stmtReadsBinding(block[j], b, stmt_refs) || containsJump(block[j])) {
+			return false
+		}
+	}
+	if next < 0 {
+		return false
+	}
+	// 覆盖的赋值本身也不能读取 b（如 x = x + 1）
+	for _, ref := range stmt_refs[block[next]] {
+		if ref.binding == b && !ref.write {
+			return false
+		}
+	}
+
+	start, end, ok := o.ownedStmtLines(block, idx)
+	if !ok || o.isDisabled("dead_code", start, end) {
+		return false
+	}
+	if o.opts.DeadCodeWarnOnly {
+		o.addSkip(Skip{Pass: "dead_code", Line: o.origLine(start), Target: b.name, Reason: deadCodeOverwritten})
+		return false
+	}
+
+	rw := Rewrite{Pass: "dead_code", Target: b.name, GroupSize: 1, Replaced: 1}
+	rw.Line, rw.EndLine = o.origRange(start, end)
+	var lines []string
+	if assign.LocalDecl {
+		decl := &ast.Assign{LocalDecl: true, Targets: assign.Targets}
+		lines = stmt_to_lines(decl, get_content_space(o.filecontent[start-1]))
+	}
+	o.spliceLines(start, end, lines)
+	o.logf("opt dead_code at: %s:%d dead store to %s", o.filename, rw.Line, b.name)
+	o.addRewrite(rw)
+	return true
+}
+
+// stmtReadsBinding 判断 stmt（包括嵌套的语句块和函数体）中是否读取了 b。
+func stmtReadsBinding(stmt ast.Stmt, b *localBinding, stmt_refs map[ast.Stmt][]scopeRef) bool {
+	found := false
+	f := lua_visitor{f: func(n ast.Node, ok *bool) {
+		if s, is_stmt := n.(ast.Stmt); is_stmt {
+			for _, ref := range stmt_refs[s] {
+				if !ref.write && ref.binding == b {
+					found = true
+				}
+			}
+		}
+	}}
+	ast.Walk(&f, stmt)
+	return found
+}
+
+// containsJump 判断 stmt 中（不含函数体）是否有 goto、break 或标签。
+func containsJump(stmt ast.Stmt) bool {
+	found := false
+	f := lua_visitor{f: func(n ast.Node, ok *bool) {
+		switch n.(type) {
+		case *ast.FuncDecl:
+			*ok = false
+		case *ast.Goto, *ast.Label:
+			found = true
+		}
+	}}
+	ast.Walk(&f, stmt)
+	return found
+}
@@ -0,0 +1,124 @@
+package olua
+
+import (
+	"os"
+	"testing"
+)
+
+// ============================================================================
+// 集成测试：对比优化器输出与期望文件
+// ============================================================================
+
+// deadCodeOptions 返回只启用删除无效代码的测试选项。
+func deadCodeOptions() Options {
+	opts := DefaultOptions()
+	opts.DeadCode = true
+	return opts
+}
+
+func TestDeadCode(t *testing.T) {
+	compareOptOutputWith(t, deadCodeOptions(), "input/dead_code.lua", "output/dead_code.lua")
+}
+
+func TestDeadCodeWarnOnly(t *testing.T) {
+	src, err := os.ReadFile("input/dead_code.lua")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := deadCodeOptions()
+	opts.DeadCodeWarnOnly = true
+	out, report, err := Optimize(src, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != string(src) {
+		t.Errorf("warn-only mode changed the code:\n%s", UnifiedDiff("dead_code.lua", src, out))
+	}
+	may := ", but the right-hand side may have side effects"
+	want := []Skip{
+		{Pass: "dead_code", Line: 4, Target: "first", Reason: deadCodeUnused},
+		{Pass: "dead_code", Line: 23, Target: "helper", Reason: deadCodeUnused},
+		{Pass: "dead_code", Line: 26, Target: "s", Reason: deadCodeUnused},
+		{Pass: "dead_code", Line: 33, Target: "r", Reason: deadCodeUnused + may},
+		{Pass: "dead_code", Line: 34, Target: "p", Reason: deadCodeUnused + may},
+		{Pass: "dead_code", Line: 40, Target: "a_b", Reason: deadCodeUnused + may},
+		{Pass: "dead_code", Line: 41, Target: "sum", Reason: deadCodeUnused + may},
+		{Pass: "dead_code", Line: 42, Target: "len", Reason: deadCodeUnused + may},
+		{Pass: "dead_code", Line: 10, Target: "count", Reason: deadCodeOverwritten},
+		{Pass: "dead_code", Line: 16, Target: "y", Reason: deadCodeOverwritten},
+		{Pass: "dead_code", Line: 26, Target: "s", Reason: deadCodeOverwritten},
+	}
+	got := map[Skip]bool{}
+	for _, s := range report.Skipped {
+		got[s] = true
+	}
+	for _, s := range want {
+		if !got[s] {
+			t.Errorf("missing skip %+v in %+v", s, report.Skipped)
+		}
+	}
+	if len(report.Skipped) != len(want) {
+		t.Errorf("got %d skips, want %d: %+v", len(report.Skipped), len(want), report.Skipped)
+	}
+}
+
+// ============================================================================
+// 单元测试：副作用和不处理的情况
+// ============================================================================
+
+func TestDeadCodeSkips(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+	}{
+		{"impure call", "local x = f()\nreturn 1\n"},
+		{"impure store", "local x = {}\nx.n = 1\nx = g(x)\nreturn 1\n"},
+		{"read in the overwrite", "local x = 1\nx = x + 1\nreturn x\n"},
+		{"goto between", "local x = 1\n::top::\nx = 2\nreturn x\n"},
+		{"method call", "local s = obj:name()\nreturn 1\n"},
+		{"vararg table", "local function f(...)\n    local t = {g(...)}\n    return 1\nend\nreturn f\n"},
+		{"shared line", "local x = 1 print(x)\nlocal y = 2 x = 3\nreturn x\n"},
+		{"pure but visible", "local x = print(1)\nreturn 1\n"},
+	}
+	for _, tt := range tests {
+		out, _, err := Optimize([]byte(tt.src), deadCodeOptions())
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if string(out) != tt.src {
+			t.Errorf("%s: expected no rewrite, got:\n%s", tt.name, out)
+		}
+	}
+}
+
+func TestDeadCodePureFuncs(t *testing.T) {
+	// 配置的纯函数只保证不修改参数，内置纯函数也可能出错（如 string.len(nil)），调用都不删除
+	for _, src := range []string{"local x = util.len(t)\nreturn 1\n", "local ok = log_info(\"starting\")\nreturn 1\n", "local x = string.len(t)\nreturn 1\n"} {
+		opts := deadCodeOptions()
+		opts.TableAccessPureFuncs = append(opts.TableAccessPureFuncs, "util.len")
+		out, _, err := Optimize([]byte(src), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != src {
+			t.Errorf("expected the pure call to be kept, got:\n%s", out)
+		}
+	}
+}
+
+func TestDeadCodeVerify(t *testing.T) {
+	src, err := os.ReadFile("input/dead_code.lua")
+	if err != nil {
+		t.Fatal(err)
+	}
+	optimized, _, err := Optimize(src, deadCodeOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 删除的赋值不能让原来出错的调用不再出错
+	for _, entry := range []string{"return may_error(nil, 1)", "return may_error({}, nil)", "return unused_local({1, 2})", "return reassigned(1)"} {
+		if diffs := verifyDiffs(t, string(src), string(optimized), VerifyOptions{Entry: entry}); len(diffs) != 0 {
+			t.Errorf("%s: optimized code diverged: %v", entry, diffs)
+		}
+	}
+}
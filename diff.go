@@ -0,0 +1,166 @@
+package olua
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ============================================================================
+// 统一格式 diff（unified diff）
+// ============================================================================
+
+// diffContext 是每个 hunk 前后保留的上下文行数，与 diff -u 默认值一致
+const diffContext = 3
+
+// UnifiedDiff 返回 original 到 optimized 的统一格式 diff，
+// 文件头为 a/filename 和 b/filename，可以用 git apply 或 patch -p1 应用。
+// 两者相同时返回空字符串。
+func UnifiedDiff(filename string, original, optimized []byte) string {
+	a := splitLines(original)
+	b := splitLines(optimized)
+	edits := diffLines(a, b)
+
+	var sb strings.Builder
+	for start := 0; start < len(edits); {
+		// 找到下一处改动
+		for start < len(edits) && edits[start].kind == ' ' {
+			start++
+		}
+		if start == len(edits) {
+			break
+		}
+		// 合并间隔不超过 2*diffContext 行的改动，形成一个 hunk
+		end := start
+		for i := start; i < len(edits); i++ {
+			if edits[i].kind != ' ' {
+				end = i + 1
+			} else if i-end >= 2*diffContext {
+				break
+			}
+		}
+		lo := start - diffContext
+		if lo < 0 {
+			lo = 0
+		}
+		hi := end + diffContext
+		if hi > len(edits) {
+			hi = len(edits)
+		}
+
+		if sb.Len() == 0 {
+			fmt.Fprintf(&sb, "--- a/%s\n+++ b/%s\n", filename, filename)
+		}
+		writeHunk(&sb, edits[lo:hi])
+		start = hi
+	}
+	return sb.String()
+}
+
+// diffEdit 是一行的编辑操作：' ' 保留，'-' 删除，'+' 插入。
+// aLine 和 bLine 是该行之前已经过的原始/新文件行数。
+type diffEdit struct {
+	kind  byte
+	text  string
+	aLine int
+	bLine int
+}
+
+func writeHunk(sb *strings.Builder, edits []diffEdit) {
+	aCount, bCount := 0, 0
+	for _, e := range edits {
+		if e.kind != '+' {
+			aCount++
+		}
+		if e.kind != '-' {
+			bCount++
+		}
+	}
+	fmt.Fprintf(sb, "@@ -%s +%s @@\n", hunkRange(edits[0].aLine, aCount), hunkRange(edits[0].bLine, bCount))
+	for _, e := range edits {
+		sb.WriteByte(e.kind)
+		sb.WriteString(e.text)
+		sb.WriteByte('\n')
+	}
+}
+
+// hunkRange 按 diff -u 的规则格式化行范围：空范围的起始行是它前面那一行。
+func hunkRange(before, count int) string {
+	start := before + 1
+	if count == 0 {
+		start = before
+	}
+	if count == 1 {
+		return fmt.Sprint(start)
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
+
+// diffLines 使用 Myers 算法计算 a 到 b 的最短编辑序列。
+// 优化只插入或改写少量行，编辑距离 D 很小，O((N+M)D) 的开销可以接受。
+func diffLines(a, b []string) []diffEdit {
+	n, m := len(a), len(b)
+	max := n + m
+	offset := max + 1
+	v := make([]int, 2*max+3)
+	var trace [][]int
+
+	found := false
+	for d := 0; d <= max && !found; d++ {
+		trace = append(trace, append([]int(nil), v...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				found = true
+				break
+			}
+		}
+	}
+
+	// 从终点回溯，得到倒序的编辑序列
+	var rev []diffEdit
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		tv := trace[d]
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && tv[offset+k-1] < tv[offset+k+1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := tv[offset+prevK]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x--
+			y--
+			rev = append(rev, diffEdit{kind: ' ', text: a[x], aLine: x, bLine: y})
+		}
+		if d == 0 {
+			break
+		}
+		if x == prevX {
+			y--
+			rev = append(rev, diffEdit{kind: '+', text: b[y], aLine: x, bLine: y})
+		} else {
+			x--
+			rev = append(rev, diffEdit{kind: '-', text: a[x], aLine: x, bLine: y})
+		}
+	}
+
+	edits := make([]diffEdit, len(rev))
+	for i, e := range rev {
+		edits[len(rev)-1-i] = e
+	}
+	return edits
+}
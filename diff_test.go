@@ -0,0 +1,86 @@
+package olua
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// ============================================================================
+// 单元测试：统一格式 diff
+// ============================================================================
+
+func numberedLines(n int) string {
+	var sb strings.Builder
+	for i := 1; i <= n; i++ {
+		fmt.Fprintf(&sb, "line%d\n", i)
+	}
+	return sb.String()
+}
+
+func TestUnifiedDiffIdentical(t *testing.T) {
+	src := []byte("a\nb\n")
+	if got := UnifiedDiff("x.lua", src, src); got != "" {
+		t.Errorf("UnifiedDiff of identical input = %q, want empty", got)
+	}
+}
+
+func TestUnifiedDiffInsert(t *testing.T) {
+	original := "function f()\n    local x = a.b.c\n    local y = a.b.d\nend\n"
+	optimized := "function f()\n    local a_b = a.b -- opt by oLua\n    local x = a_b.c\n    local y = a_b.d\nend\n"
+	want := `--- a/x.lua
++++ b/x.lua
+@@ -1,4 +1,5 @@
+ function f()
+-    local x = a.b.c
+-    local y = a.b.d
++    local a_b = a.b -- opt by oLua
++    local x = a_b.c
++    local y = a_b.d
+ end
+`
+	if got := UnifiedDiff("x.lua", []byte(original), []byte(optimized)); got != want {
+		t.Errorf("UnifiedDiff =\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestUnifiedDiffHunks(t *testing.T) {
+	original := numberedLines(20)
+	optimized := strings.Replace(original, "line2\n", "line2\nnew\n", 1)
+	optimized = strings.Replace(optimized, "line18\n", "", 1)
+	want := `--- a/x.lua
++++ b/x.lua
+@@ -1,5 +1,6 @@
+ line1
+ line2
++new
+ line3
+ line4
+ line5
+@@ -15,6 +16,5 @@
+ line15
+ line16
+ line17
+-line18
+ line19
+ line20
+`
+	if got := UnifiedDiff("x.lua", []byte(original), []byte(optimized)); got != want {
+		t.Errorf("UnifiedDiff =\n%s\nwant:\n%s", got, want)
+	}
+
+	// 间隔不超过 6 行的改动合并到同一个 hunk
+	optimized = strings.Replace(original, "line5\n", "five\n", 1)
+	optimized = strings.Replace(optimized, "line12\n", "twelve\n", 1)
+	got := UnifiedDiff("x.lua", []byte(original), []byte(optimized))
+	if strings.Count(got, "@@ -") != 1 || !strings.Contains(got, "@@ -2,14 +2,14 @@") {
+		t.Errorf("nearby changes should share one hunk:\n%s", got)
+	}
+}
+
+func TestUnifiedDiffEmpty(t *testing.T) {
+	want := "--- a/x.lua\n+++ b/x.lua\n@@ -0,0 +1 @@\n+a\n"
+	if got := UnifiedDiff("x.lua", nil, []byte("a\n")); got != want {
+		t.Errorf("UnifiedDiff = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,197 @@
+package olua
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/milochristiansen/lua/ast"
+)
+
+// ============================================================================
+// 注释指令：-- olua:disable / disable-next-line / disable-line / enable
+// ============================================================================
+//
+// 指令可以带优化名列表（空格或逗号分隔），不带时作用于所有优化：
+//
+//	-- olua:disable                     单独一行：从这一行到所在函数或语句块结束（顶层时到文件结束）
+//	-- olua:disable table_access        只关闭 table 访问优化
+//	-- olua:enable                      提前结束同一作用域内之前的 disable
+//	-- olua:disable-next-line           下一行开始的整条语句（如果是函数声明则是整个函数）
+//	x = a.b.c -- olua:disable-line      只作用于本行；写在代码行末尾的 disable 也只作用于本行
+//
+// 被关闭的行不会被任何改写触及：table 访问优化不缓存这些行中的读，
+// table 构造优化不合并跨越这些行的语句。
+
+// directive_re 匹配一条指令，第 1 组为指令名，第 2 组为优化名列表
+var directive_re = regexp.MustCompile(`--\s*olua:(disable-next-line|disable-line|disable|enable)\b([\w\s,]*)$`)
+
+// knownPasses 是指令中可以使用的优化名
+var knownPasses = map[string]bool{
+	"table_access":      true,
+	"table_constructor": true,
+	"localize":          true,
+	"method_cache":      true,
+	"const_fold":        true,
+	"concat_buffer":     true,
+	"table_insert":      true,
+	"table_prealloc":    true,
+	"dead_code":         true,
+	"inline":            true,
+	"cse":               true,
+	"ipairs":            true,
+}
+
+// disabledRange 是关闭了某个优化的行范围（1-based，闭区间），pass 为空表示所有优化
+type disabledRange struct {
+	pass  string
+	start int
+	end   int
+}
+
+type directive struct {
+	kind   string
+	passes []string // 空表示所有优化
+	line   int
+	inline bool // 指令写在代码行末尾
+}
+
+// parse_directives 扫描源码中的指令并计算被关闭的行范围，每轮解析后调用。
+func (o *optimizer) parse_directives() {
+	o.disabled = nil
+	var directives []directive
+	for i, line := range o.filecontent {
+		if !strings.Contains(line, "olua:") {
+			continue
+		}
+		m := directive_re.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		d := directive{kind: m[1], line: i + 1}
+		d.inline = !strings.HasPrefix(strings.TrimSpace(line), "--")
+		for _, pass := range strings.FieldsFunc(m[2], func(r rune) bool { return r == ',' || r == ' ' || r == '\t' }) {
+			if !knownPasses[pass] {
+				o.logf("unknown pass %q in directive at: %s:%d", pass, o.filename, i+1)
+				continue
+			}
+			d.passes = append(d.passes, pass)
+		}
+		directives = append(directives, d)
+	}
+	if len(directives) == 0 {
+		return
+	}
+
+	for i, d := range directives {
+		switch {
+		case d.kind == "disable-line" || (d.kind == "disable" && d.inline):
+			o.addDisabled(d.passes, d.line, d.line)
+		case d.kind == "disable-next-line":
+			next := o.nextCodeLine(d.line)
+			if next == 0 {
+				continue
+			}
+			_, end := o.stmtRangeStartingAt(next)
+			o.addDisabled(d.passes, next, end)
+		case d.kind == "disable":
+			end := o.scopeEnd(d.line)
+			passes := d.passes
+			if len(passes) == 0 {
+				passes = []string{""}
+			}
+			for _, pass := range passes {
+				passEnd := end
+				// 同一作用域内第一个覆盖该优化的 enable 提前结束范围
+				for _, e := range directives[i+1:] {
+					if e.line > end {
+						break
+					}
+					if e.kind == "enable" && (len(e.passes) == 0 || (pass != "" && containsString(e.passes, pass))) {
+						passEnd = e.line
+						break
+					}
+				}
+				o.disabled = append(o.disabled, disabledRange{pass: pass, start: d.line, end: passEnd})
+			}
+		}
+	}
+}
+
+func (o *optimizer) addDisabled(passes []string, start int, end int) {
+	if len(passes) == 0 {
+		o.disabled = append(o.disabled, disabledRange{start: start, end: end})
+		return
+	}
+	for _, pass := range passes {
+		o.disabled = append(o.disabled, disabledRange{pass: pass, start: start, end: end})
+	}
+}
+
+// isDisabled 判断 pass 在第 start 到 end 行中是否有被关闭的行。
+func (o *optimizer) isDisabled(pass string, start int, end int) bool {
+	if end < start {
+		end = start
+	}
+	for _, r := range o.disabled {
+		if (r.pass == "" || r.pass == pass) && r.start <= end && start <= r.end {
+			return true
+		}
+	}
+	return false
+}
+
+// nextCodeLine 返回 line 之后第一个非空、非注释行，没有时返回 0。
+func (o *optimizer) nextCodeLine(line int) int {
+	for i := line; i < len(o.filecontent); i++ {
+		trimmed := strings.TrimSpace(o.filecontent[i])
+		if trimmed != "" && !strings.HasPrefix(trimmed, "--") {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// stmtRangeStartingAt 返回从第 line 行开始的最外层语句的行范围，没有语句从这一行开始时返回该行本身。
+func (o *optimizer) stmtRangeStartingAt(line int) (int, int) {
+	start, end := line, line
+	o.for_each_block(func(block []ast.Stmt) bool {
+		for _, stmt := range block {
+			if stmt.Line() > line {
+				break
+			}
+			s, e := o.find_stmt_line_range(stmt)
+			if s == line && e > end {
+				end = e
+			}
+		}
+		return true
+	})
+	return start, end
+}
+
+// scopeEnd 返回第 line 行所在的最内层函数或语句块的结束行，在顶层时返回文件最后一行。
+func (o *optimizer) scopeEnd(line int) int {
+	end := len(o.filecontent)
+	o.for_each_block(func(block []ast.Stmt) bool {
+		for _, stmt := range block {
+			if stmt.Line() > line {
+				break
+			}
+			s, e := o.find_stmt_line_range(stmt)
+			if s < line && line <= e && e < end {
+				end = e
+			}
+		}
+		return true
+	})
+	return end
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,129 @@
+package olua
+
+import (
+	"strings"
+	"testing"
+)
+
+// ============================================================================
+// 注释指令测试
+// ============================================================================
+
+func optimizeWithDirectives(t *testing.T, src string) string {
+	t.Helper()
+	opts := tableAccessOptions()
+	opts.TableConstructor = true
+	out, _, err := Optimize([]byte(src), opts)
+	if err != nil {
+		t.Fatalf("Optimize failed: %v", err)
+	}
+	return string(out)
+}
+
+func TestDirectiveRanges(t *testing.T) {
+	src := `function f()
+    local x = 1
+    -- olua:disable table_access
+    local y = 2
+    -- olua:enable
+    local z = 3 -- olua:disable-line
+    -- olua:disable-next-line table_constructor
+    if x then
+        y = 1
+    end
+    -- olua:disable
+    local w = 4
+end
+local v = 5
+`
+	o := newTestOptimizer()
+	o.setSource(splitLines([]byte(src)))
+	if err := o.parse_lua(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		pass string
+		line int
+		want bool
+	}{
+		{"table_access", 2, false},
+		{"table_access", 4, true},
+		{"table_constructor", 4, false},
+		{"table_access", 5, true},
+		{"table_access", 6, true},
+		{"table_constructor", 6, true},
+		{"table_constructor", 9, true},
+		{"table_access", 9, false},
+		{"table_access", 12, true},
+		{"table_access", 14, false},
+	}
+	for _, tt := range tests {
+		if got := o.isDisabled(tt.pass, tt.line, tt.line); got != tt.want {
+			t.Errorf("isDisabled(%s, %d) = %v, want %v", tt.pass, tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestDirectiveTableAccess(t *testing.T) {
+	out := optimizeWithDirectives(t, `function f()
+    local x = a.b.c + a.b.e
+    -- olua:disable-next-line
+    local y = a.b.d + a.b.f
+    local z = a.b.g
+end
+
+function g()
+    -- olua:disable table_access
+    local x = a.b.c + a.b.e
+    local y = a.b.d
+end
+`)
+	want := `function f()
+    local a_b = a.b -- opt by oLua
+    local x = a_b.c + a_b.e
+    -- olua:disable-next-line
+    local y = a.b.d + a.b.f
+    local z = a_b.g
+end
+
+function g()
+    -- olua:disable table_access
+    local x = a.b.c + a.b.e
+    local y = a.b.d
+end
+`
+	if out != want {
+		t.Errorf("got:\n%s\nwant:\n%s", out, want)
+	}
+}
+
+func TestDirectiveTableConstructor(t *testing.T) {
+	out := optimizeWithDirectives(t, `function f()
+    local t = {}
+    t.x = 1
+    t.y = 2 -- olua:disable-line
+    t.z = 3
+end
+
+function g()
+    -- olua:disable-next-line
+    local t = {}
+    t.x = 1
+end
+
+function h()
+    -- olua:disable table_access
+    local t = {}
+    t.x = 1
+end
+`)
+	for _, want := range []string{
+		"local t = {x = 1} -- opt by oLua (table_constructor 0)\n    t.y = 2 -- olua:disable-line\n    t.z = 3",
+		"-- olua:disable-next-line\n    local t = {}\n    t.x = 1\n",
+		"-- olua:disable table_access\n    local t = {x = 1} -- opt by oLua",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output missing %q:\n%s", want, out)
+		}
+	}
+}
@@ -2,4 +2,7 @@ module oLua
 
 go 1.18
 
-require github.com/milochristiansen/lua v1.1.8
+require (
+	github.com/BurntSushi/toml v1.5.0
+	github.com/milochristiansen/lua v1.1.8
+)
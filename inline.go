@@ -0,0 +1,568 @@
+package olua
+
+import (
+	"fmt"
+
+	"github.com/milochristiansen/lua/ast"
+)
+
+// ============================================================================
+// 内联小的 local function
+// ============================================================================
+//
+// 热点循环中调用的小工具函数，每次调用都要付出函数调用的开销。对于不递归、只被直接调用
+// （没有被赋值、传参或保存）的 local function，把调用处替换为函数体：
+//
+//	local function clamp(x, lo, hi)
+//	    return math.max(lo, math.min(hi, x))
+//	end
+//	v = clamp(v + dv, 0, 100)          →  v = math.max(0, math.min(100, v + dv))
+//
+// 函数体只有一条 return 表达式时，在任意表达式中内联：参数直接替换为实参。实参不是常量或从不被赋值的局部变量时，
+// 必须没有副作用、在函数体中最多使用一次，并且函数体本身没有副作用，这样求值次数和顺序的差异不可见。
+//
+// 函数体是几条没有 return、goto 和标签的语句时，只内联作为语句的调用，展开为 do ... end，
+// 参数和函数体中的局部变量改名为文件中没有出现过的名字（collectIdentifiers），不会与调用处的名字冲突：
+//
+//	do
+//	    local reset_e = list[i]
+//	    reset_e.hp = 0
+//	end
+//
+// 函数体中引用的外部名字（全局变量、上值）在调用处必须解析到同一个变量，被调用处的局部变量遮蔽时不内联。
+// 是否内联由调用处的开销决定：函数体的 AST 节点数不超过 InlineMaxCost，循环中的调用处不超过 InlineLoopMaxCost。
+// 内联后函数不再被调用时可以由 dead_code 删除。改写不加标记，revert 也不会还原。
+
+// 开销上限的默认值
+const (
+	defaultInlineMaxCost     = 12
+	defaultInlineLoopMaxCost = 24
+)
+
+// inlineFunc 是一个可以内联的 local function
+type inlineFunc struct {
+	name string
+	decl *ast.FuncDecl
+	// expr 是函数体中唯一的 return 表达式，为 nil 时函数体按语句内联
+	expr ast.Expr
+	cost int
+	// params 是参数对应的局部变量，locals 是函数体中声明的局部变量（不含参数）
+	params []*localBinding
+	locals []*localBinding
+	// refs 是函数体中的引用
+	refs []scopeRef
+}
+
+// inlineState 是一轮内联分析的结果
+type inlineState struct {
+	info *scopeInfo
+	// calls 是对可以内联的函数的直接调用
+	calls map[*ast.FuncCall]*inlineFunc
+	// refOf 是每个名字对应的引用，writes 是每个局部变量被赋值的次数
+	refOf  map[*ast.ConstIdent]scopeRef
+	writes map[*localBinding]int
+	// locals 是解析到局部变量的名字
+	locals map[*ast.ConstIdent]bool
+	// visible 是每条语句执行前函数体中引用的外部名字解析到的局部变量
+	visible map[ast.Stmt]map[string]*localBinding
+	// inLoop 是位于循环体中（同一个函数内）的语句
+	inLoop map[ast.Stmt]bool
+	used   map[string]bool
+}
+
+// opt_inline 在文件中内联一处对小的 local function 的调用。
+func (o *optimizer) opt_inline() {
+	st := o.analyzeInline()
+	if st == nil {
+		return
+	}
+	starts := o.stmtStarts()
+	for _, site := range o.collectFoldSites() {
+		if site.keyword == "until" {
+			// until 的条件可以看到循环体中的局部变量，不按语句解析调用处的名字
+			continue
+		}
+		stmt := site.owners[len(site.owners)-1]
+		if call, ok := stmt.(*ast.FuncCall); ok && site.keyword == "" {
+			if fn := st.calls[call]; fn != nil && fn.expr == nil && o.inlineStmt(st, site, starts, call, fn) {
+				return
+			}
+		}
+		for _, p := range site.exprs {
+			for _, slot := range inlineCallSlots(p, st.calls) {
+				call := (*slot).(*ast.FuncCall)
+				if fn := st.calls[call]; fn.expr != nil && o.inlineExpr(st, site, starts, slot, fn) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// analyzeInline 找出文件中可以内联的函数和对它们的调用，没有时返回 nil。
+func (o *optimizer) analyzeInline() *inlineState {
+	st := &inlineState{
+		info:    analyzeScopes(o.block),
+		calls:   map[*ast.FuncCall]*inlineFunc{},
+		refOf:   map[*ast.ConstIdent]scopeRef{},
+		locals:  map[*ast.ConstIdent]bool{},
+		writes:  map[*localBinding]int{},
+		visible: map[ast.Stmt]map[string]*localBinding{},
+		inLoop:  map[ast.Stmt]bool{},
+	}
+	// 直接调用 f(...) 中的 f
+	callees := map[*ast.ConstIdent]*ast.FuncCall{}
+	f := lua_visitor{f: func(n ast.Node, ok *bool) {
+		if call, is_call := n.(*ast.FuncCall); is_call && call.Receiver == nil {
+			if ident, is_ident := call.Function.(*ast.ConstIdent); is_ident {
+				callees[ident] = call
+			}
+		}
+	}}
+	for _, stmt := range o.block {
+		ast.Walk(&f, stmt)
+	}
+	refs := map[*localBinding][]scopeRef{}
+	body_refs := map[*ast.FuncDecl][]scopeRef{}
+	for _, ref := range st.info.refs {
+		st.refOf[ref.node] = ref
+		if ref.binding != nil {
+			st.locals[ref.node] = true
+		}
+		if ref.fn != nil {
+			body_refs[ref.fn] = append(body_refs[ref.fn], ref)
+		}
+		if ref.binding == nil {
+			continue
+		}
+		refs[ref.binding] = append(refs[ref.binding], ref)
+		if ref.write {
+			st.writes[ref.binding]++
+		}
+	}
+	inner := map[*ast.FuncDecl][]*localBinding{}
+	for _, b := range st.info.bindings {
+		if b.fn != nil {
+			inner[b.fn] = append(inner[b.fn], b)
+		}
+	}
+
+	names := map[string]bool{}
+	for _, b := range st.info.bindings {
+		fn := o.inlineCandidate(b, refs[b], callees)
+		if fn == nil {
+			continue
+		}
+		fn.refs = body_refs[fn.decl]
+		for _, local := range inner[fn.decl] {
+			if local.decl == fn.decl {
+				fn.params = append(fn.params, local)
+			} else {
+				fn.locals = append(fn.locals, local)
+			}
+		}
+		for _, ref := range fn.refs {
+			if ref.binding == nil || ref.binding.fn != fn.decl {
+				names[ref.node.Value] = true
+			}
+		}
+		for _, ref := range refs[b] {
+			st.calls[callees[ref.node]] = fn
+		}
+	}
+	if len(st.calls) == 0 {
+		return nil
+	}
+
+	// walkScopes 重新创建声明，按声明所在的节点和名字对应到 st.info 中的声明
+	type bindingKey struct {
+		decl ast.Node
+		name string
+	}
+	same := map[bindingKey]*localBinding{}
+	for _, b := range st.info.bindings {
+		same[bindingKey{b.decl, b.name}] = b
+	}
+	walkScopes(o.block, func(stmt ast.Stmt, env *scopeEnv) {
+		visible := map[string]*localBinding{}
+		for name := range names {
+			if b := env.lookup(name); b != nil {
+				visible[name] = same[bindingKey{b.decl, b.name}]
+			}
+		}
+		st.visible[stmt] = visible
+	})
+	markLoopStmts(o.block, false, st.inLoop)
+	st.used = collectIdentifiers(o.block)
+	return st
+}
+
+// inlineCandidate 判断局部变量 b 是否是可以内联的函数，refs 是对 b 的所有引用。
+func (o *optimizer) inlineCandidate(b *localBinding, refs []scopeRef, callees map[*ast.ConstIdent]*ast.FuncCall) *inlineFunc {
+	assign, ok := b.decl.(*ast.Assign)
+	decl, is_func := b.value.(*ast.FuncDecl)
+	if !ok || !is_func || decl.IsVariadic || len(assign.Targets) != 1 {
+		return nil
+	}
+	fn := &inlineFunc{name: b.name, decl: decl}
+	if len(decl.Block) == 1 {
+		if ret, is_ret := decl.Block[0].(*ast.Return); is_ret && len(ret.Items) == 1 {
+			fn.expr = ret.Items[0]
+		}
+	}
+	nested, jumps := false, false
+	f := lua_visitor{f: func(n ast.Node, ok *bool) {
+		switch nn := n.(type) {
+		case *ast.FuncDecl:
+			nested = true
+			*ok = false
+		case *ast.Return, *ast.Label, *ast.ConstVariadic:
+			jumps = true
+		case *ast.Goto:
+			if !nn.IsBreak {
+				jumps = true
+			}
+		}
+		fn.cost++
+	}}
+	if fn.expr != nil {
+		ast.Walk(&f, fn.expr)
+	} else {
+		for _, stmt := range decl.Block {
+			ast.Walk(&f, stmt)
+		}
+		if jumps {
+			// 有 return 的多条语句无法展开
+			return nil
+		}
+	}
+	if nested || len(decl.Block) == 0 {
+		return nil
+	}
+
+	line := o.origLine(assign.Line())
+	for _, ref := range refs {
+		if ref.fn == decl {
+			o.addSkip(Skip{Pass: "inline", Line: line, Target: b.name, Reason: "recursive function"})
+			return nil
+		}
+		if ref.write || callees[ref.node] == nil {
+			o.addSkip(Skip{Pass: "inline", Line: line, Target: b.name, Reason: "function is used as a value"})
+			return nil
+		}
+	}
+	return fn
+}
+
+// markLoopStmts 把 block 中的语句记录到 marks，in 表示它们是否位于循环体中。
+// 函数体重新从循环外开始。
+func markLoopStmts(block []ast.Stmt, in bool, marks map[ast.Stmt]bool) {
+	for _, stmt := range block {
+		marks[stmt] = in
+		// 语句自身表达式中定义的函数，嵌套语句块由下面的递归处理
+		f := lua_visitor{f: func(n ast.Node, ok *bool) {
+			switch nn := n.(type) {
+			case *ast.FuncDecl:
+				markLoopStmts(nn.Block, false, marks)
+				*ok = false
+			case *ast.Assign, *ast.Return, *ast.DoBlock, *ast.If, *ast.WhileLoop, *ast.RepeatUntilLoop,
+				*ast.ForLoopNumeric, *ast.ForLoopGeneric:
+				if nn != stmt {
+					*ok = false
+				}
+			}
+		}}
+		ast.Walk(&f, stmt)
+		switch s := stmt.(type) {
+		case *ast.ForLoopNumeric, *ast.ForLoopGeneric, *ast.WhileLoop, *ast.RepeatUntilLoop:
+			for _, body := range loop_body(stmt) {
+				markLoopStmts(body, true, marks)
+			}
+		case *ast.DoBlock:
+			markLoopStmts(s.Block, in, marks)
+		case *ast.If:
+			markLoopStmts(s.Then, in, marks)
+			markLoopStmts(s.Else, in, marks)
+		}
+	}
+}
+
+// inlineCallSlots 按先序返回 *p 中对可以内联的函数的调用所在的位置（不进入函数定义）。
+func inlineCallSlots(p *ast.Expr, calls map[*ast.FuncCall]*inlineFunc) []*ast.Expr {
+	var slots []*ast.Expr
+	var visit func(p *ast.Expr)
+	visit = func(p *ast.Expr) {
+		switch e := (*p).(type) {
+		case *ast.FuncCall:
+			if calls[e] != nil {
+				slots = append(slots, p)
+			}
+			if e.Receiver != nil {
+				visit(&e.Receiver)
+			}
+			visit(&e.Function)
+			for i := range e.Args {
+				visit(&e.Args[i])
+			}
+		case *ast.Operator:
+			if e.Left != nil {
+				visit(&e.Left)
+			}
+			visit(&e.Right)
+		case *ast.Parens:
+			visit(&e.Inner)
+		case *ast.TableAccessor:
+			visit(&e.Obj)
+			visit(&e.Key)
+		case *ast.TableConstructor:
+			for i := range e.Vals {
+				if e.Keys[i] != nil {
+					visit(&e.Keys[i])
+				}
+				visit(&e.Vals[i])
+			}
+		}
+	}
+	if *p != nil {
+		visit(p)
+	}
+	return slots
+}
+
+// checkInlineSite 检查语句 stmt 中的调用 call 的开销、实参个数和名字解析，不能内联时记录原因。
+func (o *optimizer) checkInlineSite(st *inlineState, stmt ast.Stmt, call *ast.FuncCall, fn *inlineFunc) bool {
+	line := o.origLine(call.Line())
+	limit, limit_name := o.opts.InlineMaxCost, "opt_inline_max_cost"
+	if limit < 1 {
+		limit = defaultInlineMaxCost
+	}
+	if st.inLoop[stmt] {
+		limit, limit_name = o.opts.InlineLoopMaxCost, "opt_inline_loop_max_cost"
+		if limit < 1 {
+			limit = defaultInlineLoopMaxCost
+		}
+	}
+	if fn.cost > limit {
+		o.addSkip(Skip{Pass: "inline", Line: line, Target: fn.name,
+			Reason: fmt.Sprintf("inlining cost %d exceeds %s %d", fn.cost, limit_name, limit)})
+		return false
+	}
+	if len(call.Args) > len(fn.params) {
+		o.addSkip(Skip{Pass: "inline", Line: line, Target: fn.name, Reason: "called with extra arguments"})
+		return false
+	}
+	for _, ref := range fn.refs {
+		if ref.binding != nil && ref.binding.fn == fn.decl {
+			continue
+		}
+		if st.visible[stmt][ref.node.Value] != ref.binding {
+			o.addSkip(Skip{Pass: "inline", Line: line, Target: fn.name,
+				Reason: "name " + ref.node.Value + " is shadowed at the call site"})
+			return false
+		}
+	}
+	return true
+}
+
+// stableArg 判断实参是否是常量或从不被赋值的局部变量，可以在函数体中任意替换。
+func (st *inlineState) stableArg(arg ast.Expr) bool {
+	if isLiteralExpr(arg) {
+		return true
+	}
+	ident, ok := arg.(*ast.ConstIdent)
+	if !ok {
+		return false
+	}
+	ref, ok := st.refOf[ident]
+	return ok && ref.binding != nil && st.writes[ref.binding] == 0
+}
+
+// inlineExpr 尝试把 *slot 处的调用替换为 fn 的 return 表达式，成功时返回 true。
+func (o *optimizer) inlineExpr(st *inlineState, site *foldSite, starts map[int][]ast.Stmt, slot *ast.Expr, fn *inlineFunc) bool {
+	call := (*slot).(*ast.FuncCall)
+	stmt := site.owners[len(site.owners)-1]
+	if !o.checkInlineSite(st, stmt, call, fn) {
+		return false
+	}
+	line := o.origLine(call.Line())
+	args := map[*localBinding]ast.Expr{}
+	for i, param := range fn.params {
+		if i < len(call.Args) {
+			args[param] = call.Args[i]
+		} else {
+			args[param] = &ast.ConstNil{}
+		}
+	}
+	if n := len(call.Args); n > 0 && n < len(fn.params) {
+		switch call.Args[n-1].(type) {
+		case *ast.FuncCall, *ast.ConstVariadic:
+			// 最后一个实参的多个返回值会依次赋给剩下的参数
+			o.addSkip(Skip{Pass: "inline", Line: line, Target: fn.name, Reason: "last argument may expand to several values"})
+			return false
+		}
+	}
+	uses := map[*localBinding]int{}
+	for _, ref := range fn.refs {
+		if ref.binding != nil && ref.binding.decl == fn.decl {
+			uses[ref.binding]++
+		}
+	}
+	body_pure := only_builtin_pure_calls(fn.expr)
+	for i, param := range fn.params {
+		arg := args[param]
+		if st.stableArg(arg) {
+			continue
+		}
+		reason := ""
+		switch {
+		case uses[param] == 0 && !isSideEffectFree(arg, st.locals):
+			// 没有用到的实参会被删除，求值必须既没有副作用也不会出错
+			reason = "may have side effects"
+		case !only_builtin_pure_calls(arg):
+			reason = "may have side effects"
+		case uses[param] > 1:
+			reason = "is used more than once"
+		case uses[param] == 1 && !body_pure:
+			reason = "may be changed by the function body"
+		}
+		if reason != "" {
+			o.addSkip(Skip{Pass: "inline", Line: line, Target: fn.name, Reason: fmt.Sprintf("argument %d %s", i+1, reason)})
+			return false
+		}
+	}
+
+	content, comment, ok := o.checkFoldSite(site, starts, "inline")
+	if !ok {
+		return false
+	}
+	params := map[*ast.ConstIdent]ast.Expr{}
+	for _, ref := range fn.refs {
+		if arg, is_param := args[ref.binding]; is_param {
+			// 函数调用和 ... 作为实参只取第一个值
+			params[ref.node] = singleValue(arg)
+		}
+	}
+	*slot = substituteExpr(fn.expr, params)
+	new_line, ok := renderFoldSite(site, content, comment)
+	if !ok {
+		return false
+	}
+
+	rw := Rewrite{Pass: "inline", Target: fn.name, GroupSize: 1, Replaced: 1}
+	rw.Line, rw.EndLine = o.origRange(site.line, site.line)
+	o.spliceLines(site.line, site.line, []string{new_line})
+	o.logf("opt inline at: %s:%d function %s", o.filename, rw.Line, fn.name)
+	o.addRewrite(rw)
+	return true
+}
+
+// substituteExpr 复制 expr，其中 params 中的名字替换为对应的表达式。
+func substituteExpr(expr ast.Expr, params map[*ast.ConstIdent]ast.Expr) ast.Expr {
+	sub := func(e ast.Expr) ast.Expr {
+		if e == nil {
+			return nil
+		}
+		return substituteExpr(e, params)
+	}
+	switch e := expr.(type) {
+	case *ast.ConstIdent:
+		if arg, ok := params[e]; ok {
+			return arg
+		}
+		return &ast.ConstIdent{Value: e.Value}
+	case *ast.Operator:
+		return &ast.Operator{Op: e.Op, Left: sub(e.Left), Right: sub(e.Right)}
+	case *ast.Parens:
+		return &ast.Parens{Inner: sub(e.Inner)}
+	case *ast.TableAccessor:
+		return &ast.TableAccessor{Obj: sub(e.Obj), Key: sub(e.Key)}
+	case *ast.FuncCall:
+		call := &ast.FuncCall{Receiver: sub(e.Receiver), Function: sub(e.Function)}
+		for _, arg := range e.Args {
+			call.Args = append(call.Args, sub(arg))
+		}
+		return call
+	case *ast.TableConstructor:
+		cons := &ast.TableConstructor{}
+		for i := range e.Vals {
+			cons.Keys = append(cons.Keys, sub(e.Keys[i]))
+			cons.Vals = append(cons.Vals, sub(e.Vals[i]))
+		}
+		return cons
+	}
+	// 常量不会被修改，可以共享
+	return expr
+}
+
+// inlineStmt 尝试把调用语句 call 展开为 do ... end 包裹的函数体，成功时返回 true。
+func (o *optimizer) inlineStmt(st *inlineState, site *foldSite, starts map[int][]ast.Stmt, call *ast.FuncCall, fn *inlineFunc) bool {
+	if !o.checkInlineSite(st, call, call, fn) {
+		return false
+	}
+	content, comment, ok := o.checkFoldSite(site, starts, "inline")
+	if !ok {
+		return false
+	}
+
+	// 参数和局部变量改为文件中没有出现过的名字
+	renames := map[*localBinding]string{}
+	var names []ast.Expr
+	for _, b := range append(append([]*localBinding(nil), fn.params...), fn.locals...) {
+		renames[b] = freshName(st.used, fn.name+"_"+b.name)
+	}
+	for _, param := range fn.params {
+		names = append(names, &ast.ConstIdent{Value: renames[param]})
+	}
+	for _, ref := range fn.refs {
+		if name, ok := renames[ref.binding]; ok {
+			ref.node.Value = name
+		}
+	}
+	for _, b := range fn.locals {
+		switch decl := b.decl.(type) {
+		case *ast.Assign:
+			for _, t := range decl.Targets {
+				if ident, ok := t.(*ast.ConstIdent); ok && ident.Value == b.name {
+					ident.Value = renames[b]
+				}
+			}
+		case *ast.ForLoopNumeric:
+			if decl.Counter == b.name {
+				decl.Counter = renames[b]
+			}
+		case *ast.ForLoopGeneric:
+			for i, local := range decl.Locals {
+				if local == b.name {
+					decl.Locals[i] = renames[b]
+				}
+			}
+		}
+	}
+
+	body := &ast.DoBlock{}
+	if len(names) > 0 {
+		body.Block = append(body.Block, &ast.Assign{LocalDecl: true, Targets: names, Values: call.Args})
+	}
+	body.Block = append(body.Block, fn.decl.Block...)
+	lines := stmt_to_lines(body, get_content_space(content))
+	if comment != "" {
+		lines[0] += " " + comment
+	}
+
+	rw := Rewrite{Pass: "inline", Target: fn.name, GroupSize: 1, Replaced: 1}
+	rw.Line, rw.EndLine = o.origRange(site.line, site.line)
+	o.spliceLines(site.line, site.line, lines)
+	o.logf("opt inline at: %s:%d function %s", o.filename, rw.Line, fn.name)
+	o.addRewrite(rw)
+	return true
+}
+
+// freshName 返回不在 used 中的名字并把它加入 used，后缀规则与 getUniqueLocalName 相同。
+func freshName(used map[string]bool, base string) string {
+	name := base
+	for i := 1; used[name]; i++ {
+		name = fmt.Sprintf("%s_%d", base, i)
+	}
+	used[name] = true
+	return name
+}
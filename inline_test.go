@@ -0,0 +1,137 @@
+package olua
+
+import (
+	"strings"
+	"testing"
+)
+
+// ============================================================================
+// 集成测试：对比优化器输出与期望文件
+// ============================================================================
+
+// inlineOptions 返回只启用内联的测试选项。
+func inlineOptions() Options {
+	opts := DefaultOptions()
+	opts.Inline = true
+	return opts
+}
+
+func TestInline(t *testing.T) {
+	compareOptOutputWith(t, inlineOptions(), "input/inline.lua", "output/inline.lua")
+}
+
+// ============================================================================
+// 单元测试：开销、求值顺序和改名
+// ============================================================================
+
+func TestInlineRewrites(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{
+			"precedence",
+			"local function add(a, b)\n    return a + b\nend\nx = add(y, z) * 2\n",
+			"local function add(a, b)\n    return a + b\nend\nx = (y + z) * 2\n",
+		},
+		{
+			"missing argument",
+			"local function or_default(v, d)\n    return v or d\nend\nx = or_default(y)\n",
+			"local function or_default(v, d)\n    return v or d\nend\nx = y or nil\n",
+		},
+		{
+			"call argument keeps one value",
+			"local function wrap(v)\n    return {v}\nend\nx = wrap(string.find(y, \"a\"))\n",
+			"local function wrap(v)\n    return {v}\nend\nx = {(string.find(y, \"a\"))}\n",
+		},
+		{
+			"fresh names",
+			"local reset_e = 1\nlocal function reset(e)\n    local n = e.n\n    e.n = n + reset_e\nend\nreset(t)\n",
+			"local reset_e = 1\nlocal function reset(e)\n    local n = e.n\n    e.n = n + reset_e\nend\ndo\n    local reset_e_1 = t\n    local reset_n = reset_e_1.n\n    reset_e_1.n = reset_n + reset_e\nend\n",
+		},
+	}
+	for _, tt := range tests {
+		out, _, err := Optimize([]byte(tt.src), inlineOptions())
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if string(out) != tt.want {
+			t.Errorf("%s: got:\n%s\nwant:\n%s", tt.name, out, tt.want)
+		}
+	}
+}
+
+func TestInlineSkips(t *testing.T) {
+	tests := []struct {
+		name   string
+		src    string
+		reason string
+	}{
+		{"used twice", "local function sq(x)\n    return x * x\nend\nprint(sq(t.n))\n", "argument 1 is used more than once"},
+		{"impure body", "local function add_id(x)\n    return next_id() + x\nend\nprint(add_id(t.n))\n", "argument 1 may be changed by the function body"},
+		{"configured pure argument", "local function one(x)\n    return 1\nend\nprint(one(log_info(\"a\")))\n", "argument 1 may have side effects"},
+		{"unused argument may error", "local function one(x)\n    return 1\nend\nprint(one(t.n))\n", "argument 1 may have side effects"},
+		{"extra arguments", "local function id(x)\n    return x\nend\nprint(id(1, 2))\n", "called with extra arguments"},
+		{"expanding argument", "local function pair(a, b)\n    return {a, b}\nend\nprint(pair(f()))\n", "last argument may expand to several values"},
+		{"stored", "local function id(x)\n    return x\nend\nlocal g = id\n", "function is used as a value"},
+		{"method receiver", "local function id(x)\n    return x\nend\nid:foo()\n", "function is used as a value"},
+	}
+	for _, tt := range tests {
+		out, report, err := Optimize([]byte(tt.src), inlineOptions())
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if string(out) != tt.src {
+			t.Errorf("%s: expected no rewrite, got:\n%s", tt.name, out)
+		}
+		found := false
+		for _, s := range report.Skipped {
+			if s.Pass == "inline" && s.Reason == tt.reason {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("%s: missing skip %q in %+v", tt.name, tt.reason, report.Skipped)
+		}
+	}
+}
+
+func TestInlineCost(t *testing.T) {
+	src := "local function dist(x, y)\n    return math.sqrt(x * x + y * y)\nend\nprint(dist(1, 2))\nfor i = 1, 10 do\n    print(dist(i, 2))\nend\n"
+	opts := inlineOptions()
+	opts.InlineMaxCost = 4
+	out, report, err := Optimize([]byte(src), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), "print(dist(1, 2))") || !strings.Contains(string(out), "print(math.sqrt(i * i + 2 * 2))") {
+		t.Errorf("expected only the call in the loop to be inlined, got:\n%s", out)
+	}
+	want := Skip{Pass: "inline", Line: 4, Target: "dist", Reason: "inlining cost 11 exceeds opt_inline_max_cost 4"}
+	if len(report.Skipped) != 1 || report.Skipped[0] != want {
+		t.Errorf("got skips %+v, want %+v", report.Skipped, want)
+	}
+
+	opts.InlineLoopMaxCost = 4
+	out, _, err = Optimize([]byte(src), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != src {
+		t.Errorf("expected no rewrite with both limits at 4, got:\n%s", out)
+	}
+}
+
+func TestInlineWithDeadCode(t *testing.T) {
+	src := "local function half(x)\n    return x / 2\nend\nprint(half(n))\n"
+	opts := inlineOptions()
+	opts.DeadCode = true
+	out, _, err := Optimize([]byte(src), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "print(n / 2)\n" {
+		t.Errorf("expected the inlined function to be removed, got:\n%s", out)
+	}
+}
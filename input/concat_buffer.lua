@@ -0,0 +1,69 @@
+-- 循环中的字符串拼接
+
+function join_names(list)
+    local s = ""
+    for i = 1, #list do
+        s = s .. list[i].name .. "," -- 名字之间用逗号分隔
+    end
+    return s
+end
+
+function build_html(rows)
+    local html = "<table>"
+    for _, row in ipairs(rows) do
+        html = html .. "<tr>"
+        for _, cell in ipairs(row) do
+            html = html .. "<td>" .. tostring(cell) .. "</td>"
+        end
+        html = html .. "</tr>"
+    end
+    html = html .. "</table>"
+    return html
+end
+
+function repeat_text(text, n)
+    local out = ""
+    local i = 0
+    while i < n do
+        i = i + 1
+        if i > 1 then
+            out = out .. " "
+        end
+        out = out .. text
+    end
+    return out
+end
+
+-- 跳过：循环中读取了 s
+function with_progress(list)
+    local s = ""
+    for i = 1, #list do
+        s = s .. list[i]
+        print(#s)
+    end
+    return s
+end
+
+-- 跳过：s 是参数
+function append_all(s, list)
+    for i = 1, #list do
+        s = s .. list[i]
+    end
+    return s
+end
+
+-- 跳过：被闭包捕获
+function with_closure(list)
+    local s = ""
+    local function get() return s end
+    for i = 1, #list do
+        s = s .. list[i]
+    end
+    return get()
+end
+
+local log = ""
+for i = 1, 3 do
+    log = log .. i
+end
+print(log)
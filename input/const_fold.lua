@@ -0,0 +1,36 @@
+-- Test constant folding and boolean simplification
+
+local SECONDS_PER_DAY = 60 * 60 * 24 -- seconds
+local PREFIX = "prefix_" .. "name"
+local HALF = 10 / 4
+local MASK = 1 << 4 | 0x0f
+local COERCED = "10" + 1
+local LABEL = "level " .. 2 * 5
+local SQUARE = (2 - 5) ^ 2
+
+function check(flag, a, b)
+    if not not flag then
+        print((a < b) == true, a == true)
+    elseif (a == b) == false then
+        return not (a == b)
+    end
+    while true and flag do
+        flag = next_flag()
+    end
+    for i = 1, 2 * 8 do
+        emit(i, -(-3), #"abc")
+    end
+    repeat
+        a = a + 1
+    until not not done(a)
+    return false or compute()
+end
+
+function unchanged(x, ...)
+    -- Errors, unprintable results and locale-dependent comparisons are left alone
+    local bad = 1 // 0, "abc" + 1, 1 / 0, "a" < "b"
+    local y = x == true, - -x, not not x
+    local t = { 1 + 1 }; local u = 2 * 2
+    local s = "-- not a comment" .. "!"
+    return x and ...
+end
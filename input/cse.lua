@@ -0,0 +1,69 @@
+-- Test caching repeated pure subexpressions
+
+function pad(name, width)
+    if string.len(name) >= width then
+        return name
+    end
+    return name .. string.rep(" ", width - string.len(name))
+end
+
+function cell(x, y)
+    local cx = math.floor(x / 32)
+    local cy = math.floor(y / 32)
+    return cx + cy * 64, math.floor(x / 32) * 32
+end
+
+function last(list)
+    local top = list[#list]
+    if #list > 10 then
+        print("long list")
+    end
+    return top, #list
+end
+
+function push(list, v)
+    -- The append changes #list between the reads
+    local n = #list
+    list[#list + 1] = v
+    return n, #list
+end
+
+function grow(list, v)
+    -- table.insert may change the list
+    print(#list)
+    table.insert(list, v)
+    print(#list)
+end
+
+function guard(s)
+    -- The first read is conditional, evaluating it early may raise an error
+    if s ~= nil and string.len(s) > 0 then
+        print(s)
+    end
+    return string.len(s)
+end
+
+function update(self)
+    -- Writes to a field of the input invalidate the cached length
+    local n = #self.items
+    self.items[n + 1] = 1
+    local total = #self.items + #self.items
+    return n, total
+end
+
+function random()
+    -- Impure and non-deterministic calls are not cached
+    local a = math.random(10)
+    local b = math.random(10)
+    local c = string.format("%d", a) .. string.format("%d", a)
+    return a + b, c
+end
+
+function loop(list)
+    -- The loop does not change the list, the header and the body see the same length
+    local n = #list
+    for i = 1, #list do
+        print(list[i])
+    end
+    return n
+end
@@ -0,0 +1,75 @@
+-- 删除未使用的局部变量和无效赋值
+
+function unused_local(a)
+    local first = a
+    local n = #a
+    return n
+end
+
+function overwritten(list)
+    local count = 0
+    count = #list
+    return count
+end
+
+function reassigned(x)
+    local y = x
+    y = x + 1
+    y = y * 3
+    return y
+end
+
+function unused_helper()
+    local function helper(v)
+        return v + 1
+    end
+    local s = {1, "a", x = true}
+    s = {}
+    return 1
+end
+
+-- 不处理：右侧可能有副作用
+function side_effect(t)
+    local r = compute(t)
+    local p = print("x")
+    return t
+end
+
+-- 不处理：table 访问、运算符和内置函数调用可能出错
+function may_error(a, s)
+    local a_b = a.b -- opt by oLua
+    local sum = a + 1
+    local len = string.len(s)
+    return 1
+end
+
+-- 不处理：被函数捕获
+function captured()
+    local v = 1
+    local get = function()
+        return v
+    end
+    v = 2
+    return get
+end
+
+-- 不处理：两次赋值之间有 break
+function with_break(list)
+    local last = 0
+    for i = 1, #list do
+        last = i
+        if list[i] then
+            break
+        end
+        last = 0
+    end
+    return last
+end
+
+-- 不处理：两次赋值之间有读取
+function read_between(a)
+    local v = a.x
+    print(v)
+    v = a.y
+    return v
+end
@@ -0,0 +1,56 @@
+-- Test converting ipairs loops to numeric for loops
+
+function sum(list)
+    local total = 0
+    for i, v in ipairs(list) do
+        total = total + v * i
+    end
+    return total
+end
+
+function names(self)
+    for _, item in ipairs(self.items) do -- keep this comment
+        print(item.name)
+    end
+end
+
+function count(list)
+    local n = 0
+    for i in ipairs(list) do
+        n = i
+    end
+    return n
+end
+
+function skip(list, other)
+    -- Appending makes ipairs visit the new elements
+    for i, v in ipairs(list) do
+        if v > 0 then
+            list[#list + 1] = -v
+        end
+    end
+    -- table.insert may change the list
+    for _, v in ipairs(list) do
+        table.insert(list, v)
+    end
+    -- Rebinding the list inside the loop
+    for _, v in ipairs(list) do
+        list = other
+    end
+    -- The argument is not a path
+    for _, v in ipairs(get_list()) do
+        print(v)
+    end
+    -- The loop variable shadows the list
+    for list, v in ipairs(list) do
+        print(v)
+    end
+end
+
+function nested(rows)
+    for _, row in ipairs(rows) do
+        for _, cell in ipairs(row) do
+            print(cell)
+        end
+    end
+end
@@ -0,0 +1,42 @@
+-- Test localization of globals and standard library functions
+
+local M = {}
+
+function M.format_all(list)
+    local out = {}
+    for i, v in ipairs(list) do
+        out[#out + 1] = string.format("%d:%s", i, tostring(v))
+    end
+    for k, v in pairs(out) do
+        print(string.format("%s=%s", k, v))
+    end
+    return table.concat(out, ","), string.format("%d", #out)
+end
+
+function M.round(x, y, z)
+    -- Text inside strings is never rewritten
+    print("math.floor")
+    return math.floor(x + 0.5), math.floor(y + 0.5), math.floor(z + 0.5)
+end
+
+function M.walk(t)
+    for k in pairs(t) do
+        print(k)
+    end
+    for k in pairs(t) do
+        print(k, type(t[k]), type(k), type(M))
+    end
+end
+
+-- The file replaces os.time, so it is never cached
+os.time = function() return 0 end
+function M.now()
+    return os.time() + os.time() + os.time()
+end
+
+-- next is shadowed by a parameter, so global uses are left alone
+function M.iter(t, next)
+    return next(t), next(t), next(t)
+end
+
+return M
@@ -0,0 +1,55 @@
+-- Test hoisting method lookups out of loops
+
+function Obj:tick(list, n)
+    for i = 1, n do
+        self:update(i)
+        self:draw(i, list[i])
+        self:update (i + 1)
+    end
+end
+
+function Obj:render()
+    -- Receiver is a path, the call has no arguments
+    while self.running do
+        self.canvas:flush()
+        if self.dirty then
+            self.canvas:flush()
+        end
+    end
+end
+
+function Obj:nested(rows)
+    for _, row in ipairs(rows) do
+        -- row is the loop variable, so only the inner self call is cached
+        row:reset()
+        for j = 1, #row do
+            self:visit(row[j])
+        end
+    end
+end
+
+function Obj:skip(list)
+    -- The method field is reassigned inside the loop
+    for i = 1, #list do
+        self.update = list[i]
+        self:update(i)
+    end
+    -- The receiver is passed to a function that may modify it
+    for i = 1, #list do
+        self:update(i)
+        notify(self)
+    end
+    -- Other method calls on the receiver may replace the method
+    for i = 1, #list do
+        self:update(i)
+        self:swap()
+    end
+    -- Closures are called later and keep their own lookup
+    for i = 1, #list do
+        list[i] = function() return self:update(i) end
+    end
+    -- String call syntax cannot be rewritten in place
+    for i = 1, #list do
+        self:log"tick"
+    end
+end
@@ -0,0 +1,35 @@
+-- Test optimization of top-level chunk code executed at require time
+
+local M = {}
+
+-- Reads at load time are cached in a file-level local
+local width = Config.ui.window.width
+local height = Config.ui.window.height
+local title = Config.ui.window.title
+
+-- Functions defined in the chunk capture the cached local as an upvalue,
+-- so their bodies must keep reading the live path
+function M.get_width()
+    return Config.ui.window.width
+end
+
+M.on_resize = function(w)
+    Config.ui.window.width = w
+end
+
+-- A later global with the same name as the generated local must not be shadowed
+function M.dump()
+    print(Config_ui_window)
+end
+
+-- Nested blocks at top level are optimized in place
+if Config.debug then
+    print(Config.log.level)
+    print(Config.log.file)
+end
+
+for i = 1, 3 do
+    M.items[i] = Config.items.list[i] + Config.items.base
+end
+
+return M
@@ -0,0 +1,69 @@
+-- Test hoisting loop-invariant table paths out of loops
+
+function sum_width(list, n)
+    local sum = 0
+    for i = 1, n do
+        local w = cfg.ui.window.width
+        sum = sum + cfg.ui.window.height * w + list[i]
+    end
+    return sum
+end
+
+function sum_items(cfg)
+    local sum = 0
+    -- The path is read by the loop limit before the first iteration
+    for i = 1, #cfg.ui.items do
+        sum = sum + cfg.ui.items[i].width
+    end
+    return sum
+end
+
+function zero_iterations(a, n)
+    -- Only read in the body: a.b may be nil when the loop never runs
+    local s = 0
+    for i = 1, n do
+        s = s + a.b.c
+        s = s + a.b.d
+    end
+    return s
+end
+
+function Obj:run()
+    -- The condition path is read on entry, the write is to a field below it
+    while self.state.running do
+        self.counter.value = self.counter.value + 1
+    end
+end
+
+function guarded(list)
+    for _, v in ipairs(list) do
+        -- Read behind a condition: not hoisted, cached in the body
+        if opts.debug then
+            print(opts.debug.level, v)
+        end
+    end
+end
+
+function invalidated(list)
+    for _, v in ipairs(list) do
+        v.x = M.conf.scale * v.x
+        M.conf = nil
+    end
+end
+
+function closures(list)
+    local fns = {}
+    for i = 1, #list do
+        fns[i] = function() return G.handler.name end
+        print(G.handler.name)
+    end
+    return fns
+end
+
+function repeated(queue)
+    -- The condition is evaluated after the body: not hoisted
+    repeat
+        local item = queue.items.first
+        process(item)
+    until queue.items.first == nil
+end
@@ -0,0 +1,52 @@
+-- Test treating an if/elseif chain as one region
+
+function test_chain_reads(a)
+    -- Every condition and branch reads a.b
+    if a.b.kind == 1 then
+        print(a.b.x)
+    elseif a.b.tag == 2 then
+        print(a.b.y)
+    else
+        print(a.b.z)
+    end
+end
+
+function test_branch_reads(a, t)
+    -- Only the branches read a.b, the first condition may guard it
+    if t == 1 then
+        print(a.b.x)
+    elseif t == 2 then
+        print(a.b.y)
+    end
+end
+
+function test_guarded_chain(t)
+    -- The first condition guards the reads in the elseif
+    if t == nil then
+        return "none"
+    elseif t.b.kind == 1 then
+        return t.b.name
+    end
+    return "other"
+end
+
+function test_single_branch(a, t)
+    -- Only one branch reads a.b, it is cached inside the branch
+    if t == 1 then
+        print(a.b.x)
+        print(a.b.y)
+    elseif t == 2 then
+        print(t)
+    end
+end
+
+function test_branch_write(a, t)
+    -- A branch writes a.b, the chain is not cached
+    if t == 1 then
+        print(a.b.x)
+    elseif t == 2 then
+        a.b = {}
+    else
+        print(a.b.y)
+    end
+end
@@ -0,0 +1,53 @@
+-- Test stopping constructor merging at values with side effects
+
+function test_reads_table()
+    local t = {}
+    t.a = 1
+    t.b = t.a + 1
+    return t
+end
+
+function test_impure_call()
+    local t = {}
+    t.a = math.floor(1.5)
+    t.b = load_config()
+    t.c = 3
+    return t
+end
+
+function test_local_between()
+    local t = {}
+    t.a = 1
+    local n = compute()
+    t.b = n
+    return t
+end
+
+function test_pure_values(x)
+    local t = {}
+    t.a = tostring(x)
+    t.b = string.format("%d", x)
+    return t
+end
+
+function test_key_reads()
+    local t = {}
+    t.a = 1
+    t[t] = 2
+    return t
+end
+
+function test_key_local_between()
+    local t = {}
+    t.a = 1
+    local k = next_key()
+    t[k] = 2
+    return t
+end
+
+function test_key_call()
+    local t = {}
+    t.a = 1
+    t[next_id()] = 2
+    return t
+end
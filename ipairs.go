@@ -0,0 +1,136 @@
+package olua
+
+import (
+	"strings"
+
+	"github.com/milochristiansen/lua/ast"
+)
+
+// ============================================================================
+// ipairs 循环改写为数值 for 循环
+// ============================================================================
+//
+// ipairs 每次迭代都要调用一次迭代函数，数值 for 循环直接索引更快：
+//
+//	for i, v in ipairs(list) do         for i = 1, #list do
+//	    print(i, v)               →         local v = list[i]
+//	end                                     if v == nil then
+//	                                            break
+//	                                        end
+//	                                        print(i, v)
+//	                                    end
+//
+// ipairs 在第一个 nil 处停止，而有空洞的数组的 #list 可能大于这个位置，
+// 因此循环体开头加上 nil 检查；没有值变量时检查 list[i]。#list 不会小于第一个 nil 之前的长度，
+// 改写后遍历的元素与 ipairs 相同。
+//
+// 只改写 ipairs 的参数是变量或 a.b.c 形式路径的循环，并且循环体（不含函数体）中：
+//   - 没有对该路径、其父路径或其字段的赋值（t[#t + 1] = v 会让 ipairs 继续遍历新元素）
+//   - 没有把该路径或其字段传给非纯函数的调用，也没有它的方法调用（table.insert(t, v)、t:push(v)）
+//
+// 假设 t 是普通的数组（没有 __index、__len 元方法），ipairs 在文件中没有被重新定义。
+
+// opt_ipairs 把文件中第一个可以改写的 ipairs 循环改写为数值 for 循环。
+func (o *optimizer) opt_ipairs() {
+	if o.isGlobalShadowed("ipairs") {
+		return
+	}
+	starts := o.stmtStarts()
+	o.for_each_block(func(block []ast.Stmt) bool {
+		for _, stmt := range block {
+			if loop, ok := stmt.(*ast.ForLoopGeneric); ok && o.ipairsLoop(loop, starts) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// ipairsTarget 判断 loop 是 for i, v in ipairs(t) 形式的循环，返回 t 的路径和表达式。
+func ipairsTarget(loop *ast.ForLoopGeneric) (string, ast.Expr, bool) {
+	if len(loop.Init) != 1 || len(loop.Locals) == 0 || len(loop.Locals) > 2 {
+		return "", nil, false
+	}
+	call, ok := loop.Init[0].(*ast.FuncCall)
+	if !ok || call.Receiver != nil || len(call.Args) != 1 {
+		return "", nil, false
+	}
+	if fn, ok := call.Function.(*ast.ConstIdent); !ok || fn.Value != "ipairs" {
+		return "", nil, false
+	}
+	path, ok := constPath(call.Args[0])
+	if !ok {
+		return "", nil, false
+	}
+	// 循环变量遮蔽了 t 时，循环体中的 t[i] 不再是原来的 table
+	if containsString(loop.Locals, strings.Split(path, ".")[0]) {
+		return "", nil, false
+	}
+	return path, call.Args[0], true
+}
+
+// ipairsLoop 尝试改写 ipairs 循环 loop，成功时返回 true。
+func (o *optimizer) ipairsLoop(loop *ast.ForLoopGeneric, starts map[int][]ast.Stmt) bool {
+	path, target, ok := ipairsTarget(loop)
+	if !ok {
+		return false
+	}
+	line := loop.Line()
+	// 循环体必须从下一行开始，才能在头部之后插入取值和 nil 检查
+	if len(loop.Block) > 0 && loop.Block[0].Line() <= line {
+		return false
+	}
+
+	used := collectIdentifiers([]ast.Stmt{loop})
+	for _, name := range loop.Locals {
+		used[name] = true
+	}
+	index := loop.Locals[0]
+	if index == "_" {
+		index = freshName(used, "i")
+	}
+	length := &ast.Operator{Op: ast.OpLength, Right: target}
+	site := &foldSite{line: line, owners: []ast.Stmt{loop}, keyword: "for", suffix: "do",
+		exprs: []*ast.Expr{&loop.Init[0]}, render: func() string {
+			return "for " + index + " = 1, " + expr_to_string(length) + " do"
+		}}
+	content, comment, ok := o.checkFoldSite(site, starts, "ipairs")
+	if !ok {
+		return false
+	}
+
+	for _, stmt := range loop.Block {
+		if target_write, call_write := o.cseStmtWrites(stmt, []string{path}); target_write || call_write {
+			o.addSkip(Skip{Pass: "ipairs", Line: o.origLine(line), Target: path,
+				Reason: "loop body may change " + path})
+			return false
+		}
+	}
+
+	new_line, ok := renderFoldSite(site, content, comment)
+	if !ok {
+		return false
+	}
+	indent := get_content_space(content) + printIndent
+	if len(loop.Block) > 0 {
+		indent = get_content_space(o.filecontent[loop.Block[0].Line()-1])
+	}
+	var value ast.Expr = &ast.TableAccessor{Obj: target, Key: &ast.ConstIdent{Value: index}}
+	lines := []string{new_line}
+	if len(loop.Locals) == 2 && loop.Locals[1] != "_" {
+		name := &ast.ConstIdent{Value: loop.Locals[1]}
+		decl := &ast.Assign{LocalDecl: true, Targets: []ast.Expr{name}, Values: []ast.Expr{value}}
+		lines = append(lines, stmt_to_lines(decl, indent)...)
+		value = name
+	}
+	check := &ast.If{Cond: &ast.Operator{Op: ast.OpEqual, Left: value, Right: &ast.ConstNil{}},
+		Then: []ast.Stmt{&ast.Goto{IsBreak: true, Label: "break"}}}
+	lines = append(lines, stmt_to_lines(check, indent)...)
+
+	rw := Rewrite{Pass: "ipairs", Target: path, GroupSize: 1, Replaced: 1}
+	rw.Line, rw.EndLine = o.origRange(line, line)
+	o.spliceLines(line, line, lines)
+	o.logf("opt ipairs at: %s:%d target=%s", o.filename, rw.Line, path)
+	o.addRewrite(rw)
+	return true
+}
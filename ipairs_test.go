@@ -0,0 +1,84 @@
+package olua
+
+import (
+	"testing"
+)
+
+// ============================================================================
+// 集成测试：对比优化器输出与期望文件
+// ============================================================================
+
+// ipairsOptions 返回只启用 ipairs 循环改写的测试选项。
+func ipairsOptions() Options {
+	opts := DefaultOptions()
+	opts.Ipairs = true
+	return opts
+}
+
+func TestIpairs(t *testing.T) {
+	compareOptOutputWith(t, ipairsOptions(), "input/ipairs.lua", "output/ipairs.lua")
+}
+
+func TestIpairsSkips(t *testing.T) {
+	src, err := readFileLines("input/ipairs.lua")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, report, err := Optimize([]byte(joinSource(src)), ipairsOptions())
+	if err != nil {
+		t.Fatalf("Optimize failed: %v", err)
+	}
+	want := []int{27, 33, 37}
+	if len(report.Skipped) != len(want) {
+		t.Fatalf("skipped = %+v, want lines %v", report.Skipped, want)
+	}
+	for i, skip := range report.Skipped {
+		if skip.Pass != "ipairs" || skip.Line != want[i] || skip.Target != "list" || skip.Reason != "loop body may change list" {
+			t.Errorf("skipped[%d] = %+v, want line %d", i, skip, want[i])
+		}
+	}
+}
+
+func TestIpairsShadowed(t *testing.T) {
+	src := "local ipairs = my_ipairs\nfor i, v in ipairs(list) do\n    print(v)\nend\n"
+	out, report, err := Optimize([]byte(src), ipairsOptions())
+	if err != nil {
+		t.Fatalf("Optimize failed: %v", err)
+	}
+	if string(out) != src || len(report.Rewrites) != 0 {
+		t.Errorf("shadowed ipairs was rewritten:\n%s", out)
+	}
+}
+
+// ============================================================================
+// 差分执行：改写后遍历的元素与 ipairs 相同
+// ============================================================================
+
+func TestIpairsVerify(t *testing.T) {
+	src := `
+function test()
+    local holes = {1, 2, nil, 4}
+    holes[7] = 7
+    local out = {}
+    for i, v in ipairs(holes) do
+        out[#out + 1] = i * 10 + v
+    end
+    local flags = {"a", "b", false, nil, "e"}
+    local n = 0
+    for i in ipairs(flags) do
+        n = i
+    end
+    return out, n
+end
+`
+	optimized, report, err := Optimize([]byte(src), ipairsOptions())
+	if err != nil {
+		t.Fatalf("Optimize failed: %v", err)
+	}
+	if len(report.Rewrites) != 2 {
+		t.Fatalf("rewrites = %+v:\n%s", report.Rewrites, optimized)
+	}
+	if diffs := verifyDiffs(t, src, string(optimized), VerifyOptions{}); len(diffs) != 0 {
+		t.Errorf("optimized code diverged: %v\n%s", diffs, optimized)
+	}
+}
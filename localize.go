@@ -0,0 +1,295 @@
+package olua
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/milochristiansen/lua/ast"
+)
+
+// ============================================================================
+// 全局变量和标准库函数局部化
+// ============================================================================
+//
+// 每次调用 math.floor 都要先查找全局变量 math，再查找字段 floor。使用次数达到阈值时，
+// 在文件开头（或每个函数开头）声明 local 并改写所有使用：
+//
+//	local math_floor = math.floor -- opt by oLua (localize)
+//	local pairs = pairs -- opt by oLua (localize)
+//
+// local 保存的是声明时的值，因此以下情况不做局部化：
+//   - 文件中对该名字（或其前缀，如 math）赋值，包括 _G.pairs = ...
+//   - 文件中把根名字声明为 local、函数参数或循环变量（使用处可能指向这个局部变量）
+//   - 文件中使用了 setfenv、getfenv、module 或 _ENV（全局变量的解析方式会改变）
+
+// localizeMarker 是局部化生成行的标记
+const localizeMarker = "-- opt by oLua (localize)"
+
+// localizableFuncs 是 builtinPureFuncs 之外可以局部化的标准库函数和常量，
+// 它们会修改参数，但函数本身不会被替换。
+var localizableFuncs = map[string]bool{
+	"table.insert":   true,
+	"table.remove":   true,
+	"table.sort":     true,
+	"table.unpack":   true,
+	"string.gsub":    true,
+	"string.reverse": true,
+	"setmetatable":   true,
+	"getmetatable":   true,
+	"rawset":         true,
+	"pcall":          true,
+	"xpcall":         true,
+	"math.fmod":      true,
+	"math.modf":      true,
+	"math.pi":        true,
+	"math.huge":      true,
+}
+
+// envFuncs 出现时全局变量可能不再从 _G 解析，整个文件不做局部化
+var envFuncs = []string{"setfenv", "getfenv", "module", "_ENV"}
+
+// isLocalizable 判断 name 是否是可以局部化的全局函数或标准库函数。
+func isLocalizable(name string) bool {
+	if name == "#" {
+		return false
+	}
+	return builtinPureFuncs[name] || localizableFuncs[name]
+}
+
+// localizeUse 记录某个名字在作用域内的使用情况
+type localizeUse struct {
+	count int
+	lines map[int]int // 行号 → 该行的使用次数
+}
+
+// opt_file_localize 在文件开头为主代码块及所有函数中的使用生成 local。
+func (o *optimizer) opt_file_localize() {
+	o.opt_localize(o.block, 0)
+}
+
+// opt_func_localize 在每个最外层函数开头为该函数（包括嵌套函数）中的使用生成 local。
+func (o *optimizer) opt_func_localize() {
+	f := lua_visitor{f: func(n ast.Node, ok *bool) {
+		if o.hasOpt {
+			*ok = false
+			return
+		}
+		if func_decl, is_func := n.(*ast.FuncDecl); is_func {
+			o.opt_localize(func_decl.Block, func_decl.Line())
+			*ok = false
+		}
+	}}
+	for _, stmt := range o.block {
+		ast.Walk(&f, stmt)
+	}
+}
+
+// opt_localize 在 block 开头为一个达到阈值的名字生成 local 并改写其使用。
+// header_line 是函数头所在行，主代码块为 0。
+func (o *optimizer) opt_localize(block []ast.Stmt, header_line int) {
+	if len(block) == 0 || o.hasOpt {
+		return
+	}
+	idents := collectIdentifiers(o.block)
+	for _, name := range envFuncs {
+		if idents[name] {
+			return
+		}
+	}
+	if countLocalDecls(block) >= maxChunkLocals {
+		return
+	}
+
+	// 插入位置：之前生成的 local 之后的第一条语句
+	var first ast.Stmt
+	localized := map[string]bool{}
+	for _, stmt := range block {
+		if o.isLocalizeLine(stmt.Line()) {
+			if assign, ok := stmt.(*ast.Assign); ok && len(assign.Values) == 1 {
+				if path, ok := getExprPath(assign.Values[0]); ok {
+					localized[path] = true
+				}
+			}
+			continue
+		}
+		first = stmt
+		break
+	}
+	if first == nil {
+		return
+	}
+	insert_line, _ := o.find_stmt_line_range(first)
+	if insert_line <= header_line {
+		// 函数体与函数头在同一行
+		return
+	}
+
+	threshold := o.opts.LocalizeThreshold
+	if threshold < 2 {
+		threshold = 2
+	}
+	uses, assigned, declared := o.collectLocalizeUses(block)
+
+	var names []string
+	for name, use := range uses {
+		if use.count >= threshold && !localized[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		root := strings.Split(name, ".")[0]
+		if declared[root] {
+			continue
+		}
+		skip := false
+		for path := range assigned {
+			if path == name || isPathPrefix(path, name) {
+				skip = true
+				break
+			}
+		}
+		if skip {
+			continue
+		}
+		local_name := name
+		if strings.Contains(name, ".") {
+			local_name = getUniqueLocalName(o.scopeBlock(block), table_access_to_local_name(name))
+			// 文本替换必须与 AST 中的使用一一对应，否则（如字符串中出现同样的文本）放弃
+			mismatch := false
+			for line, n := range uses[name].lines {
+				if contain_table_access_in(o.filecontent[line-1], o.longBracketOpen(line), name) != n {
+					mismatch = true
+					break
+				}
+			}
+			if mismatch {
+				continue
+			}
+		}
+		o.applyLocalize(name, local_name, uses[name], insert_line)
+		return
+	}
+}
+
+// scopeBlock 返回生成的 local 可见范围内需要避免冲突的代码：主代码块时为整个文件。
+func (o *optimizer) scopeBlock(block []ast.Stmt) []ast.Stmt {
+	if o.isMainChunk(block) {
+		return o.block
+	}
+	return block
+}
+
+// isLocalizeLine 判断第 line 行是否是局部化生成的行。
+func (o *optimizer) isLocalizeLine(line int) bool {
+	return line > 0 && line <= len(o.filecontent) && strings.Contains(o.filecontent[line-1], localizeMarker)
+}
+
+// collectLocalizeUses 统计 block 中可局部化名字的读取，
+// 并收集整个文件中被赋值的路径和被声明为局部变量的名字（不含局部化生成的 local）。
+func (o *optimizer) collectLocalizeUses(block []ast.Stmt) (map[string]*localizeUse, map[string]bool, map[string]bool) {
+	uses := map[string]*localizeUse{}
+	targets := map[ast.Expr]bool{}
+	f := lua_visitor{f: func(n ast.Node, ok *bool) {
+		if stmt, is_stmt := n.(ast.Stmt); is_stmt && o.isLocalizeLine(stmt.Line()) {
+			*ok = false
+			return
+		}
+		switch e := n.(type) {
+		case *ast.Assign:
+			for _, t := range e.Targets {
+				targets[t] = true
+			}
+		case *ast.ConstIdent, *ast.TableAccessor:
+			expr := n.(ast.Expr)
+			if targets[expr] {
+				return
+			}
+			path, path_ok := getExprPath(expr)
+			if !path_ok || !isLocalizable(path) {
+				return
+			}
+			line := expr.Line()
+			if o.isDisabled("localize", line, line) {
+				return
+			}
+			use := uses[path]
+			if use == nil {
+				use = &localizeUse{lines: map[int]int{}}
+				uses[path] = use
+			}
+			use.count++
+			use.lines[line]++
+			*ok = false
+		}
+	}}
+	for _, stmt := range block {
+		ast.Walk(&f, stmt)
+	}
+
+	assigned := map[string]bool{}
+	declared := map[string]bool{}
+	g := lua_visitor{f: func(n ast.Node, ok *bool) {
+		switch e := n.(type) {
+		case *ast.Assign:
+			if o.isLocalizeLine(e.Line()) {
+				return
+			}
+			for _, t := range e.Targets {
+				path, path_ok := getExprPath(t)
+				if !path_ok {
+					continue
+				}
+				if e.LocalDecl {
+					declared[path] = true
+				} else {
+					assigned[strings.TrimPrefix(path, "_G.")] = true
+				}
+			}
+		case *ast.FuncDecl:
+			for _, param := range e.Params {
+				declared[param] = true
+			}
+		case *ast.ForLoopNumeric:
+			declared[e.Counter] = true
+		case *ast.ForLoopGeneric:
+			for _, local := range e.Locals {
+				declared[local] = true
+			}
+		}
+	}}
+	for _, stmt := range o.block {
+		ast.Walk(&g, stmt)
+	}
+	return uses, assigned, declared
+}
+
+// applyLocalize 在第 insert_line 行之前插入 local 声明，并把 name 的使用改写为 local_name。
+func (o *optimizer) applyLocalize(name string, local_name string, use *localizeUse, insert_line int) {
+	rw := Rewrite{Pass: "localize", Target: name, Local: local_name, GroupSize: len(use.lines), Replaced: use.count}
+
+	var lines []int
+	for line := range use.lines {
+		lines = append(lines, line)
+	}
+	sort.Ints(lines)
+	rw.Line, rw.EndLine = o.origRange(lines[0], lines[len(lines)-1])
+
+	if local_name != name {
+		for _, line := range lines {
+			o.filecontent[line-1] = replace_table_access_in(o.filecontent[line-1], o.longBracketOpen(line), name, local_name)
+		}
+	}
+
+	decl := &ast.Assign{
+		LocalDecl: true,
+		Targets:   []ast.Expr{&ast.ConstIdent{Value: local_name}},
+		Values:    []ast.Expr{pathToExpr(name)},
+	}
+	indent := get_content_space(o.filecontent[insert_line-1])
+	o.spliceLines(insert_line, insert_line-1, []string{stmt_to_lines(decl, indent)[0] + " " + localizeMarker})
+
+	o.logf("opt localize at: %s:%d target=%s", o.filename, insert_line, name)
+	o.addRewrite(rw)
+}
@@ -0,0 +1,132 @@
+package olua
+
+import (
+	"strings"
+	"testing"
+)
+
+// ============================================================================
+// 集成测试：对比优化器输出与期望文件
+// ============================================================================
+
+// localizeOptions 返回只启用局部化的测试选项。
+func localizeOptions() Options {
+	opts := DefaultOptions()
+	opts.Localize = true
+	return opts
+}
+
+func TestLocalize(t *testing.T) {
+	compareOptOutputWith(t, localizeOptions(), "input/localize.lua", "output/localize.lua")
+}
+
+// ============================================================================
+// 单元测试：作用域和跳过条件
+// ============================================================================
+
+func optimizeLocalize(t *testing.T, opts Options, src string) (string, Report) {
+	t.Helper()
+	out, report, err := Optimize([]byte(src), opts)
+	if err != nil {
+		t.Fatalf("Optimize failed: %v", err)
+	}
+	return string(out), report
+}
+
+func TestLocalizeFunctionScope(t *testing.T) {
+	opts := localizeOptions()
+	opts.LocalizeFunctionScope = true
+	out, report := optimizeLocalize(t, opts, `function f(t)
+    local a = math.floor(t[1]) + math.floor(t[2])
+    return function() return math.floor(t[3]) end
+end
+
+function g(t)
+    return math.floor(t[1])
+end
+`)
+	want := `function f(t)
+    local math_floor = math.floor -- opt by oLua (localize)
+    local a = math_floor(t[1]) + math_floor(t[2])
+    return function() return math_floor(t[3]) end
+end
+
+function g(t)
+    return math.floor(t[1])
+end
+`
+	if out != want {
+		t.Errorf("got:\n%s\nwant:\n%s", out, want)
+	}
+	if len(report.Rewrites) != 1 || report.Rewrites[0] != (Rewrite{Pass: "localize", Line: 2, EndLine: 3, Target: "math.floor", Local: "math_floor", GroupSize: 2, Replaced: 3}) {
+		t.Errorf("rewrites = %+v", report.Rewrites)
+	}
+}
+
+func TestLocalizeUniqueName(t *testing.T) {
+	out, _ := optimizeLocalize(t, localizeOptions(), `local math_floor = 1
+print(math.floor(1), math.floor(2), math.floor(3), math_floor)
+`)
+	if !strings.Contains(out, "local math_floor_1 = math.floor -- opt by oLua (localize)\nlocal math_floor = 1\n") ||
+		!strings.Contains(out, "math_floor_1(1), math_floor_1(2), math_floor_1(3), math_floor)") {
+		t.Errorf("unexpected output:\n%s", out)
+	}
+}
+
+func TestLocalizeKeepsStrings(t *testing.T) {
+	out, _ := optimizeLocalize(t, localizeOptions(), "print(math.floor(1), \"math.floor\") -- math.floor\nprint(math.floor(2), math.floor(3))\n")
+	if !strings.Contains(out, "print(math_floor(1), \"math.floor\") -- math.floor\n") {
+		t.Errorf("unexpected output:\n%s", out)
+	}
+
+	// 跨行的长字符串和长注释
+	src := "print(math.floor(1), [[\nmath.floor]], math.floor(2))\n--[==[\nmath.floor ]]\n]==] print(math.floor(3))\n"
+	out, _ = optimizeLocalize(t, localizeOptions(), src)
+	want := "print(math_floor(1), [[\nmath.floor]], math_floor(2))\n--[==[\nmath.floor ]]\n]==] print(math_floor(3))\n"
+	if !strings.Contains(out, want) {
+		t.Errorf("unexpected output:\n%s", out)
+	}
+}
+
+func TestLocalizeSkip(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+	}{
+		{"below threshold", "print(math.floor(1), math.floor(2))\n"},
+		{"assigned", "math.floor = nil\nprint(math.floor(1), math.floor(2), math.floor(3))\n"},
+		{"root assigned", "function f() math = {} end\nprint(math.floor(1), math.floor(2), math.floor(3))\n"},
+		{"assigned via _G", "_G.pairs = nil\nprint(pairs(a), pairs(b), pairs(c))\n"},
+		{"declared local", "do local math = {} end\nprint(math.floor(1), math.floor(2), math.floor(3))\n"},
+		{"loop variable", "for _, type in ipairs(x) do end\nprint(type(1), type(2), type(3))\n"},
+		{"setfenv", "setfenv(1, {})\nprint(type(1), type(2), type(3))\n"},
+		{"disabled", "-- olua:disable localize\nprint(type(1), type(2), type(3))\n"},
+	}
+	for _, tt := range tests {
+		out, report := optimizeLocalize(t, localizeOptions(), tt.src)
+		for _, rw := range report.Rewrites {
+			if rw.Target != "print" {
+				t.Errorf("%s: unexpected rewrite %+v:\n%s", tt.name, rw, out)
+			}
+		}
+	}
+}
+
+func TestLocalizeRevert(t *testing.T) {
+	src, err := readFileLines("input/localize.lua")
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := strings.Join(src, "\n") + "\n"
+	optimized, _ := optimizeLocalize(t, localizeOptions(), input)
+	reverted, report, err := Revert([]byte(optimized), DefaultOptions())
+	if err != nil {
+		t.Fatalf("Revert failed: %v", err)
+	}
+	if string(reverted) != input {
+		t.Errorf("revert mismatch:\n%s", reverted)
+	}
+	if len(report.Rewrites) != 5 || report.Rewrites[0].Pass != "localize" {
+		t.Errorf("rewrites = %+v", report.Rewrites)
+	}
+}
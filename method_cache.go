@@ -0,0 +1,422 @@
+package olua
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/milochristiansen/lua/ast"
+)
+
+// ============================================================================
+// 循环中的方法查找缓存
+// ============================================================================
+//
+// 循环中每次执行 self:update(i) 都要经过元表查找 self.update。当接收者和方法字段
+// 在循环中都不会被改变时，把查找提到循环之前：
+//
+//	local update = self.update -- opt by oLua (method_cache)
+//	for i = 1, n do
+//	    update(self, i)
+//	end
+//
+// 以下情况不做缓存：
+//   - 接收者的根变量是循环变量，或在循环中被声明为 local、被赋值
+//   - 循环中（包括循环中定义的函数）对 self.update、self 或其父路径赋值
+//   - 循环中的函数调用把接收者或其父路径作为参数或接收者传入（纯函数除外）。
+//     对象自己的方法调用（包括 self:update() 本身）也可能替换 self.update，
+//     只有方法名匹配 MethodCacheStableMethods（opt_method_cache_stable_methods）时才不算
+//
+// 缓存在循环之前读取 self.update，即使循环一次都不执行（如 for i = 1, 0 do）也会读取：
+// 循环不执行时 self 为 nil 或没有 update 字段的代码，优化后会在循环之前出错或触发 __index。
+
+// methodCacheMarker 是方法缓存生成行的标记
+const methodCacheMarker = "-- opt by oLua (method_cache)"
+
+// methodCall 是循环中一组相同接收者和方法名的调用
+type methodCall struct {
+	recv   string      // 接收者路径，如 self、a.b
+	method string      // 方法名
+	lines  map[int]int // 行号 → 该行的调用次数
+	count  int
+}
+
+// opt_block_method_cache 在函数体或主代码块（不含嵌套函数）的循环中查找可缓存的方法调用，
+// 每次只应用一处。
+func (o *optimizer) opt_block_method_cache(block []ast.Stmt) {
+	for i, stmt := range block {
+		if o.hasOpt {
+			return
+		}
+		switch s := stmt.(type) {
+		case *ast.ForLoopNumeric, *ast.ForLoopGeneric, *ast.WhileLoop, *ast.RepeatUntilLoop:
+			if o.opt_loop_method_cache(block, i) {
+				return
+			}
+		case *ast.DoBlock:
+			o.opt_block_method_cache(s.Block)
+			continue
+		case *ast.If:
+			o.opt_block_method_cache(s.Then)
+			o.opt_block_method_cache(s.Else)
+			continue
+		}
+		// 外层循环无法缓存时尝试内层循环
+		for _, inner := range loop_body(stmt) {
+			o.opt_block_method_cache(inner)
+		}
+	}
+}
+
+// loop_body 返回循环语句的循环体，其他语句返回 nil。
+func loop_body(stmt ast.Stmt) [][]ast.Stmt {
+	switch s := stmt.(type) {
+	case *ast.ForLoopNumeric:
+		return [][]ast.Stmt{s.Block}
+	case *ast.ForLoopGeneric:
+		return [][]ast.Stmt{s.Block}
+	case *ast.WhileLoop:
+		return [][]ast.Stmt{s.Block}
+	case *ast.RepeatUntilLoop:
+		return [][]ast.Stmt{s.Block}
+	}
+	return nil
+}
+
+// opt_loop_method_cache 尝试缓存 block[idx] 循环中的一个方法，成功时返回 true。
+func (o *optimizer) opt_loop_method_cache(block []ast.Stmt, idx int) bool {
+	loop := block[idx]
+	loop_start, _ := o.find_stmt_line_range(loop)
+	if idx > 0 {
+		// 循环必须独占起始行，local 才能插在循环之前
+		if _, prev_end := o.find_stmt_line_range(block[idx-1]); prev_end >= loop_start {
+			return false
+		}
+	}
+
+	calls := o.collectLoopMethodCalls(loop)
+	if len(calls) == 0 {
+		return false
+	}
+	shadowed := loopLocalNames(loop)
+
+	for _, call := range calls {
+		root := strings.Split(call.recv, ".")[0]
+		if shadowed[root] || root == "_G" || o.isOluaGeneratedName(root) {
+			continue
+		}
+		if o.loopInvalidatesMethod(loop, call.recv, call.method) {
+			continue
+		}
+		// 文本替换必须与 AST 中的调用一一对应
+		mismatch := false
+		for line, n := range call.lines {
+			if count_method_call(o.filecontent[line-1], call.recv, call.method) != n {
+				mismatch = true
+				break
+			}
+		}
+		if mismatch {
+			continue
+		}
+		o.applyMethodCache(block, call, loop_start)
+		return true
+	}
+	return false
+}
+
+// collectLoopMethodCalls 收集循环体中（不含嵌套函数）接收者为路径的方法调用，按出现顺序排列。
+func (o *optimizer) collectLoopMethodCalls(loop ast.Stmt) []*methodCall {
+	calls := map[string]*methodCall{}
+	var order []string
+	f := lua_visitor{f: func(n ast.Node, ok *bool) {
+		switch e := n.(type) {
+		case *ast.FuncDecl:
+			*ok = false
+		case *ast.FuncCall:
+			if e.Receiver == nil {
+				return
+			}
+			recv, recv_ok := getExprPath(e.Receiver)
+			name, name_ok := e.Function.(*ast.ConstString)
+			if !recv_ok || !name_ok || !isLuaName(name.Value) {
+				return
+			}
+			line := e.Line()
+			if o.isDisabled("method_cache", line, line) {
+				return
+			}
+			key := recv + ":" + name.Value
+			call := calls[key]
+			if call == nil {
+				call = &methodCall{recv: recv, method: name.Value, lines: map[int]int{}}
+				calls[key] = call
+				order = append(order, key)
+			}
+			call.count++
+			call.lines[line]++
+		}
+	}}
+	for _, body := range loop_body(loop) {
+		for _, stmt := range body {
+			ast.Walk(&f, stmt)
+		}
+	}
+	ret := make([]*methodCall, 0, len(order))
+	for _, key := range order {
+		ret = append(ret, calls[key])
+	}
+	return ret
+}
+
+// loopLocalNames 收集循环变量以及循环中（包括嵌套函数）声明的局部变量和参数名。
+func loopLocalNames(loop ast.Stmt) map[string]bool {
+	names := map[string]bool{}
+	f := lua_visitor{f: func(n ast.Node, ok *bool) {
+		switch e := n.(type) {
+		case *ast.Assign:
+			if e.LocalDecl {
+				for _, t := range e.Targets {
+					if ident, is_ident := t.(*ast.ConstIdent); is_ident {
+						names[ident.Value] = true
+					}
+				}
+			}
+		case *ast.FuncDecl:
+			for _, param := range e.Params {
+				names[param] = true
+			}
+		case *ast.ForLoopNumeric:
+			names[e.Counter] = true
+		case *ast.ForLoopGeneric:
+			for _, local := range e.Locals {
+				names[local] = true
+			}
+		}
+	}}
+	ast.Walk(&f, loop)
+	return names
+}
+
+// loopInvalidatesMethod 判断循环中（包括条件和循环中定义的函数）是否可能改变 recv.method。
+func (o *optimizer) loopInvalidatesMethod(loop ast.Stmt, recv string, method string) bool {
+	target := recv + "." + method
+	invalid := false
+	f := lua_visitor{f: func(n ast.Node, ok *bool) {
+		if invalid {
+			*ok = false
+			return
+		}
+		switch e := n.(type) {
+		case *ast.Assign:
+			for _, t := range e.Targets {
+				if path, path_ok := getExprPath(t); path_ok && isWriteToTarget(path, target) {
+					invalid = true
+				}
+			}
+		case *ast.FuncCall:
+			// 参数和接收者中的嵌套调用由遍历继续检查
+			if name, is_method := o.methodCallName(e); is_method {
+				// 方法调用不按纯函数白名单判断：纯函数只保证不修改参数，不保证不替换方法字段
+				if !o.isStableMethod(name) && o.callArgsInvalidateTarget(e, target) {
+					invalid = true
+				}
+			} else if o.funcCallInvalidatesTarget(e, target) {
+				invalid = true
+			}
+		}
+	}}
+	ast.Walk(&f, loop)
+	return invalid
+}
+
+// methodCallName 返回方法调用 obj:method() 或对已缓存方法的调用 method(obj) 的方法名。
+func (o *optimizer) methodCallName(call *ast.FuncCall) (string, bool) {
+	if call.Receiver != nil {
+		return getFuncCallName(call)
+	}
+	if ident, ok := call.Function.(*ast.ConstIdent); ok {
+		name, ok := o.cachedMethods()[ident]
+		return name, ok
+	}
+	return "", false
+}
+
+// isStableMethod 判断方法名是否匹配 MethodCacheStableMethods。
+func (o *optimizer) isStableMethod(name string) bool {
+	for _, re := range o.stablePatterns {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// cachedMethods 返回引用方法缓存局部变量（local update = self.update -- opt by oLua (method_cache)）的名字
+// 到方法名的映射，每轮解析后计算一次。
+func (o *optimizer) cachedMethods() map[*ast.ConstIdent]string {
+	if o.methodCacheRefs != nil {
+		return o.methodCacheRefs
+	}
+	o.methodCacheRefs = map[*ast.ConstIdent]string{}
+	for _, ref := range analyzeScopes(o.block).refs {
+		b := ref.binding
+		if b == nil || b.value == nil {
+			continue
+		}
+		decl, is_assign := b.decl.(*ast.Assign)
+		if !is_assign || !strings.Contains(o.filecontent[decl.Line()-1], methodCacheMarker) {
+			continue
+		}
+		if path, ok := getExprPath(b.value); ok {
+			o.methodCacheRefs[ref.node] = path[strings.LastIndex(path, ".")+1:]
+		}
+	}
+	return o.methodCacheRefs
+}
+
+// applyMethodCache 在循环之前插入方法缓存，并把循环中的调用改写为普通函数调用。
+func (o *optimizer) applyMethodCache(block []ast.Stmt, call *methodCall, loop_start int) {
+	local_name := getUniqueLocalName(o.scopeBlock(block), call.method)
+	rw := Rewrite{Pass: "method_cache", Target: call.recv + ":" + call.method, Local: local_name,
+		GroupSize: len(call.lines), Replaced: call.count}
+
+	var lines []int
+	for line := range call.lines {
+		lines = append(lines, line)
+	}
+	sort.Ints(lines)
+	rw.Line, rw.EndLine = o.origRange(loop_start, lines[len(lines)-1])
+
+	for _, line := range lines {
+		o.filecontent[line-1] = replace_method_call(o.filecontent[line-1], call.recv, call.method, local_name)
+	}
+
+	decl := &ast.Assign{
+		LocalDecl: true,
+		Targets:   []ast.Expr{&ast.ConstIdent{Value: local_name}},
+		Values:    []ast.Expr{pathToExpr(call.recv + "." + call.method)},
+	}
+	indent := get_content_space(o.filecontent[loop_start-1])
+	o.spliceLines(loop_start, loop_start-1, []string{stmt_to_lines(decl, indent)[0] + " " + methodCacheMarker})
+
+	o.logf("opt method_cache at: %s:%d target=%s", o.filename, loop_start, rw.Target)
+	o.addRewrite(rw)
+}
+
+// ============================================================================
+// 方法调用的文本替换
+// ============================================================================
+
+// find_method_call 返回 content 中从 begin 开始第一个 recv:method( 的位置和 "(" 之后的位置，没有时返回 -1。
+// recv 前面不能是 . 或标识符字符，: 两侧和 ( 之前允许空白。
+func find_method_call(content string, begin int, recv string, method string) (int, int) {
+	for {
+		idx := strings.Index(content[begin:], recv)
+		if idx == -1 {
+			return -1, -1
+		}
+		idx += begin
+		begin = idx + len(recv)
+		if idx > 0 && (content[idx-1] == '.' || isIdentByte(content[idx-1])) {
+			continue
+		}
+		pos := skipSpaces(content, idx+len(recv))
+		if pos >= len(content) || content[pos] != ':' {
+			continue
+		}
+		pos = skipSpaces(content, pos+1)
+		if !strings.HasPrefix(content[pos:], method) {
+			continue
+		}
+		pos += len(method)
+		if pos < len(content) && isIdentByte(content[pos]) {
+			continue
+		}
+		pos = skipSpaces(content, pos)
+		if pos >= len(content) || content[pos] != '(' {
+			continue
+		}
+		if skipSpaces(content, pos+1) >= len(content) {
+			// 参数从下一行开始，无法只改写这一行
+			continue
+		}
+		return idx, pos + 1
+	}
+}
+
+// count_method_call 统计 content 中 recv:method( 出现的次数。
+func count_method_call(content string, recv string, method string) int {
+	n := 0
+	begin := 0
+	for {
+		_, end := find_method_call(content, begin, recv, method)
+		if end == -1 {
+			return n
+		}
+		n++
+		begin = end
+	}
+}
+
+// replace_method_call 把 content 中的 recv:method(args) 改写为 fn(recv, args)。
+func replace_method_call(content string, recv string, method string, fn string) string {
+	begin := 0
+	for {
+		start, end := find_method_call(content, begin, recv, method)
+		if start == -1 {
+			return content
+		}
+		repl := fn + "(" + recv
+		next := skipSpaces(content, end)
+		if content[next] != ')' {
+			repl += ", "
+		}
+		end = next
+		content = content[:start] + repl + content[end:]
+		begin = start + len(repl)
+	}
+}
+
+// revert_method_call 把 content 中由 replace_method_call 生成的 fn(recv, ...) 还原为 recv:method(...)，
+// 返回还原后的内容和还原次数。
+func revert_method_call(content string, recv string, method string, fn string) (string, int) {
+	n := 0
+	prefix := fn + "(" + recv
+	begin := 0
+	for {
+		idx := strings.Index(content[begin:], prefix)
+		if idx == -1 {
+			return content, n
+		}
+		idx += begin
+		begin = idx + len(prefix)
+		if idx > 0 && (content[idx-1] == '.' || content[idx-1] == ':' || isIdentByte(content[idx-1])) {
+			continue
+		}
+		rest := content[idx+len(prefix):]
+		var repl string
+		switch {
+		case strings.HasPrefix(rest, ", "):
+			repl = recv + ":" + method + "("
+			rest = rest[2:]
+		case strings.HasPrefix(rest, ")"):
+			repl = recv + ":" + method + "("
+		default:
+			continue
+		}
+		content = content[:idx] + repl + rest
+		begin = idx + len(repl)
+		n++
+	}
+}
+
+func isIdentByte(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+func skipSpaces(content string, pos int) int {
+	for pos < len(content) && (content[pos] == ' ' || content[pos] == '\t') {
+		pos++
+	}
+	return pos
+}
@@ -0,0 +1,141 @@
+package olua
+
+import (
+	"strings"
+	"testing"
+)
+
+// ============================================================================
+// 集成测试：对比优化器输出与期望文件
+// ============================================================================
+
+// methodCacheOptions 返回只启用方法缓存的测试选项，fixture 中的方法被配置为不替换方法字段。
+func methodCacheOptions() Options {
+	opts := DefaultOptions()
+	opts.MethodCache = true
+	opts.MethodCacheStableMethods = []string{"update", "draw", "flush", "visit"}
+	return opts
+}
+
+func TestMethodCache(t *testing.T) {
+	compareOptOutputWith(t, methodCacheOptions(), "input/method_cache.lua", "output/method_cache.lua")
+}
+
+// ============================================================================
+// 单元测试：文本改写和还原
+// ============================================================================
+
+func TestReplaceMethodCall(t *testing.T) {
+	tests := []struct {
+		content string
+		recv    string
+		want    string
+		count   int
+	}{
+		{"self:update(i)", "self", "update(self, i)", 1},
+		{"self:update()", "self", "update(self)", 1},
+		{"self : update ( )", "self", "update(self)", 1},
+		{"x = self:update(a) + self:update(b)", "self", "x = update(self, a) + update(self, b)", 2},
+		{"myself:update(i)", "self", "myself:update(i)", 0},
+		{"a.self:update(i)", "self", "a.self:update(i)", 0},
+		{"self:updated(i)", "self", "self:updated(i)", 0},
+		{"self:update(", "self", "self:update(", 0},
+		{"a.b:update(1)", "a.b", "update(a.b, 1)", 1},
+	}
+	for _, tt := range tests {
+		if got := count_method_call(tt.content, tt.recv, "update"); got != tt.count {
+			t.Errorf("count_method_call(%q) = %d, want %d", tt.content, got, tt.count)
+		}
+		got := replace_method_call(tt.content, tt.recv, "update", "update")
+		if got != tt.want {
+			t.Errorf("replace_method_call(%q) = %q, want %q", tt.content, got, tt.want)
+		}
+		if tt.count > 0 {
+			back, n := revert_method_call(got, tt.recv, "update", "update")
+			if n != tt.count || strings.ReplaceAll(back, " ", "") != strings.ReplaceAll(tt.content, " ", "") {
+				t.Errorf("revert_method_call(%q) = %q, %d", got, back, n)
+			}
+		}
+	}
+}
+
+func TestMethodCacheRevert(t *testing.T) {
+	lines, err := readFileLines("output/method_cache.lua")
+	if err != nil {
+		t.Fatal(err)
+	}
+	optimized := strings.Join(lines, "\n") + "\n"
+	reverted, report, err := Revert([]byte(optimized), DefaultOptions())
+	if err != nil {
+		t.Fatalf("Revert failed: %v", err)
+	}
+	if strings.Contains(string(reverted), "opt by oLua") || len(report.Rewrites) != 4 || report.Rewrites[0].Pass != "method_cache" {
+		t.Fatalf("revert = %+v:\n%s", report.Rewrites, reverted)
+	}
+	again, _, err := Optimize(reverted, methodCacheOptions())
+	if err != nil {
+		t.Fatalf("Optimize failed: %v", err)
+	}
+	if string(again) != optimized {
+		t.Errorf("re-optimized output differs:\n%s", again)
+	}
+}
+
+func TestMethodCacheReplacedMethod(t *testing.T) {
+	// swap 替换了 self.update，缓存后会继续调用旧的方法
+	src := `local o = {}
+function o:inc(i) self.n = self.n + i end
+function o:dec(i) self.n = self.n - i end
+o.update = o.inc
+function o:swap()
+    if self.update == self.inc then self.update = self.dec else self.update = self.inc end
+end
+function run()
+    o.n = 0
+    for i = 1, 4 do
+        o:update(i)
+        o:swap()
+    end
+    return o.n
+end
+`
+	opts := DefaultOptions()
+	opts.MethodCache = true
+	optimized, report, err := Optimize([]byte(src), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Rewrites) != 0 {
+		t.Fatalf("rewrites = %+v:\n%s", report.Rewrites, optimized)
+	}
+	if diffs := verifyDiffs(t, src, string(optimized), VerifyOptions{Entry: "return run()"}); len(diffs) != 0 {
+		t.Errorf("optimized code diverged: %v\n%s", diffs, optimized)
+	}
+}
+
+func TestMethodCacheStableMethods(t *testing.T) {
+	src := "function f(self, n)\n    for i = 1, n do\n        self:update(i)\n    end\nend\n"
+	// 纯函数只保证不修改参数，不能说明 update 不会替换 self.update
+	opts := DefaultOptions()
+	opts.MethodCache = true
+	opts.TableAccessPureFuncs = append(opts.TableAccessPureFuncs, "update")
+	out, report, err := Optimize([]byte(src), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Rewrites) != 0 {
+		t.Errorf("pure funcs must not enable method caching:\n%s", out)
+	}
+
+	opts = DefaultOptions()
+	opts.MethodCache = true
+	opts.MethodCacheStableMethods = []string{"upd.*"}
+	out, _, err = Optimize([]byte(src), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "    local update = self.update -- opt by oLua (method_cache)\n    for i = 1, n do\n        update(self, i)\n"
+	if !strings.Contains(string(out), want) {
+		t.Errorf("expected update to be cached, got:\n%s", out)
+	}
+}
@@ -0,0 +1,434 @@
+// Package olua 是一个聊胜于无的 Lua 源码优化器。
+//
+// 优化以源码到源码的方式进行：每轮解析一次 AST，应用一处改写，
+// 然后重新解析，直到没有新的优化机会。所有状态都保存在单次调用内，
+// 因此 Optimize 可以被多个 goroutine 并发调用。
+package olua
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/milochristiansen/lua/ast"
+)
+
+// Options 控制 Optimize 启用哪些优化以及优化参数。
+type Options struct {
+	// Filename 只用于日志、报告和错误信息中标识源文件。
+	Filename string
+
+	// ConstFold 启用常量折叠（60 * 60 * 24 → 86400）和布尔表达式化简。
+	ConstFold bool
+
+	// Inline 把对不递归、只被直接调用的小 local function 的调用替换为函数体。
+	Inline bool
+	// InlineMaxCost 是内联到循环外的调用处的函数体最大开销（AST 节点数），小于 1 时使用默认值 12。
+	InlineMaxCost int
+	// InlineLoopMaxCost 是内联到循环中的调用处的函数体最大开销，小于 1 时使用默认值 24。
+	InlineLoopMaxCost int
+
+	// TableAccess 启用 table 访问优化（缓存重复读取的 a.b.c 路径）。
+	TableAccess bool
+	// TableAccessThreshold 触发 table 访问优化的最小读次数，小于 2 时按 2 处理。
+	TableAccessThreshold int
+	// TableAccessPureFuncs 不会修改参数的函数名正则（在内置白名单之外），自动按整词匹配。
+	TableAccessPureFuncs []string
+	// TableAccessGlobal 同时优化 _G.xxx 访问（默认关闭，可读性差）。
+	TableAccessGlobal bool
+	// TableAccessHoist 把循环中不会失效的路径缓存到循环之前，而不是循环体中第一次读的位置。
+	TableAccessHoist bool
+
+	// TableConstructor 启用 table 构造优化（把紧随其后的字段赋值合并进构造表达式）。
+	TableConstructor bool
+
+	// CSE 把同一语句块中重复计算的纯函数调用和取长度（string.len(name)、#list）缓存到局部变量中。
+	CSE bool
+
+	// MethodCache 把循环中 obj:method() 的方法查找提到循环之前（local method = obj.method）。
+	MethodCache bool
+	// MethodCacheStableMethods 不会替换任何对象的方法字段的方法名正则，自动按整词匹配。
+	// 循环中对这些方法的调用不会使缓存的方法失效。
+	MethodCacheStableMethods []string
+
+	// Localize 为使用次数达到阈值的标准库函数和全局函数生成 local（如 local math_floor = math.floor）。
+	Localize bool
+	// LocalizeThreshold 触发局部化的最小使用次数，小于 2 时按 2 处理。
+	LocalizeThreshold int
+	// LocalizeFunctionScope 在每个最外层函数开头而不是文件开头声明 local。
+	LocalizeFunctionScope bool
+
+	// Ipairs 把 for i, v in ipairs(t) 循环改写为数值 for 循环（循环体不改变 t 时）。
+	Ipairs bool
+
+	// TableInsert 把两个参数的 table.insert(t, v) 改写为 t[#t + 1] = v。
+	TableInsert bool
+	// TableInsertCounter 把同一语句块中连续追加同一个 table 的语句改为只取一次长度（local t_n = #t）。
+	TableInsertCounter bool
+
+	// TablePrealloc 按 Dialect 为能静态确定大小的空表生成预分配（LuaJIT 的 table.new 或 Lua 5.4 的预设大小构造表达式）。
+	TablePrealloc bool
+	// Dialect 是目标 Lua 方言："luajit" 或 "5.4"，为空时按 Lua 5.3 处理，不做预分配。
+	Dialect string
+
+	// DeadCode 删除未使用的局部变量和在读取之前被覆盖的赋值（右侧没有副作用时）。
+	DeadCode bool
+	// DeadCodeWarnOnly 只在报告中记录未使用的局部变量和无效赋值，不修改代码。
+	DeadCodeWarnOnly bool
+
+	// ConcatBuffer 把循环中 s = s .. piece 形式的字符串拼接改写为缓冲区 table 加 table.concat。
+	ConcatBuffer bool
+
+	// Logger 接收优化过程日志，nil 表示不输出。
+	Logger *log.Logger
+}
+
+// DefaultOptions 返回与命令行默认值一致的选项（所有优化默认关闭）。
+func DefaultOptions() Options {
+	return Options{
+		TableAccessThreshold: 2,
+		TableAccessPureFuncs: []string{"log_.*"},
+		LocalizeThreshold:    3,
+		InlineMaxCost:        defaultInlineMaxCost,
+		InlineLoopMaxCost:    defaultInlineLoopMaxCost,
+	}
+}
+
+// Rewrite 描述一次已应用的改写。
+type Rewrite struct {
+	Pass    string `json:"pass"`     // 优化名，如 "table_access"、"table_constructor"
+	Line    int    `json:"line"`     // 改写范围在原始源码中的起始行号（1-based）
+	EndLine int    `json:"end_line"` // 改写范围在原始源码中的结束行号（含）
+	Target  string `json:"target"`   // 被优化的表路径或表达式
+	// Local 是生成的局部变量名，没有生成局部变量时为空
+	Local string `json:"local,omitempty"`
+	// GroupSize 是参与改写的语句数：table 访问为读组中的读事件数，
+	// table 构造为合并进构造表达式的赋值语句数
+	GroupSize int `json:"group_size"`
+	// Replaced 是被替换的访问次数：table 访问为替换成局部变量的 target 出现次数，
+	// table 构造为被合并掉的字段赋值数
+	Replaced int `json:"replaced"`
+}
+
+// Skip 描述一个被发现但没有改写的优化机会。
+type Skip struct {
+	Pass   string `json:"pass"`   // 优化名
+	Line   int    `json:"line"`   // 在原始源码中的行号
+	Target string `json:"target"` // 候选的变量名或表达式
+	Reason string `json:"reason"` // 没有改写的原因
+}
+
+// Report 汇总一次 Optimize 调用应用的改写。
+type Report struct {
+	Filename string    `json:"file"`
+	OptCount int       `json:"opt_count"`
+	Rewrites []Rewrite `json:"rewrites"`
+	// Skipped 是被跳过的候选，只有部分优化会记录
+	Skipped []Skip `json:"skipped,omitempty"`
+}
+
+// Optimize 对 Lua 源码执行 opts 中启用的优化，返回优化后的源码和报告。
+// 源码无法解析时返回错误。
+func Optimize(src []byte, opts Options) ([]byte, Report, error) {
+	o := newOptimizer(opts)
+	o.setSource(splitLines(src))
+	if err := o.run(); err != nil {
+		return nil, o.report, err
+	}
+	return joinLines(o.filecontent), o.report, nil
+}
+
+// optimizer 保存单次优化调用的全部状态。
+type optimizer struct {
+	opts         Options
+	purePatterns []*regexp.Regexp
+	// stablePatterns 是 MethodCacheStableMethods 编译后的正则
+	stablePatterns []*regexp.Regexp
+
+	filename    string
+	filecontent []string
+	block       []ast.Stmt
+	// origLines[i] 是当前第 i+1 行在原始源码中的行号，0 表示该行由优化插入
+	origLines []int
+	// disabled 是本轮解析得到的被 olua:disable 指令关闭的行范围
+	disabled []disabledRange
+	// elseIfs 是本轮解析中作为 elseif 分支的 if 语句，按需计算
+	elseIfs map[*ast.If]bool
+	// methodCacheRefs 是本轮解析中引用方法缓存局部变量的名字到方法名的映射，按需计算
+	methodCacheRefs map[*ast.ConstIdent]string
+	// longBrackets[i] 是第 i+1 行行首未闭合的长字符串或长注释的等号个数，源码行变化后置空，按需重新计算
+	longBrackets []int
+
+	// hasOpt 表示本轮已应用了一处改写，需要重新解析
+	hasOpt   bool
+	optCount int
+	report   Report
+	// skipped 用于避免每轮重复记录同一个被跳过的候选
+	skipped map[Skip]bool
+}
+
+func newOptimizer(opts Options) *optimizer {
+	o := &optimizer{
+		opts:     opts,
+		filename: opts.Filename,
+	}
+	o.report.Filename = opts.Filename
+	o.compilePureFuncPatterns(opts.TableAccessPureFuncs)
+	o.stablePatterns = o.compileNamePatterns("method_cache_stable_methods", opts.MethodCacheStableMethods)
+	return o
+}
+
+// run 反复解析并优化，直到某一轮没有应用任何改写。
+func (o *optimizer) run() error {
+	o.hasOpt = true
+	for o.hasOpt {
+		o.hasOpt = false
+		if err := o.parse_lua(); err != nil {
+			return err
+		}
+		o.opt_lua()
+	}
+	return nil
+}
+
+func (o *optimizer) parse_lua() error {
+	block, err := ast.Parse(joinSource(o.filecontent), 1)
+	if err != nil {
+		return fmt.Errorf("%v %v", o.filename, err)
+	}
+	o.block = block
+	o.longBrackets = nil
+	o.methodCacheRefs = nil
+	o.elseIfs = nil
+	o.parse_directives()
+	return nil
+}
+
+func (o *optimizer) opt_lua() {
+	// 先折叠常量，折叠后的代码可能让其他优化有更多机会
+	if o.opts.ConstFold {
+		o.opt_const_fold()
+		if o.hasOpt {
+			return
+		}
+	}
+	// 内联在局部化之前进行，展开后的函数体中的标准库调用也会被计数
+	if o.opts.Inline {
+		o.opt_inline()
+		if o.hasOpt {
+			return
+		}
+	}
+	// 在局部化之前改写，避免为即将消失的 table.insert 生成 local
+	if o.opts.TableInsert {
+		o.opt_table_insert()
+		if o.hasOpt {
+			return
+		}
+	}
+	// 同样在局部化之前改写，避免为即将消失的 ipairs 生成 local
+	if o.opts.Ipairs {
+		o.opt_ipairs()
+		if o.hasOpt {
+			return
+		}
+	}
+	if o.opts.Localize {
+		if o.opts.LocalizeFunctionScope {
+			o.opt_func_localize()
+		} else {
+			o.opt_file_localize()
+		}
+		if o.hasOpt {
+			return
+		}
+	}
+	f := lua_visitor{f: func(n ast.Node, ok *bool) {
+		if o.hasOpt {
+			*ok = false
+			return
+		}
+		if n != nil {
+			switch n.(type) {
+			case *ast.FuncDecl:
+				func_decl := n.(*ast.FuncDecl)
+				o.opt_block(func_decl.Block)
+			}
+		}
+	}}
+	for _, stmt := range o.block {
+		ast.Walk(&f, stmt)
+	}
+	// 最后优化主代码块（模块加载时执行的代码）
+	if !o.hasOpt {
+		o.opt_block(o.block)
+	}
+	// 其他优化都没有改写时才清理，它们可能让局部变量不再被使用
+	if !o.hasOpt && o.opts.DeadCode {
+		o.opt_dead_code()
+	}
+}
+
+// opt_block 对一个函数体或主代码块依次尝试各个优化。
+func (o *optimizer) opt_block(block []ast.Stmt) {
+	if o.opts.TableConstructor {
+		o.opt_block_table_constructor(block)
+		if o.hasOpt {
+			return
+		}
+	}
+	if o.opts.TableAccess {
+		o.opt_block_table_access(block)
+		if o.hasOpt {
+			return
+		}
+	}
+	// 在 table 访问优化之后，表达式中的路径已经被缓存
+	if o.opts.CSE {
+		o.opt_block_cse(block)
+		if o.hasOpt {
+			return
+		}
+	}
+	if o.opts.MethodCache {
+		o.opt_block_method_cache(block)
+		if o.hasOpt {
+			return
+		}
+	}
+	if o.opts.ConcatBuffer {
+		o.opt_block_concat_buffer(block)
+		if o.hasOpt {
+			return
+		}
+	}
+	// 在 table 构造优化之后，只为没有合并进构造表达式的空表预分配
+	if o.opts.TablePrealloc {
+		o.opt_block_table_prealloc(block)
+		if o.hasOpt {
+			return
+		}
+	}
+}
+
+// isMainChunk 判断 block 是否是文件的主代码块。
+func (o *optimizer) isMainChunk(block []ast.Stmt) bool {
+	return len(block) > 0 && len(o.block) > 0 && &block[0] == &o.block[0]
+}
+
+// setSource 设置待优化的源码行，并建立与原始行号的对应关系。
+func (o *optimizer) setSource(lines []string) {
+	o.filecontent = lines
+	o.longBrackets = nil
+	o.origLines = make([]int, len(lines))
+	for i := range o.origLines {
+		o.origLines[i] = i + 1
+	}
+}
+
+// spliceLines 用 lines 替换当前源码的第 start 到 end 行（1-based，闭区间）。
+// end 为 start-1 时表示在第 start 行之前插入。替换后的第一行沿用原第 start 行
+// 对应的原始行号，其余新行视为插入行。
+func (o *optimizer) spliceLines(start int, end int, lines []string) {
+	orig := make([]int, len(lines))
+	if end >= start && len(lines) > 0 {
+		orig[0] = o.origLines[start-1]
+	}
+	var filecontent []string
+	filecontent = append(filecontent, o.filecontent[:start-1]...)
+	filecontent = append(filecontent, lines...)
+	filecontent = append(filecontent, o.filecontent[end:]...)
+	o.filecontent = filecontent
+
+	var origLines []int
+	origLines = append(origLines, o.origLines[:start-1]...)
+	origLines = append(origLines, orig...)
+	origLines = append(origLines, o.origLines[end:]...)
+	o.origLines = origLines
+	o.longBrackets = nil
+}
+
+// longBracketOpen 返回第 line 行行首未闭合的长字符串或长注释的等号个数，-1 表示没有。
+func (o *optimizer) longBracketOpen(line int) int {
+	if o.longBrackets == nil {
+		o.longBrackets = long_bracket_states(o.filecontent)
+	}
+	return o.longBrackets[line-1]
+}
+
+// origLine 返回当前第 line 行在原始源码中的行号。插入行对应其后第一个原始行，
+// 即改写在原文件中生效的位置。
+func (o *optimizer) origLine(line int) int {
+	for i := line - 1; i >= 0 && i < len(o.origLines); i++ {
+		if o.origLines[i] > 0 {
+			return o.origLines[i]
+		}
+	}
+	return len(o.origLines)
+}
+
+// origRange 返回当前源码第 start 到 end 行在原始源码中的行号范围，
+// 必须在修改源码之前调用。
+func (o *optimizer) origRange(start int, end int) (int, int) {
+	if end < start {
+		end = start
+	}
+	return o.origLine(start), o.origLine(end)
+}
+
+// addRewrite 记录一次改写并标记本轮已优化。rw 中的行号已经是原始源码中的行号。
+func (o *optimizer) addRewrite(rw Rewrite) {
+	o.report.Rewrites = append(o.report.Rewrites, rw)
+	o.optCount++
+	o.report.OptCount = o.optCount
+	o.hasOpt = true
+}
+
+// addSkip 记录一个被跳过的候选，同一候选只记录一次。
+func (o *optimizer) addSkip(skip Skip) {
+	if o.skipped[skip] {
+		return
+	}
+	if o.skipped == nil {
+		o.skipped = map[Skip]bool{}
+	}
+	o.skipped[skip] = true
+	o.report.Skipped = append(o.report.Skipped, skip)
+	o.logf("skip %s at: %s:%d target=%s: %s", skip.Pass, o.filename, skip.Line, skip.Target, skip.Reason)
+}
+
+func (o *optimizer) logf(format string, args ...interface{}) {
+	if o.opts.Logger != nil {
+		o.opts.Logger.Output(2, fmt.Sprintf(format, args...))
+	}
+}
+
+// splitLines 按行切分源码（与 bufio.ScanLines 行为一致：去掉行尾的 \r）。
+func splitLines(src []byte) []string {
+	if len(src) == 0 {
+		return nil
+	}
+	lines := strings.Split(string(src), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	for i, line := range lines {
+		lines[i] = strings.TrimSuffix(line, "\r")
+	}
+	return lines
+}
+
+// joinLines 把行重新拼接为文件内容，每行以 \n 结尾。
+func joinLines(lines []string) []byte {
+	return []byte(joinSource(lines))
+}
+
+func joinSource(lines []string) string {
+	var sb strings.Builder
+	for _, line := range lines {
+		sb.WriteString(line)
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
@@ -0,0 +1,127 @@
+package olua
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// ============================================================================
+// 库 API 测试
+// ============================================================================
+
+func TestOptimizeParseError(t *testing.T) {
+	opts := tableAccessOptions()
+	opts.Filename = "broken.lua"
+	_, _, err := Optimize([]byte("function test(\n"), opts)
+	if err == nil {
+		t.Fatal("Optimize on invalid source should return an error")
+	}
+	if !strings.Contains(err.Error(), "broken.lua") {
+		t.Errorf("error %q should mention the file name", err)
+	}
+}
+
+func TestOptimizeReport(t *testing.T) {
+	src := "function test()\n    local x = a.b.c\n    local y = a.b.d\nend\n"
+	opts := tableAccessOptions()
+	opts.Filename = "report.lua"
+	out, report, err := Optimize([]byte(src), opts)
+	if err != nil {
+		t.Fatalf("Optimize failed: %v", err)
+	}
+	if report.OptCount != 1 || len(report.Rewrites) != 1 {
+		t.Fatalf("report = %+v, want exactly one rewrite", report)
+	}
+	rw := report.Rewrites[0]
+	if rw.Pass != "table_access" || rw.Target != "a.b" || rw.Line != 2 {
+		t.Errorf("rewrite = %+v, want table_access a.b at line 2", rw)
+	}
+	if report.Filename != "report.lua" {
+		t.Errorf("report.Filename = %q, want %q", report.Filename, "report.lua")
+	}
+	if !strings.Contains(string(out), "local a_b = a.b -- opt by oLua") {
+		t.Errorf("output missing cached local:\n%s", out)
+	}
+}
+
+func TestOptimizeNoPassEnabled(t *testing.T) {
+	src := "function test()\r\n    local x = a.b.c\r\n    local y = a.b.d\r\nend"
+	out, report, err := Optimize([]byte(src), DefaultOptions())
+	if err != nil {
+		t.Fatalf("Optimize failed: %v", err)
+	}
+	if report.OptCount != 0 {
+		t.Errorf("OptCount = %d, want 0 with every pass disabled", report.OptCount)
+	}
+	want := "function test()\n    local x = a.b.c\n    local y = a.b.d\nend\n"
+	if string(out) != want {
+		t.Errorf("output = %q, want %q", out, want)
+	}
+}
+
+func TestOptimizeConcurrent(t *testing.T) {
+	// 多个 goroutine 同时优化不同文件，结果必须与串行运行一致
+	files := []string{"table_access_advanced", "table_access_loop", "table_access_purefunc", "table_access_realworld"}
+	var wg sync.WaitGroup
+	for round := 0; round < 4; round++ {
+		for _, name := range files {
+			wg.Add(1)
+			go func(name string) {
+				defer wg.Done()
+				src, err := os.ReadFile("input/" + name + ".lua")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				want, err := os.ReadFile("output/" + name + ".lua")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				out, _, err := Optimize(src, tableAccessOptions())
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if string(out) != string(want) {
+					t.Errorf("concurrent Optimize of %s differs from expected output", name)
+				}
+			}(name)
+		}
+	}
+	wg.Wait()
+}
+
+func TestOptimizeReportOriginalLines(t *testing.T) {
+	// 后面的改写发生在前面插入的行之后，报告中的行号仍然对应原始源码
+	src := `function f()
+    local x = a.b.c
+    local y = a.b.d
+end
+
+function g()
+    local x = a.b.c
+    local y = a.b.d
+    local t = {}
+    t.x = 1
+end
+`
+	opts := tableAccessOptions()
+	opts.TableConstructor = true
+	_, report, err := Optimize([]byte(src), opts)
+	if err != nil {
+		t.Fatalf("Optimize failed: %v", err)
+	}
+	got := map[string]bool{}
+	for _, rw := range report.Rewrites {
+		got[fmt.Sprintf("%s:%d:%s", rw.Pass, rw.Line, rw.Target)] = true
+	}
+	for _, want := range []string{"table_access:2:a.b", "table_access:7:a.b", "table_constructor:9:t"} {
+		if !got[want] {
+			t.Errorf("report %v is missing %s", report.Rewrites, want)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+-- 循环中的字符串拼接
+
+function join_names(list)
+    local s = ""
+    local s_buf = {s} -- opt by oLua (concat_buffer)
+    for i = 1, #list do
+        s_buf[#s_buf + 1] = list[i].name .. "," -- 名字之间用逗号分隔
+    end
+    s = table.concat(s_buf) -- opt by oLua (concat_buffer)
+    return s
+end
+
+function build_html(rows)
+    local html = "<table>"
+    local html_buf = {html} -- opt by oLua (concat_buffer)
+    for _, row in ipairs(rows) do
+        html_buf[#html_buf + 1] = "<tr>"
+        for _, cell in ipairs(row) do
+            html_buf[#html_buf + 1] = "<td>" .. tostring(cell) .. "</td>"
+        end
+        html_buf[#html_buf + 1] = "</tr>"
+    end
+    html = table.concat(html_buf) -- opt by oLua (concat_buffer)
+    html = html .. "</table>"
+    return html
+end
+
+function repeat_text(text, n)
+    local out = ""
+    local i = 0
+    local out_buf = {out} -- opt by oLua (concat_buffer)
+    while i < n do
+        i = i + 1
+        if i > 1 then
+            out_buf[#out_buf + 1] = " "
+        end
+        out_buf[#out_buf + 1] = text
+    end
+    out = table.concat(out_buf) -- opt by oLua (concat_buffer)
+    return out
+end
+
+-- 跳过：循环中读取了 s
+function with_progress(list)
+    local s = ""
+    for i = 1, #list do
+        s = s .. list[i]
+        print(#s)
+    end
+    return s
+end
+
+-- 跳过：s 是参数
+function append_all(s, list)
+    for i = 1, #list do
+        s = s .. list[i]
+    end
+    return s
+end
+
+-- 跳过：被闭包捕获
+function with_closure(list)
+    local s = ""
+    local function get() return s end
+    for i = 1, #list do
+        s = s .. list[i]
+    end
+    return get()
+end
+
+local log = ""
+local log_buf = {log} -- opt by oLua (concat_buffer)
+for i = 1, 3 do
+    log_buf[#log_buf + 1] = i
+end
+log = table.concat(log_buf) -- opt by oLua (concat_buffer)
+print(log)
@@ -0,0 +1,36 @@
+-- Test constant folding and boolean simplification
+
+local SECONDS_PER_DAY = 86400 -- seconds
+local PREFIX = "prefix_name"
+local HALF = 2.5
+local MASK = 31
+local COERCED = 11
+local LABEL = "level 10"
+local SQUARE = 9.0
+
+function check(flag, a, b)
+    if flag then
+        print(a < b, a == true)
+    elseif a ~= b then
+        return a ~= b
+    end
+    while flag do
+        flag = next_flag()
+    end
+    for i = 1, 16 do
+        emit(i, 3, 3)
+    end
+    repeat
+        a = a + 1
+    until done(a)
+    return (compute())
+end
+
+function unchanged(x, ...)
+    -- Errors, unprintable results and locale-dependent comparisons are left alone
+    local bad = 1 // 0, "abc" + 1, 1 / 0, "a" < "b"
+    local y = x == true, - -x, not not x
+    local t = { 1 + 1 }; local u = 2 * 2
+    local s = "-- not a comment!"
+    return x and ...
+end
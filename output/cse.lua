@@ -0,0 +1,76 @@
+-- Test caching repeated pure subexpressions
+
+function pad(name, width)
+    local name_len = string.len(name) -- opt by oLua (cse)
+    if name_len >= width then
+        return name
+    end
+    return name .. string.rep(" ", width - name_len)
+end
+
+function cell(x, y)
+    local x_floor = math.floor(x / 32) -- opt by oLua (cse)
+    local cx = x_floor
+    local cy = math.floor(y / 32)
+    return cx + cy * 64, x_floor * 32
+end
+
+function last(list)
+    local list_len = #list -- opt by oLua (cse)
+    local top = list[list_len]
+    if list_len > 10 then
+        print("long list")
+    end
+    return top, list_len
+end
+
+function push(list, v)
+    -- The append changes #list between the reads
+    local list_len = #list -- opt by oLua (cse)
+    local n = list_len
+    list[list_len + 1] = v
+    return n, #list
+end
+
+function grow(list, v)
+    -- table.insert may change the list
+    print(#list)
+    table.insert(list, v)
+    print(#list)
+end
+
+function guard(s)
+    -- The first read is conditional, evaluating it early may raise an error
+    if s ~= nil and string.len(s) > 0 then
+        print(s)
+    end
+    return string.len(s)
+end
+
+function update(self)
+    -- Writes to a field of the input invalidate the cached length
+    local n = #self.items
+    self.items[n + 1] = 1
+    local self_items_len = #self.items -- opt by oLua (cse)
+    local total = self_items_len + self_items_len
+    return n, total
+end
+
+function random()
+    -- Impure and non-deterministic calls are not cached
+    local a = math.random(10)
+    local b = math.random(10)
+    local a_format = string.format("%d", a) -- opt by oLua (cse)
+    local c = a_format .. a_format
+    return a + b, c
+end
+
+function loop(list)
+    -- The loop does not change the list, the header and the body see the same length
+    local list_len = #list -- opt by oLua (cse)
+    local n = list_len
+    for i = 1, list_len do
+        print(list[i])
+    end
+    return n
+end
@@ -0,0 +1,76 @@
+-- 内联小的 local function
+
+local function clamp(x, lo, hi)
+    return math.max(lo, math.min(hi, x))
+end
+
+local function is_alive(e)
+    return e.hp > 0 and not e.dead
+end
+
+local function reset(e)
+    e.hp = e.max_hp
+    e.dead = false
+end
+
+function update(list, dv)
+    for i = 1, #list do
+        local e = list[i]
+        e.hp = math.max(0, math.min(e.max_hp, e.hp + dv)) -- 限制范围
+        if e.hp > 0 and not e.dead then
+            e.time = e.time + 1
+        else
+            do
+                local reset_e = e
+                reset_e.hp = reset_e.max_hp
+                reset_e.dead = false
+            end
+        end
+    end
+end
+
+function revive(e)
+    do
+        local reset_e_1 = e
+        reset_e_1.hp = reset_e_1.max_hp
+        reset_e_1.dead = false
+    end
+    return e.hp > 0 and not e.dead
+end
+
+-- 不处理：递归
+local function fib(n)
+    return n < 2 and n or fib(n - 1) + fib(n - 2)
+end
+
+-- 不处理：作为值使用
+local function less(a, b)
+    return a < b
+end
+table.sort(items, less)
+print(less(1, 2))
+
+-- 不处理：实参有副作用
+local function twice(x)
+    return x + x
+end
+print(twice(next_id()))
+
+-- 不处理：函数体中有多条 return
+local function sign(x)
+    if x < 0 then
+        return -1
+    end
+    return 1
+end
+print(sign(-3))
+
+-- 不处理：函数体引用的名字在调用处被遮蔽
+local scale = 2
+local function scaled(v)
+    return v * scale
+end
+function f(v)
+    local scale = 3
+    return scaled(v) + scale
+end
@@ -0,0 +1,75 @@
+-- Test converting ipairs loops to numeric for loops
+
+function sum(list)
+    local total = 0
+    for i = 1, #list do
+        local v = list[i]
+        if v == nil then
+            break
+        end
+        total = total + v * i
+    end
+    return total
+end
+
+function names(self)
+    for i = 1, #self.items do -- keep this comment
+        local item = self.items[i]
+        if item == nil then
+            break
+        end
+        print(item.name)
+    end
+end
+
+function count(list)
+    local n = 0
+    for i = 1, #list do
+        if list[i] == nil then
+            break
+        end
+        n = i
+    end
+    return n
+end
+
+function skip(list, other)
+    -- Appending makes ipairs visit the new elements
+    for i, v in ipairs(list) do
+        if v > 0 then
+            list[#list + 1] = -v
+        end
+    end
+    -- table.insert may change the list
+    for _, v in ipairs(list) do
+        table.insert(list, v)
+    end
+    -- Rebinding the list inside the loop
+    for _, v in ipairs(list) do
+        list = other
+    end
+    -- The argument is not a path
+    for _, v in ipairs(get_list()) do
+        print(v)
+    end
+    -- The loop variable shadows the list
+    for list, v in ipairs(list) do
+        print(v)
+    end
+end
+
+function nested(rows)
+    for i = 1, #rows do
+        local row = rows[i]
+        if row == nil then
+            break
+        end
+        for i = 1, #row do
+            local cell = row[i]
+            if cell == nil then
+                break
+            end
+            print(cell)
+        end
+    end
+end
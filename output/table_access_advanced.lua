@@ -34,7 +34,7 @@ function test_method_call_invalidation()
     -- Method call on target invalidates it
     local a_b = a.b -- opt by oLua
     local x = a_b.c
-    a_b:doSomething()  -- a_b is self, written
+    a_b:doSomething()  -- a.b is self, written
     local y = a_b.d
     local z = a_b.e
 end
@@ -87,7 +87,7 @@ function test_func_arg_child()
     local a_b = a.b -- opt by oLua
     local x = a_b.d
     local y = a_b.e
-    func1(a_b.c)       -- invalidates a_b (parent of arg)
+    func1(a_b.c)       -- invalidates a.b (parent of arg)
     local z = a_b.f
     local w = a_b.g
 end
@@ -0,0 +1,38 @@
+-- Test optimization of top-level chunk code executed at require time
+
+local M = {}
+
+-- Reads at load time are cached in a file-level local
+local Config_ui_window_1 = Config.ui.window -- opt by oLua
+local width = Config_ui_window_1.width
+local height = Config_ui_window_1.height
+local title = Config_ui_window_1.title
+
+-- Functions defined in the chunk capture the cached local as an upvalue,
+-- so their bodies must keep reading the live path
+function M.get_width()
+    return Config.ui.window.width
+end
+
+M.on_resize = function(w)
+    Config.ui.window.width = w
+end
+
+-- A later global with the same name as the generated local must not be shadowed
+function M.dump()
+    print(Config_ui_window)
+end
+
+-- Nested blocks at top level are optimized in place
+if Config.debug then
+    local Config_log = Config.log -- opt by oLua
+    print(Config_log.level)
+    print(Config_log.file)
+end
+
+for i = 1, 3 do
+    local Config_items = Config.items -- opt by oLua
+    M.items[i] = Config_items.list[i] + Config_items.base
+end
+
+return M
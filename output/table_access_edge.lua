@@ -45,8 +45,8 @@ end
 
 function test_condition_reads()
     -- Table access in condition
-    if a.b.c then
-        local a_b = a.b -- opt by oLua
+    local a_b = a.b -- opt by oLua
+    if a_b.c then
         local x = a_b.d
         local y = a_b.e
     end
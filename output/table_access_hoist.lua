@@ -0,0 +1,74 @@
+-- Test hoisting loop-invariant table paths out of loops
+
+function sum_width(list, n)
+    local sum = 0
+    for i = 1, n do
+        local cfg_ui_window = cfg.ui.window -- opt by oLua
+        local w = cfg_ui_window.width
+        sum = sum + cfg_ui_window.height * w + list[i]
+    end
+    return sum
+end
+
+function sum_items(cfg)
+    local sum = 0
+    -- The path is read by the loop limit before the first iteration
+    local cfg_ui_items = cfg.ui.items -- opt by oLua
+    for i = 1, #cfg_ui_items do
+        sum = sum + cfg_ui_items[i].width
+    end
+    return sum
+end
+
+function zero_iterations(a, n)
+    -- Only read in the body: a.b may be nil when the loop never runs
+    local s = 0
+    for i = 1, n do
+        local a_b = a.b -- opt by oLua
+        s = s + a_b.c
+        s = s + a_b.d
+    end
+    return s
+end
+
+function Obj:run()
+    -- The condition path is read on entry, the write is to a field below it
+    local self_state_running = self.state.running -- opt by oLua
+    while self_state_running do
+        self.counter.value = self.counter.value + 1
+    end
+end
+
+function guarded(list)
+    for _, v in ipairs(list) do
+        -- Read behind a condition: not hoisted, cached in the body
+        local opts_debug = opts.debug -- opt by oLua
+        if opts_debug then
+            print(opts_debug.level, v)
+        end
+    end
+end
+
+function invalidated(list)
+    for _, v in ipairs(list) do
+        v.x = M.conf.scale * v.x
+        M.conf = nil
+    end
+end
+
+function closures(list)
+    local fns = {}
+    for i = 1, #list do
+        fns[i] = function() return G.handler.name end
+        print(G.handler.name)
+    end
+    return fns
+end
+
+function repeated(queue)
+    -- The condition is evaluated after the body: not hoisted
+    repeat
+        local item = queue.items.first
+        process(item)
+    until queue.items.first == nil
+end
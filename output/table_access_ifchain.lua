@@ -0,0 +1,54 @@
+-- Test treating an if/elseif chain as one region
+
+function test_chain_reads(a)
+    -- Every condition and branch reads a.b
+    local a_b = a.b -- opt by oLua
+    if a_b.kind == 1 then
+        print(a_b.x)
+    elseif a_b.tag == 2 then
+        print(a_b.y)
+    else
+        print(a_b.z)
+    end
+end
+
+function test_branch_reads(a, t)
+    -- Only the branches read a.b, the first condition may guard it
+    if t == 1 then
+        print(a.b.x)
+    elseif t == 2 then
+        print(a.b.y)
+    end
+end
+
+function test_guarded_chain(t)
+    -- The first condition guards the reads in the elseif
+    if t == nil then
+        return "none"
+    elseif t.b.kind == 1 then
+        return t.b.name
+    end
+    return "other"
+end
+
+function test_single_branch(a, t)
+    -- Only one branch reads a.b, it is cached inside the branch
+    if t == 1 then
+        local a_b = a.b -- opt by oLua
+        print(a_b.x)
+        print(a_b.y)
+    elseif t == 2 then
+        print(t)
+    end
+end
+
+function test_branch_write(a, t)
+    -- A branch writes a.b, the chain is not cached
+    if t == 1 then
+        print(a.b.x)
+    elseif t == 2 then
+        a.b = {}
+    else
+        print(a.b.y)
+    end
+end
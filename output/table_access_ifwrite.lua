@@ -7,8 +7,8 @@ function test_if_child_write()
     local x = a_b.c
     local y = a_b.d
     if cond then
-        a_b.e = 100  -- writes a_b.e, but NOT a_b itself
-        a_b.f = 200  -- writes a_b.f, but NOT a_b itself
+        a_b.e = 100  -- writes a.b.e, but NOT a.b itself
+        a_b.f = 200  -- writes a.b.f, but NOT a.b itself
     end
     local z = a_b.g
     local w = a_b.h
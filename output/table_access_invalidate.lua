@@ -30,7 +30,7 @@ function test_pass_target_table_no_invalidate()
     local x = a_b.c
     local y = a_b.d
     func1(a_b)
-    local z = a_b.e  -- a_b 缓存应仍有效
+    local z = a_b.e  -- a.b 缓存应仍有效
     local w = a_b.f
 end
 
@@ -52,7 +52,7 @@ function test_method_on_target_no_invalidate()
     local x = a_b.c
     local y = a_b.d
     a_b:method()
-    local z = a_b.e  -- a_b 缓存应仍有效
+    local z = a_b.e  -- a.b 缓存应仍有效
     local w = a_b.f
 end
 
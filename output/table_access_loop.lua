@@ -16,7 +16,7 @@ function test_for_with_method_in_body()
         local a_b = a.b -- opt by oLua
         local x = a_b.c
         local y = a_b.d
-        a_b:update()       -- invalidates a_b
+        a_b:update()       -- invalidates a.b
         local z = a_b.e
         local w = a_b.f
     end
@@ -10,7 +10,8 @@ function test()
 
         local b = 4
 
-        local a = {a=1, 2, b={}, c=3, [3]=4, [b]=5, d={e=6,f=7,[1]=8}, e=os.time() or 0, f={1,2,3}, g='str'..' '..i, h=(2+3)*2-1, i=tmp()} -- opt by oLua
+        local a = {a = 1, 2, b = {}, c = 3, [3] = 4, [b] = 5, d = {e = 6, f = 7, [1] = 8}, e = os.time() or 0, f = {1, 2, 3}, g = "str" .. " " .. i, h = (2 + 3) * 2 - 1} -- opt by oLua (table_constructor 2)
+        a.i = tmp()
         a.b.c = 9
 
     end
@@ -0,0 +1,45 @@
+-- Test stopping constructor merging at values with side effects
+
+function test_reads_table()
+    local t = {a = 1} -- opt by oLua (table_constructor 0)
+    t.b = t.a + 1
+    return t
+end
+
+function test_impure_call()
+    local t = {a = math.floor(1.5)} -- opt by oLua (table_constructor 0)
+    t.b = load_config()
+    t.c = 3
+    return t
+end
+
+function test_local_between()
+    local t = {a = 1} -- opt by oLua (table_constructor 0)
+    local n = compute()
+    t.b = n
+    return t
+end
+
+function test_pure_values(x)
+    local t = {a = tostring(x), b = string.format("%d", x)} -- opt by oLua (table_constructor 0)
+    return t
+end
+
+function test_key_reads()
+    local t = {a = 1} -- opt by oLua (table_constructor 0)
+    t[t] = 2
+    return t
+end
+
+function test_key_local_between()
+    local t = {a = 1} -- opt by oLua (table_constructor 0)
+    local k = next_key()
+    t[k] = 2
+    return t
+end
+
+function test_key_call()
+    local t = {a = 1} -- opt by oLua (table_constructor 0)
+    t[next_id()] = 2
+    return t
+end
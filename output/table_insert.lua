@@ -0,0 +1,49 @@
+-- table.insert(t, v) 改写为索引赋值
+
+function collect_ids(list)
+    local ids = {}
+    for _, item in ipairs(list) do
+        ids[#ids + 1] = item.id -- 收集 id
+    end
+    return ids
+end
+
+function build_row(self, a, b)
+    self.cells[#self.cells + 1] = tostring(a)
+    self.cells[#self.cells + 1] = tostring(b)
+    self.cells[#self.cells + 1] = a + b
+    self.dirty = true
+end
+
+local tinsert = table.insert
+
+function collect_names(list, out)
+    for i = 1, #list do
+        out[#out + 1] = list[i].name
+    end
+end
+
+-- 不改写：三个参数
+function push_front(t, v)
+    table.insert(t, 1, v)
+end
+
+-- 不改写：值中调用了可能修改 t 的函数
+function push_next(t, iter)
+    table.insert(t, iter())
+end
+
+-- 不改写：值可能返回多个值
+function push_find(t, s)
+    table.insert(t, string.find(s, "x"))
+end
+
+-- 不改写：t 不是简单路径
+function push_dynamic(t, k, v)
+    table.insert(t[k], v)
+end
+
+-- 不改写：同一行有多条语句
+function push_two(t, a, b)
+    table.insert(t, a); table.insert(t, b)
+end
@@ -0,0 +1,47 @@
+-- 为能静态确定大小的空表预分配
+
+function squares()
+    local t = {}
+    for i = 1, 100 do
+        t[i] = i * i
+    end
+    return t
+end
+
+function pairs_of(a, b)
+    local list = {nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil} -- 结果 -- opt by oLua (table_prealloc)
+    for i = 1, 10 do
+        list[#list + 1] = a
+        list[#list + 1] = b
+    end
+    return list
+end
+
+function make_point(x, y)
+    local p = {x = nil, y = nil, len = nil} -- opt by oLua (table_prealloc)
+    p.x = x
+    p.y = y
+    p.len = math.sqrt(x * x + y * y)
+    return p
+end
+
+-- 不处理：上限不是常量
+function fill(n)
+    local t = {}
+    for i = 1, n do
+        t[i] = 0
+    end
+    return t
+end
+
+-- 不处理：只有一个字段
+function single(v)
+    local t = {}
+    t.v = v
+    return t
+end
+
+local cache = {nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil} -- opt by oLua (table_prealloc)
+for i = 1, 16 do
+    cache[i] = false
+end
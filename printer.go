@@ -0,0 +1,543 @@
+package olua
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/milochristiansen/lua/ast"
+)
+
+// ============================================================================
+// Lua 源码打印
+// 把 milochristiansen/lua/ast 节点还原为等价的 Lua 源码。
+// 注意：AST 不保留注释和原始排版，因此只用于打印被改写的语句。
+// ============================================================================
+
+// printIndent 是打印嵌套代码块时每一级的缩进。
+const printIndent = "    "
+
+// luaKeywords 是 Lua 保留字，不能作为 a.b 形式的字段名。
+var luaKeywords = map[string]bool{
+	"and": true, "break": true, "do": true, "else": true, "elseif": true,
+	"end": true, "false": true, "for": true, "function": true, "goto": true,
+	"if": true, "in": true, "local": true, "nil": true, "not": true,
+	"or": true, "repeat": true, "return": true, "then": true, "true": true,
+	"until": true, "while": true,
+}
+
+// binaryPriority 返回二元运算符的左右优先级，与 ast 包的解析优先级一致。
+// right < left 表示右结合。
+func binaryPriority(op ast.Operator) (int, int) {
+	switch op.Op {
+	case ast.OpOr:
+		return 1, 1
+	case ast.OpAnd:
+		return 2, 2
+	case ast.OpEqual, ast.OpNotEqual, ast.OpLessThan, ast.OpGreaterThan, ast.OpLessOrEqual, ast.OpGreaterOrEqual:
+		return 3, 3
+	case ast.OpBinOR:
+		return 4, 4
+	case ast.OpBinXOR:
+		return 5, 5
+	case ast.OpBinAND:
+		return 6, 6
+	case ast.OpBinShiftL, ast.OpBinShiftR:
+		return 7, 7
+	case ast.OpConcat:
+		return 9, 8
+	case ast.OpAdd, ast.OpSub:
+		return 10, 10
+	case ast.OpMul, ast.OpDiv, ast.OpIDiv, ast.OpMod:
+		return 11, 11
+	case ast.OpPow:
+		return 14, 13
+	}
+	return 12, 12
+}
+
+// unaryPriority 是一元运算符的优先级。
+const unaryPriority = 12
+
+// isUnaryOp 判断运算符是否是一元运算符（操作数在 Right 中）。
+func isUnaryOp(op ast.Operator) bool {
+	switch op.Op {
+	case ast.OpUMinus, ast.OpBinNot, ast.OpNot, ast.OpLength:
+		return true
+	}
+	return false
+}
+
+// opSymbol 返回运算符的源码写法。
+func opSymbol(op ast.Operator) string {
+	switch op.Op {
+	case ast.OpAdd:
+		return "+"
+	case ast.OpSub, ast.OpUMinus:
+		return "-"
+	case ast.OpMul:
+		return "*"
+	case ast.OpMod:
+		return "%"
+	case ast.OpPow:
+		return "^"
+	case ast.OpDiv:
+		return "/"
+	case ast.OpIDiv:
+		return "//"
+	case ast.OpBinAND:
+		return "&"
+	case ast.OpBinOR:
+		return "|"
+	case ast.OpBinXOR, ast.OpBinNot:
+		return "~"
+	case ast.OpBinShiftL:
+		return "<<"
+	case ast.OpBinShiftR:
+		return ">>"
+	case ast.OpNot:
+		return "not"
+	case ast.OpLength:
+		return "#"
+	case ast.OpConcat:
+		return ".."
+	case ast.OpEqual:
+		return "=="
+	case ast.OpNotEqual:
+		return "~="
+	case ast.OpLessThan:
+		return "<"
+	case ast.OpGreaterThan:
+		return ">"
+	case ast.OpLessOrEqual:
+		return "<="
+	case ast.OpGreaterOrEqual:
+		return ">="
+	case ast.OpAnd:
+		return "and"
+	case ast.OpOr:
+		return "or"
+	}
+	return "?"
+}
+
+// exprPriority 返回表达式作为运算符操作数时的左右优先级，非运算符表达式视为最高。
+func exprPriority(expr ast.Expr) (int, int) {
+	op, ok := expr.(*ast.Operator)
+	if !ok {
+		return 100, 100
+	}
+	if isUnaryOp(*op) {
+		return unaryPriority, unaryPriority
+	}
+	return binaryPriority(*op)
+}
+
+// isLuaName 判断 s 是否是合法的 Lua 标识符（且不是保留字）。
+func isLuaName(s string) bool {
+	if s == "" || luaKeywords[s] {
+		return false
+	}
+	for i, c := range s {
+		if c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') {
+			continue
+		}
+		if i > 0 && c >= '0' && c <= '9' {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// quoteLuaString 把字符串值转换为带双引号的 Lua 字符串字面量。
+// 控制字符使用三位十进制转义，避免与后面的数字连在一起被误读。
+func quoteLuaString(s string) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case '"':
+			sb.WriteString("\\\"")
+		case '\\':
+			sb.WriteString("\\\\")
+		case '\n':
+			sb.WriteString("\\n")
+		case '\r':
+			sb.WriteString("\\r")
+		case '\t':
+			sb.WriteString("\\t")
+		case '\a':
+			sb.WriteString("\\a")
+		case '\b':
+			sb.WriteString("\\b")
+		case '\f':
+			sb.WriteString("\\f")
+		case '\v':
+			sb.WriteString("\\v")
+		default:
+			if c < 0x20 || c == 0x7f {
+				sb.WriteString("\\")
+				num := strconv.Itoa(int(c))
+				sb.WriteString(strings.Repeat("0", 3-len(num)) + num)
+			} else {
+				sb.WriteByte(c)
+			}
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+// luaPrinter 把语句和表达式打印为按行组织的 Lua 源码。
+type luaPrinter struct {
+	lines  []string
+	indent string
+	cur    strings.Builder
+}
+
+// expr_to_string 把表达式打印为 Lua 源码。
+// 包含函数体的表达式会打印为多行。
+func expr_to_string(expr ast.Expr) string {
+	p := &luaPrinter{}
+	p.expr(expr)
+	return strings.Join(p.finish(), "\n")
+}
+
+// stmt_to_lines 以 indent 为基础缩进把语句打印为源码行。
+func stmt_to_lines(stmt ast.Stmt, indent string) []string {
+	p := &luaPrinter{indent: indent}
+	p.stmt(stmt)
+	return p.finish()
+}
+
+// block_to_lines 以 indent 为基础缩进把代码块打印为源码行。
+func block_to_lines(block []ast.Stmt, indent string) []string {
+	p := &luaPrinter{indent: indent}
+	for _, stmt := range block {
+		p.stmt(stmt)
+	}
+	return p.finish()
+}
+
+func (p *luaPrinter) write(s string) {
+	if p.cur.Len() == 0 {
+		p.cur.WriteString(p.indent)
+	}
+	p.cur.WriteString(s)
+}
+
+func (p *luaPrinter) newline() {
+	if p.cur.Len() > 0 {
+		p.lines = append(p.lines, p.cur.String())
+		p.cur.Reset()
+	}
+}
+
+func (p *luaPrinter) finish() []string {
+	p.newline()
+	return p.lines
+}
+
+// block 打印缩进一级的代码块。
+func (p *luaPrinter) block(block []ast.Stmt) {
+	p.newline()
+	old := p.indent
+	p.indent += printIndent
+	for _, stmt := range block {
+		p.stmt(stmt)
+	}
+	p.indent = old
+}
+
+func (p *luaPrinter) stmt(stmt ast.Stmt) {
+	switch s := stmt.(type) {
+	case *ast.Assign:
+		p.assign(s)
+	case *ast.FuncCall:
+		p.expr(s)
+	case *ast.DoBlock:
+		if s.Block == nil {
+			// 解析器把单独的 ';' 表示为空 DoBlock，无需打印
+			return
+		}
+		p.write("do")
+		p.block(s.Block)
+		p.write("end")
+	case *ast.If:
+		p.write("if ")
+		p.expr(s.Cond)
+		p.write(" then")
+		p.block(s.Then)
+		for len(s.Else) == 1 {
+			elseif, ok := s.Else[0].(*ast.If)
+			if !ok {
+				break
+			}
+			p.write("elseif ")
+			p.expr(elseif.Cond)
+			p.write(" then")
+			p.block(elseif.Then)
+			s = elseif
+		}
+		if len(s.Else) > 0 {
+			p.write("else")
+			p.block(s.Else)
+		}
+		p.write("end")
+	case *ast.WhileLoop:
+		p.write("while ")
+		p.expr(s.Cond)
+		p.write(" do")
+		p.block(s.Block)
+		p.write("end")
+	case *ast.RepeatUntilLoop:
+		p.write("repeat")
+		p.block(s.Block)
+		p.write("until ")
+		p.expr(s.Cond)
+	case *ast.ForLoopNumeric:
+		p.write("for " + s.Counter + " = ")
+		p.expr(s.Init)
+		p.write(", ")
+		p.expr(s.Limit)
+		if step, ok := s.Step.(*ast.ConstInt); !ok || step.Value != "1" {
+			p.write(", ")
+			p.expr(s.Step)
+		}
+		p.write(" do")
+		p.block(s.Block)
+		p.write("end")
+	case *ast.ForLoopGeneric:
+		p.write("for " + strings.Join(s.Locals, ", ") + " in ")
+		p.exprList(s.Init)
+		p.write(" do")
+		p.block(s.Block)
+		p.write("end")
+	case *ast.Goto:
+		if s.IsBreak {
+			p.write(s.Label)
+		} else {
+			p.write("goto " + s.Label)
+		}
+	case *ast.Label:
+		p.write("::" + s.Label + "::")
+	case *ast.Return:
+		p.write("return")
+		if len(s.Items) > 0 {
+			p.write(" ")
+			p.exprList(s.Items)
+		}
+	}
+	p.newline()
+}
+
+func (p *luaPrinter) assign(s *ast.Assign) {
+	// 函数声明语法糖：local function f() / function a.b:c()
+	if len(s.Targets) == 1 && len(s.Values) == 1 {
+		if fn, ok := s.Values[0].(*ast.FuncDecl); ok {
+			if s.LocalFunc {
+				p.write("local function ")
+				p.expr(s.Targets[0])
+				p.funcBody(fn.Params, fn.IsVariadic, fn.Block)
+				return
+			}
+			if !s.LocalDecl {
+				if name, params, ok := funcDeclName(s.Targets[0], fn.Params); ok {
+					p.write("function " + name)
+					p.funcBody(params, fn.IsVariadic, fn.Block)
+					return
+				}
+			}
+		}
+	}
+
+	if s.LocalDecl {
+		p.write("local ")
+	}
+	p.exprList(s.Targets)
+	if len(s.Values) > 0 {
+		p.write(" = ")
+		p.exprList(s.Values)
+	}
+}
+
+// funcDeclName 尝试把赋值目标还原为 function 语句的函数名。
+// 形如 a.b.c 且第一个参数为 self 时还原为 a.b:c 形式。
+func funcDeclName(target ast.Expr, params []string) (string, []string, bool) {
+	path, ok := getExprPath(target)
+	if !ok {
+		return "", nil, false
+	}
+	parts := strings.Split(path, ".")
+	for _, part := range parts {
+		if !isLuaName(part) {
+			return "", nil, false
+		}
+	}
+	if len(parts) > 1 && len(params) > 0 && params[0] == "self" {
+		return strings.Join(parts[:len(parts)-1], ".") + ":" + parts[len(parts)-1], params[1:], true
+	}
+	return path, params, true
+}
+
+func (p *luaPrinter) funcBody(params []string, variadic bool, block []ast.Stmt) {
+	all := append([]string{}, params...)
+	if variadic {
+		all = append(all, "...")
+	}
+	p.write("(" + strings.Join(all, ", ") + ")")
+	p.block(block)
+	p.write("end")
+}
+
+func (p *luaPrinter) exprList(exprs []ast.Expr) {
+	for i, e := range exprs {
+		if i > 0 {
+			p.write(", ")
+		}
+		p.expr(e)
+	}
+}
+
+// prefixExpr 打印用作调用/索引前缀的表达式，必要时加括号。
+func (p *luaPrinter) prefixExpr(expr ast.Expr) {
+	switch expr.(type) {
+	case *ast.ConstIdent, *ast.TableAccessor, *ast.FuncCall, *ast.Parens:
+		p.expr(expr)
+	default:
+		p.write("(")
+		p.expr(expr)
+		p.write(")")
+	}
+}
+
+// operand 打印运算符的操作数，优先级不足时加括号。
+func (p *luaPrinter) operand(expr ast.Expr, needParens bool) {
+	if needParens {
+		p.write("(")
+		p.expr(expr)
+		p.write(")")
+		return
+	}
+	p.expr(expr)
+}
+
+func (p *luaPrinter) expr(expr ast.Expr) {
+	switch e := expr.(type) {
+	case nil:
+		p.write("nil")
+	case *ast.ConstIdent:
+		p.write(e.Value)
+	case *ast.ConstString:
+		p.write(quoteLuaString(e.Value))
+	case *ast.ConstInt:
+		p.write(e.Value)
+	case *ast.ConstFloat:
+		p.write(e.Value)
+	case *ast.ConstNil:
+		p.write("nil")
+	case *ast.ConstBool:
+		if e.Value {
+			p.write("true")
+		} else {
+			p.write("false")
+		}
+	case *ast.ConstVariadic:
+		p.write("...")
+	case *ast.Parens:
+		p.write("(")
+		p.expr(e.Inner)
+		p.write(")")
+	case *ast.TableAccessor:
+		p.prefixExpr(e.Obj)
+		if key, ok := e.Key.(*ast.ConstString); ok && isLuaName(key.Value) {
+			p.write("." + key.Value)
+		} else {
+			p.write("[")
+			p.expr(e.Key)
+			p.write("]")
+		}
+	case *ast.FuncCall:
+		if e.Receiver != nil {
+			p.prefixExpr(e.Receiver)
+			p.write(":")
+			switch fn := e.Function.(type) {
+			case *ast.ConstString:
+				p.write(fn.Value)
+			case *ast.ConstIdent:
+				p.write(fn.Value)
+			}
+		} else {
+			p.prefixExpr(e.Function)
+		}
+		p.write("(")
+		p.exprList(e.Args)
+		p.write(")")
+	case *ast.FuncDecl:
+		p.write("function")
+		p.funcBody(e.Params, e.IsVariadic, e.Block)
+	case *ast.TableConstructor:
+		p.write("{")
+		for i, key := range e.Keys {
+			if i > 0 {
+				p.write(", ")
+			}
+			if key != nil {
+				if str, ok := key.(*ast.ConstString); ok && isLuaName(str.Value) {
+					p.write(str.Value)
+				} else {
+					p.write("[")
+					p.expr(key)
+					p.write("]")
+				}
+				p.write(" = ")
+			}
+			p.expr(e.Vals[i])
+		}
+		p.write("}")
+	case *ast.Operator:
+		if isUnaryOp(*e) {
+			p.write(opSymbol(*e))
+			_, rp := exprPriority(e.Right)
+			needParens := rp < unaryPriority && !isUnaryExpr(e.Right)
+			if e.Op == ast.OpNot || (!needParens && e.Op == ast.OpUMinus && strings.HasPrefix(expr_to_string(e.Right), "-")) {
+				// not 后必须有空格；"- -x" 不能写成注释 "--x"
+				p.write(" ")
+			}
+			p.operand(e.Right, needParens)
+			return
+		}
+		left, right := binaryPriority(*e)
+		// 左操作数：其右优先级低于本运算符左优先级时，会被解析为吞掉本运算符
+		_, lr := exprPriority(e.Left)
+		p.operand(e.Left, lr < left)
+		p.write(" " + opSymbol(*e) + " ")
+		// 右操作数：一元表达式无需括号；二元表达式左优先级不高于本运算符右优先级时需要括号
+		rl, _ := exprPriority(e.Right)
+		p.operand(e.Right, !isUnaryExpr(e.Right) && rl <= right)
+	}
+}
+
+// isUnaryExpr 判断表达式是否是一元运算表达式。
+func isUnaryExpr(expr ast.Expr) bool {
+	op, ok := expr.(*ast.Operator)
+	return ok && isUnaryOp(*op)
+}
+
+// can_expr_to_string 判断表达式是否可以安全地移动到一行中重新打印。
+// 函数体可能包含注释，重新打印会丢失，因此不参与改写。
+func can_expr_to_string(expr ast.Expr) bool {
+	if expr == nil {
+		return false
+	}
+	ret := true
+	f := lua_visitor{f: func(n ast.Node, ok *bool) {
+		if _, isFunc := n.(*ast.FuncDecl); isFunc {
+			ret = false
+			*ok = false
+		}
+	}}
+	ast.Walk(&f, expr)
+	return ret
+}
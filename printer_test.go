@@ -0,0 +1,178 @@
+package olua
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/milochristiansen/lua/ast"
+)
+
+// ============================================================================
+// 单元测试：表达式打印
+// ============================================================================
+
+func ident(name string) ast.Expr {
+	return &ast.ConstIdent{Value: name}
+}
+
+func binop(op ast.Operator, left, right ast.Expr) ast.Expr {
+	op.Left = left
+	op.Right = right
+	return &op
+}
+
+func unop(op ast.Operator, operand ast.Expr) ast.Expr {
+	op.Right = operand
+	return &op
+}
+
+func TestExprToStringPrecedence(t *testing.T) {
+	add := ast.Operator{Op: ast.OpAdd}
+	sub := ast.Operator{Op: ast.OpSub}
+	mul := ast.Operator{Op: ast.OpMul}
+	pow := ast.Operator{Op: ast.OpPow}
+	concat := ast.Operator{Op: ast.OpConcat}
+	neg := ast.Operator{Op: ast.OpUMinus}
+	not := ast.Operator{Op: ast.OpNot}
+	and := ast.Operator{Op: ast.OpAnd}
+	or := ast.Operator{Op: ast.OpOr}
+
+	tests := []struct {
+		expr ast.Expr
+		want string
+	}{
+		{binop(mul, binop(add, ident("a"), ident("b")), ident("c")), "(a + b) * c"},
+		{binop(add, ident("a"), binop(mul, ident("b"), ident("c"))), "a + b * c"},
+		{binop(sub, ident("a"), binop(sub, ident("b"), ident("c"))), "a - (b - c)"},
+		{binop(sub, binop(sub, ident("a"), ident("b")), ident("c")), "a - b - c"},
+		{binop(pow, ident("a"), binop(pow, ident("b"), ident("c"))), "a ^ b ^ c"},
+		{binop(pow, binop(pow, ident("a"), ident("b")), ident("c")), "(a ^ b) ^ c"},
+		{binop(concat, ident("a"), binop(concat, ident("b"), ident("c"))), "a .. b .. c"},
+		{binop(concat, binop(concat, ident("a"), ident("b")), ident("c")), "(a .. b) .. c"},
+		{unop(neg, binop(pow, ident("x"), ident("y"))), "-x ^ y"},
+		{binop(pow, unop(neg, ident("x")), ident("y")), "(-x) ^ y"},
+		{binop(pow, ident("x"), unop(neg, ident("y"))), "x ^ -y"},
+		{unop(neg, unop(neg, ident("x"))), "- -x"},
+		{unop(not, unop(not, ident("x"))), "not not x"},
+		{unop(not, binop(and, ident("a"), ident("b"))), "not (a and b)"},
+		{binop(and, binop(or, ident("a"), ident("b")), ident("c")), "(a or b) and c"},
+		{binop(ast.Operator{Op: ast.OpDiv}, ident("a"), ident("b")), "a / b"},
+		{binop(ast.Operator{Op: ast.OpIDiv}, ident("a"), ident("b")), "a // b"},
+		{unop(ast.Operator{Op: ast.OpLength}, ident("t")), "#t"},
+	}
+	for _, tt := range tests {
+		got := expr_to_string(tt.expr)
+		if got != tt.want {
+			t.Errorf("expr_to_string = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestExprToStringLiterals(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{`x = "a\"b\\c"`, `"a\"b\\c"`},
+		{`x = 'it\'s'`, `"it's"`},
+		{`x = "tab\tnl\n"`, `"tab\tnl\n"`},
+		{`x = "a\0b"`, `"a\000b"`},
+		{`x = "\x7f"`, `"\127"`},
+		{`x = [[raw "str"]]`, `"raw \"str\""`},
+		{`x = 0x10`, `0x10`},
+		{`x = 1e5`, `1e5`},
+		{`x = 3.0`, `3.0`},
+		{`x = t["end"]`, `t["end"]`},
+		{`x = t["a b"].c[1]`, `t["a b"].c[1]`},
+		{`x = ("s"):rep(2)`, `("s"):rep(2)`},
+		{`x = {1, k = 2, ["x y"] = 3, [4] = 5}`, `{1, k = 2, ["x y"] = 3, [4] = 5}`},
+		{`x = f{1}`, `f({1})`},
+		{`x = f"s"`, `f("s")`},
+		{`x = function(a, ...) return ... end`, "function(a, ...)\n    return ...\nend"},
+	}
+	for _, tt := range tests {
+		block, err := parseSource(tt.src)
+		if err != nil {
+			t.Fatalf("parse %q: %v", tt.src, err)
+		}
+		got := expr_to_string(block[0].(*ast.Assign).Values[0])
+		if got != tt.want {
+			t.Errorf("expr_to_string(%s) = %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
+
+// ============================================================================
+// 单元测试：语句打印
+// ============================================================================
+
+func TestBlockToLinesRoundTrip(t *testing.T) {
+	src := `local a, b = 1
+local function f(x, ...)
+    if x > 1 then
+        return x
+    elseif x < 0 then
+        return -x
+    else
+        return
+    end
+end
+function M.g(y)
+    while y do
+        y = y - 1
+    end
+    repeat
+        y = y + 1
+    until y > 10
+end
+function M:h()
+    for i = 10, 1, -1 do
+        break
+    end
+    for k, v in pairs(self) do
+        print(k, v)
+    end
+    do
+        goto done
+    end
+    ::done::
+end
+t.x, t.y = f(1), "s"
+`
+	block, err := parseSource(src)
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	got := strings.Join(block_to_lines(block, ""), "\n") + "\n"
+	if got != src {
+		t.Errorf("block_to_lines round trip:\n%s\nwant:\n%s", got, src)
+	}
+}
+
+func TestStmtToLinesIndent(t *testing.T) {
+	block, err := parseSource("if a then b() end")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	got := stmt_to_lines(block[0], "  ")
+	want := []string{"  if a then", "      b()", "  end"}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("stmt_to_lines = %q, want %q", got, want)
+	}
+}
+
+func TestCanExprToString(t *testing.T) {
+	block, err := parseSource("x = {f = function() end}\ny = a.b + 1\n")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	if can_expr_to_string(block[0].(*ast.Assign).Values[0]) {
+		t.Error("can_expr_to_string should reject expressions containing function bodies")
+	}
+	if !can_expr_to_string(block[1].(*ast.Assign).Values[0]) {
+		t.Error("can_expr_to_string(a.b + 1) = false, want true")
+	}
+	if can_expr_to_string(nil) {
+		t.Error("can_expr_to_string(nil) = true, want false")
+	}
+}
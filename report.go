@@ -0,0 +1,167 @@
+package olua
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+)
+
+// ============================================================================
+// 机器可读的优化报告（JSON 和 SARIF）
+// ============================================================================
+
+// reportEntry 是 JSON 报告中的一条改写记录。
+type reportEntry struct {
+	File string `json:"file"`
+	Rewrite
+}
+
+// skipEntry 是 JSON 报告中的一条跳过记录。
+type skipEntry struct {
+	File string `json:"file"`
+	Skip
+}
+
+// jsonReport 是 JSON 报告的顶层结构。
+type jsonReport struct {
+	Files    int           `json:"files"`
+	OptCount int           `json:"opt_count"`
+	Rewrites []reportEntry `json:"rewrites"`
+	Skipped  []skipEntry   `json:"skipped,omitempty"`
+}
+
+// WriteJSONReport 把多个文件的报告写成一个 JSON 文档，
+// 每条改写记录包含文件名、优化名、原始行范围、目标、生成的局部变量名、
+// 读组大小和替换次数。被跳过的候选及原因记录在 skipped 中。
+func WriteJSONReport(w io.Writer, reports []Report) error {
+	r := jsonReport{Files: len(reports), Rewrites: []reportEntry{}}
+	for _, report := range reports {
+		r.OptCount += report.OptCount
+		for _, rw := range report.Rewrites {
+			r.Rewrites = append(r.Rewrites, reportEntry{File: report.Filename, Rewrite: rw})
+		}
+		for _, skip := range report.Skipped {
+			r.Skipped = append(r.Skipped, skipEntry{File: report.Filename, Skip: skip})
+		}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// passDescriptions 是 SARIF 规则的说明
+var passDescriptions = map[string]string{
+	"table_access":      "Cache repeated table path reads in a local variable",
+	"table_constructor": "Merge field assignments into the table constructor",
+	"localize":          "Cache frequently used globals and standard library functions in locals",
+	"method_cache":      "Hoist method lookups of obj:method() calls out of loops",
+	"const_fold":        "Fold constant expressions and simplify boolean expressions",
+	"concat_buffer":     "Replace string concatenation in loops with a table.concat buffer",
+	"table_insert":      "Replace table.insert(t, v) with t[#t + 1] = v",
+	"table_prealloc":    "Preallocate tables whose size is known statically",
+	"dead_code":         "Remove unused locals and assignments overwritten before being read",
+	"inline":            "Inline calls to small non-recursive local functions",
+	"cse":               "Cache repeated pure calls and length expressions in a local",
+	"ipairs":            "Convert ipairs loops to numeric for loops",
+}
+
+// WriteSARIFReport 把多个文件的报告写成 SARIF 2.1.0 文档，供代码扫描界面展示。
+// 每条改写对应一个 note 级别的结果，规则 id 为优化名。
+func WriteSARIFReport(w io.Writer, reports []Report) error {
+	type sarifMessage struct {
+		Text string `json:"text"`
+	}
+	type sarifRule struct {
+		ID               string       `json:"id"`
+		ShortDescription sarifMessage `json:"shortDescription"`
+	}
+	type sarifRegion struct {
+		StartLine int `json:"startLine"`
+		EndLine   int `json:"endLine"`
+	}
+	type sarifArtifact struct {
+		URI string `json:"uri"`
+	}
+	type sarifPhysicalLocation struct {
+		ArtifactLocation sarifArtifact `json:"artifactLocation"`
+		Region           sarifRegion   `json:"region"`
+	}
+	type sarifLocation struct {
+		PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+	}
+	type sarifResult struct {
+		RuleID     string                 `json:"ruleId"`
+		Level      string                 `json:"level"`
+		Message    sarifMessage           `json:"message"`
+		Locations  []sarifLocation        `json:"locations"`
+		Properties map[string]interface{} `json:"properties"`
+	}
+	type sarifDriver struct {
+		Name           string      `json:"name"`
+		InformationURI string      `json:"informationUri"`
+		Rules          []sarifRule `json:"rules"`
+	}
+	type sarifTool struct {
+		Driver sarifDriver `json:"driver"`
+	}
+	type sarifRun struct {
+		Tool    sarifTool     `json:"tool"`
+		Results []sarifResult `json:"results"`
+	}
+	type sarifLog struct {
+		Schema  string     `json:"$schema"`
+		Version string     `json:"version"`
+		Runs    []sarifRun `json:"runs"`
+	}
+
+	passes := map[string]bool{}
+	results := []sarifResult{}
+	for _, report := range reports {
+		for _, rw := range report.Rewrites {
+			passes[rw.Pass] = true
+			text := fmt.Sprintf("%s: %s", rw.Pass, rw.Target)
+			if rw.Local != "" {
+				text += " cached in local " + rw.Local
+			}
+			results = append(results, sarifResult{
+				RuleID:  rw.Pass,
+				Level:   "note",
+				Message: sarifMessage{Text: text},
+				Locations: []sarifLocation{{PhysicalLocation: sarifPhysicalLocation{
+					ArtifactLocation: sarifArtifact{URI: filepath.ToSlash(report.Filename)},
+					Region:           sarifRegion{StartLine: rw.Line, EndLine: rw.EndLine},
+				}}},
+				Properties: map[string]interface{}{
+					"target":     rw.Target,
+					"local":      rw.Local,
+					"group_size": rw.GroupSize,
+					"replaced":   rw.Replaced,
+				},
+			})
+		}
+	}
+
+	var ids []string
+	for pass := range passes {
+		ids = append(ids, pass)
+	}
+	sort.Strings(ids)
+	rules := []sarifRule{}
+	for _, id := range ids {
+		rules = append(rules, sarifRule{ID: id, ShortDescription: sarifMessage{Text: passDescriptions[id]}})
+	}
+
+	log := sarifLog{
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Version: "2.1.0",
+		Runs: []sarifRun{{
+			Tool:    sarifTool{Driver: sarifDriver{Name: "oLua", InformationURI: "https://github.com/esrrhs/oLua", Rules: rules}},
+			Results: results,
+		}},
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(log)
+}
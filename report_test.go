@@ -0,0 +1,154 @@
+package olua
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+// ============================================================================
+// 报告输出测试
+// ============================================================================
+
+const reportSource = `function f()
+    print("x")
+    local x = a.b.c + a.b.e
+    local y = a.b.d
+end
+
+function g()
+    local t = {}
+    t.x = 1
+    t.y = 2
+end
+`
+
+func optimizeReportSource(t *testing.T) Report {
+	t.Helper()
+	opts := tableAccessOptions()
+	opts.TableConstructor = true
+	opts.Filename = "dir/r.lua"
+	_, report, err := Optimize([]byte(reportSource), opts)
+	if err != nil {
+		t.Fatalf("Optimize failed: %v", err)
+	}
+	return report
+}
+
+func TestReportRewriteDetails(t *testing.T) {
+	report := optimizeReportSource(t)
+	want := map[string]Rewrite{
+		"table_access":      {Pass: "table_access", Line: 3, EndLine: 4, Target: "a.b", Local: "a_b", GroupSize: 3, Replaced: 3},
+		"table_constructor": {Pass: "table_constructor", Line: 8, EndLine: 10, Target: "t", GroupSize: 2, Replaced: 2},
+	}
+	if len(report.Rewrites) != len(want) {
+		t.Fatalf("rewrites = %+v, want %d entries", report.Rewrites, len(want))
+	}
+	for _, rw := range report.Rewrites {
+		if rw != want[rw.Pass] {
+			t.Errorf("rewrite = %+v, want %+v", rw, want[rw.Pass])
+		}
+	}
+}
+
+func TestWriteJSONReport(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteJSONReport(&buf, []Report{optimizeReportSource(t), {Filename: "empty.lua"}}); err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		Files    int `json:"files"`
+		OptCount int `json:"opt_count"`
+		Rewrites []struct {
+			File      string `json:"file"`
+			Pass      string `json:"pass"`
+			Line      int    `json:"line"`
+			EndLine   int    `json:"end_line"`
+			Local     string `json:"local"`
+			GroupSize int    `json:"group_size"`
+			Replaced  int    `json:"replaced"`
+		} `json:"rewrites"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("invalid JSON: %v\n%s", err, buf.String())
+	}
+	if got.Files != 2 || got.OptCount != 2 || len(got.Rewrites) != 2 {
+		t.Fatalf("report = %+v", got)
+	}
+	rw := got.Rewrites[0]
+	if rw.File != "dir/r.lua" || rw.Pass != "table_access" || rw.Line != 3 || rw.EndLine != 4 || rw.Local != "a_b" || rw.GroupSize != 3 || rw.Replaced != 3 {
+		t.Errorf("first rewrite = %+v", rw)
+	}
+}
+
+func TestWriteSARIFReport(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteSARIFReport(&buf, []Report{optimizeReportSource(t)}); err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		Version string `json:"version"`
+		Runs    []struct {
+			Tool struct {
+				Driver struct {
+					Rules []struct {
+						ID string `json:"id"`
+					} `json:"rules"`
+				} `json:"driver"`
+			} `json:"tool"`
+			Results []struct {
+				RuleID    string `json:"ruleId"`
+				Locations []struct {
+					PhysicalLocation struct {
+						ArtifactLocation struct {
+							URI string `json:"uri"`
+						} `json:"artifactLocation"`
+						Region struct {
+							StartLine int `json:"startLine"`
+						} `json:"region"`
+					} `json:"physicalLocation"`
+				} `json:"locations"`
+			} `json:"results"`
+		} `json:"runs"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("invalid SARIF: %v\n%s", err, buf.String())
+	}
+	if got.Version != "2.1.0" || len(got.Runs) != 1 {
+		t.Fatalf("sarif = %+v", got)
+	}
+	run := got.Runs[0]
+	if len(run.Tool.Driver.Rules) != 2 || run.Tool.Driver.Rules[0].ID != "table_access" {
+		t.Errorf("rules = %+v", run.Tool.Driver.Rules)
+	}
+	if len(run.Results) != 2 {
+		t.Fatalf("results = %+v", run.Results)
+	}
+	loc := run.Results[1].Locations[0].PhysicalLocation
+	if run.Results[1].RuleID != "table_constructor" || loc.ArtifactLocation.URI != "dir/r.lua" || loc.Region.StartLine != 8 {
+		t.Errorf("second result = %+v", run.Results[1])
+	}
+}
+
+func TestWriteJSONReportSkipped(t *testing.T) {
+	report := Report{Filename: "s.lua", Skipped: []Skip{{Pass: "concat_buffer", Line: 3, Target: "s", Reason: "read inside the loop"}}}
+	var buf bytes.Buffer
+	if err := WriteJSONReport(&buf, []Report{report}); err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		Skipped []struct {
+			File   string `json:"file"`
+			Pass   string `json:"pass"`
+			Line   int    `json:"line"`
+			Target string `json:"target"`
+			Reason string `json:"reason"`
+		} `json:"skipped"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("invalid JSON: %v\n%s", err, buf.String())
+	}
+	if len(got.Skipped) != 1 || got.Skipped[0].File != "s.lua" || got.Skipped[0].Line != 3 || got.Skipped[0].Reason != "read inside the loop" {
+		t.Errorf("skipped = %+v", got.Skipped)
+	}
+}
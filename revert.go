@@ -0,0 +1,471 @@
+package olua
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/milochristiansen/lua/ast"
+)
+
+// ============================================================================
+// 还原：撤销所有 "-- opt by oLua" 改写
+// ============================================================================
+//
+// 与优化一样，每轮解析一次 AST，撤销一处改写，然后重新解析，
+// 因此多个 pass、多轮优化叠加的结果也能逐层还原：
+//   - table 访问：删除 "local a_b = a.b -- opt by oLua" 及之后重新赋值的同名行，
+//     并把引用该局部变量的 a_b 替换回 a.b（字符串、注释和同名的键不变）；局部化生成的 local math_floor = math.floor 同样处理
+//   - table 构造：按标记中记录的原有字段数，把之后合并进来的字段展开为赋值语句；
+//     没有记录字段数的旧标记只删除标记，保留合并后的构造表达式
+//   - 方法缓存：删除 "local update = self.update" 行，并把 update(self, ...) 还原为 self:update(...)
+//   - 拼接缓冲区：删除缓冲区声明和 table.concat 行，并把 s_buf[#s_buf + 1] = piece 还原为 s = s .. piece
+//   - table 预分配：删除 require("table.new") 行，并把预分配的声明还原为 local t = {}
+//   - table.insert 计数器：删除 "local t_n = #t" 行，并把之后的 t[t_n + k] 还原为 t[#t + 1]
+//   - 公共子表达式：删除 "local list_len = #list" 行，并把同一语句块中之后的 list_len 还原为 #list
+
+// Revert 撤销 src 中所有 oLua 改写，返回还原后的源码和报告（每条记录对应一处被撤销的改写）。
+// opts 中只使用 Filename 和 Logger。
+func Revert(src []byte, opts Options) ([]byte, Report, error) {
+	o := newOptimizer(opts)
+	o.setSource(splitLines(src))
+	o.hasOpt = true
+	for o.hasOpt {
+		o.hasOpt = false
+		if err := o.parse_lua(); err != nil {
+			return nil, o.report, err
+		}
+		o.revert_one()
+	}
+	return joinLines(o.filecontent), o.report, nil
+}
+
+// revert_one 找到第一条带 oLua 标记的语句并撤销它。
+func (o *optimizer) revert_one() {
+	o.for_each_block(func(block []ast.Stmt) bool {
+		for i, stmt := range block {
+			assign, ok := stmt.(*ast.Assign)
+			if !ok || len(assign.Targets) != 1 || len(assign.Values) != 1 {
+				continue
+			}
+			start, end := o.find_stmt_line_range(stmt)
+			if end < 1 || !strings.Contains(o.filecontent[end-1], "-- opt by oLua") {
+				continue
+			}
+			if ident, is_ident := assign.Targets[0].(*ast.ConstIdent); is_ident && assign.LocalDecl && strings.Contains(o.filecontent[end-1], concatBufferMarker) {
+				if cons, ok := assign.Values[0].(*ast.TableConstructor); ok && len(cons.Vals) == 1 {
+					if name, ok := cons.Vals[0].(*ast.ConstIdent); ok && o.revert_concat_buffer(ident.Value, name.Value, start, end) {
+						return false
+					}
+				}
+			}
+			if ident, is_ident := assign.Targets[0].(*ast.ConstIdent); is_ident && assign.LocalDecl && strings.Contains(o.filecontent[end-1], tableInsertMarker) {
+				if length, ok := assign.Values[0].(*ast.Operator); ok && length.Op == ast.OpLength && is_dotted_path(length.Right) {
+					o.revert_table_insert_counter(ident.Value, expr_to_string(length.Right), start, end)
+					return false
+				}
+			}
+			if assign.LocalDecl && strings.Contains(o.filecontent[end-1], tablePreallocMarker) {
+				o.revert_table_prealloc(assign, start, end)
+				return false
+			}
+			if ident, is_ident := assign.Targets[0].(*ast.ConstIdent); is_ident && assign.LocalDecl && strings.Contains(o.filecontent[end-1], cseMarker) {
+				o.revert_cse(block, i, ident.Value, assign.Values[0], start, end)
+				return false
+			}
+			switch value := assign.Values[0].(type) {
+			case *ast.TableConstructor:
+				if fields := o.recorded_constructor_fields(end); fields >= 0 && fields <= len(value.Keys) {
+					o.revert_table_constructor(assign, value, fields, start, end)
+					return false
+				}
+			default:
+				ident, is_ident := assign.Targets[0].(*ast.ConstIdent)
+				if accessor, ok := value.(*ast.TableAccessor); ok && assign.LocalDecl && is_ident && strings.Contains(o.filecontent[end-1], methodCacheMarker) {
+					o.revert_method_cache(block, i, ident.Value, accessor, start, end)
+					return false
+				}
+				if assign.LocalDecl && is_ident && is_dotted_path(value) {
+					o.revert_table_access(block, i, ident.Value, expr_to_string(value), start, end)
+					return false
+				}
+			}
+			o.strip_opt_marker(end)
+			return false
+		}
+		return true
+	})
+}
+
+// revert_table_access 删除 block[idx] 处生成的局部变量声明，并把解析到该声明的 name 还原为 path。
+// 只替换语法树中引用该局部变量的标识符，字符串、注释、字段名和同名的其他变量不变；
+// 某一行中无法准确定位这些引用时，只删除标记，保留缓存。
+func (o *optimizer) revert_table_access(block []ast.Stmt, idx int, name string, path string, start int, end int) {
+	rw := Rewrite{Pass: "table_access", Target: path, Local: name}
+	if o.isLocalizeLine(end) {
+		rw.Pass = "localize"
+	}
+	rw.Line, rw.EndLine = o.origRange(start, end)
+
+	reads := map[int]int{}
+	removed := map[int]bool{}
+	for _, ref := range analyzeScopes(o.block).refs {
+		if ref.binding == nil || ref.binding.decl != block[idx] || ref.binding.name != name {
+			continue
+		}
+		line := ref.node.Line()
+		if !ref.write {
+			reads[line]++
+			continue
+		}
+		// 后续读组重新赋值的行
+		trimmed := strings.TrimSpace(o.filecontent[line-1])
+		if !strings.Contains(trimmed, "-- opt by oLua") || !strings.HasPrefix(trimmed, name+" = ") {
+			o.logf("revert %s at: %s:%d target=%s: %s is assigned at line %d", rw.Pass, o.filename, rw.Line, path, name, line)
+			o.strip_opt_marker(end)
+			return
+		}
+		removed[line] = true
+	}
+	replaced := map[int]string{}
+	for line, n := range reads {
+		if removed[line] {
+			continue
+		}
+		content, count := replace_ident_refs(o.filecontent[line-1], o.longBracketOpen(line), name, path)
+		if count != n {
+			o.logf("revert %s at: %s:%d target=%s: cannot locate %s at line %d", rw.Pass, o.filename, rw.Line, path, name, line)
+			o.strip_opt_marker(end)
+			return
+		}
+		replaced[line] = content
+		rw.Replaced += n
+	}
+	for line, content := range replaced {
+		o.filecontent[line-1] = content
+	}
+	var lines []int
+	for line := range removed {
+		lines = append(lines, line)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(lines)))
+	for _, line := range lines {
+		o.spliceLines(line, line, nil)
+	}
+	o.spliceLines(start, end, nil)
+	rw.GroupSize += len(lines) + 1
+
+	o.logf("revert %s at: %s:%d target=%s", rw.Pass, o.filename, rw.Line, path)
+	o.addRewrite(rw)
+}
+
+// replace_ident_refs 把 content 代码部分中读取变量 name 的标识符替换为 dst，返回替换后的内容和替换次数。
+// open 为行首未闭合的长括号等号个数（-1 表示没有）。
+// 跳过字符串、注释、字段名和方法名（.name、:name），以及后面跟着 = 的名字（构造表达式的键或赋值目标）。
+func replace_ident_refs(content string, open int, name string, dst string) (string, int) {
+	count := 0
+	ret, _ := map_code(content, open, func(code string) string {
+		var sb strings.Builder
+		for i := 0; i < len(code); {
+			if !is_name_byte(code[i]) {
+				sb.WriteByte(code[i])
+				i++
+				continue
+			}
+			// 名字和数字（数字中的字母不是名字）
+			number := code[i] >= '0' && code[i] <= '9'
+			j := i + 1
+			for j < len(code) && (is_name_byte(code[j]) || (number && code[j] == '.')) {
+				j++
+			}
+			if word := code[i:j]; word == name && !is_field_name(code[:i]) && !followed_by_assign(code[j:]) {
+				sb.WriteString(dst)
+				count++
+			} else {
+				sb.WriteString(word)
+			}
+			i = j
+		}
+		return sb.String()
+	})
+	return ret, count
+}
+
+// is_name_byte 判断 ch 是否可以出现在名字或数字中。
+func is_name_byte(ch byte) bool {
+	return ch == '_' || (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') || (ch >= '0' && ch <= '9')
+}
+
+// is_field_name 判断紧跟在 before 之后的名字是否是字段名或方法名（a.name、a:name，不含 .. 拼接和 :: 标签）。
+func is_field_name(before string) bool {
+	before = strings.TrimRight(before, " \t")
+	if strings.HasSuffix(before, "..") || strings.HasSuffix(before, "::") {
+		return false
+	}
+	return strings.HasSuffix(before, ".") || strings.HasSuffix(before, ":")
+}
+
+// followed_by_assign 判断名字之后是否是赋值的 =（不含 ==）。
+func followed_by_assign(after string) bool {
+	after = strings.TrimLeft(after, " \t")
+	return strings.HasPrefix(after, "=") && !strings.HasPrefix(after, "==")
+}
+
+// revert_method_cache 删除 block[idx] 处生成的方法缓存，并在其作用域内把 name(recv, ...) 还原为 recv:method(...)。
+func (o *optimizer) revert_method_cache(block []ast.Stmt, idx int, name string, value *ast.TableAccessor, start int, end int) {
+	recv := expr_to_string(value.Obj)
+	method := expr_to_string(value.Key)
+	if key, ok := value.Key.(*ast.ConstString); ok {
+		method = key.Value
+	}
+	rw := Rewrite{Pass: "method_cache", Target: recv + ":" + method, Local: name}
+	rw.Line, rw.EndLine = o.origRange(start, end)
+
+	scope_end := end
+	if idx+1 < len(block) {
+		_, scope_end = o.find_stmt_line_range(block[len(block)-1])
+	}
+	for line := end + 1; line <= scope_end; line++ {
+		content, n := revert_method_call(o.filecontent[line-1], recv, method, name)
+		if n > 0 {
+			o.filecontent[line-1] = content
+			rw.GroupSize++
+			rw.Replaced += n
+		}
+	}
+	o.spliceLines(start, end, nil)
+
+	o.logf("revert method_cache at: %s:%d target=%s", o.filename, rw.Line, rw.Target)
+	o.addRewrite(rw)
+}
+
+// revert_table_constructor 只保留构造表达式原有的 fields 个字段，其余字段展开为赋值语句。
+func (o *optimizer) revert_table_constructor(assign *ast.Assign, cons *ast.TableConstructor, fields int, start int, end int) {
+	target := assign.Targets[0]
+	rw := Rewrite{Pass: "table_constructor", Target: expr_to_string(target),
+		GroupSize: len(cons.Keys) - fields, Replaced: len(cons.Keys) - fields}
+	rw.Line, rw.EndLine = o.origRange(start, end)
+
+	indent := get_content_space(o.filecontent[start-1])
+	keys, vals := cons.Keys[fields:], cons.Vals[fields:]
+	assign.Values[0] = &ast.TableConstructor{Keys: cons.Keys[:fields], Vals: cons.Vals[:fields]}
+	new_lines := stmt_to_lines(assign, indent)
+	for i := range keys {
+		field := &ast.Assign{
+			Targets: []ast.Expr{&ast.TableAccessor{Obj: target, Key: keys[i]}},
+			Values:  []ast.Expr{vals[i]},
+		}
+		new_lines = append(new_lines, stmt_to_lines(field, indent)...)
+	}
+	o.spliceLines(start, end, new_lines)
+
+	o.logf("revert table_constructor at: %s:%d target=%s", o.filename, rw.Line, rw.Target)
+	o.addRewrite(rw)
+}
+
+// revert_concat_buffer 删除 start 到 end 行的缓冲区声明 local buf = {name} 及其后的 name = table.concat(buf) 行，
+// 并把两者之间的 buf[#buf + 1] = piece 还原为 name = name .. piece。找不到 table.concat 行时返回 false。
+func (o *optimizer) revert_concat_buffer(buf string, name string, start int, end int) bool {
+	concat_line := 0
+	prefix := name + " = table.concat(" + buf + ")"
+	for line := end + 1; line <= len(o.filecontent); line++ {
+		trimmed := strings.TrimSpace(o.filecontent[line-1])
+		if strings.HasPrefix(trimmed, prefix) && strings.Contains(trimmed, concatBufferMarker) {
+			concat_line = line
+			break
+		}
+	}
+	if concat_line == 0 {
+		return false
+	}
+	rw := Rewrite{Pass: "concat_buffer", Target: name, Local: buf}
+	rw.Line, rw.EndLine = o.origRange(start, concat_line)
+
+	for line := end + 1; line < concat_line; line++ {
+		content := o.filecontent[line-1]
+		if !strings.HasPrefix(strings.TrimSpace(content), buf+"[#"+buf) {
+			continue
+		}
+		code, comment, ok := splitLineComment(content)
+		if !ok {
+			continue
+		}
+		parsed, err := ast.Parse(code, line)
+		if err != nil || len(parsed) != 1 {
+			continue
+		}
+		push, ok := parsed[0].(*ast.Assign)
+		if !ok || len(push.Targets) != 1 || len(push.Values) != 1 {
+			continue
+		}
+		if accessor, ok := push.Targets[0].(*ast.TableAccessor); !ok || expr_to_string(accessor.Obj) != buf {
+			continue
+		}
+		append_stmt := &ast.Assign{
+			Targets: []ast.Expr{&ast.ConstIdent{Value: name}},
+			Values:  []ast.Expr{&ast.Operator{Op: ast.OpConcat, Left: &ast.ConstIdent{Value: name}, Right: push.Values[0]}},
+		}
+		new_line := stmt_to_lines(append_stmt, get_content_space(content))[0]
+		if comment != "" {
+			new_line += " " + comment
+		}
+		o.filecontent[line-1] = new_line
+		rw.GroupSize++
+		rw.Replaced++
+	}
+	o.spliceLines(concat_line, concat_line, nil)
+	o.spliceLines(start, end, nil)
+
+	o.logf("revert concat_buffer at: %s:%d target=%s", o.filename, rw.Line, name)
+	o.addRewrite(rw)
+	return true
+}
+
+// revert_table_insert_counter 删除 start 到 end 行的计数器声明 local counter = #path，
+// 并把紧随其后的 path[counter + k] = v 还原为 path[#path + 1] = v。
+func (o *optimizer) revert_table_insert_counter(counter string, path string, start int, end int) {
+	rw := Rewrite{Pass: "table_insert", Target: path, Local: counter}
+	prefix := path + "[" + counter + " + "
+	line := end + 1
+	for ; line <= len(o.filecontent); line++ {
+		content := o.filecontent[line-1]
+		indent := get_content_space(content)
+		rest := strings.TrimPrefix(content, indent)
+		if !strings.HasPrefix(rest, prefix) {
+			break
+		}
+		bracket := strings.Index(rest[len(prefix):], "]")
+		if bracket < 0 {
+			break
+		}
+		o.filecontent[line-1] = indent + path + "[#" + path + " + 1]" + rest[len(prefix)+bracket+1:]
+		rw.GroupSize++
+		rw.Replaced++
+	}
+	rw.Line, rw.EndLine = o.origRange(start, line-1)
+	o.spliceLines(start, end, nil)
+
+	o.logf("revert table_insert at: %s:%d target=%s", o.filename, rw.Line, path)
+	o.addRewrite(rw)
+}
+
+// revert_table_prealloc 删除 start 到 end 行的 require("table.new")，或把预分配的声明还原为空表。
+func (o *optimizer) revert_table_prealloc(assign *ast.Assign, start int, end int) {
+	rw := Rewrite{Pass: "table_prealloc", Target: expr_to_string(assign.Targets[0])}
+	rw.Line, rw.EndLine = o.origRange(start, end)
+	if call, ok := assign.Values[0].(*ast.FuncCall); ok && isRequireTableNew(call) {
+		o.spliceLines(start, end, nil)
+	} else {
+		_, comment, _ := splitLineComment(o.filecontent[end-1])
+		comment = strings.TrimSpace(strings.Replace(comment, tablePreallocMarker, "", 1))
+		decl := &ast.Assign{LocalDecl: true, Targets: assign.Targets, Values: []ast.Expr{&ast.TableConstructor{}}}
+		line := stmt_to_lines(decl, get_content_space(o.filecontent[start-1]))[0]
+		if comment != "" {
+			line += " " + comment
+		}
+		o.spliceLines(start, end, []string{line})
+		rw.GroupSize, rw.Replaced = 1, 1
+	}
+
+	o.logf("revert table_prealloc at: %s:%d target=%s", o.filename, rw.Line, rw.Target)
+	o.addRewrite(rw)
+}
+
+// revert_cse 删除 block[idx] 处的公共子表达式缓存，并把之后各语句中的 name 还原为 value。
+func (o *optimizer) revert_cse(block []ast.Stmt, idx int, name string, value ast.Expr, start int, end int) {
+	rw := Rewrite{Pass: "cse", Target: expr_to_string(value), Local: name}
+	rw.Line, rw.EndLine = o.origRange(start, end)
+
+	starts := o.stmtStarts()
+	for _, stmt := range block[idx+1:] {
+		site := cseSite(o.stmtFoldSites(stmt), stmt)
+		if site == nil {
+			continue
+		}
+		content, comment, ok := o.checkFoldSite(site, starts, "cse")
+		if !ok {
+			continue
+		}
+		n := 0
+		for _, p := range site.exprs {
+			walkExprSlots(p, func(p *ast.Expr) bool {
+				if ident, is_ident := (*p).(*ast.ConstIdent); is_ident && ident.Value == name {
+					*p = substituteExpr(value, nil)
+					n++
+					return false
+				}
+				return true
+			})
+		}
+		if new_line, ok := renderFoldSite(site, content, comment); ok && n > 0 {
+			o.filecontent[site.line-1] = new_line
+			rw.GroupSize++
+			rw.Replaced += n
+		}
+	}
+	o.spliceLines(start, end, nil)
+
+	o.logf("revert cse at: %s:%d target=%s", o.filename, rw.Line, rw.Target)
+	o.addRewrite(rw)
+}
+
+// strip_opt_marker 删除第 line 行无法识别的 oLua 标记，保留代码本身。
+func (o *optimizer) strip_opt_marker(line int) {
+	content := o.filecontent[line-1]
+	idx := strings.Index(content, "-- opt by oLua")
+	o.filecontent[line-1] = strings.TrimRight(content[:idx], " \t")
+	o.hasOpt = true
+}
+
+// is_dotted_path 判断 expr 是否是 a.b.c 形式的路径（table 访问优化缓存的对象）。
+func is_dotted_path(expr ast.Expr) bool {
+	switch e := expr.(type) {
+	case *ast.ConstIdent:
+		return true
+	case *ast.TableAccessor:
+		key, ok := e.Key.(*ast.ConstString)
+		return ok && isLuaName(key.Value) && is_dotted_path(e.Obj)
+	}
+	return false
+}
+
+// for_each_block 按源码顺序对文件中的每个语句块调用 f，f 返回 false 时停止。
+func (o *optimizer) for_each_block(f func(block []ast.Stmt) bool) {
+	if !f(o.block) {
+		return
+	}
+	stop := false
+	visit := func(block []ast.Stmt) {
+		if !stop && !f(block) {
+			stop = true
+		}
+	}
+	v := lua_visitor{f: func(n ast.Node, ok *bool) {
+		if stop {
+			*ok = false
+			return
+		}
+		switch nn := n.(type) {
+		case *ast.FuncDecl:
+			visit(nn.Block)
+		case *ast.DoBlock:
+			visit(nn.Block)
+		case *ast.If:
+			visit(nn.Then)
+			visit(nn.Else)
+		case *ast.WhileLoop:
+			visit(nn.Block)
+		case *ast.RepeatUntilLoop:
+			visit(nn.Block)
+		case *ast.ForLoopNumeric:
+			visit(nn.Block)
+		case *ast.ForLoopGeneric:
+			visit(nn.Block)
+		}
+	}}
+	for _, stmt := range o.block {
+		if stop {
+			return
+		}
+		ast.Walk(&v, stmt)
+	}
+}
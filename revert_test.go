@@ -0,0 +1,175 @@
+package olua
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// ============================================================================
+// 还原测试
+// ============================================================================
+
+func TestRevertTableAccessFixtures(t *testing.T) {
+	// table 访问和拼接缓冲区优化只插入行和替换文本，还原后应与原始文件完全一致
+	files := []string{"concat_buffer", "table_access_advanced", "table_access_chunk", "table_access_coverage3", "table_access_hoist", "table_access_invalidate", "table_access_loop", "table_access_realworld", "table_access_semantic"}
+	for _, name := range files {
+		original, err := os.ReadFile("input/" + name + ".lua")
+		if err != nil {
+			t.Fatal(err)
+		}
+		optimized, err := os.ReadFile("output/" + name + ".lua")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _, err := Revert(optimized, Options{Filename: name})
+		if err != nil {
+			t.Fatalf("Revert(%s) failed: %v", name, err)
+		}
+		if string(got) != string(original) {
+			t.Errorf("Revert(%s) differs from the input:\n%s", name, UnifiedDiff(name, original, got))
+		}
+	}
+}
+
+func TestRevertRoundTrip(t *testing.T) {
+	// 两个 pass 多轮叠加的结果还原后再优化，应得到相同的结果
+	opts := tableAccessOptions()
+	opts.TableConstructor = true
+	for _, name := range []string{"table_access_coverage", "table_access_invalidate", "table_constructor"} {
+		src, err := os.ReadFile("input/" + name + ".lua")
+		if err != nil {
+			t.Fatal(err)
+		}
+		optimized, report, err := Optimize(src, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reverted, revertReport, err := Revert(optimized, Options{Filename: name})
+		if err != nil {
+			t.Fatalf("Revert(%s) failed: %v", name, err)
+		}
+		if revertReport.OptCount == 0 || strings.Contains(string(reverted), "-- opt by oLua") {
+			t.Errorf("Revert(%s) left markers behind (%d of %d rewrites reverted):\n%s", name, revertReport.OptCount, report.OptCount, reverted)
+		}
+		again, _, err := Optimize(reverted, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(again) != string(optimized) {
+			t.Errorf("re-optimizing reverted %s differs:\n%s", name, UnifiedDiff(name, optimized, again))
+		}
+	}
+}
+
+func TestRevertTableConstructor(t *testing.T) {
+	src := `function f()
+    local a = {x = 1}
+    a.b = 2
+    a.c = {}
+    a.c.d = 3
+    a["e f"] = math.max(1, 2)
+    return a
+end
+`
+	opts := tableAccessOptions()
+	opts.TableConstructor = true
+	optimized, _, err := Optimize([]byte(src), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(optimized), `local a = {x = 1, b = 2, c = {d = 3}, ["e f"] = math.max(1, 2)} -- opt by oLua (table_constructor 1)`) {
+		t.Fatalf("unexpected optimized output:\n%s", optimized)
+	}
+	got, report, err := Revert(optimized, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 嵌套构造 c 的合并记录在外层合并时丢失，按合并后的形式还原
+	want := `function f()
+    local a = {x = 1}
+    a.b = 2
+    a.c = {d = 3}
+    a["e f"] = math.max(1, 2)
+    return a
+end
+`
+	if string(got) != want {
+		t.Errorf("Revert =\n%s\nwant:\n%s", got, want)
+	}
+	if report.OptCount != 1 || report.Rewrites[0].Pass != "table_constructor" || report.Rewrites[0].Replaced != 3 {
+		t.Errorf("report = %+v", report)
+	}
+}
+
+func TestRevertTableAccessTokens(t *testing.T) {
+	// 只还原引用生成的局部变量的标识符，字符串、注释、构造表达式的键和字段名不变
+	src := `function f()
+    local a_b = a.b -- opt by oLua
+    print(a_b.c, "a_b is cached") -- a_b is cached
+    local t = {a_b = a_b.e, [a_b] = 1, x = a_b}
+    return t.a_b, a_b:get(), "a_b" .. a_b.d
+end
+`
+	want := `function f()
+    print(a.b.c, "a_b is cached") -- a_b is cached
+    local t = {a_b = a.b.e, [a.b] = 1, x = a.b}
+    return t.a_b, a.b:get(), "a_b" .. a.b.d
+end
+`
+	got, report, err := Revert([]byte(src), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("Revert =\n%s\nwant\n%s", got, want)
+	}
+	if len(report.Rewrites) != 1 || report.Rewrites[0].Replaced != 6 {
+		t.Errorf("rewrites = %+v", report.Rewrites)
+	}
+}
+
+func TestRevertTableAccessShadowed(t *testing.T) {
+	// 内层同名变量不是生成的局部变量，不还原
+	src := `function f()
+    local a_b = a.b -- opt by oLua
+    print(a_b.c)
+    for _, a_b in ipairs(list) do
+        print(a_b)
+    end
+end
+`
+	want := `function f()
+    print(a.b.c)
+    for _, a_b in ipairs(list) do
+        print(a_b)
+    end
+end
+`
+	got, _, err := Revert([]byte(src), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("Revert =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestRevertUnrecordedMarker(t *testing.T) {
+	// 没有记录字段数的旧标记无法展开，只删除标记
+	src := "function f()\n    local t = {a = 1, b = 2} -- opt by oLua\n    return t\nend\n"
+	got, _, err := Revert([]byte(src), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "function f()\n    local t = {a = 1, b = 2}\n    return t\nend\n"
+	if string(got) != want {
+		t.Errorf("Revert = %q, want %q", got, want)
+	}
+}
+
+func TestRevertParseError(t *testing.T) {
+	if _, _, err := Revert([]byte("function f(\n"), Options{Filename: "bad.lua"}); err == nil {
+		t.Error("Revert on invalid source should return an error")
+	}
+}
@@ -0,0 +1,214 @@
+package olua
+
+import (
+	"github.com/milochristiansen/lua/ast"
+)
+
+// ============================================================================
+// 局部变量作用域
+// ============================================================================
+//
+// 按 Lua 的作用域规则遍历语句，遍历到每条语句时可以查询该位置可见的局部变量：
+//   - local 声明从下一条语句开始可见（local function 在函数体内即可见）
+//   - 函数参数、循环变量只在函数体、循环体中可见
+//   - repeat ... until 的条件可以看到循环体中声明的局部变量
+
+// localBinding 是一个局部变量声明
+type localBinding struct {
+	name string
+	// value 是声明时的初始值，参数、循环变量和没有对应初始值的声明为 nil
+	value ast.Expr
+	// decl 是声明所在的语句，参数和循环变量为声明它的函数或循环
+	decl ast.Node
+	// fn 是声明所在的函数，主代码块为 nil
+	fn *ast.FuncDecl
+}
+
+// scopeRef 是对一个名字的读或写
+type scopeRef struct {
+	node *ast.ConstIdent
+	// binding 是引用的局部变量，全局变量为 nil
+	binding *localBinding
+	write   bool
+	// stmt 是引用所在的语句（不含嵌套语句块和函数体）
+	stmt ast.Stmt
+	// fn 是引用所在的函数，主代码块为 nil
+	fn *ast.FuncDecl
+}
+
+// scopeInfo 是整个代码块的局部变量声明和引用，按源码顺序排列
+type scopeInfo struct {
+	bindings []*localBinding
+	refs     []scopeRef
+}
+
+// scopeEnv 是某个位置可见的局部变量
+type scopeEnv struct {
+	parent *scopeEnv
+	names  map[string]*localBinding
+}
+
+func (e *scopeEnv) child() *scopeEnv {
+	return &scopeEnv{parent: e, names: map[string]*localBinding{}}
+}
+
+func (e *scopeEnv) declare(b *localBinding) {
+	e.names[b.name] = b
+}
+
+// lookup 返回 name 在该位置可见的局部变量声明，name 是全局变量时返回 nil。
+func (e *scopeEnv) lookup(name string) *localBinding {
+	for s := e; s != nil; s = s.parent {
+		if b, ok := s.names[name]; ok {
+			return b
+		}
+	}
+	return nil
+}
+
+// walkScopes 按源码顺序对 block 及其中所有函数体内的每条语句调用 f，
+// env 是执行该语句前可见的局部变量。
+func walkScopes(block []ast.Stmt, f func(stmt ast.Stmt, env *scopeEnv)) {
+	w := &scopeWalker{f: f}
+	w.block(block, (&scopeEnv{}).child())
+}
+
+// analyzeScopes 收集 block 及其中所有函数体内的局部变量声明，并把每个名字的读写解析到对应的声明。
+func analyzeScopes(block []ast.Stmt) *scopeInfo {
+	w := &scopeWalker{f: func(ast.Stmt, *scopeEnv) {}, info: &scopeInfo{}}
+	w.block(block, (&scopeEnv{}).child())
+	return w.info
+}
+
+type scopeWalker struct {
+	f func(stmt ast.Stmt, env *scopeEnv)
+	// info 不为 nil 时收集声明和引用
+	info *scopeInfo
+	// fn 和 cur 是当前所在的函数和语句
+	fn  *ast.FuncDecl
+	cur ast.Stmt
+}
+
+// declare 在 env 中声明 b，并记录到 info。
+func (w *scopeWalker) declare(env *scopeEnv, b *localBinding) {
+	b.fn = w.fn
+	env.declare(b)
+	if w.info != nil {
+		w.info.bindings = append(w.info.bindings, b)
+	}
+}
+
+// ref 记录对 ident 的读或写。
+func (w *scopeWalker) ref(ident *ast.ConstIdent, env *scopeEnv, write bool) {
+	if w.info != nil {
+		w.info.refs = append(w.info.refs, scopeRef{node: ident, binding: env.lookup(ident.Value), write: write, stmt: w.cur, fn: w.fn})
+	}
+}
+
+// block 在 env 中依次处理语句，语句中的 local 声明加入 env。
+func (w *scopeWalker) block(block []ast.Stmt, env *scopeEnv) {
+	for _, stmt := range block {
+		w.stmt(stmt, env)
+	}
+}
+
+func (w *scopeWalker) stmt(stmt ast.Stmt, env *scopeEnv) {
+	w.f(stmt, env)
+	w.cur = stmt
+	switch s := stmt.(type) {
+	case *ast.Assign:
+		if s.LocalFunc {
+			w.declareLocals(s, env)
+			w.exprs(s.Values, env)
+			return
+		}
+		if !s.LocalDecl {
+			for _, t := range s.Targets {
+				if ident, ok := t.(*ast.ConstIdent); ok {
+					w.ref(ident, env, true)
+				} else {
+					w.expr(t, env)
+				}
+			}
+		}
+		w.exprs(s.Values, env)
+		if s.LocalDecl {
+			w.declareLocals(s, env)
+		}
+	case *ast.FuncCall:
+		w.expr(s, env)
+	case *ast.Return:
+		w.exprs(s.Items, env)
+	case *ast.DoBlock:
+		w.block(s.Block, env.child())
+	case *ast.If:
+		w.expr(s.Cond, env)
+		w.block(s.Then, env.child())
+		w.block(s.Else, env.child())
+	case *ast.WhileLoop:
+		w.expr(s.Cond, env)
+		w.block(s.Block, env.child())
+	case *ast.RepeatUntilLoop:
+		body := env.child()
+		w.block(s.Block, body)
+		w.cur = s
+		w.expr(s.Cond, body)
+	case *ast.ForLoopNumeric:
+		w.exprs([]ast.Expr{s.Init, s.Limit, s.Step}, env)
+		body := env.child()
+		w.declare(body, &localBinding{name: s.Counter, decl: s})
+		w.block(s.Block, body)
+	case *ast.ForLoopGeneric:
+		w.exprs(s.Init, env)
+		body := env.child()
+		for _, name := range s.Locals {
+			w.declare(body, &localBinding{name: name, decl: s})
+		}
+		w.block(s.Block, body)
+	}
+}
+
+// declareLocals 把 local 声明的变量加入 env。
+func (w *scopeWalker) declareLocals(s *ast.Assign, env *scopeEnv) {
+	for i, t := range s.Targets {
+		ident, ok := t.(*ast.ConstIdent)
+		if !ok {
+			continue
+		}
+		b := &localBinding{name: ident.Value, decl: s}
+		if i < len(s.Values) {
+			b.value = s.Values[i]
+		}
+		w.declare(env, b)
+	}
+}
+
+func (w *scopeWalker) exprs(exprs []ast.Expr, env *scopeEnv) {
+	for _, expr := range exprs {
+		w.expr(expr, env)
+	}
+}
+
+// expr 记录表达式中的读，并处理表达式中定义的函数。
+func (w *scopeWalker) expr(expr ast.Expr, env *scopeEnv) {
+	if expr == nil {
+		return
+	}
+	v := lua_visitor{f: func(n ast.Node, ok *bool) {
+		switch e := n.(type) {
+		case *ast.ConstIdent:
+			w.ref(e, env, false)
+		case *ast.FuncDecl:
+			outer_fn, outer_stmt := w.fn, w.cur
+			w.fn = e
+			body := env.child()
+			for _, param := range e.Params {
+				w.declare(body, &localBinding{name: param, decl: e})
+			}
+			w.block(e.Block, body)
+			w.fn, w.cur = outer_fn, outer_stmt
+			*ok = false
+		}
+	}}
+	ast.Walk(&v, expr)
+}
@@ -0,0 +1,125 @@
+package olua
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/milochristiansen/lua/ast"
+)
+
+// ============================================================================
+// 单元测试：局部变量作用域
+// ============================================================================
+
+// scopeAt 返回 src 中第 line 行语句执行前 name 的可见声明，全局变量时返回 nil。
+func scopeAt(t *testing.T, src string, line int, name string) *localBinding {
+	t.Helper()
+	block, err := parseSource(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found *localBinding
+	seen := false
+	walkScopes(block, func(stmt ast.Stmt, env *scopeEnv) {
+		if stmt.Line() == line && !seen {
+			seen = true
+			found = env.lookup(name)
+		}
+	})
+	if !seen {
+		t.Fatalf("no statement at line %d", line)
+	}
+	return found
+}
+
+func TestWalkScopes(t *testing.T) {
+	src := `local a = 1
+local function f(b)
+    print(a, b, f)
+    local a = "x"
+    for i = 1, 3 do
+        print(a, i)
+    end
+    print(i)
+    repeat
+        local c = 1
+    until c
+end
+do
+    local d = 2
+end
+print(d, a)
+`
+	tests := []struct {
+		line  int
+		name  string
+		value string // 期望的初始值，"param" 表示参数或循环变量，空串表示全局变量
+	}{
+		{3, "a", "1"},
+		{3, "b", "param"},
+		{3, "f", "function"},
+		{6, "a", "\"x\""},
+		{6, "i", "param"},
+		{8, "i", ""},
+		{16, "d", ""},
+		{16, "a", "1"},
+	}
+	for _, tt := range tests {
+		b := scopeAt(t, src, tt.line, tt.name)
+		got := ""
+		switch {
+		case b == nil:
+		case b.value == nil:
+			got = "param"
+		case b.value != nil:
+			if _, ok := b.value.(*ast.FuncDecl); ok {
+				got = "function"
+			} else {
+				got = expr_to_string(b.value)
+			}
+		}
+		if got != tt.value {
+			t.Errorf("line %d %s = %q, want %q", tt.line, tt.name, got, tt.value)
+		}
+	}
+}
+
+func TestAnalyzeScopes(t *testing.T) {
+	src := `local a = 1
+a = a + 1
+g = a
+local function f()
+    return a
+end
+`
+	block, err := parseSource(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := analyzeScopes(block)
+	if len(info.bindings) != 2 || info.bindings[0].name != "a" || info.bindings[1].name != "f" {
+		t.Fatalf("unexpected bindings: %+v", info.bindings)
+	}
+	a := info.bindings[0]
+	var got []string
+	for _, ref := range info.refs {
+		kind := "read"
+		if ref.write {
+			kind = "write"
+		}
+		switch {
+		case ref.binding == nil:
+			kind += " global"
+		case ref.fn != ref.binding.fn:
+			kind += " captured"
+		}
+		got = append(got, ref.node.Value+" "+kind)
+		if ref.binding != nil && ref.binding != a {
+			t.Errorf("%s resolved to %s", ref.node.Value, ref.binding.name)
+		}
+	}
+	want := []string{"a write", "a read", "g write global", "a read", "a read captured"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("refs = %v, want %v", got, want)
+	}
+}
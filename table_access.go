@@ -1,9 +1,8 @@
-package main
+package olua
 
 import (
 	"fmt"
 	"github.com/milochristiansen/lua/ast"
-	"log"
 	"regexp"
 	"sort"
 	"strings"
@@ -68,22 +67,15 @@ var builtinPureFuncs = map[string]bool{
 	"os.date":  true,
 }
 
-// 用户自定义纯函数正则列表（在首次使用时编译）
-var userPureFuncPatterns []*regexp.Regexp
-var userPureFuncPatternsCompiled bool
-
 // compilePureFuncPatterns 编译用户自定义的纯函数正则列表。
-func compilePureFuncPatterns() {
-	if userPureFuncPatternsCompiled {
-		return
-	}
-	userPureFuncPatternsCompiled = true
-	userPureFuncPatterns = nil
+func (o *optimizer) compilePureFuncPatterns(parts []string) {
+	o.purePatterns = o.compileNamePatterns("pure_funcs", parts)
+}
 
-	if opt_table_access_pure_funcs == nil || *opt_table_access_pure_funcs == "" {
-		return
-	}
-	parts := strings.Split(*opt_table_access_pure_funcs, ",")
+// compileNamePatterns 把名字正则列表编译为完整匹配的正则，kind 用于警告信息。
+// 无效的正则只记录警告并跳过，不影响其余模式。
+func (o *optimizer) compileNamePatterns(kind string, parts []string) []*regexp.Regexp {
+	var patterns []*regexp.Regexp
 	for _, part := range parts {
 		part = strings.TrimSpace(part)
 		if part == "" {
@@ -93,24 +85,24 @@ func compilePureFuncPatterns() {
 		pattern := "^" + part + "$"
 		re, err := regexp.Compile(pattern)
 		if err != nil {
-			log.Printf("warning: invalid pure_funcs pattern %q: %v", part, err)
+			o.logf("warning: invalid %s pattern %q: %v", kind, part, err)
 			continue
 		}
-		userPureFuncPatterns = append(userPureFuncPatterns, re)
+		patterns = append(patterns, re)
 	}
+	return patterns
 }
 
 // isPureFunction 判断函数名是否在纯函数白名单中（不会修改参数）。
 // funcName 是函数的完整路径（如 "print", "math.floor", "log_info"）。
-func isPureFunction(funcName string) bool {
+func (o *optimizer) isPureFunction(funcName string) bool {
 	// 检查内置白名单
 	if builtinPureFuncs[funcName] {
 		return true
 	}
 
 	// 检查用户自定义正则
-	compilePureFuncPatterns()
-	for _, re := range userPureFuncPatterns {
+	for _, re := range o.purePatterns {
 		if re.MatchString(funcName) {
 			return true
 		}
@@ -178,6 +170,16 @@ func getExprPath(expr ast.Expr) (string, bool) {
 	}
 }
 
+// pathToExpr 把 getExprPath 产生的点分路径还原为 TableAccessor 链。
+func pathToExpr(path string) ast.Expr {
+	parts := strings.Split(path, ".")
+	var expr ast.Expr = &ast.ConstIdent{Value: parts[0]}
+	for _, part := range parts[1:] {
+		expr = &ast.TableAccessor{Obj: expr, Key: &ast.ConstString{Value: part}}
+	}
+	return expr
+}
+
 // isPathPrefix 判断 prefix 是否是 path 的点分前缀。
 // 例如 "a.b" 是 "a.b.c" 的前缀，但不是 "a.bc" 的前缀。
 func isPathPrefix(prefix, path string) bool {
@@ -232,10 +234,52 @@ func getUniqueLocalName(block []ast.Stmt, baseName string) string {
 	return "_opt_" + baseName
 }
 
+// isGlobalShadowed 判断全局变量 name 是否在文件中被声明为局部变量、参数、循环变量或被赋值。
+// local name = name 形式的局部化声明保存的仍是全局变量，不算遮蔽。
+func (o *optimizer) isGlobalShadowed(name string) bool {
+	shadowed := false
+	f := lua_visitor{f: func(n ast.Node, ok *bool) {
+		switch e := n.(type) {
+		case *ast.Assign:
+			if e.LocalDecl && len(e.Targets) == 1 && len(e.Values) == 1 {
+				target, is_target := e.Targets[0].(*ast.ConstIdent)
+				value, is_value := e.Values[0].(*ast.ConstIdent)
+				if is_target && is_value && target.Value == name && value.Value == name {
+					return
+				}
+			}
+			for _, t := range e.Targets {
+				if ident, is_ident := t.(*ast.ConstIdent); is_ident && ident.Value == name {
+					shadowed = true
+				}
+				if path, path_ok := getExprPath(t); path_ok && path == "_G."+name {
+					shadowed = true
+				}
+			}
+		case *ast.FuncDecl:
+			if containsString(e.Params, name) {
+				shadowed = true
+			}
+		case *ast.ForLoopNumeric:
+			if e.Counter == name {
+				shadowed = true
+			}
+		case *ast.ForLoopGeneric:
+			if containsString(e.Locals, name) {
+				shadowed = true
+			}
+		}
+	}}
+	for _, stmt := range o.block {
+		ast.Walk(&f, stmt)
+	}
+	return shadowed
+}
+
 // isOluaGeneratedName 判断某个变量名是否由 oLua 在之前的 pass 中生成。
-// 通过扫描 gfilecontent 查找 "local <name> = ... -- opt by oLua" 形式的行。
-func isOluaGeneratedName(name string) bool {
-	for _, line := range gfilecontent {
+// 通过扫描 o.filecontent 查找 "local <name> = ... -- opt by oLua" 形式的行。
+func (o *optimizer) isOluaGeneratedName(name string) bool {
+	for _, line := range o.filecontent {
 		trimmed := strings.TrimSpace(line)
 		if strings.Contains(trimmed, "-- opt by oLua") {
 			if strings.HasPrefix(trimmed, "local "+name+" = ") || strings.HasPrefix(trimmed, name+" = ") {
@@ -346,6 +390,44 @@ func exprContainsPathRead(expr ast.Expr, target string) bool {
 	return false
 }
 
+// exprAlwaysReadsPath 检查 expr 每次求值时是否一定会读取 target：
+// and/or 右侧只在短路没有发生时求值，不算一定读取。
+func exprAlwaysReadsPath(expr ast.Expr, target string) bool {
+	if expr == nil {
+		return false
+	}
+	if path, ok := getExprPath(expr); ok && (path == target || isPathPrefix(target, path)) {
+		return true
+	}
+	switch e := expr.(type) {
+	case *ast.TableAccessor:
+		return exprAlwaysReadsPath(e.Obj, target) || exprAlwaysReadsPath(e.Key, target)
+	case *ast.Operator:
+		if e.Op == ast.OpAnd || e.Op == ast.OpOr {
+			return exprAlwaysReadsPath(e.Left, target)
+		}
+		return exprAlwaysReadsPath(e.Left, target) || exprAlwaysReadsPath(e.Right, target)
+	case *ast.FuncCall:
+		if exprAlwaysReadsPath(e.Receiver, target) || exprAlwaysReadsPath(e.Function, target) {
+			return true
+		}
+		for _, arg := range e.Args {
+			if exprAlwaysReadsPath(arg, target) {
+				return true
+			}
+		}
+	case *ast.TableConstructor:
+		for i, key := range e.Keys {
+			if exprAlwaysReadsPath(key, target) || exprAlwaysReadsPath(e.Vals[i], target) {
+				return true
+			}
+		}
+	case *ast.Parens:
+		return exprAlwaysReadsPath(e.Inner, target)
+	}
+	return false
+}
+
 // funcCallInvalidatesTarget 检查函数调用是否会使 target 缓存失效。
 // 规则：
 //   - 如果函数在纯函数白名单中，不失效（不修改参数）
@@ -354,13 +436,18 @@ func exprContainsPathRead(expr ast.Expr, target string) bool {
 //   - 接收者/参数路径等于 target 或是 target 的子级时 → 不失效
 //     （如 func1(a.b) 不能修改 a 表上 b 字段的绑定 → a.b 缓存仍有效）
 //   - Function 表达式中的嵌套调用也需检查
-func funcCallInvalidatesTarget(call *ast.FuncCall, target string) bool {
+func (o *optimizer) funcCallInvalidatesTarget(call *ast.FuncCall, target string) bool {
 	// 纯函数白名单检查：如果函数名在白名单中，不使 target 失效
 	funcName, nameOk := getFuncCallName(call)
-	if nameOk && isPureFunction(funcName) {
+	if nameOk && o.isPureFunction(funcName) {
 		return false
 	}
+	return o.callArgsInvalidateTarget(call, target)
+}
 
+// callArgsInvalidateTarget 判断调用是否把 target 的父路径作为接收者或参数传入，
+// 或其中的嵌套调用是否使 target 失效，不检查被调用的函数本身是否是纯函数。
+func (o *optimizer) callArgsInvalidateTarget(call *ast.FuncCall, target string) bool {
 	// 检查接收者（方法调用：a.b:method() → self=a.b，可以修改 a.b 的字段）
 	// 只有当 recvPath 是 target 的严格父级时才失效
 	if call.Receiver != nil {
@@ -378,13 +465,13 @@ func funcCallInvalidatesTarget(call *ast.FuncCall, target string) bool {
 			return true
 		}
 		// 同时检查参数中的嵌套函数调用
-		if nestedCallInvalidates(arg, target) {
+		if o.nestedCallInvalidates(arg, target) {
 			return true
 		}
 	}
 
 	// 检查 Function 表达式内的嵌套调用（如 getHandler(a.b)()）
-	if nestedCallInvalidates(call.Function, target) {
+	if o.nestedCallInvalidates(call.Function, target) {
 		return true
 	}
 
@@ -392,79 +479,79 @@ func funcCallInvalidatesTarget(call *ast.FuncCall, target string) bool {
 }
 
 // nestedCallInvalidates 检查表达式中是否存在使 target 失效的嵌套函数调用。
-func nestedCallInvalidates(expr ast.Expr, target string) bool {
+func (o *optimizer) nestedCallInvalidates(expr ast.Expr, target string) bool {
 	if expr == nil {
 		return false
 	}
 	switch e := expr.(type) {
 	case *ast.FuncCall:
-		if funcCallInvalidatesTarget(e, target) {
+		if o.funcCallInvalidatesTarget(e, target) {
 			return true
 		}
 	case *ast.TableAccessor:
-		return nestedCallInvalidates(e.Obj, target)
+		return o.nestedCallInvalidates(e.Obj, target)
 	case *ast.Operator:
-		return nestedCallInvalidates(e.Left, target) || nestedCallInvalidates(e.Right, target)
+		return o.nestedCallInvalidates(e.Left, target) || o.nestedCallInvalidates(e.Right, target)
 	case *ast.TableConstructor:
 		for i, key := range e.Keys {
-			if nestedCallInvalidates(key, target) {
+			if o.nestedCallInvalidates(key, target) {
 				return true
 			}
-			if nestedCallInvalidates(e.Vals[i], target) {
+			if o.nestedCallInvalidates(e.Vals[i], target) {
 				return true
 			}
 		}
 	case *ast.Parens:
-		return nestedCallInvalidates(e.Inner, target)
+		return o.nestedCallInvalidates(e.Inner, target)
 	}
 	return false
 }
 
 // exprContainsFuncCallInvalidating 检查表达式中是否有任何函数调用会使 target 失效。
-func exprContainsFuncCallInvalidating(expr ast.Expr, target string) bool {
+func (o *optimizer) exprContainsFuncCallInvalidating(expr ast.Expr, target string) bool {
 	if expr == nil {
 		return false
 	}
 	switch e := expr.(type) {
 	case *ast.FuncCall:
-		if funcCallInvalidatesTarget(e, target) {
+		if o.funcCallInvalidatesTarget(e, target) {
 			return true
 		}
 		// 递归检查接收者、函数体、参数
-		if exprContainsFuncCallInvalidating(e.Receiver, target) {
+		if o.exprContainsFuncCallInvalidating(e.Receiver, target) {
 			return true
 		}
-		if exprContainsFuncCallInvalidating(e.Function, target) {
+		if o.exprContainsFuncCallInvalidating(e.Function, target) {
 			return true
 		}
 		for _, arg := range e.Args {
-			if exprContainsFuncCallInvalidating(arg, target) {
+			if o.exprContainsFuncCallInvalidating(arg, target) {
 				return true
 			}
 		}
 	case *ast.TableAccessor:
-		return exprContainsFuncCallInvalidating(e.Obj, target) || exprContainsFuncCallInvalidating(e.Key, target)
+		return o.exprContainsFuncCallInvalidating(e.Obj, target) || o.exprContainsFuncCallInvalidating(e.Key, target)
 	case *ast.Operator:
-		return exprContainsFuncCallInvalidating(e.Left, target) || exprContainsFuncCallInvalidating(e.Right, target)
+		return o.exprContainsFuncCallInvalidating(e.Left, target) || o.exprContainsFuncCallInvalidating(e.Right, target)
 	case *ast.TableConstructor:
 		for i, key := range e.Keys {
-			if exprContainsFuncCallInvalidating(key, target) {
+			if o.exprContainsFuncCallInvalidating(key, target) {
 				return true
 			}
-			if exprContainsFuncCallInvalidating(e.Vals[i], target) {
+			if o.exprContainsFuncCallInvalidating(e.Vals[i], target) {
 				return true
 			}
 		}
 	case *ast.Parens:
-		return exprContainsFuncCallInvalidating(e.Inner, target)
+		return o.exprContainsFuncCallInvalidating(e.Inner, target)
 	}
 	return false
 }
 
 // blockContainsWrite 检查代码块中是否包含对 target 的写操作。
-func blockContainsWrite(block []ast.Stmt, target string) bool {
+func (o *optimizer) blockContainsWrite(block []ast.Stmt, target string) bool {
 	for _, stmt := range block {
-		if stmtContainsWrite(stmt, target) {
+		if o.stmtContainsWrite(stmt, target) {
 			return true
 		}
 	}
@@ -472,7 +559,7 @@ func blockContainsWrite(block []ast.Stmt, target string) bool {
 }
 
 // stmtContainsWrite 递归检查语句中是否包含对 target 的写操作。
-func stmtContainsWrite(stmt ast.Stmt, target string) bool {
+func (o *optimizer) stmtContainsWrite(stmt ast.Stmt, target string) bool {
 	switch s := stmt.(type) {
 	case *ast.Assign:
 		// 检查赋值左侧目标
@@ -487,56 +574,56 @@ func stmtContainsWrite(stmt ast.Stmt, target string) bool {
 		}
 		// 检查右侧是否有使 target 失效的函数调用
 		for _, v := range s.Values {
-			if exprContainsFuncCallInvalidating(v, target) {
+			if o.exprContainsFuncCallInvalidating(v, target) {
 				return true
 			}
 		}
 	case *ast.FuncCall:
-		if funcCallInvalidatesTarget(s, target) {
+		if o.funcCallInvalidatesTarget(s, target) {
 			return true
 		}
 	case *ast.DoBlock:
-		if blockContainsWrite(s.Block, target) {
+		if o.blockContainsWrite(s.Block, target) {
 			return true
 		}
 	case *ast.If:
-		if exprContainsFuncCallInvalidating(s.Cond, target) {
+		if o.exprContainsFuncCallInvalidating(s.Cond, target) {
 			return true
 		}
-		if blockContainsWrite(s.Then, target) {
+		if o.blockContainsWrite(s.Then, target) {
 			return true
 		}
-		if blockContainsWrite(s.Else, target) {
+		if o.blockContainsWrite(s.Else, target) {
 			return true
 		}
 	case *ast.WhileLoop:
-		if exprContainsFuncCallInvalidating(s.Cond, target) {
+		if o.exprContainsFuncCallInvalidating(s.Cond, target) {
 			return true
 		}
-		if blockContainsWrite(s.Block, target) {
+		if o.blockContainsWrite(s.Block, target) {
 			return true
 		}
 	case *ast.RepeatUntilLoop:
-		if exprContainsFuncCallInvalidating(s.Cond, target) {
+		if o.exprContainsFuncCallInvalidating(s.Cond, target) {
 			return true
 		}
-		if blockContainsWrite(s.Block, target) {
+		if o.blockContainsWrite(s.Block, target) {
 			return true
 		}
 	case *ast.ForLoopNumeric:
-		if exprContainsFuncCallInvalidating(s.Init, target) || exprContainsFuncCallInvalidating(s.Limit, target) || exprContainsFuncCallInvalidating(s.Step, target) {
+		if o.exprContainsFuncCallInvalidating(s.Init, target) || o.exprContainsFuncCallInvalidating(s.Limit, target) || o.exprContainsFuncCallInvalidating(s.Step, target) {
 			return true
 		}
-		if blockContainsWrite(s.Block, target) {
+		if o.blockContainsWrite(s.Block, target) {
 			return true
 		}
 	case *ast.ForLoopGeneric:
 		for _, init := range s.Init {
-			if exprContainsFuncCallInvalidating(init, target) {
+			if o.exprContainsFuncCallInvalidating(init, target) {
 				return true
 			}
 		}
-		if blockContainsWrite(s.Block, target) {
+		if o.blockContainsWrite(s.Block, target) {
 			return true
 		}
 	}
@@ -546,8 +633,8 @@ func stmtContainsWrite(stmt ast.Stmt, target string) bool {
 // analyzeBlockAccess 分析代码块中各语句对 target 的读写事件。
 // 不递归进入子块的内部事件——子块由外层单独处理。
 // 复合语句作为整体：如果包含写则整条语句标记为写。
-// 已被 oLua 优化过的行（含 "-- opt by oLua"）会被跳过。
-func analyzeBlockAccess(block []ast.Stmt, target string) []AccessEvent {
+// 已被 oLua 优化过的行（含 "-- opt by oLua"）会被跳过，被指令关闭的行中的读也会被去掉。
+func (o *optimizer) analyzeBlockAccess(block []ast.Stmt, target string) []AccessEvent {
 	var events []AccessEvent
 
 	for i, stmt := range block {
@@ -556,8 +643,8 @@ func analyzeBlockAccess(block []ast.Stmt, target string) []AccessEvent {
 		stmtLine := stmt.Line()
 
 		// 跳过 oLua 生成的行（避免重复优化自己的输出）
-		if stmtLine > 0 && stmtLine <= len(gfilecontent) {
-			if strings.Contains(gfilecontent[stmtLine-1], "-- opt by oLua") {
+		if stmtLine > 0 && stmtLine <= len(o.filecontent) {
+			if strings.Contains(o.filecontent[stmtLine-1], "-- opt by oLua") {
 				continue
 			}
 		}
@@ -585,21 +672,21 @@ func analyzeBlockAccess(block []ast.Stmt, target string) []AccessEvent {
 					stmtHasRead = true
 				}
 				// 检查右侧函数调用是否使 target 失效
-				if exprContainsFuncCallInvalidating(v, target) {
+				if o.exprContainsFuncCallInvalidating(v, target) {
 					stmtHasWrite = true
 				}
 			}
 
 			// 检查左侧表达式中的嵌套函数调用（少见但可能存在）
 			for _, t := range s.Targets {
-				if exprContainsFuncCallInvalidating(t, target) {
+				if o.exprContainsFuncCallInvalidating(t, target) {
 					stmtHasWrite = true
 				}
 			}
 
 		case *ast.FuncCall:
 			// 函数调用作为独立语句
-			if funcCallInvalidatesTarget(s, target) {
+			if o.funcCallInvalidatesTarget(s, target) {
 				stmtHasWrite = true
 			}
 			// 函数表达式和参数可能包含读
@@ -616,7 +703,7 @@ func analyzeBlockAccess(block []ast.Stmt, target string) []AccessEvent {
 			}
 
 		case *ast.DoBlock:
-			if blockContainsWrite(s.Block, target) {
+			if o.blockContainsWrite(s.Block, target) {
 				stmtHasWrite = true
 			}
 			if blockContainsRead(s.Block, target) {
@@ -626,9 +713,9 @@ func analyzeBlockAccess(block []ast.Stmt, target string) []AccessEvent {
 		case *ast.If:
 			// 条件表达式的读（条件先于 body 执行，安全）
 			condHasRead := exprContainsPathRead(s.Cond, target)
-			condHasWrite := exprContainsFuncCallInvalidating(s.Cond, target)
+			condHasWrite := o.exprContainsFuncCallInvalidating(s.Cond, target)
 			// body 中的写
-			bodyHasWrite := blockContainsWrite(s.Then, target) || blockContainsWrite(s.Else, target)
+			bodyHasWrite := o.blockContainsWrite(s.Then, target) || o.blockContainsWrite(s.Else, target)
 			bodyHasRead := blockContainsRead(s.Then, target) || blockContainsRead(s.Else, target)
 
 			if condHasRead {
@@ -648,10 +735,10 @@ func analyzeBlockAccess(block []ast.Stmt, target string) []AccessEvent {
 			if exprContainsPathRead(s.Cond, target) {
 				stmtHasRead = true
 			}
-			if exprContainsFuncCallInvalidating(s.Cond, target) {
+			if o.exprContainsFuncCallInvalidating(s.Cond, target) {
 				stmtHasWrite = true
 			}
-			if blockContainsWrite(s.Block, target) {
+			if o.blockContainsWrite(s.Block, target) {
 				stmtHasWrite = true
 			}
 			if blockContainsRead(s.Block, target) {
@@ -662,10 +749,10 @@ func analyzeBlockAccess(block []ast.Stmt, target string) []AccessEvent {
 			if exprContainsPathRead(s.Cond, target) {
 				stmtHasRead = true
 			}
-			if exprContainsFuncCallInvalidating(s.Cond, target) {
+			if o.exprContainsFuncCallInvalidating(s.Cond, target) {
 				stmtHasWrite = true
 			}
-			if blockContainsWrite(s.Block, target) {
+			if o.blockContainsWrite(s.Block, target) {
 				stmtHasWrite = true
 			}
 			if blockContainsRead(s.Block, target) {
@@ -676,7 +763,7 @@ func analyzeBlockAccess(block []ast.Stmt, target string) []AccessEvent {
 			if exprContainsPathRead(s.Init, target) || exprContainsPathRead(s.Limit, target) || exprContainsPathRead(s.Step, target) {
 				stmtHasRead = true
 			}
-			if blockContainsWrite(s.Block, target) {
+			if o.blockContainsWrite(s.Block, target) {
 				stmtHasWrite = true
 			}
 			if blockContainsRead(s.Block, target) {
@@ -689,7 +776,7 @@ func analyzeBlockAccess(block []ast.Stmt, target string) []AccessEvent {
 					stmtHasRead = true
 				}
 			}
-			if blockContainsWrite(s.Block, target) {
+			if o.blockContainsWrite(s.Block, target) {
 				stmtHasWrite = true
 			}
 			if blockContainsRead(s.Block, target) {
@@ -701,12 +788,18 @@ func analyzeBlockAccess(block []ast.Stmt, target string) []AccessEvent {
 				if exprContainsPathRead(item, target) {
 					stmtHasRead = true
 				}
-				if exprContainsFuncCallInvalidating(item, target) {
+				if o.exprContainsFuncCallInvalidating(item, target) {
 					stmtHasWrite = true
 				}
 			}
 		}
 
+		// 语句中的函数体读取了 target 时不算作读：替换会让函数体改为读取定义时缓存的
+		// local（成为该函数的 upvalue），而函数体是在之后调用时才执行的
+		if stmtHasRead && closureReadsTarget(stmt, target) {
+			stmtHasRead = false
+		}
+
 		// 生成事件——同一语句中写在读之后
 		// （如 a.b.c = a.b.d → 先读 a.b，然后 a.b.c 被写但 a.b 仍有效）
 		// 对于复合语句（if/while/for）：条件/头部表达式先于 body 执行，
@@ -714,7 +807,7 @@ func analyzeBlockAccess(block []ast.Stmt, target string) []AccessEvent {
 		// 策略：条件中的读 emit READ（只覆盖条件行），body 的写 emit WRITE（覆盖全语句）
 		// 计算复合语句的结束行
 		stmtEndLine := stmtLine
-		_, maxLine := find_stmt_line_range(stmt)
+		_, maxLine := o.find_stmt_line_range(stmt)
 		if maxLine > stmtEndLine {
 			stmtEndLine = maxLine
 		}
@@ -728,7 +821,7 @@ func analyzeBlockAccess(block []ast.Stmt, target string) []AccessEvent {
 		case *ast.If:
 			isCompound = true
 			// if 条件只求值一次且先于 body 执行，条件中的读安全
-			condOnlyRead = exprContainsPathRead(s.Cond, target) && !exprContainsFuncCallInvalidating(s.Cond, target)
+			condOnlyRead = exprContainsPathRead(s.Cond, target) && !o.exprContainsFuncCallInvalidating(s.Cond, target)
 		case *ast.WhileLoop:
 			isCompound = true
 			// while 条件每次迭代重新求值，如果 body 有写则条件不安全
@@ -741,7 +834,7 @@ func analyzeBlockAccess(block []ast.Stmt, target string) []AccessEvent {
 			isCompound = true
 			// for 的 init/limit/step 只在进入循环前求值一次，安全
 			hasCondRead := exprContainsPathRead(s.Init, target) || exprContainsPathRead(s.Limit, target) || exprContainsPathRead(s.Step, target)
-			hasCondWrite := exprContainsFuncCallInvalidating(s.Init, target) || exprContainsFuncCallInvalidating(s.Limit, target) || exprContainsFuncCallInvalidating(s.Step, target)
+			hasCondWrite := o.exprContainsFuncCallInvalidating(s.Init, target) || o.exprContainsFuncCallInvalidating(s.Limit, target) || o.exprContainsFuncCallInvalidating(s.Step, target)
 			condOnlyRead = hasCondRead && !hasCondWrite
 		case *ast.ForLoopGeneric:
 			isCompound = true
@@ -752,7 +845,7 @@ func analyzeBlockAccess(block []ast.Stmt, target string) []AccessEvent {
 				if exprContainsPathRead(init, target) {
 					hasRead = true
 				}
-				if exprContainsFuncCallInvalidating(init, target) {
+				if o.exprContainsFuncCallInvalidating(init, target) {
 					hasWrite = true
 				}
 			}
@@ -771,6 +864,12 @@ func analyzeBlockAccess(block []ast.Stmt, target string) []AccessEvent {
 				// 计算该语句中有多少个不同的子路径访问了 target
 				// 这样单条语句中多次读取也能形成有效的 group
 				readCount := countDistinctReads(stmt, target)
+				if ifStmt, ok := stmt.(*ast.If); ok && !o.isElseIf(ifStmt) && exprAlwaysReadsPath(ifStmt.Cond, target) {
+					// 第一个条件每次都会读取 target 时，整个 if/elseif 链（各条件和各分支）作为一个区域，
+					// 在 if 之前缓存不会多出读取；否则 target 可能被前面的条件保护，由各分支的子块处理。
+					// elseif 之前不能插入语句，它只作为外层链的一部分计数
+					readCount = countChainReads(ifStmt, target)
+				}
 				if readCount < 1 {
 					readCount = 1
 				}
@@ -784,9 +883,67 @@ func analyzeBlockAccess(block []ast.Stmt, target string) []AccessEvent {
 		}
 	}
 
+	// 被 olua:disable 指令关闭的行保持直接读取，不参与分组；写事件仍然保留以使缓存失效
+	if len(o.disabled) > 0 {
+		filtered := events[:0]
+		for _, event := range events {
+			if event.Type == AccessRead && o.isDisabled("table_access", event.Line, event.EndLine) {
+				continue
+			}
+			filtered = append(filtered, event)
+		}
+		events = filtered
+	}
+
 	return events
 }
 
+// closureReadsTarget 判断语句中定义的函数（包括嵌套在子块中的）的函数体是否读取了 target。
+func closureReadsTarget(stmt ast.Stmt, target string) bool {
+	found := false
+	inner := lua_visitor{f: func(n ast.Node, ok *bool) {
+		if found {
+			*ok = false
+			return
+		}
+		if e, isExpr := n.(ast.Expr); isExpr {
+			if path, pathOk := getExprPath(e); pathOk && (path == target || isPathPrefix(target, path)) {
+				found = true
+				*ok = false
+			}
+		}
+	}}
+	outer := lua_visitor{f: func(n ast.Node, ok *bool) {
+		if found {
+			*ok = false
+			return
+		}
+		if fn, isFunc := n.(*ast.FuncDecl); isFunc {
+			for _, s := range fn.Block {
+				ast.Walk(&inner, s)
+			}
+			*ok = false
+		}
+	}}
+	ast.Walk(&outer, stmt)
+	return found
+}
+
+// maxChunkLocals 是主代码块中已有 local 的上限，Lua 每个函数最多 200 个活动局部变量，
+// 留出余量给嵌套块中的 local
+const maxChunkLocals = 180
+
+// countLocalDecls 统计 block 这一层声明的 local 变量个数（包括 local function）。
+func countLocalDecls(block []ast.Stmt) int {
+	count := 0
+	for _, stmt := range block {
+		if assign, ok := stmt.(*ast.Assign); ok && assign.LocalDecl {
+			count += len(assign.Targets)
+		}
+	}
+	return count
+}
+
 // countDistinctReads 计算单条语句中有多少个不同的子路径访问了 target。
 // 例如 target="a.b"，语句包含 a.b.c, a.b.d, a.b.e → 返回 3（各算一次读）。
 func countDistinctReads(stmt ast.Stmt, target string) int {
@@ -853,6 +1010,62 @@ func countDistinctReads(stmt ast.Stmt, target string) int {
 	return len(paths)
 }
 
+// isElseIf 判断 s 是否是 if 链中的 elseif 分支：在语法树中是外层 if 的 else 块里唯一的语句。
+// else if ... end 也是这样的结构，同样按 elseif 处理。
+func (o *optimizer) isElseIf(s *ast.If) bool {
+	if o.elseIfs == nil {
+		o.elseIfs = map[*ast.If]bool{}
+		f := lua_visitor{f: func(n ast.Node, ok *bool) {
+			if ifStmt, is_if := n.(*ast.If); is_if && len(ifStmt.Else) == 1 {
+				if next, is_next := ifStmt.Else[0].(*ast.If); is_next {
+					o.elseIfs[next] = true
+				}
+			}
+		}}
+		for _, stmt := range o.block {
+			ast.Walk(&f, stmt)
+		}
+	}
+	return o.elseIfs[s]
+}
+
+// countChainReads 计算 if/elseif 链中各条件和各分支对 target 的读次数。
+// 条件和简单语句按不同的子路径计数，分支中的其他复合语句读取了 target 时算一次。
+func countChainReads(s *ast.If, target string) int {
+	count := 0
+	for cur := s; cur != nil; {
+		count += countDistinctReads(&ast.Return{Items: []ast.Expr{cur.Cond}}, target)
+		count += countBlockReads(cur.Then, target)
+		next := (*ast.If)(nil)
+		if len(cur.Else) == 1 {
+			next, _ = cur.Else[0].(*ast.If)
+		}
+		if next == nil {
+			count += countBlockReads(cur.Else, target)
+		}
+		cur = next
+	}
+	return count
+}
+
+// countBlockReads 计算代码块中对 target 的读次数，计数规则与 countChainReads 相同。
+func countBlockReads(block []ast.Stmt, target string) int {
+	count := 0
+	for _, stmt := range block {
+		switch s := stmt.(type) {
+		case *ast.Assign, *ast.FuncCall, *ast.Return:
+			count += countDistinctReads(stmt, target)
+		case *ast.If:
+			count += countChainReads(s, target)
+		default:
+			if stmtContainsRead(stmt, target) {
+				count++
+			}
+		}
+	}
+	return count
+}
+
 // blockContainsRead 检查代码块中是否有语句读取了 target。
 func blockContainsRead(block []ast.Stmt, target string) bool {
 	for _, stmt := range block {
@@ -934,7 +1147,7 @@ func stmtContainsRead(stmt ast.Stmt, target string) bool {
 // 父路径 "a.b" 的计数 = 有多少个不同的子路径访问了它
 // （例如 a.b.c 和 a.b.d 各使 a.b 计数+1，合计 count=2）。
 // 路径计数必须 >= threshold 才算候选。
-func collectTableAccessCandidates(block []ast.Stmt, threshold int) map[string]int {
+func (o *optimizer) collectTableAccessCandidates(block []ast.Stmt, threshold int) map[string]int {
 	counts := make(map[string]int)
 
 	// 每条语句收集叶路径，再统计父路径的贡献
@@ -979,8 +1192,8 @@ func collectTableAccessCandidates(block []ast.Stmt, threshold int) map[string]in
 		for _, stmt := range block {
 			// 跳过 oLua 生成的行
 			stmtLine := stmt.Line()
-			if stmtLine > 0 && stmtLine <= len(gfilecontent) {
-				if strings.Contains(gfilecontent[stmtLine-1], "-- opt by oLua") {
+			if stmtLine > 0 && stmtLine <= len(o.filecontent) {
+				if strings.Contains(o.filecontent[stmtLine-1], "-- opt by oLua") {
 					continue
 				}
 			}
@@ -1104,47 +1317,47 @@ func findReadGroups(events []AccessEvent, threshold int) []ReadGroup {
 // 返回 true 表示已应用优化。
 // 策略：优先尝试当前层级（覆盖范围更广），
 // 当前层无优化机会时才递归进入子块。
-func optimizeBlock(block []ast.Stmt) bool {
-	if has_opt {
+func (o *optimizer) optimizeBlock(block []ast.Stmt) bool {
+	if o.hasOpt {
 		return true
 	}
 
 	// 先尝试当前层级（外层优先，覆盖更广）
-	if optimizeBlockLevel(block) {
+	if o.optimizeBlockLevel(block) {
 		return true
 	}
 
 	// 当前层无优化，递归子块
 	for _, stmt := range block {
-		if has_opt {
+		if o.hasOpt {
 			return true
 		}
 		switch s := stmt.(type) {
 		case *ast.DoBlock:
-			if optimizeBlock(s.Block) {
+			if o.optimizeBlock(s.Block) {
 				return true
 			}
 		case *ast.If:
-			if optimizeBlock(s.Then) {
+			if o.optimizeBlock(s.Then) {
 				return true
 			}
-			if optimizeBlock(s.Else) {
+			if o.optimizeBlock(s.Else) {
 				return true
 			}
 		case *ast.WhileLoop:
-			if optimizeBlock(s.Block) {
+			if o.optimizeBlock(s.Block) {
 				return true
 			}
 		case *ast.RepeatUntilLoop:
-			if optimizeBlock(s.Block) {
+			if o.optimizeBlock(s.Block) {
 				return true
 			}
 		case *ast.ForLoopNumeric:
-			if optimizeBlock(s.Block) {
+			if o.optimizeBlock(s.Block) {
 				return true
 			}
 		case *ast.ForLoopGeneric:
-			if optimizeBlock(s.Block) {
+			if o.optimizeBlock(s.Block) {
 				return true
 			}
 		}
@@ -1157,18 +1370,23 @@ func optimizeBlock(block []ast.Stmt) bool {
 // 处理多个互不冲突的候选以减少重新解析轮次。
 // 候选按最长路径优先排序。两个候选冲突的条件是路径存在前缀关系
 // （如 "a.b" 和 "a.b.c" 冲突，因为优化 "a.b" 会改变 "a.b.c" 依赖的文本）。
-func optimizeBlockLevel(block []ast.Stmt) bool {
-	if has_opt {
+func (o *optimizer) optimizeBlockLevel(block []ast.Stmt) bool {
+	if o.hasOpt {
 		return true
 	}
 
-	threshold := *opt_table_access_threshold
+	threshold := o.opts.TableAccessThreshold
 	if threshold < 2 {
 		threshold = 2
 	}
 
+	// 主代码块中生成的 local 一直存活到文件结束，接近 Lua 的局部变量上限时不再生成
+	if o.isMainChunk(block) && countLocalDecls(block) >= maxChunkLocals {
+		return false
+	}
+
 	// 收集候选
-	candidates := collectTableAccessCandidates(block, threshold)
+	candidates := o.collectTableAccessCandidates(block, threshold)
 	if len(candidates) == 0 {
 		return false
 	}
@@ -1201,7 +1419,7 @@ func optimizeBlockLevel(block []ast.Stmt) bool {
 		blockStartLine = block[0].Line()
 		blockEndLine = blockStartLine
 		for _, stmt := range block {
-			_, maxLine := find_stmt_line_range(stmt)
+			_, maxLine := o.find_stmt_line_range(stmt)
 			if maxLine > blockEndLine {
 				blockEndLine = maxLine
 			}
@@ -1217,12 +1435,12 @@ func optimizeBlockLevel(block []ast.Stmt) bool {
 
 		// 跳过根标识符是 oLua 生成的路径
 		rootIdent := strings.Split(target, ".")[0]
-		if isOluaGeneratedName(rootIdent) {
+		if o.isOluaGeneratedName(rootIdent) {
 			continue
 		}
 
 		// 默认跳过 _G.xxx 路径（可读性差，且通常是常量）
-		if !*opt_table_access_global && rootIdent == "_G" {
+		if !o.opts.TableAccessGlobal && rootIdent == "_G" {
 			continue
 		}
 
@@ -1242,8 +1460,8 @@ func optimizeBlockLevel(block []ast.Stmt) bool {
 		localName := getUniqueLocalName(block, table_access_to_local_name(target))
 		alreadyOptimized := false
 		if blockStartLine > 0 {
-			for lineIdx := blockStartLine - 1; lineIdx < blockEndLine && lineIdx < len(gfilecontent); lineIdx++ {
-				trimmed := strings.TrimSpace(gfilecontent[lineIdx])
+			for lineIdx := blockStartLine - 1; lineIdx < blockEndLine && lineIdx < len(o.filecontent); lineIdx++ {
+				trimmed := strings.TrimSpace(o.filecontent[lineIdx])
 				if strings.Contains(trimmed, "-- opt by oLua") {
 					if strings.Contains(trimmed, " = "+target+" ") ||
 						strings.HasSuffix(trimmed, " = "+target) {
@@ -1258,7 +1476,7 @@ func optimizeBlockLevel(block []ast.Stmt) bool {
 		}
 
 		// 分析读写事件
-		events := analyzeBlockAccess(block, target)
+		events := o.analyzeBlockAccess(block, target)
 		if len(events) == 0 {
 			continue
 		}
@@ -1278,9 +1496,9 @@ func optimizeBlockLevel(block []ast.Stmt) bool {
 				if endLine < startLine {
 					endLine = startLine
 				}
-				for lineNum := startLine; lineNum <= endLine && lineNum <= len(gfilecontent); lineNum++ {
-					line := gfilecontent[lineNum-1]
-					if !strings.Contains(line, "-- opt by oLua") && contain_table_access(line, target) > 0 {
+				for lineNum := startLine; lineNum <= endLine && lineNum <= len(o.filecontent); lineNum++ {
+					line := o.filecontent[lineNum-1]
+					if !strings.Contains(line, "-- opt by oLua") && contain_table_access_in(line, o.longBracketOpen(lineNum), target) > 0 {
 						hasValidGroup = true
 						break
 					}
@@ -1301,7 +1519,7 @@ func optimizeBlockLevel(block []ast.Stmt) bool {
 		for gi := len(groups) - 1; gi >= 0; gi-- {
 			group := groups[gi]
 			isFirst := (gi == 0)
-			applyTableAccessOptimization(target, localName, group, isFirst)
+			o.applyTableAccessOptimization(target, localName, group, isFirst)
 		}
 		appliedPaths = append(appliedPaths, target)
 		appliedAny = true
@@ -1315,23 +1533,34 @@ func optimizeBlockLevel(block []ast.Stmt) bool {
 }
 
 // applyTableAccessOptimization 对单个读组应用优化。
-func applyTableAccessOptimization(target string, localName string, group ReadGroup, isFirstDecl bool) {
+func (o *optimizer) applyTableAccessOptimization(target string, localName string, group ReadGroup, isFirstDecl bool) {
 	if len(group.Events) == 0 {
 		return
 	}
 
 	firstReadLine := group.Events[0].Line
+	lastLine := firstReadLine
+	for _, event := range group.Events {
+		if event.Line > lastLine {
+			lastLine = event.Line
+		}
+		if event.EndLine > lastLine {
+			lastLine = event.EndLine
+		}
+	}
+	rw := Rewrite{Pass: "table_access", Target: target, Local: localName, GroupSize: len(group.Events)}
+	rw.Line, rw.EndLine = o.origRange(firstReadLine, lastLine)
 
 	// 获取首行缩进
-	indent := get_content_space(gfilecontent[firstReadLine-1])
+	indent := get_content_space(o.filecontent[firstReadLine-1])
 
 	// 构造插入行
-	var insertLine string
-	if isFirstDecl {
-		insertLine = indent + "local " + localName + " = " + target + " -- opt by oLua"
-	} else {
-		insertLine = indent + localName + " = " + target + " -- opt by oLua"
+	decl := &ast.Assign{
+		LocalDecl: isFirstDecl,
+		Targets:   []ast.Expr{&ast.ConstIdent{Value: localName}},
+		Values:    []ast.Expr{pathToExpr(target)},
 	}
+	insertLine := stmt_to_lines(decl, indent)[0] + " -- opt by oLua"
 
 	// 替换读事件覆盖的所有行中的 target
 	// 对于复合语句，替换整个语句行范围内的所有行
@@ -1342,38 +1571,48 @@ func applyTableAccessOptimization(target string, localName string, group ReadGro
 		if endLine < startLine {
 			endLine = startLine
 		}
-		for lineNum := startLine; lineNum <= endLine && lineNum <= len(gfilecontent); lineNum++ {
+		for lineNum := startLine; lineNum <= endLine && lineNum <= len(o.filecontent); lineNum++ {
 			if !replacedLines[lineNum] {
 				replacedLines[lineNum] = true
 				// 跳过 oLua 生成的行
-				if strings.Contains(gfilecontent[lineNum-1], "-- opt by oLua") {
+				if strings.Contains(o.filecontent[lineNum-1], "-- opt by oLua") {
 					continue
 				}
-				gfilecontent[lineNum-1] = replace_table_access(gfilecontent[lineNum-1], target, localName)
+				open := o.longBracketOpen(lineNum)
+				rw.Replaced += contain_table_access_in(o.filecontent[lineNum-1], open, target)
+				o.filecontent[lineNum-1] = replace_table_access_in(o.filecontent[lineNum-1], open, target, localName)
 			}
 		}
 	}
 
 	// 在第一个读行之前插入 local 声明
-	var filecontent []string
-	filecontent = append(filecontent, gfilecontent[:firstReadLine-1]...)
-	filecontent = append(filecontent, insertLine)
-	filecontent = append(filecontent, gfilecontent[firstReadLine-1:]...)
-	gfilecontent = filecontent
-
-	log.Printf("opt table_access at: %s:%d target=%s", gfilename, firstReadLine, target)
-	goptcount++
-	has_opt = true
+	o.spliceLines(firstReadLine, firstReadLine-1, []string{insertLine})
+
+	o.logf("opt table_access at: %s:%d target=%s", o.filename, firstReadLine, target)
+	o.addRewrite(rw)
 }
 
 // ============================================================================
 // 字符串替换（带单词边界检测）
 // ============================================================================
 
-// contain_table_access 统计 content 中 src 出现的次数（带单词边界检查）。
+// contain_table_access 统计 content 代码部分中 src 出现的次数（带单词边界检查，不含字符串和注释）。
 func contain_table_access(content string, src string) int {
+	return contain_table_access_in(content, -1, src)
+}
+
+// contain_table_access_in 同 contain_table_access，open 为行首未闭合的长括号等号个数（-1 表示没有）。
+func contain_table_access_in(content string, open int, src string) int {
+	ret := 0
+	map_code(content, open, func(code string) string {
+		ret += contain_code_access(code, src)
+		return code
+	})
+	return ret
+}
+
+func contain_code_access(tmp string, src string) int {
 	ret := 0
-	tmp := content
 	begin := 0
 	for {
 		idx := strings.Index(tmp[begin:], src)
@@ -1401,9 +1640,20 @@ func contain_table_access(content string, src string) int {
 	return ret
 }
 
-// replace_table_access 将 content 中的 src 替换为 dst（带单词边界检查）。
+// replace_table_access 将 content 代码部分中的 src 替换为 dst（带单词边界检查，字符串和注释不变）。
 func replace_table_access(content string, src string, dst string) string {
-	tmp := content
+	return replace_table_access_in(content, -1, src, dst)
+}
+
+// replace_table_access_in 同 replace_table_access，open 为行首未闭合的长括号等号个数（-1 表示没有）。
+func replace_table_access_in(content string, open int, src string, dst string) string {
+	ret, _ := map_code(content, open, func(code string) string {
+		return replace_code_access(code, src, dst)
+	})
+	return ret
+}
+
+func replace_code_access(tmp string, src string, dst string) string {
 	begin := 0
 	for {
 		idx := strings.Index(tmp[begin:], src)
@@ -1431,11 +1681,119 @@ func replace_table_access(content string, src string, dst string) string {
 	return tmp
 }
 
+// map_code 对 content 中字符串和注释之外的每段代码调用 f，用 f 的结果替换该段代码。
+// open 为行首仍未闭合的长字符串或长注释（[[ ]]、--[==[ ]==]）的等号个数，-1 表示没有；
+// 返回替换后的内容和行尾未闭合的长括号等号个数，供下一行继续使用。
+func map_code(content string, open int, f func(code string) string) (string, int) {
+	var sb strings.Builder
+	code_start := 0
+	skip := func(i int, j int) {
+		sb.WriteString(f(content[code_start:i]))
+		sb.WriteString(content[i:j])
+		code_start = j
+	}
+	// close_long 返回从 i 开始查找 level 级长括号结束位置之后的下标，找不到时返回 -1
+	close_long := func(i int, level int) int {
+		if k := strings.Index(content[i:], "]"+strings.Repeat("=", level)+"]"); k >= 0 {
+			return i + k + level + 2
+		}
+		return -1
+	}
+	i := 0
+	if open >= 0 {
+		j := close_long(0, open)
+		if j < 0 {
+			return content, open
+		}
+		skip(0, j)
+		i = j
+		open = -1
+	}
+	for i < len(content) {
+		ch := content[i]
+		switch {
+		case ch == '"' || ch == '\'':
+			j := i + 1
+			for j < len(content) && content[j] != ch {
+				if content[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j > len(content) {
+				j = len(content)
+			} else if j < len(content) {
+				j++
+			}
+			skip(i, j)
+			i = j
+		case strings.HasPrefix(content[i:], "--"):
+			j := len(content)
+			if level, ok := long_bracket_level(content[i+2:]); ok {
+				if k := close_long(i+2, level); k >= 0 {
+					j = k
+				} else {
+					open = level
+				}
+			}
+			skip(i, j)
+			i = j
+		case ch == '[':
+			level, ok := long_bracket_level(content[i:])
+			if !ok {
+				i++
+				continue
+			}
+			j := len(content)
+			if k := close_long(i, level); k >= 0 {
+				j = k
+			} else {
+				open = level
+			}
+			skip(i, j)
+			i = j
+		default:
+			i++
+		}
+	}
+	sb.WriteString(f(content[code_start:]))
+	return sb.String(), open
+}
+
+// long_bracket_states 返回每行行首未闭合的长字符串或长注释的等号个数，-1 表示没有。
+func long_bracket_states(lines []string) []int {
+	states := make([]int, len(lines))
+	open := -1
+	for i, line := range lines {
+		states[i] = open
+		_, open = map_code(line, open, func(code string) string { return code })
+	}
+	return states
+}
+
+// long_bracket_level 判断 s 是否以长括号 [[ 或 [==[ 开头，返回等号的个数。
+func long_bracket_level(s string) (int, bool) {
+	if !strings.HasPrefix(s, "[") {
+		return 0, false
+	}
+	level := 1
+	for level < len(s) && s[level] == '=' {
+		level++
+	}
+	if level < len(s) && s[level] == '[' {
+		return level - 1, true
+	}
+	return 0, false
+}
+
 // ============================================================================
 // 入口
 // ============================================================================
 
-// opt_func_table_access 对单个函数执行表访问优化。
-func opt_func_table_access(func_decl *ast.FuncDecl) {
-	optimizeBlock(func_decl.Block)
+// opt_block_table_access 对单个函数体或主代码块执行表访问优化。
+func (o *optimizer) opt_block_table_access(block []ast.Stmt) {
+	if o.opts.TableAccessHoist && o.hoistLoopInvariants(block) {
+		return
+	}
+	o.optimizeBlock(block)
 }
@@ -0,0 +1,190 @@
+package olua
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/milochristiansen/lua/ast"
+)
+
+// ============================================================================
+// 循环不变量外提：把循环中不会失效的表路径缓存到循环之前
+// ============================================================================
+//
+// optimizeBlock 把 local 放在第一次读之前，对循环体来说每次迭代仍然要查找一次。
+// 开启 TableAccessHoist 后，循环（条件、头部和循环体，包括嵌套的子块）中没有任何
+// 使 a.b.c 失效的写时，local 放在循环之前：
+//
+//	local cfg_ui_items = cfg.ui.items -- opt by oLua
+//	for i = 1, #cfg_ui_items do
+//	    sum = sum + cfg_ui_items[i].width
+//	end
+//
+// 外提后路径在循环之前就会被读取（即使循环一次都不执行），因此不论路径有几段，
+// 都必须在循环头部（for 的初值、上限、步长和迭代器，while 的条件）中读取。
+// 只在循环体中读取的路径不外提：循环一次都不执行时（如 for i = 1, 0 do），
+// 或读取被 if cfg then ... end 这样的条件保护时，外提会读取原来不会读取的路径。
+// and/or 右侧的读也是有条件的，不算。
+//
+// 循环中定义的函数读取或修改该路径时不外提：函数可能在循环之后才被调用。
+
+// hoistLoopInvariants 在 block 及其子块（不含嵌套函数）的循环中外提一个不变路径。
+func (o *optimizer) hoistLoopInvariants(block []ast.Stmt) bool {
+	for i, stmt := range block {
+		if o.hasOpt {
+			return true
+		}
+		switch s := stmt.(type) {
+		case *ast.ForLoopNumeric, *ast.ForLoopGeneric, *ast.WhileLoop, *ast.RepeatUntilLoop:
+			if o.hoistLoop(block, i) {
+				return true
+			}
+		case *ast.DoBlock:
+			if o.hoistLoopInvariants(s.Block) {
+				return true
+			}
+			continue
+		case *ast.If:
+			if o.hoistLoopInvariants(s.Then) || o.hoistLoopInvariants(s.Else) {
+				return true
+			}
+			continue
+		}
+		// 外层循环没有可外提的路径时尝试内层循环
+		for _, inner := range loop_body(stmt) {
+			if o.hoistLoopInvariants(inner) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hoistLoop 尝试把 block[idx] 循环中的一个不变路径外提到循环之前，成功时返回 true。
+func (o *optimizer) hoistLoop(block []ast.Stmt, idx int) bool {
+	loop := block[idx]
+	loop_start, loop_end := o.find_stmt_line_range(loop)
+	if idx > 0 {
+		// 循环必须独占起始行，local 才能插在循环之前
+		if _, prev_end := o.find_stmt_line_range(block[idx-1]); prev_end >= loop_start {
+			return false
+		}
+	}
+	if o.isDisabled("table_access", loop_start, loop_end) {
+		return false
+	}
+
+	candidates := o.collectTableAccessCandidates([]ast.Stmt{loop}, 1)
+	var paths []string
+	for path := range candidates {
+		paths = append(paths, path)
+	}
+	// 最长路径优先（外提收益更大），其次按字母序保证稳定
+	sort.Slice(paths, func(i, j int) bool {
+		depthI, depthJ := strings.Count(paths[i], "."), strings.Count(paths[j], ".")
+		if depthI != depthJ {
+			return depthI > depthJ
+		}
+		return paths[i] < paths[j]
+	})
+
+	shadowed := loopLocalNames(loop)
+	for _, target := range paths {
+		root := strings.Split(target, ".")[0]
+		if shadowed[root] || o.isOluaGeneratedName(root) {
+			continue
+		}
+		if !o.opts.TableAccessGlobal && root == "_G" {
+			continue
+		}
+		if !o.readOnLoopEntry(loop, target) {
+			continue
+		}
+		if o.stmtContainsWrite(loop, target) || closureReadsTarget(loop, target) || o.closureWritesTarget(loop, target) {
+			continue
+		}
+		if o.countLoopText(loop_start, loop_end, target) == 0 {
+			// 动态 key 如 list[i] 也会产生路径 list.i，文本中没有对应的点号访问
+			continue
+		}
+		o.applyLoopHoist(block, target, loop_start, loop_end)
+		return true
+	}
+	return false
+}
+
+// readOnLoopEntry 判断 target 是否在进入循环时一定会被读取：只有循环头部（for 的初值、上限、步长和迭代器，
+// while 的条件）中不在 and/or 右侧的读才算。循环体可能一次都不执行，repeat 的条件在循环体之后才求值，都不算。
+func (o *optimizer) readOnLoopEntry(loop ast.Stmt, target string) bool {
+	switch s := loop.(type) {
+	case *ast.ForLoopNumeric:
+		return exprAlwaysReadsPath(s.Init, target) || exprAlwaysReadsPath(s.Limit, target) || exprAlwaysReadsPath(s.Step, target)
+	case *ast.ForLoopGeneric:
+		for _, init := range s.Init {
+			if exprAlwaysReadsPath(init, target) {
+				return true
+			}
+		}
+	case *ast.WhileLoop:
+		return exprAlwaysReadsPath(s.Cond, target)
+	}
+	return false
+}
+
+// closureWritesTarget 判断语句中定义的函数的函数体是否可能使 target 失效。
+func (o *optimizer) closureWritesTarget(stmt ast.Stmt, target string) bool {
+	found := false
+	f := lua_visitor{f: func(n ast.Node, ok *bool) {
+		if found {
+			*ok = false
+			return
+		}
+		if fn, is_func := n.(*ast.FuncDecl); is_func {
+			if o.blockContainsWrite(fn.Block, target) {
+				found = true
+			}
+		}
+	}}
+	ast.Walk(&f, stmt)
+	return found
+}
+
+// countLoopText 统计循环各行（不含 oLua 生成的行）中 target 的文本出现次数。
+func (o *optimizer) countLoopText(loop_start int, loop_end int, target string) int {
+	count := 0
+	for line := loop_start; line <= loop_end; line++ {
+		content := o.filecontent[line-1]
+		if !strings.Contains(content, "-- opt by oLua") {
+			count += contain_table_access_in(content, o.longBracketOpen(line), target)
+		}
+	}
+	return count
+}
+
+// applyLoopHoist 在循环之前插入 target 的缓存，并替换循环中所有行的 target。
+func (o *optimizer) applyLoopHoist(block []ast.Stmt, target string, loop_start int, loop_end int) {
+	local_name := getUniqueLocalName(o.scopeBlock(block), table_access_to_local_name(target))
+	rw := Rewrite{Pass: "table_access", Target: target, Local: local_name, GroupSize: 1}
+	rw.Line, rw.EndLine = o.origRange(loop_start, loop_end)
+
+	for line := loop_start; line <= loop_end; line++ {
+		content := o.filecontent[line-1]
+		if strings.Contains(content, "-- opt by oLua") {
+			continue
+		}
+		open := o.longBracketOpen(line)
+		rw.Replaced += contain_table_access_in(content, open, target)
+		o.filecontent[line-1] = replace_table_access_in(content, open, target, local_name)
+	}
+
+	decl := &ast.Assign{
+		LocalDecl: true,
+		Targets:   []ast.Expr{&ast.ConstIdent{Value: local_name}},
+		Values:    []ast.Expr{pathToExpr(target)},
+	}
+	indent := get_content_space(o.filecontent[loop_start-1])
+	o.spliceLines(loop_start, loop_start-1, []string{stmt_to_lines(decl, indent)[0] + " -- opt by oLua"})
+
+	o.logf("opt table_access hoist at: %s:%d target=%s", o.filename, loop_start, target)
+	o.addRewrite(rw)
+}
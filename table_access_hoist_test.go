@@ -0,0 +1,111 @@
+package olua
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// ============================================================================
+// 集成测试：对比优化器输出与期望文件
+// ============================================================================
+
+// tableAccessHoistOptions 返回启用 table 访问优化和循环外提的测试选项。
+func tableAccessHoistOptions() Options {
+	opts := tableAccessOptions()
+	opts.TableAccessHoist = true
+	return opts
+}
+
+func TestTableAccessHoist(t *testing.T) {
+	compareOptOutputWith(t, tableAccessHoistOptions(), "input/table_access_hoist.lua", "output/table_access_hoist.lua")
+}
+
+// ============================================================================
+// 单元测试：外提条件
+// ============================================================================
+
+func TestTableAccessHoistSkips(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		// forbid 不应出现在输出中，为空时表示不应有任何改写
+		forbid string
+	}{
+		{"write in body", "function f(n)\n    for i = 1, n do\n        a.b.x = a.b.x + i\n        a.b = nil\n    end\nend\n", ""},
+		{"call with parent", "function f(n)\n    for i = 1, n do\n        print(a.b.c)\n        reset(a)\n    end\nend\n", ""},
+		{"conditional deep read", "function f(n)\n    for i = 1, n do\n        if i > 1 then\n            print(a.b.c)\n        end\n    end\nend\n", "a_b_c"},
+		{"conditional two-segment read", "function f(n)\n    for i = 1, n do\n        if cfg then\n            s = s + cfg.a.b + cfg.a.c\n        end\n    end\nend\n", "local cfg_a = cfg.a -- opt by oLua\n    for"},
+		{"body read", "function f(a, n)\n    local s = 0\n    for i = 1, n do\n        s = s + a.b.c\n    end\n    return s\nend\n", "local a_b_c = a.b.c -- opt by oLua\n    for"},
+		{"repeat body read", "function f(q)\n    repeat\n        print(q.a.b)\n    until q.a.b == nil\nend\n", "local q_a_b = q.a.b -- opt by oLua\n    repeat"},
+		{"read right of and", "function f(n)\n    for i = 1, n do\n        print(x and a.b.c, x and a.b.d)\n    end\nend\n", "local a_b = a.b -- opt by oLua\n    for"},
+		{"closure", "function f(n)\n    for i = 1, n do\n        g(function() return a.b end)\n        print(a.b)\n    end\nend\n", ""},
+		{"loop variable", "function f(list)\n    for _, a in ipairs(list) do\n        print(a.b)\n    end\nend\n", ""},
+		{"dynamic key", "function f(list, n)\n    for i = 1, n do\n        print(list[i])\n    end\nend\n", ""},
+		{"disabled", "function f(n)\n    -- olua:disable-next-line table_access\n    for i = 1, n do\n        print(a.b)\n    end\nend\n", ""},
+	}
+	for _, tt := range tests {
+		out, _, err := Optimize([]byte(tt.src), tableAccessHoistOptions())
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		forbid := tt.forbid
+		if forbid == "" {
+			forbid = "-- opt by oLua"
+		}
+		if strings.Contains(string(out), forbid) {
+			t.Errorf("%s: expected no hoisting, got:\n%s", tt.name, out)
+		}
+	}
+}
+
+func TestTableAccessHoistNested(t *testing.T) {
+	src := "function f(n)\n    for i = 1, n do\n        for j = 1, #a.b do\n            print(a.b[j])\n        end\n        a.b = {}\n    end\nend\n"
+	out, _, err := Optimize([]byte(src), tableAccessHoistOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 外层循环写了 a.b，只能外提到内层循环之前
+	want := "        local a_b = a.b -- opt by oLua\n        for j = 1, #a_b do\n            print(a_b[j])\n"
+	if !strings.Contains(string(out), want) {
+		t.Errorf("expected a.b hoisted before the inner loop, got:\n%s", out)
+	}
+}
+
+func TestTableAccessHoistGuardedVerify(t *testing.T) {
+	// cfg 为 nil 时循环体只在条件成立时读取 cfg.a，外提后会出错
+	src := `function f(n)
+    local s = 0
+    for i = 1, n do
+        if cfg then
+            s = s + cfg.a.b + cfg.a.c
+        end
+    end
+    return s
+end
+`
+	optimized, _, err := Optimize([]byte(src), tableAccessHoistOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diffs := verifyDiffs(t, src, string(optimized), VerifyOptions{Entry: "return f(3)"}); len(diffs) != 0 {
+		t.Errorf("optimized code diverged: %v\n%s", diffs, optimized)
+	}
+}
+
+func TestTableAccessHoistZeroIterations(t *testing.T) {
+	src, err := os.ReadFile("input/table_access_hoist.lua")
+	if err != nil {
+		t.Fatal(err)
+	}
+	optimized, _, err := Optimize(src, tableAccessHoistOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 循环一次都不执行时 a.b 不会被读取，优化后也不能读取
+	for _, entry := range []string{"return zero_iterations({}, 0)", "return sum_items({ui = {items = {}}})"} {
+		if diffs := verifyDiffs(t, string(src), string(optimized), VerifyOptions{Entry: entry}); len(diffs) != 0 {
+			t.Errorf("%s: optimized code diverged: %v\n%s", entry, diffs, optimized)
+		}
+	}
+}
@@ -1,4 +1,4 @@
-package main
+package olua
 
 import (
 	"fmt"
@@ -68,6 +68,68 @@ func TestTableAccessPureFunc(t *testing.T) {
 	compareOptOutput(t, "input/table_access_purefunc.lua", "output/table_access_purefunc.lua")
 }
 
+func TestTableAccessChunk(t *testing.T) {
+	compareOptOutput(t, "input/table_access_chunk.lua", "output/table_access_chunk.lua")
+}
+
+func TestTableAccessIfChain(t *testing.T) {
+	compareOptOutput(t, "input/table_access_ifchain.lua", "output/table_access_ifchain.lua")
+}
+
+func TestTableAccessIfChainGuard(t *testing.T) {
+	// 第一个条件保护了 elseif 中的读，不能在 if 之前缓存；elseif 不在行首时也要按语法树识别
+	srcs := []string{`function f(t)
+    if t == nil then
+        return "none"
+    elseif t.b.kind == 1 then
+        return t.b.name
+    else
+        return t.b.kind
+    end
+end
+`, `function f(t)
+    if t == nil then return "none" elseif t.b.kind == 1 then
+        return t.b.name
+    else
+        return t.b.kind
+    end
+end
+`}
+	for _, src := range srcs {
+		optimized, report, err := Optimize([]byte(src), tableAccessOptions())
+		if err != nil {
+			t.Fatalf("Optimize failed: %v", err)
+		}
+		if len(report.Rewrites) != 0 {
+			t.Fatalf("rewrites = %+v:\n%s", report.Rewrites, optimized)
+		}
+		entry := `return f(nil), f({b = {kind = 1, name = "x"}}), f({b = {kind = 2}})`
+		if diffs := verifyDiffs(t, src, string(optimized), VerifyOptions{Entry: entry}); len(diffs) != 0 {
+			t.Errorf("optimized code diverged: %v\n%s", diffs, optimized)
+		}
+	}
+}
+
+func TestTableAccessChunkLocalLimit(t *testing.T) {
+	// 主代码块的 local 接近上限时不再生成新的 local，嵌套块不受影响
+	var sb strings.Builder
+	for i := 0; i < maxChunkLocals; i++ {
+		fmt.Fprintf(&sb, "local v%d = %d\n", i, i)
+	}
+	sb.WriteString("local x = a.b.c + a.b.d\n")
+	sb.WriteString("do\n    local y = a.b.c + a.b.d\nend\n")
+	out, report, err := Optimize([]byte(sb.String()), tableAccessOptions())
+	if err != nil {
+		t.Fatalf("Optimize failed: %v", err)
+	}
+	if report.OptCount != 1 || len(report.Rewrites) != 1 || report.Rewrites[0].Line != maxChunkLocals+3 {
+		t.Fatalf("report = %+v", report)
+	}
+	if !strings.Contains(string(out), "local x = a.b.c + a.b.d\n") {
+		t.Errorf("top-level statement should not be rewritten:\n%s", out)
+	}
+}
+
 // ============================================================================
 // 单元测试：辅助函数
 // ============================================================================
@@ -164,6 +226,7 @@ func TestContainTableAccess(t *testing.T) {
 		{"a.bc = 1", "a.b", 0},         // 后面有字母
 		{"a.b = a.b + a.b", "a.b", 3},
 		{"nothing here", "a.b", 0},
+		{"x = a.b .. \"a.b\" .. [[a.b]] -- a.b", "a.b", 1}, // 字符串和注释不算
 	}
 	for _, tt := range tests {
 		got := contain_table_access(tt.content, tt.src)
@@ -185,6 +248,7 @@ func TestReplaceTableAccess(t *testing.T) {
 		{"xa.b = 1", "a.b", "a_b", "xa.b = 1"},       // 前面有字母，不替换
 		{"a.bc = 1", "a.b", "a_b", "a.bc = 1"},       // 后面有字母，不替换
 		{"if a.b then a.b.c = 1 end", "a.b", "a_b", "if a_b then a_b.c = 1 end"},
+		{"print(a.b, 'a.b', \"a\\\"a.b\") --[[ a.b ]] print(a.b) -- a.b", "a.b", "a_b", "print(a_b, 'a.b', \"a\\\"a.b\") --[[ a.b ]] print(a_b) -- a.b"},
 	}
 	for _, tt := range tests {
 		got := replace_table_access(tt.content, tt.src, tt.dst)
@@ -194,16 +258,45 @@ func TestReplaceTableAccess(t *testing.T) {
 	}
 }
 
+func TestLongBracketStates(t *testing.T) {
+	lines := []string{
+		"x = a.b .. [[",
+		"a.b",
+		"]] .. a.b --[==[ a.b",
+		"a.b ]]",
+		"]==] y = a.b",
+		"z = [[a.b]] .. a.b",
+	}
+	states := long_bracket_states(lines)
+	wantStates := []int{-1, 0, 0, 2, 2, -1}
+	want := []string{
+		"x = a_b .. [[",
+		"a.b",
+		"]] .. a_b --[==[ a.b",
+		"a.b ]]",
+		"]==] y = a_b",
+		"z = [[a.b]] .. a_b",
+	}
+	for i, line := range lines {
+		if states[i] != wantStates[i] {
+			t.Errorf("line %d: state = %d, want %d", i+1, states[i], wantStates[i])
+		}
+		if got := replace_table_access_in(line, states[i], "a.b", "a_b"); got != want[i] {
+			t.Errorf("line %d: replace_table_access_in = %q, want %q", i+1, got, want[i])
+		}
+	}
+}
+
 // ============================================================================
 // 阈值测试
 // ============================================================================
 
 func TestThreshold3(t *testing.T) {
 	// threshold=3 时，每组只有 2 次读的函数不应被优化
-	*opt_table_access_threshold = 3
-	defer func() { *opt_table_access_threshold = 2 }()
+	opts := tableAccessOptions()
+	opts.TableAccessThreshold = 3
 
-	actual, err := runOptimizer("input/table_access_advanced.lua")
+	actual, err := runOptimizer("input/table_access_advanced.lua", opts)
 	if err != nil {
 		t.Fatalf("optimizer failed: %v", err)
 	}
@@ -238,10 +331,10 @@ func TestThreshold3(t *testing.T) {
 
 func TestThreshold1FallsBackTo2(t *testing.T) {
 	// threshold=1 应被强制为 2（最小值）
-	*opt_table_access_threshold = 1
-	defer func() { *opt_table_access_threshold = 2 }()
+	opts := tableAccessOptions()
+	opts.TableAccessThreshold = 1
 
-	actual, err := runOptimizer("input/table_access_advanced.lua")
+	actual, err := runOptimizer("input/table_access_advanced.lua", opts)
 	if err != nil {
 		t.Fatalf("optimizer failed: %v", err)
 	}
@@ -301,7 +394,8 @@ func TestGetUniqueLocalNameFallback(t *testing.T) {
 
 func TestNestedCallInvalidatesNil(t *testing.T) {
 	// nil 输入返回 false
-	if nestedCallInvalidates(nil, "a.b") {
+	o := newTestOptimizer()
+	if o.nestedCallInvalidates(nil, "a.b") {
 		t.Error("nestedCallInvalidates(nil, \"a.b\") = true, want false")
 	}
 }
@@ -309,6 +403,7 @@ func TestNestedCallInvalidatesNil(t *testing.T) {
 func TestNestedCallInvalidatesTableConstructor(t *testing.T) {
 	// TableConstructor key 中含使 target 失效的函数调用
 	// target="a.b.c"，foo(a.b) 传入 a.b 是 target 的严格父级 → 失效
+	o := newTestOptimizer()
 	source := "function test() local t = {[foo(a.b)] = 1, bar = baz(a.b)} end\n"
 	block, err := parseSource(source)
 	if err != nil {
@@ -318,7 +413,7 @@ func TestNestedCallInvalidatesTableConstructor(t *testing.T) {
 	f := lua_visitor{f: func(n ast.Node, ok *bool) {
 		if n != nil {
 			if tc, isTc := n.(*ast.TableConstructor); isTc {
-				if nestedCallInvalidates(tc, "a.b.c") {
+				if o.nestedCallInvalidates(tc, "a.b.c") {
 					found = true
 				}
 				*ok = false
@@ -335,6 +430,7 @@ func TestNestedCallInvalidatesTableConstructor(t *testing.T) {
 
 func TestNestedCallInvalidatesParens(t *testing.T) {
 	// Parens 内含函数调用，target 是参数的子路径
+	o := newTestOptimizer()
 	source := "function test() local x = (foo(a.b)) end\n"
 	block, err := parseSource(source)
 	if err != nil {
@@ -344,7 +440,7 @@ func TestNestedCallInvalidatesParens(t *testing.T) {
 	f := lua_visitor{f: func(n ast.Node, ok *bool) {
 		if n != nil {
 			if p, isP := n.(*ast.Parens); isP {
-				if nestedCallInvalidates(p, "a.b.c") {
+				if o.nestedCallInvalidates(p, "a.b.c") {
 					found = true
 				}
 				*ok = false
@@ -361,6 +457,7 @@ func TestNestedCallInvalidatesParens(t *testing.T) {
 
 func TestNestedCallInvalidatesTableConstructorVals(t *testing.T) {
 	// 确保 TableConstructor vals 分支被覆盖（key 不含调用，val 含调用）
+	o := newTestOptimizer()
 	source := "function test() local t = {[\"key\"] = foo(a.b)} end\n"
 	block, err := parseSource(source)
 	if err != nil {
@@ -381,7 +478,7 @@ func TestNestedCallInvalidatesTableConstructorVals(t *testing.T) {
 		t.Fatal("TableConstructor not found in AST")
 	}
 	// target="a.b.c"，foo(a.b) 中 a.b 是 target 的父级 → 失效
-	if !nestedCallInvalidates(tc, "a.b.c") {
+	if !o.nestedCallInvalidates(tc, "a.b.c") {
 		t.Error("nestedCallInvalidates({[\"key\"]=foo(a.b)}, target=a.b.c) = false, want true")
 	}
 }
@@ -389,6 +486,7 @@ func TestNestedCallInvalidatesTableConstructorVals(t *testing.T) {
 func TestExprContainsFuncCallInvalidatingFunctionExpr(t *testing.T) {
 	// getHandler(a.b)(123) — Function 表达式内含 invalidating call
 	// target="a.b.c"，foo(a.b) 中 a.b 是 target 的父级 → 失效
+	o := newTestOptimizer()
 	source := "function test() getHandler(a.b)(123) end\n"
 	block, err := parseSource(source)
 	if err != nil {
@@ -399,7 +497,7 @@ func TestExprContainsFuncCallInvalidatingFunctionExpr(t *testing.T) {
 		if n != nil {
 			if fc, isFc := n.(*ast.FuncCall); isFc {
 				if fc.Function != nil {
-					if exprContainsFuncCallInvalidating(fc, "a.b.c") {
+					if o.exprContainsFuncCallInvalidating(fc, "a.b.c") {
 						found = true
 					}
 				}
@@ -423,31 +521,20 @@ func TestExprContainsFuncCallInvalidatingRecursive(t *testing.T) {
 
 func TestApplyTableAccessOptimizationEmpty(t *testing.T) {
 	// 空 events 不应 panic
+	o := newTestOptimizer()
 	group := ReadGroup{Events: nil}
-	applyTableAccessOptimization("a.b", "a_b", group, true)
+	o.applyTableAccessOptimization("a.b", "a_b", group, true)
 }
 
 func TestApplyTableAccessOptimizationWithOluaLine(t *testing.T) {
 	// 测试替换时跳过 oLua 生成行 + endLine < startLine 防御路径
-	oldContent := gfilecontent
-	oldOpt := has_opt
-	oldCount := goptcount
-	oldFilename := gfilename
-	defer func() {
-		gfilecontent = oldContent
-		has_opt = oldOpt
-		goptcount = oldCount
-		gfilename = oldFilename
-	}()
-
-	gfilecontent = []string{
+	o := newTestOptimizer()
+	o.setSource([]string{
 		"    local a_b = a.b -- opt by oLua",
 		"    local x = a.b.c",
 		"    local y = a.b.d",
-	}
-	gfilename = "test"
-	goptcount = 0
-	has_opt = false
+	})
+	o.filename = "test"
 
 	// endLine < Line 触发修正路径
 	group := ReadGroup{
@@ -456,29 +543,25 @@ func TestApplyTableAccessOptimizationWithOluaLine(t *testing.T) {
 			{Type: AccessRead, Line: 3, EndLine: 3, StmtIdx: 1},
 		},
 	}
-	applyTableAccessOptimization("a.b", "a_b", group, false)
+	o.applyTableAccessOptimization("a.b", "a_b", group, false)
 }
 
 func TestOptimizeBlockLevelHasOptGuard(t *testing.T) {
-	// 测试 has_opt=true 时的 guard 路径
-	oldOpt := has_opt
-	defer func() { has_opt = oldOpt }()
-
-	has_opt = true
-	result := optimizeBlockLevel(nil)
+	// 测试 hasOpt=true 时的 guard 路径
+	o := newTestOptimizer()
+	o.hasOpt = true
+	result := o.optimizeBlockLevel(nil)
 	if !result {
-		t.Error("optimizeBlockLevel with has_opt=true should return true")
+		t.Error("optimizeBlockLevel with hasOpt=true should return true")
 	}
 }
 
 func TestOptimizeBlockHasOptGuard(t *testing.T) {
-	// 测试 has_opt=true 时的 guard 路径
-	oldOpt := has_opt
-	defer func() { has_opt = oldOpt }()
-
-	has_opt = true
-	result := optimizeBlock(nil)
+	// 测试 hasOpt=true 时的 guard 路径
+	o := newTestOptimizer()
+	o.hasOpt = true
+	result := o.optimizeBlock(nil)
 	if !result {
-		t.Error("optimizeBlock with has_opt=true should return true")
+		t.Error("optimizeBlock with hasOpt=true should return true")
 	}
 }
@@ -1,12 +1,14 @@
-package main
+package olua
 
 import (
+	"fmt"
+	"regexp"
+	"strconv"
+
 	"github.com/milochristiansen/lua/ast"
-	"log"
-	"strings"
 )
 
-func find_last_table_constructor(block []ast.Stmt) (bool, []ast.Stmt, ast.Stmt, int, int) {
+func (o *optimizer) find_last_table_constructor(block []ast.Stmt) (bool, []ast.Stmt, ast.Stmt, int, int) {
 	var r_ok bool
 	var r_block []ast.Stmt
 	var r_stmt ast.Stmt
@@ -26,42 +28,42 @@ func find_last_table_constructor(block []ast.Stmt) (bool, []ast.Stmt, ast.Stmt,
 				}
 			}
 			if is_new {
-				used_count, end_line := get_used_table_constructor_assign(block, stmt)
+				used_count, end_line := o.get_used_table_constructor_assign(block, stmt)
 				if used_count > 0 {
 					r_ok, r_block, r_stmt, r_used_count, r_end_line = true, block, stmt, used_count, end_line
 				}
 			}
 		case *ast.DoBlock:
-			ok, ret_block, ret_stmt, ret_used_count, ret_end_line := find_last_table_constructor(nn.Block)
+			ok, ret_block, ret_stmt, ret_used_count, ret_end_line := o.find_last_table_constructor(nn.Block)
 			if ok {
 				r_ok, r_block, r_stmt, r_used_count, r_end_line = true, ret_block, ret_stmt, ret_used_count, ret_end_line
 			}
 		case *ast.If:
-			ok, ret_block, ret_stmt, ret_used_count, ret_end_line := find_last_table_constructor(nn.Then)
+			ok, ret_block, ret_stmt, ret_used_count, ret_end_line := o.find_last_table_constructor(nn.Then)
 			if ok {
 				r_ok, r_block, r_stmt, r_used_count, r_end_line = true, ret_block, ret_stmt, ret_used_count, ret_end_line
 			}
-			ok, ret_block, ret_stmt, ret_used_count, ret_end_line = find_last_table_constructor(nn.Else)
+			ok, ret_block, ret_stmt, ret_used_count, ret_end_line = o.find_last_table_constructor(nn.Else)
 			if ok {
 				r_ok, r_block, r_stmt, r_used_count, r_end_line = true, ret_block, ret_stmt, ret_used_count, ret_end_line
 			}
 		case *ast.WhileLoop:
-			ok, ret_block, ret_stmt, ret_used_count, ret_end_line := find_last_table_constructor(nn.Block)
+			ok, ret_block, ret_stmt, ret_used_count, ret_end_line := o.find_last_table_constructor(nn.Block)
 			if ok {
 				r_ok, r_block, r_stmt, r_used_count, r_end_line = true, ret_block, ret_stmt, ret_used_count, ret_end_line
 			}
 		case *ast.RepeatUntilLoop:
-			ok, ret_block, ret_stmt, ret_used_count, ret_end_line := find_last_table_constructor(nn.Block)
+			ok, ret_block, ret_stmt, ret_used_count, ret_end_line := o.find_last_table_constructor(nn.Block)
 			if ok {
 				r_ok, r_block, r_stmt, r_used_count, r_end_line = true, ret_block, ret_stmt, ret_used_count, ret_end_line
 			}
 		case *ast.ForLoopNumeric:
-			ok, ret_block, ret_stmt, ret_used_count, ret_end_line := find_last_table_constructor(nn.Block)
+			ok, ret_block, ret_stmt, ret_used_count, ret_end_line := o.find_last_table_constructor(nn.Block)
 			if ok {
 				r_ok, r_block, r_stmt, r_used_count, r_end_line = true, ret_block, ret_stmt, ret_used_count, ret_end_line
 			}
 		case *ast.ForLoopGeneric:
-			ok, ret_block, ret_stmt, ret_used_count, ret_end_line := find_last_table_constructor(nn.Block)
+			ok, ret_block, ret_stmt, ret_used_count, ret_end_line := o.find_last_table_constructor(nn.Block)
 			if ok {
 				r_ok, r_block, r_stmt, r_used_count, r_end_line = true, ret_block, ret_stmt, ret_used_count, ret_end_line
 			}
@@ -70,28 +72,50 @@ func find_last_table_constructor(block []ast.Stmt) (bool, []ast.Stmt, ast.Stmt,
 	return r_ok, r_block, r_stmt, r_used_count, r_end_line
 }
 
-func get_used_table_constructor_assign(block []ast.Stmt, assign_stmt ast.Stmt) (int, int) {
+func (o *optimizer) get_used_table_constructor_assign(block []ast.Stmt, assign_stmt ast.Stmt) (int, int) {
 	target := assign_stmt.(*ast.Assign).Targets[0]
+	if o.stmt_disabled(assign_stmt) {
+		return 0, -1
+	}
 	use_count := 0
 	next := false
-	var last_value ast.Node
-	for _, stmt := range block {
+	var last_stmt ast.Stmt
+	for i, stmt := range block {
 		if stmt == assign_stmt {
 			next = true
 			continue
 		}
 		if next {
 			has_use := false
+			if o.stmt_disabled(stmt) {
+				// 被指令关闭的语句不合并，也不越过它继续合并
+				break
+			}
 			switch stmt.(type) {
 			case *ast.Assign:
 				assign := stmt.(*ast.Assign)
-				if len(assign.Targets) == 1 {
+				if assign.LocalDecl {
+					// 之后的字段赋值用到了这里声明的 local 时，即使越过这条语句也不能合并
+					if i+1 < len(block) {
+						if key, value, ok := table_field_value(block[i+1], target); ok {
+							if expr_references_names(key, assign.Targets) {
+								o.skip_table_constructor(block[i+1], target, "key references local declared between")
+							} else if expr_references_names(value, assign.Targets) {
+								o.skip_table_constructor(block[i+1], target, "value references local declared between")
+							}
+						}
+					}
+				} else if len(assign.Targets) == 1 && len(assign.Values) == 1 {
 					switch assign.Targets[0].(type) {
 					case *ast.TableAccessor:
 						accessor := assign.Targets[0].(*ast.TableAccessor)
 						obj := accessor.Obj
 						if check_expr_same(obj, target) {
 							if can_expr_to_string(assign.Values[0]) {
+								if reason := o.constructor_field_stop_reason(accessor.Key, assign.Values[0], target); reason != "" {
+									o.skip_table_constructor(stmt, target, reason)
+									break
+								}
 								switch accessor.Key.(type) {
 								case *ast.ConstIdent:
 									has_use = true
@@ -100,7 +124,7 @@ func get_used_table_constructor_assign(block []ast.Stmt, assign_stmt ast.Stmt) (
 								case *ast.ConstInt:
 									has_use = true
 								}
-								last_value = assign.Values[0]
+								last_stmt = stmt
 							}
 						}
 					}
@@ -113,94 +137,205 @@ func get_used_table_constructor_assign(block []ast.Stmt, assign_stmt ast.Stmt) (
 			}
 		}
 	}
-	_, end_line := find_stmt_line_range(last_value)
+	if use_count == 0 {
+		return 0, -1
+	}
+	// 被合并的语句必须独占 [起始行, 结束行]，否则无法整体替换
+	start_line, _ := o.find_stmt_line_range(assign_stmt)
+	_, max_line := o.find_stmt_line_range(last_stmt)
+	end_line, ok := o.find_stmts_end_line(start_line, max_line, use_count+1)
+	if !ok {
+		return 0, -1
+	}
 	return use_count, end_line
 }
 
-func opt_func_table_constructor(func_decl *ast.FuncDecl) {
-	ok, ret_block, ret_stmt, ret_used_count, ret_end_line := find_last_table_constructor(func_decl.Block)
+// constructor_field_stop_reason 返回字段赋值 target[key] = value 不能合并进 target 的构造表达式的原因，
+// 可以合并时返回空串。合并后键和值在 target 被赋值之前求值：读取 target 会读到旧值，
+// 非纯函数调用可能依赖或修改 target。
+func (o *optimizer) constructor_field_stop_reason(key ast.Expr, value ast.Expr, target ast.Expr) string {
+	for _, part := range []struct {
+		name string
+		expr ast.Expr
+	}{{"key", key}, {"value", value}} {
+		if !only_builtin_pure_calls(part.expr) {
+			return part.name + " calls impure function"
+		}
+		if expr_reads(part.expr, target) {
+			return part.name + " reads the table being built"
+		}
+	}
+	return ""
+}
+
+// effectFuncs 是纯函数白名单中有可见效果的函数，调用它们可能依赖或改变程序状态
+var effectFuncs = map[string]bool{
+	"print":       true,
+	"error":       true,
+	"warn":        true,
+	"assert":      true,
+	"math.random": true,
+}
+
+// only_builtin_pure_calls 判断 expr 中的函数调用（不含函数定义的函数体）是否都是内置纯函数白名单中
+// 没有可见效果的函数。table 访问和运算符不算，它们求值可能出错，但不会修改 target。
+func only_builtin_pure_calls(expr ast.Expr) bool {
+	pure := true
+	f := lua_visitor{f: func(n ast.Node, ok *bool) {
+		switch e := n.(type) {
+		case *ast.FuncDecl:
+			*ok = false
+		case *ast.FuncCall:
+			name, name_ok := constPath(e.Function)
+			if !name_ok || e.Receiver != nil || !builtinPureFuncs[name] || effectFuncs[name] {
+				pure = false
+			}
+		}
+	}}
+	ast.Walk(&f, expr)
+	return pure
+}
+
+// expr_reads 判断 expr 中是否有与 target 相同的子表达式。
+func expr_reads(expr ast.Expr, target ast.Expr) bool {
+	found := false
+	f := lua_visitor{f: func(n ast.Node, ok *bool) {
+		if found {
+			*ok = false
+			return
+		}
+		if e, is_expr := n.(ast.Expr); is_expr && check_expr_same(e, target) {
+			found = true
+		}
+	}}
+	ast.Walk(&f, expr)
+	return found
+}
+
+// table_field_value 判断 stmt 是对 target 字段的单个赋值，返回字段的键和赋的值。
+func table_field_value(stmt ast.Stmt, target ast.Expr) (ast.Expr, ast.Expr, bool) {
+	assign, ok := stmt.(*ast.Assign)
+	if !ok || assign.LocalDecl || len(assign.Targets) != 1 || len(assign.Values) != 1 {
+		return nil, nil, false
+	}
+	accessor, ok := assign.Targets[0].(*ast.TableAccessor)
+	if !ok || !check_expr_same(accessor.Obj, target) {
+		return nil, nil, false
+	}
+	return accessor.Key, assign.Values[0], true
+}
+
+// expr_references_names 判断 expr 中是否引用了 names 中的变量。
+func expr_references_names(expr ast.Expr, names []ast.Expr) bool {
+	found := false
+	f := lua_visitor{f: func(n ast.Node, ok *bool) {
+		if ident, is_ident := n.(*ast.ConstIdent); is_ident {
+			for _, name := range names {
+				if check_expr_same(ident, name) {
+					found = true
+				}
+			}
+		}
+	}}
+	ast.Walk(&f, expr)
+	return found
+}
+
+// skip_table_constructor 在报告中记录 stmt 没有合并进 target 构造表达式的原因。
+func (o *optimizer) skip_table_constructor(stmt ast.Stmt, target ast.Expr, reason string) {
+	start_line, _ := o.find_stmt_line_range(stmt)
+	o.addSkip(Skip{Pass: "table_constructor", Line: o.origLine(start_line), Target: expr_to_string(target), Reason: reason})
+}
+
+// stmt_disabled 判断 stmt 所在的行是否被指令关闭了 table 构造优化。
+func (o *optimizer) stmt_disabled(stmt ast.Stmt) bool {
+	if len(o.disabled) == 0 {
+		return false
+	}
+	start_line, end_line := o.find_stmt_line_range(stmt)
+	return o.isDisabled("table_constructor", start_line, end_line)
+}
+
+func (o *optimizer) opt_block_table_constructor(block []ast.Stmt) {
+	ok, ret_block, ret_stmt, ret_used_count, ret_end_line := o.find_last_table_constructor(block)
 	if !ok {
 		return
 	}
 
-	has_opt = true
+	start_line, stmt_end_line := o.find_stmt_line_range(ret_stmt)
+	fields := o.recorded_constructor_fields(stmt_end_line)
+	if fields < 0 {
+		if cons, ok := ret_stmt.(*ast.Assign).Values[0].(*ast.TableConstructor); ok {
+			fields = len(cons.Keys)
+		}
+	}
+	rw := Rewrite{Pass: "table_constructor", Target: expr_to_string(ret_stmt.(*ast.Assign).Targets[0]),
+		GroupSize: ret_used_count, Replaced: ret_used_count}
+	rw.Line, rw.EndLine = o.origRange(start_line, ret_end_line)
+
+	new_cons := merge_table_constructor_used(ret_block, ret_stmt, ret_used_count)
+	o.logf("opt_block_table_constructor %s", expr_to_string(new_cons))
 
-	new_cons := replace_table_constructor_used(ret_block, ret_stmt, ret_used_count)
-	log.Println("opt_func_table_constructor", new_cons)
+	indent := get_content_space(o.filecontent[start_line-1])
+	new_lines := stmt_to_lines(ret_stmt, indent)
+	new_lines[len(new_lines)-1] += " " + constructor_marker(fields)
 
-	start_line := ret_stmt.Line()
+	o.spliceLines(start_line, ret_end_line, new_lines)
 
-	content := gfilecontent[start_line-1]
-	left_content := content[:strings.Index(content, "=")]
-	insert_line := strings.TrimRight(left_content, " ") + " = {" + strings.Join(new_cons, ", ") + "}" + " -- opt by oLua"
+	o.logf("opt at: %s:%d", o.filename, start_line)
+	o.addRewrite(rw)
+}
 
-	var filecontent []string
-	filecontent = append(filecontent, gfilecontent[:start_line-1]...)
-	filecontent = append(filecontent, insert_line)
-	filecontent = append(filecontent, gfilecontent[start_line+ret_end_line-start_line:]...)
-	gfilecontent = filecontent
+// constructor_marker_re 匹配 table 构造改写的标记，括号中是构造表达式原有的字段数
+var constructor_marker_re = regexp.MustCompile(`-- opt by oLua \(table_constructor (\d+)\)`)
 
-	log.Printf("opt at: %s:%d", gfilename, start_line)
-	goptcount++
+// constructor_marker 返回 table 构造改写的标记。记录原有字段数是为了 revert 时
+// 能把之后合并进来的字段还原为赋值语句。
+func constructor_marker(fields int) string {
+	return fmt.Sprintf("-- opt by oLua (table_constructor %d)", fields)
 }
 
-func replace_table_constructor_used(block []ast.Stmt, assign_stmt ast.Stmt, used_count int) []string {
-	var new_keys []ast.Expr
-	var new_vals []ast.Expr
+// recorded_constructor_fields 返回第 line 行上已记录的原有字段数，没有记录时返回 -1。
+// 同一个构造表达式被多轮合并时，保留第一次记录的字段数。
+func (o *optimizer) recorded_constructor_fields(line int) int {
+	if line < 1 || line > len(o.filecontent) {
+		return -1
+	}
+	m := constructor_marker_re.FindStringSubmatch(o.filecontent[line-1])
+	if m == nil {
+		return -1
+	}
+	n, _ := strconv.Atoi(m[1])
+	return n
+}
 
-	old_value := assign_stmt.(*ast.Assign).Values[0]
-	switch old_value.(type) {
+// merge_table_constructor_used 把构造语句之后的 used_count 条字段赋值合并进构造表达式，
+// 直接修改 assign_stmt 的 AST 并返回新的构造表达式。
+func merge_table_constructor_used(block []ast.Stmt, assign_stmt ast.Stmt, used_count int) *ast.TableConstructor {
+	assign := assign_stmt.(*ast.Assign)
+	new_cons := &ast.TableConstructor{}
+	switch old_cons := assign.Values[0].(type) {
 	case *ast.TableConstructor:
-		old_cons := old_value.(*ast.TableConstructor)
-		for _, k := range old_cons.Keys {
-			new_keys = append(new_keys, k)
-		}
-		for _, v := range old_cons.Vals {
-			new_vals = append(new_vals, v)
-		}
+		new_cons.Keys = append(new_cons.Keys, old_cons.Keys...)
+		new_cons.Vals = append(new_cons.Vals, old_cons.Vals...)
 	}
 
 	next := false
 	c := 0
-	var ret []string
 	for _, stmt := range block {
 		if stmt == assign_stmt {
 			next = true
 			continue
 		}
-		if next {
-			if c < used_count {
-				c++
-				switch stmt.(type) {
-				case *ast.Assign:
-					assign := stmt.(*ast.Assign)
-					if len(assign.Targets) == 1 {
-						switch assign.Targets[0].(type) {
-						case *ast.TableAccessor:
-							accessor := assign.Targets[0].(*ast.TableAccessor)
-							new_keys = append(new_keys, accessor.Key)
-							new_vals = append(new_vals, assign.Values[0])
-						}
-					}
-				}
-			}
-		}
-	}
-
-	for i, k := range new_keys {
-		if k == nil {
-			ret = append(ret, expr_to_string(new_vals[i]))
-			continue
-		}
-		switch k.(type) {
-		case *ast.ConstIdent:
-			ret = append(ret, "["+k.(*ast.ConstIdent).Value+"]="+expr_to_string(new_vals[i]))
-		case *ast.ConstString:
-			ret = append(ret, k.(*ast.ConstString).Value+"="+expr_to_string(new_vals[i]))
-		case *ast.ConstInt:
-			ret = append(ret, "["+k.(*ast.ConstInt).Value+"]="+expr_to_string(new_vals[i]))
+		if next && c < used_count {
+			c++
+			used := stmt.(*ast.Assign)
+			accessor := used.Targets[0].(*ast.TableAccessor)
+			new_cons.Keys = append(new_cons.Keys, accessor.Key)
+			new_cons.Vals = append(new_cons.Vals, used.Values[0])
 		}
 	}
 
-	return ret
+	assign.Values[0] = new_cons
+	return new_cons
 }
@@ -0,0 +1,119 @@
+package olua
+
+import (
+	"strings"
+	"testing"
+)
+
+// ============================================================================
+// 集成测试：对比优化器输出与期望文件
+// ============================================================================
+
+// tableConstructorOptions 返回只启用 table 构造优化的测试选项。
+func tableConstructorOptions() Options {
+	opts := DefaultOptions()
+	opts.TableConstructor = true
+	return opts
+}
+
+func TestTableConstructor(t *testing.T) {
+	compareOptOutputWith(t, tableConstructorOptions(), "input/table_constructor.lua", "output/table_constructor.lua")
+}
+
+func TestTableConstructorEffects(t *testing.T) {
+	compareOptOutputWith(t, tableConstructorOptions(), "input/table_constructor_effects.lua", "output/table_constructor_effects.lua")
+}
+
+func TestTableConstructorEffectsSkipped(t *testing.T) {
+	src, err := readFileLines("input/table_constructor_effects.lua")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, report, err := Optimize([]byte(strings.Join(src, "\n")+"\n"), tableConstructorOptions())
+	if err != nil {
+		t.Fatalf("Optimize failed: %v", err)
+	}
+	want := []Skip{
+		{Pass: "table_constructor", Line: 6, Target: "t", Reason: "value reads the table being built"},
+		{Pass: "table_constructor", Line: 13, Target: "t", Reason: "value calls impure function"},
+		{Pass: "table_constructor", Line: 22, Target: "t", Reason: "value references local declared between"},
+		{Pass: "table_constructor", Line: 36, Target: "t", Reason: "key reads the table being built"},
+		{Pass: "table_constructor", Line: 44, Target: "t", Reason: "key references local declared between"},
+		{Pass: "table_constructor", Line: 51, Target: "t", Reason: "key calls impure function"},
+	}
+	if len(report.Skipped) != len(want) {
+		t.Fatalf("skipped = %+v, want %+v", report.Skipped, want)
+	}
+	for i := range want {
+		if report.Skipped[i] != want[i] {
+			t.Errorf("skipped[%d] = %+v, want %+v", i, report.Skipped[i], want[i])
+		}
+	}
+}
+
+// ============================================================================
+// 单元测试：合并边界
+// ============================================================================
+
+func TestTableConstructorMultiLineValue(t *testing.T) {
+	// 字符串和注释中的括号不能影响结束行判断
+	src := `function test()
+    local t = {}
+    t.a = "}"
+    t.b = string.format(
+        "(", -- )
+        2
+    )
+    print(t)
+end
+`
+	out, report, err := Optimize([]byte(src), tableConstructorOptions())
+	if err != nil {
+		t.Fatalf("Optimize failed: %v", err)
+	}
+	if report.OptCount != 1 {
+		t.Fatalf("OptCount = %d, want 1", report.OptCount)
+	}
+	want := `    local t = {a = "}", b = string.format("(", 2)} -- opt by oLua (table_constructor 0)
+    print(t)`
+	if !strings.Contains(string(out), want) {
+		t.Errorf("output:\n%s\nwant to contain:\n%s", out, want)
+	}
+}
+
+func TestTableConstructorSharedLine(t *testing.T) {
+	// 被合并的语句与其他语句同行时不能整体替换，应跳过
+	src := "function test()\n    local t = {} t.a = 1 print(t)\nend\n"
+	out, report, err := Optimize([]byte(src), tableConstructorOptions())
+	if err != nil {
+		t.Fatalf("Optimize failed: %v", err)
+	}
+	if report.OptCount != 0 || string(out) != src {
+		t.Errorf("shared line should not be rewritten, got:\n%s", out)
+	}
+}
+
+func TestTableConstructorSkipFunctionValue(t *testing.T) {
+	// 函数体可能含注释，不参与合并
+	src := "function test()\n    local t = {}\n    t.f = function() return 1 end\nend\n"
+	_, report, err := Optimize([]byte(src), tableConstructorOptions())
+	if err != nil {
+		t.Fatalf("Optimize failed: %v", err)
+	}
+	if report.OptCount != 0 {
+		t.Errorf("OptCount = %d, want 0 for function values", report.OptCount)
+	}
+}
+
+func TestTableConstructorChunk(t *testing.T) {
+	// 模块加载时执行的主代码块同样合并
+	src := "local M = {}\nM.name = \"m\"\nM.size = 3\n\nfunction M.get()\n    return M.name\nend\n\nreturn M\n"
+	out, report, err := Optimize([]byte(src), tableConstructorOptions())
+	if err != nil {
+		t.Fatalf("Optimize failed: %v", err)
+	}
+	want := "local M = {name = \"m\", size = 3} -- opt by oLua (table_constructor 0)\n\nfunction M.get()"
+	if report.OptCount != 1 || !strings.HasPrefix(string(out), want) {
+		t.Errorf("output:\n%s\nwant prefix:\n%s", out, want)
+	}
+}
@@ -0,0 +1,361 @@
+package olua
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/milochristiansen/lua/ast"
+)
+
+// ============================================================================
+// table.insert(t, v) 改写为 t[#t + 1] = v
+// ============================================================================
+//
+// table.insert(t, v) 要查找全局变量 table 和字段 insert，再调用 C 函数；t[#t + 1] = v 只需要一次取长度和赋值。
+// 只改写两个参数的调用，并且：
+//   - t 是局部变量、全局变量或 a.b.c 形式的路径（改写后 t 会被求值两次）
+//   - v 中的函数调用都在纯函数白名单中（调用在 #t 之后求值，可能改变 t 的长度）；
+//     v 本身是函数调用时还必须只返回一个值，否则原调用会变成 table.insert(t, pos, v)
+//   - table 没有在文件中被重新声明或赋值，table.insert 没有被替换
+//
+// 通过 local tinsert = table.insert 等局部化的调用同样会被改写（包括局部化优化生成的 table_insert）。
+//
+// 启用计数器时，同一个语句块中连续多次追加同一个 table 会改为只取一次长度：
+//
+//	local t_n = #t -- opt by oLua (table_insert)
+//	t[t_n + 1] = a
+//	t[t_n + 2] = b
+//
+// 这里假设追加的值都不是 nil，并且 t 是序列（没有空洞）。
+//
+// 改写为 t[#t + 1] = v 的语句不加标记，revert 只撤销计数器。
+
+// tableInsertMarker 是计数器声明行的标记
+const tableInsertMarker = "-- opt by oLua (table_insert)"
+
+// singleValueFuncs 是只返回一个值的纯函数，可以直接作为追加的值
+var singleValueFuncs = map[string]bool{
+	"tostring":      true,
+	"tonumber":      true,
+	"type":          true,
+	"math.abs":      true,
+	"math.ceil":     true,
+	"math.floor":    true,
+	"math.max":      true,
+	"math.min":      true,
+	"math.sqrt":     true,
+	"string.format": true,
+	"string.len":    true,
+	"string.sub":    true,
+	"string.rep":    true,
+	"string.lower":  true,
+	"string.upper":  true,
+	"string.char":   true,
+	"table.concat":  true,
+}
+
+// tableInsertSite 是一处可以改写的追加
+type tableInsertSite struct {
+	stmt  ast.Stmt
+	path  string
+	value ast.Expr
+}
+
+// opt_table_insert 在整个文件中改写一处 table.insert 调用，启用计数器时优先处理连续的追加。
+func (o *optimizer) opt_table_insert() {
+	sites := o.collectTableInsertSites()
+	if len(sites) == 0 {
+		return
+	}
+	if o.opts.TableInsertCounter {
+		by_stmt := map[ast.Stmt]*tableInsertSite{}
+		for i := range sites {
+			by_stmt[sites[i].stmt] = &sites[i]
+		}
+		done := false
+		o.for_each_block(func(block []ast.Stmt) bool {
+			done = o.tableInsertCounter(block, by_stmt)
+			return !done
+		})
+		if done {
+			return
+		}
+	}
+	for _, site := range sites {
+		if _, is_call := site.stmt.(*ast.FuncCall); !is_call {
+			continue
+		}
+		line := site.stmt.Line()
+		if _, ok := o.singleLineStmt(site.stmt); !ok || o.isDisabled("table_insert", line, line) {
+			continue
+		}
+		o.applyTableInsert(site, line)
+		return
+	}
+}
+
+// collectTableInsertSites 按源码顺序收集可以改写的 table.insert(t, v) 调用，
+// 启用计数器时同时收集已改写的 t[#t + 1] = v。
+func (o *optimizer) collectTableInsertSites() []tableInsertSite {
+	table_ok := !o.isGlobalShadowed("table") && !o.isPathAssigned("table.insert")
+	var sites []tableInsertSite
+	var aliases []*localBinding
+	alias_sites := map[*localBinding][]int{}
+	reassigned := map[*localBinding]bool{}
+	walkScopes(o.block, func(stmt ast.Stmt, env *scopeEnv) {
+		switch s := stmt.(type) {
+		case *ast.Assign:
+			if !s.LocalDecl && !s.LocalFunc {
+				for _, t := range s.Targets {
+					if ident, ok := t.(*ast.ConstIdent); ok {
+						if b := env.lookup(ident.Value); b != nil {
+							reassigned[b] = true
+						}
+					}
+				}
+			}
+			if o.opts.TableInsertCounter {
+				if path, value, ok := indexAppend(s); ok && o.isSafeAppendValue(value) {
+					sites = append(sites, tableInsertSite{stmt: s, path: path, value: value})
+				}
+			}
+		case *ast.FuncCall:
+			if s.Receiver != nil || len(s.Args) != 2 || !table_ok {
+				return
+			}
+			path, ok := getExprPath(s.Args[0])
+			if !ok || !is_dotted_path(s.Args[0]) || !o.isSafeAppendValue(s.Args[1]) {
+				return
+			}
+			site := tableInsertSite{stmt: s, path: path, value: s.Args[1]}
+			if ident, is_ident := s.Function.(*ast.ConstIdent); is_ident {
+				// 局部化的 table.insert
+				b := env.lookup(ident.Value)
+				if b == nil || b.value == nil {
+					return
+				}
+				if fn, fn_ok := getExprPath(b.value); !fn_ok || fn != "table.insert" {
+					return
+				}
+				if alias_sites[b] == nil {
+					aliases = append(aliases, b)
+				}
+				alias_sites[b] = append(alias_sites[b], len(sites))
+			} else if fn, fn_ok := getExprPath(s.Function); !fn_ok || fn != "table.insert" {
+				return
+			}
+			sites = append(sites, site)
+		}
+	})
+	// 被重新赋值的局部化名字不再是 table.insert
+	removed := map[int]bool{}
+	for _, b := range aliases {
+		if reassigned[b] {
+			for _, i := range alias_sites[b] {
+				removed[i] = true
+			}
+		}
+	}
+	var ret []tableInsertSite
+	for i, site := range sites {
+		if !removed[i] {
+			ret = append(ret, site)
+		}
+	}
+	return ret
+}
+
+// indexAppend 判断 stmt 是否是 t[#t + 1] = v，返回 t 的路径和 v。
+func indexAppend(stmt ast.Stmt) (string, ast.Expr, bool) {
+	assign, ok := stmt.(*ast.Assign)
+	if !ok || assign.LocalDecl || len(assign.Targets) != 1 || len(assign.Values) != 1 {
+		return "", nil, false
+	}
+	accessor, ok := assign.Targets[0].(*ast.TableAccessor)
+	if !ok || !is_dotted_path(accessor.Obj) {
+		return "", nil, false
+	}
+	path, _ := getExprPath(accessor.Obj)
+	key, ok := accessor.Key.(*ast.Operator)
+	if !ok || key.Op != ast.OpAdd {
+		return "", nil, false
+	}
+	one, ok := key.Right.(*ast.ConstInt)
+	length, len_ok := key.Left.(*ast.Operator)
+	if !ok || one.Value != "1" || !len_ok || length.Op != ast.OpLength {
+		return "", nil, false
+	}
+	if obj, obj_ok := getExprPath(length.Right); !obj_ok || obj != path || !is_dotted_path(length.Right) {
+		return "", nil, false
+	}
+	return path, assign.Values[0], true
+}
+
+// isSafeAppendValue 判断 value 可以在 #t 之后求值，并且只产生一个值。
+func (o *optimizer) isSafeAppendValue(value ast.Expr) bool {
+	if !can_expr_to_string(value) {
+		return false
+	}
+	switch v := value.(type) {
+	case *ast.ConstVariadic:
+		return false
+	case *ast.FuncCall:
+		name, ok := getFuncCallName(v)
+		if !ok || v.Receiver != nil || !singleValueFuncs[name] {
+			return false
+		}
+	}
+	safe := true
+	f := lua_visitor{f: func(n ast.Node, ok *bool) {
+		if call, is_call := n.(*ast.FuncCall); is_call {
+			name, name_ok := getFuncCallName(call)
+			if !name_ok || call.Receiver != nil || !o.isPureFunction(name) {
+				safe = false
+			}
+		}
+	}}
+	ast.Walk(&f, value)
+	return safe
+}
+
+// isPathAssigned 判断文件中是否对 path 或它的前缀赋值（包括 _G.path）。
+func (o *optimizer) isPathAssigned(path string) bool {
+	assigned := false
+	f := lua_visitor{f: func(n ast.Node, ok *bool) {
+		if assign, is_assign := n.(*ast.Assign); is_assign && !assign.LocalDecl {
+			for _, t := range assign.Targets {
+				written, path_ok := getExprPath(t)
+				if path_ok && isWriteToTarget(strings.TrimPrefix(written, "_G."), path) {
+					assigned = true
+				}
+			}
+		}
+	}}
+	for _, stmt := range o.block {
+		ast.Walk(&f, stmt)
+	}
+	return assigned
+}
+
+// singleLineStmt 判断 stmt 独占一行：单独解析这一行（去掉行末注释）恰好得到同类型的一条语句。
+// 返回行末注释。
+func (o *optimizer) singleLineStmt(stmt ast.Stmt) (string, bool) {
+	start, end := o.find_stmt_line_range(stmt)
+	if start != end || start < 1 {
+		return "", false
+	}
+	code, comment, ok := splitLineComment(o.filecontent[start-1])
+	if !ok {
+		return "", false
+	}
+	parsed, err := ast.Parse(code, start)
+	if err != nil || len(parsed) != 1 {
+		return "", false
+	}
+	switch stmt.(type) {
+	case *ast.FuncCall:
+		_, ok = parsed[0].(*ast.FuncCall)
+	case *ast.Assign:
+		_, ok = parsed[0].(*ast.Assign)
+	}
+	return comment, ok
+}
+
+// appendStmt 返回 t[key] = value 语句。
+func appendStmt(path string, key ast.Expr, value ast.Expr) ast.Stmt {
+	return &ast.Assign{
+		Targets: []ast.Expr{&ast.TableAccessor{Obj: pathToExpr(path), Key: key}},
+		Values:  []ast.Expr{value},
+	}
+}
+
+// replaceStmtLine 用 stmt 重新打印第 line 行，保留缩进和行末注释。
+func (o *optimizer) replaceStmtLine(line int, stmt ast.Stmt, comment string) {
+	content := o.filecontent[line-1]
+	new_line := stmt_to_lines(stmt, get_content_space(content))[0]
+	if comment != "" {
+		new_line += " " + comment
+	}
+	o.filecontent[line-1] = new_line
+}
+
+// applyTableInsert 把第 line 行的 table.insert(t, v) 改写为 t[#t + 1] = v。
+func (o *optimizer) applyTableInsert(site tableInsertSite, line int) {
+	comment, _ := o.singleLineStmt(site.stmt)
+	rw := Rewrite{Pass: "table_insert", Target: site.path, GroupSize: 1, Replaced: 1}
+	rw.Line, rw.EndLine = o.origRange(line, line)
+
+	key := &ast.Operator{Op: ast.OpAdd, Left: &ast.Operator{Op: ast.OpLength, Right: pathToExpr(site.path)}, Right: &ast.ConstInt{Value: "1"}}
+	o.replaceStmtLine(line, appendStmt(site.path, key, site.value), comment)
+
+	o.logf("opt table_insert at: %s:%d target=%s", o.filename, line, site.path)
+	o.addRewrite(rw)
+}
+
+// tableInsertCounter 在 block 中找到第一段连续追加同一个 table 的语句，改为使用计数器，成功时返回 true。
+func (o *optimizer) tableInsertCounter(block []ast.Stmt, sites map[ast.Stmt]*tableInsertSite) bool {
+	for i := 0; i < len(block); i++ {
+		first := sites[block[i]]
+		if first == nil {
+			continue
+		}
+		j := i + 1
+		for j < len(block) && sites[block[j]] != nil && sites[block[j]].path == first.path {
+			j++
+		}
+		run := block[i:j]
+		i = j - 1
+		if len(run) < 2 {
+			continue
+		}
+		start, end := run[0].Line(), run[len(run)-1].Line()
+		if o.isDisabled("table_insert", start, end) {
+			continue
+		}
+		if i+1 < len(block) && block[i+1].Line() <= end {
+			continue
+		}
+		comments := make([]string, len(run))
+		ok := true
+		for k, stmt := range run {
+			if _, is_nil := sites[stmt].value.(*ast.ConstNil); is_nil {
+				ok = false
+			}
+			comment, single := o.singleLineStmt(stmt)
+			if !single || stmt.Line() != start+k {
+				ok = false
+			}
+			comments[k] = comment
+		}
+		if !ok {
+			continue
+		}
+		o.applyTableInsertCounter(run, sites, comments)
+		return true
+	}
+	return false
+}
+
+// applyTableInsertCounter 在 run 之前声明计数器，并把 run 中的追加改写为 t[t_n + k] = v。
+func (o *optimizer) applyTableInsertCounter(run []ast.Stmt, sites map[ast.Stmt]*tableInsertSite, comments []string) {
+	path := sites[run[0]].path
+	start := run[0].Line()
+	counter := getUniqueLocalName(o.block, table_access_to_local_name(path)+"_n")
+	rw := Rewrite{Pass: "table_insert", Target: path, Local: counter, GroupSize: len(run), Replaced: len(run)}
+	rw.Line, rw.EndLine = o.origRange(start, start+len(run)-1)
+
+	for k, stmt := range run {
+		key := &ast.Operator{Op: ast.OpAdd, Left: &ast.ConstIdent{Value: counter}, Right: &ast.ConstInt{Value: strconv.Itoa(k + 1)}}
+		o.replaceStmtLine(start+k, appendStmt(path, key, sites[stmt].value), comments[k])
+	}
+	decl := &ast.Assign{
+		LocalDecl: true,
+		Targets:   []ast.Expr{&ast.ConstIdent{Value: counter}},
+		Values:    []ast.Expr{&ast.Operator{Op: ast.OpLength, Right: pathToExpr(path)}},
+	}
+	indent := get_content_space(o.filecontent[start-1])
+	o.spliceLines(start, start-1, []string{stmt_to_lines(decl, indent)[0] + " " + tableInsertMarker})
+
+	o.logf("opt table_insert at: %s:%d target=%s counter=%s", o.filename, start, path, counter)
+	o.addRewrite(rw)
+}
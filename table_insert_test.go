@@ -0,0 +1,107 @@
+package olua
+
+import (
+	"strings"
+	"testing"
+)
+
+// ============================================================================
+// 集成测试：对比优化器输出与期望文件
+// ============================================================================
+
+// tableInsertOptions 返回只启用 table.insert 改写的测试选项。
+func tableInsertOptions() Options {
+	opts := DefaultOptions()
+	opts.TableInsert = true
+	return opts
+}
+
+func TestTableInsert(t *testing.T) {
+	compareOptOutputWith(t, tableInsertOptions(), "input/table_insert.lua", "output/table_insert.lua")
+}
+
+func TestTableInsertCounter(t *testing.T) {
+	opts := tableInsertOptions()
+	opts.TableInsertCounter = true
+	compareOptOutputWith(t, opts, "input/table_insert.lua", "output/table_insert_counter.lua")
+}
+
+func TestTableInsertCounterRevert(t *testing.T) {
+	// 还原只撤销计数器，得到不使用计数器的结果
+	optimized, err := readFileLines("output/table_insert_counter.lua")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := readFileLines("output/table_insert.lua")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, report, err := Revert([]byte(strings.Join(optimized, "\n")+"\n"), DefaultOptions())
+	if err != nil {
+		t.Fatalf("Revert failed: %v", err)
+	}
+	if string(got) != strings.Join(expected, "\n")+"\n" || len(report.Rewrites) != 1 || report.Rewrites[0].Replaced != 3 {
+		t.Errorf("revert = %+v:\n%s", report.Rewrites, got)
+	}
+}
+
+// ============================================================================
+// 单元测试：table 被遮蔽或局部化
+// ============================================================================
+
+func TestTableInsertShadowing(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string // 为空时表示不应改写
+	}{
+		{"local table", "local table = {insert = print}\nfunction f(t, v)\n    table.insert(t, v)\nend\n", ""},
+		{"table param", "function f(table, t, v)\n    table.insert(t, v)\nend\n", ""},
+		{"table assigned", "table = my_table\nfunction f(t, v)\n    table.insert(t, v)\nend\n", ""},
+		{"insert replaced", "table.insert = my_insert\nfunction f(t, v)\n    table.insert(t, v)\nend\n", ""},
+		{"localized table", "local table = table\nfunction f(t, v)\n    table.insert(t, v)\nend\n", "    t[#t + 1] = v\n"},
+		{"localized insert", "local table_insert = table.insert -- opt by oLua (localize)\nfunction f(t, v)\n    table_insert(t, v)\nend\n", "    t[#t + 1] = v\n"},
+		{"alias reassigned", "local tinsert = table.insert\nfunction f(t, v)\n    tinsert(t, v)\nend\ntinsert = print\n", ""},
+		{"alias shadowed", "local tinsert = table.insert\nfunction f(tinsert, t, v)\n    tinsert(t, v)\nend\n", ""},
+		{"global alias", "function f(t, v)\n    tinsert(t, v)\nend\n", ""},
+		{"alias out of scope", "function f()\n    local tinsert = table.insert\nend\nfunction g(t, v)\n    tinsert(t, v)\nend\n", ""},
+	}
+	for _, tt := range tests {
+		out, report, err := Optimize([]byte(tt.src), tableInsertOptions())
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if tt.want == "" {
+			if string(out) != tt.src {
+				t.Errorf("%s: expected no rewrite, got:\n%s", tt.name, out)
+			}
+			continue
+		}
+		if !strings.Contains(string(out), tt.want) || len(report.Rewrites) != 1 {
+			t.Errorf("%s: expected %q, got:\n%s", tt.name, tt.want, out)
+		}
+	}
+}
+
+func TestTableInsertCounterSkips(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+	}{
+		{"nil value", "function f(t, a)\n    table.insert(t, a)\n    table.insert(t, nil)\nend\n"},
+		{"different tables", "function f(t, u, a)\n    table.insert(t, a)\n    table.insert(u, a)\nend\n"},
+		{"not consecutive", "function f(t, a)\n    table.insert(t, a)\n    print(a)\n    table.insert(t, a)\nend\n"},
+		{"disabled", "function f(t, a)\n    -- olua:disable-next-line table_insert\n    table.insert(t, a)\n    table.insert(t, a)\nend\n"},
+	}
+	opts := tableInsertOptions()
+	opts.TableInsertCounter = true
+	for _, tt := range tests {
+		out, _, err := Optimize([]byte(tt.src), opts)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if strings.Contains(string(out), "_n = #") {
+			t.Errorf("%s: expected no counter, got:\n%s", tt.name, out)
+		}
+	}
+}
@@ -0,0 +1,328 @@
+package olua
+
+import (
+	"strconv"
+
+	"github.com/milochristiansen/lua/ast"
+)
+
+// ============================================================================
+// table 预分配（LuaJIT 和 Lua 5.4）
+// ============================================================================
+//
+// 空表在填充过程中会多次扩容（rehash）。当紧随 local t = {} 之后的代码能静态确定大小时，
+// 按目标方言预先分配：
+//
+//	local t = {}                      local t = table_new(100, 0) -- opt by oLua (table_prealloc)
+//	for i = 1, 100 do           →     for i = 1, 100 do
+//	    t[i] = i * i                      t[i] = i * i
+//	end                               end
+//
+// 大小来自以下两种情况：
+//   - 紧随其后的数值 for 循环从 1 到常量上限、步长为 1，循环体的顶层语句中有 t[i] = v 或 t[#t + 1] = v，
+//     数组部分为上限乘以每次迭代追加的个数（循环中 break 时只是多分配）
+//   - 紧随其后的至少两条常量键字段赋值（t.a = v、t[1] = v），从 1 开始连续的整数键计入数组部分，
+//     其他键（包括 t[100] 这样不连续的整数键）计入哈希部分
+//
+// LuaJIT 使用 table.new(narr, nhash)，在文件开头加入 local table_new = require("table.new")（已有时复用）；
+// Lua 5.4 没有 table.new，使用预设大小的构造表达式 {nil, nil, a = nil}，数组部分超过 maxPresizedArray 时不处理。
+// 预分配不影响语义，只影响内存分配。
+
+// tablePreallocMarker 是预分配声明行和 require 行的标记
+const tablePreallocMarker = "-- opt by oLua (table_prealloc)"
+
+// maxPresizedArray 是 Lua 5.4 构造表达式中预设的最大数组大小
+const maxPresizedArray = 32
+
+// 支持预分配的目标方言
+const (
+	DialectLuaJIT = "luajit"
+	DialectLua54  = "5.4"
+)
+
+// IsValidDialect 判断 d 是否是支持的目标方言，空串表示默认的 Lua 5.3。
+func IsValidDialect(d string) bool {
+	return d == "" || d == DialectLuaJIT || d == DialectLua54
+}
+
+// opt_block_table_prealloc 为函数体或主代码块 block 中的一个空表生成预分配。
+func (o *optimizer) opt_block_table_prealloc(block []ast.Stmt) {
+	if o.opts.Dialect != DialectLuaJIT && o.opts.Dialect != DialectLua54 {
+		return
+	}
+	o.tablePreallocBlock(block)
+}
+
+func (o *optimizer) tablePreallocBlock(block []ast.Stmt) bool {
+	for i, stmt := range block {
+		if o.tablePreallocStmt(block, i) {
+			return true
+		}
+		var children [][]ast.Stmt
+		switch s := stmt.(type) {
+		case *ast.ForLoopNumeric, *ast.ForLoopGeneric, *ast.WhileLoop, *ast.RepeatUntilLoop:
+			children = loop_body(stmt)
+		case *ast.DoBlock:
+			children = [][]ast.Stmt{s.Block}
+		case *ast.If:
+			children = [][]ast.Stmt{s.Then, s.Else}
+		}
+		for _, child := range children {
+			if o.tablePreallocBlock(child) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// emptyTableDecl 判断 stmt 是否是 local t = {}，返回 t。
+func emptyTableDecl(stmt ast.Stmt) (string, bool) {
+	assign, ok := stmt.(*ast.Assign)
+	if !ok || !assign.LocalDecl || len(assign.Targets) != 1 || len(assign.Values) != 1 {
+		return "", false
+	}
+	ident, ok := assign.Targets[0].(*ast.ConstIdent)
+	if !ok {
+		return "", false
+	}
+	cons, ok := assign.Values[0].(*ast.TableConstructor)
+	if !ok || len(cons.Keys) != 0 {
+		return "", false
+	}
+	return ident.Value, true
+}
+
+// tablePreallocStmt 尝试为 block[idx] 处的 local t = {} 生成预分配，成功时返回 true。
+func (o *optimizer) tablePreallocStmt(block []ast.Stmt, idx int) bool {
+	name, ok := emptyTableDecl(block[idx])
+	if !ok || idx+1 >= len(block) {
+		return false
+	}
+	line := block[idx].Line()
+	comment, single := o.singleLineStmt(block[idx])
+	if !single || o.isDisabled("table_prealloc", line, line) {
+		return false
+	}
+	narr, keys, count := loopPresize(name, block[idx+1])
+	if count == 0 {
+		narr, keys, count = fieldPresize(name, block[idx+1:])
+	}
+	if count == 0 || (o.opts.Dialect == DialectLua54 && narr > maxPresizedArray) {
+		return false
+	}
+	if o.opts.Dialect == DialectLuaJIT && o.tableNewName(line) == "" && countLocalDecls(o.block) >= maxChunkLocals {
+		// require 行是主代码块中新的 local，接近 Lua 的局部变量上限时不再生成
+		o.addSkip(Skip{Pass: "table_prealloc", Line: o.origLine(line), Target: name,
+			Reason: "main chunk has too many locals to require table.new"})
+		return false
+	}
+	o.applyTablePrealloc(block[idx].(*ast.Assign), name, narr, keys, count, comment)
+	return true
+}
+
+// loopPresize 根据紧随其后的数值 for 循环计算 name 的数组大小，count 为参与计算的语句数，不能确定时为 0。
+func loopPresize(name string, stmt ast.Stmt) (int, []ast.Expr, int) {
+	loop, ok := stmt.(*ast.ForLoopNumeric)
+	if !ok || loop.Counter == name || loopLocalNames(loop)[name] {
+		return 0, nil, 0
+	}
+	init, ok := loop.Init.(*ast.ConstInt)
+	step, step_ok := loop.Step.(*ast.ConstInt)
+	limit, limit_ok := loop.Limit.(*ast.ConstInt)
+	if !ok || !step_ok || !limit_ok || init.Value != "1" || step.Value != "1" {
+		return 0, nil, 0
+	}
+	n, err := strconv.Atoi(limit.Value)
+	if err != nil || n < 1 {
+		return 0, nil, 0
+	}
+
+	// 循环变量被赋值时 t[i] 不再对应迭代次数
+	counter_assigned := false
+	f := lua_visitor{f: func(n ast.Node, ok *bool) {
+		if assign, is_assign := n.(*ast.Assign); is_assign && !assign.LocalDecl {
+			for _, t := range assign.Targets {
+				if ident, is_ident := t.(*ast.ConstIdent); is_ident && ident.Value == loop.Counter {
+					counter_assigned = true
+				}
+			}
+		}
+	}}
+	for _, s := range loop.Block {
+		ast.Walk(&f, s)
+	}
+	if counter_assigned {
+		return 0, nil, 0
+	}
+
+	per, count := 0, 0
+	indexed := false
+	for _, s := range loop.Block {
+		if path, _, ok := indexAppend(s); ok && path == name {
+			per++
+			count++
+			continue
+		}
+		assign, ok := s.(*ast.Assign)
+		if !ok || assign.LocalDecl || len(assign.Targets) != 1 {
+			continue
+		}
+		accessor, ok := assign.Targets[0].(*ast.TableAccessor)
+		if !ok {
+			continue
+		}
+		obj, obj_ok := accessor.Obj.(*ast.ConstIdent)
+		key, key_ok := accessor.Key.(*ast.ConstIdent)
+		if obj_ok && key_ok && obj.Value == name && key.Value == loop.Counter {
+			if !indexed {
+				per++
+			}
+			indexed = true
+			count++
+		}
+	}
+	if per == 0 || n > (1<<30)/per {
+		return 0, nil, 0
+	}
+	return n * per, nil, count
+}
+
+// fieldPresize 根据紧随其后的常量键字段赋值计算 name 的大小：返回数组大小、哈希部分的键和字段赋值语句数，
+// 少于两条时 count 为 0。只有从 1 开始连续的整数键计入数组部分，其他整数键（如 t[100]）计入哈希部分。
+func fieldPresize(name string, stmts []ast.Stmt) (int, []ast.Expr, int) {
+	count := 0
+	var order []ast.Expr
+	ints := map[int]bool{}
+	seen := map[string]bool{}
+	for _, s := range stmts {
+		assign, ok := s.(*ast.Assign)
+		if !ok || assign.LocalDecl || len(assign.Targets) != 1 || len(assign.Values) != 1 {
+			break
+		}
+		accessor, ok := assign.Targets[0].(*ast.TableAccessor)
+		if !ok {
+			break
+		}
+		if obj, ok := accessor.Obj.(*ast.ConstIdent); !ok || obj.Value != name {
+			break
+		}
+		var id string
+		var key_expr ast.Expr
+		switch key := accessor.Key.(type) {
+		case *ast.ConstString:
+			id = "s:" + key.Value
+			key_expr = &ast.ConstString{Value: key.Value}
+		case *ast.ConstInt:
+			n, err := strconv.Atoi(key.Value)
+			if err != nil || n < 1 {
+				break
+			}
+			id = "i:" + strconv.Itoa(n)
+			key_expr = &ast.ConstInt{Value: strconv.Itoa(n)}
+			ints[n] = true
+		}
+		if id == "" {
+			break
+		}
+		if !seen[id] {
+			order = append(order, key_expr)
+		}
+		seen[id] = true
+		count++
+	}
+	if count < 2 {
+		return 0, nil, 0
+	}
+	narr := 0
+	for ints[narr+1] {
+		narr++
+	}
+	var keys []ast.Expr
+	for _, key := range order {
+		if i, ok := key.(*ast.ConstInt); ok {
+			if n, _ := strconv.Atoi(i.Value); n <= narr {
+				continue
+			}
+		}
+		keys = append(keys, key)
+	}
+	return narr, keys, count
+}
+
+// tableNewName 返回在第 line 行可以使用的 table.new 局部变量名：主代码块顶层已有的
+// local X = require("table.new") 在 line 之前时复用，否则返回空串。
+func (o *optimizer) tableNewName(line int) string {
+	for _, stmt := range o.block {
+		if stmt.Line() >= line {
+			break
+		}
+		assign, ok := stmt.(*ast.Assign)
+		if !ok || !assign.LocalDecl || len(assign.Targets) != 1 || len(assign.Values) != 1 {
+			continue
+		}
+		ident, ok := assign.Targets[0].(*ast.ConstIdent)
+		call, call_ok := assign.Values[0].(*ast.FuncCall)
+		if !ok || !call_ok || !isRequireTableNew(call) {
+			continue
+		}
+		return ident.Value
+	}
+	return ""
+}
+
+// isRequireTableNew 判断 call 是否是 require("table.new")。
+func isRequireTableNew(call *ast.FuncCall) bool {
+	fn, ok := call.Function.(*ast.ConstIdent)
+	if !ok || fn.Value != "require" || call.Receiver != nil || len(call.Args) != 1 {
+		return false
+	}
+	arg, ok := call.Args[0].(*ast.ConstString)
+	return ok && arg.Value == "table.new"
+}
+
+// applyTablePrealloc 把 decl 改写为预分配的 table，LuaJIT 时按需在文件开头加入 require("table.new")。
+func (o *optimizer) applyTablePrealloc(decl *ast.Assign, name string, narr int, keys []ast.Expr, count int, comment string) {
+	line := decl.Line()
+	rw := Rewrite{Pass: "table_prealloc", Target: name, GroupSize: count, Replaced: 1}
+	rw.Line, rw.EndLine = o.origRange(line, line)
+
+	var value ast.Expr
+	shim := ""
+	if o.opts.Dialect == DialectLuaJIT {
+		table_new := o.tableNewName(line)
+		if table_new == "" {
+			table_new = getUniqueLocalName(o.block, "table_new")
+			shim = table_new
+		}
+		value = &ast.FuncCall{Function: &ast.ConstIdent{Value: table_new},
+			Args: []ast.Expr{&ast.ConstInt{Value: strconv.Itoa(narr)}, &ast.ConstInt{Value: strconv.Itoa(len(keys))}}}
+	} else {
+		cons := &ast.TableConstructor{}
+		for i := 0; i < narr; i++ {
+			cons.Keys = append(cons.Keys, nil)
+			cons.Vals = append(cons.Vals, &ast.ConstNil{})
+		}
+		for _, key := range keys {
+			cons.Keys = append(cons.Keys, key)
+			cons.Vals = append(cons.Vals, &ast.ConstNil{})
+		}
+		value = cons
+	}
+	new_decl := &ast.Assign{LocalDecl: true, Targets: decl.Targets, Values: []ast.Expr{value}}
+	marker := tablePreallocMarker
+	if comment != "" {
+		marker = comment + " " + marker
+	}
+	o.replaceStmtLine(line, new_decl, marker)
+
+	if shim != "" {
+		require := &ast.Assign{LocalDecl: true, Targets: []ast.Expr{&ast.ConstIdent{Value: shim}},
+			Values: []ast.Expr{&ast.FuncCall{Function: &ast.ConstIdent{Value: "require"}, Args: []ast.Expr{&ast.ConstString{Value: "table.new"}}}}}
+		insert_line, _ := o.find_stmt_line_range(o.block[0])
+		o.spliceLines(insert_line, insert_line-1, []string{stmt_to_lines(require, "")[0] + " " + tablePreallocMarker})
+	}
+
+	o.logf("opt table_prealloc at: %s:%d target=%s narr=%d nhash=%d", o.filename, line, name, narr, len(keys))
+	o.addRewrite(rw)
+}
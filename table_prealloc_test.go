@@ -0,0 +1,158 @@
+package olua
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+// ============================================================================
+// 集成测试：对比优化器输出与期望文件
+// ============================================================================
+
+// tablePreallocOptions 返回只启用 table 预分配、目标方言为 dialect 的测试选项。
+func tablePreallocOptions(dialect string) Options {
+	opts := DefaultOptions()
+	opts.TablePrealloc = true
+	opts.Dialect = dialect
+	return opts
+}
+
+func TestTablePreallocLuaJIT(t *testing.T) {
+	compareOptOutputWith(t, tablePreallocOptions(DialectLuaJIT), "input/table_prealloc.lua", "output/table_prealloc_luajit.lua")
+}
+
+func TestTablePreallocLua54(t *testing.T) {
+	compareOptOutputWith(t, tablePreallocOptions(DialectLua54), "input/table_prealloc.lua", "output/table_prealloc_54.lua")
+}
+
+func TestTablePreallocRevert(t *testing.T) {
+	original, err := os.ReadFile("input/table_prealloc.lua")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"table_prealloc_luajit", "table_prealloc_54"} {
+		optimized, err := os.ReadFile("output/" + name + ".lua")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _, err := Revert(optimized, Options{Filename: name})
+		if err != nil {
+			t.Fatalf("Revert(%s) failed: %v", name, err)
+		}
+		if string(got) != string(original) {
+			t.Errorf("Revert(%s) differs from the input:\n%s", name, UnifiedDiff(name, original, got))
+		}
+	}
+}
+
+// ============================================================================
+// 单元测试：方言和 require 复用
+// ============================================================================
+
+func TestTablePreallocNoDialect(t *testing.T) {
+	src := "local t = {}\nfor i = 1, 10 do\n    t[i] = i\nend\n"
+	out, _, err := Optimize([]byte(src), tablePreallocOptions(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != src {
+		t.Errorf("expected no rewrite without a dialect, got:\n%s", out)
+	}
+}
+
+func TestTablePreallocLua54Limit(t *testing.T) {
+	src := "local t = {}\nfor i = 1, 100 do\n    t[i] = i\nend\n"
+	out, _, err := Optimize([]byte(src), tablePreallocOptions(DialectLua54))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != src {
+		t.Errorf("expected no presized constructor over the limit, got:\n%s", out)
+	}
+}
+
+func TestTablePreallocReuseRequire(t *testing.T) {
+	src := "local new_tab = require(\"table.new\")\nfunction f()\n    local t = {}\n    t.a = 1\n    t.b = 2\nend\n"
+	out, _, err := Optimize([]byte(src), tablePreallocOptions(DialectLuaJIT))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), "local t = new_tab(0, 2)") || strings.Count(string(out), "require") != 1 {
+		t.Errorf("expected the existing require to be reused, got:\n%s", out)
+	}
+}
+
+func TestTablePreallocChunkLocalLimit(t *testing.T) {
+	// 主代码块的 local 接近上限时不能再加入 require 行；已有 require 时仍可复用
+	var sb strings.Builder
+	for i := 0; i < maxChunkLocals; i++ {
+		fmt.Fprintf(&sb, "local v%d = %d\n", i, i)
+	}
+	body := "function f()\n    local t = {}\n    t.a = 1\n    t.b = 2\nend\n"
+	src := sb.String() + body
+	out, report, err := Optimize([]byte(src), tablePreallocOptions(DialectLuaJIT))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != src {
+		t.Errorf("expected no rewrite at the local limit, got:\n%s", out)
+	}
+	if len(report.Skipped) != 1 || report.Skipped[0].Pass != "table_prealloc" || report.Skipped[0].Line != maxChunkLocals+2 {
+		t.Errorf("skipped = %+v", report.Skipped)
+	}
+
+	src = "local new_tab = require(\"table.new\")\n" + sb.String() + body
+	out, _, err = Optimize([]byte(src), tablePreallocOptions(DialectLuaJIT))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), "local t = new_tab(0, 2)") {
+		t.Errorf("expected the existing require to be reused, got:\n%s", out)
+	}
+}
+
+func TestTablePreallocSkips(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+	}{
+		{"counter assigned", "function f()\n    local t = {}\n    for i = 1, 10 do\n        t[i] = i\n        i = i + 1\n    end\nend\n"},
+		{"step", "function f()\n    local t = {}\n    for i = 1, 10, 2 do\n        t[i] = i\n    end\nend\n"},
+		{"not next statement", "function f()\n    local t = {}\n    print(t)\n    for i = 1, 10 do\n        t[i] = i\n    end\nend\n"},
+		{"other table", "function f(u)\n    local t = {}\n    for i = 1, 10 do\n        u[i] = i\n    end\nend\n"},
+		{"dynamic field", "function f(k)\n    local t = {}\n    t.a = 1\n    t[k] = 2\nend\n"},
+		{"disabled", "function f()\n    local t = {} -- olua:disable-line table_prealloc\n    t.a = 1\n    t.b = 2\nend\n"},
+	}
+	for _, tt := range tests {
+		out, _, err := Optimize([]byte(tt.src), tablePreallocOptions(DialectLuaJIT))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if string(out) != tt.src {
+			t.Errorf("%s: expected no rewrite, got:\n%s", tt.name, out)
+		}
+	}
+}
+
+func TestTablePreallocSparseKeys(t *testing.T) {
+	// 只有从 1 开始连续的整数键计入数组部分
+	src := "function f(a, b)\n    local t = {}\n    t[1] = a\n    t[100] = b\n    t[3] = a\n    return t\nend\n"
+	tests := []struct {
+		dialect string
+		want    string
+	}{
+		{DialectLuaJIT, "local t = table_new(1, 2)"},
+		{DialectLua54, "local t = {nil, [100] = nil, [3] = nil}"},
+	}
+	for _, tt := range tests {
+		out, _, err := Optimize([]byte(src), tablePreallocOptions(tt.dialect))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(out), tt.want) {
+			t.Errorf("%s: expected %q, got:\n%s", tt.dialect, tt.want, out)
+		}
+	}
+}
@@ -1,4 +1,4 @@
-package main
+package olua
 
 import (
 	"bufio"
@@ -13,11 +13,17 @@ import (
 // 放在独立文件中，所有 *_test.go 文件都可以使用。
 // ============================================================================
 
-// TestMain 设置测试默认值。
-// 注意：整个包只能有一个 TestMain，放在这里统一管理。
-func TestMain(m *testing.M) {
-	*opt_table_access_threshold = 2
-	os.Exit(m.Run())
+// tableAccessOptions 返回只启用表访问优化、阈值为 2 的测试选项。
+func tableAccessOptions() Options {
+	opts := DefaultOptions()
+	opts.TableAccess = true
+	opts.TableAccessThreshold = 2
+	return opts
+}
+
+// newTestOptimizer 返回一个使用 tableAccessOptions 的空优化器。
+func newTestOptimizer() *optimizer {
+	return newOptimizer(tableAccessOptions())
 }
 
 // readFileLines 按行读取文件内容（与优化器的 read_file 行为一致）。
@@ -41,68 +47,32 @@ func parseSource(source string) ([]ast.Stmt, error) {
 	return block, err
 }
 
-// runOptimizer 对输入文件执行表访问优化并返回结果行。
-// 模拟 main.go 中 opt() 的迭代逻辑。
-func runOptimizer(inputFile string) ([]string, error) {
-	// 重置全局状态
-	has_opt = false
-	goptcount = 0
-	gfilename = inputFile
-
-	// 读取输入
-	lines, err := readFileLines(inputFile)
+// runOptimizer 对输入文件执行 opts 指定的优化并返回结果行。
+func runOptimizer(inputFile string, opts Options) ([]string, error) {
+	src, err := os.ReadFile(inputFile)
 	if err != nil {
 		return nil, err
 	}
-	gfilecontent = lines
-
-	// 迭代优化
-	has_opt = true
-	for has_opt {
-		has_opt = false
-		source := ""
-		for _, line := range gfilecontent {
-			source += line + "\n"
-		}
-		block, err := parseSource(source)
-		if err != nil {
-			return nil, err
-		}
-		gblock = block
-		optTableAccess()
+	opts.Filename = inputFile
+	out, _, err := Optimize(src, opts)
+	if err != nil {
+		return nil, err
 	}
-
-	return gfilecontent, nil
+	return splitLines(out), nil
 }
 
-// optTableAccess 执行一轮表访问优化遍历。
-func optTableAccess() {
-	f := lua_visitor{f: func(n ast.Node, ok *bool) {
-		if has_opt {
-			*ok = false
-			return
-		}
-		if n != nil {
-			switch n.(type) {
-			case *ast.FuncDecl:
-				func_decl := n.(*ast.FuncDecl)
-				opt_func_table_access(func_decl)
-			}
-		}
-	}}
-	for _, stmt := range gblock {
-		ast.Walk(&f, stmt)
-	}
+// compareOptOutput 以表访问优化选项运行优化器并逐行对比结果与期望输出文件。
+func compareOptOutput(t *testing.T, inputFile, expectedFile string) {
+	t.Helper()
+	compareOptOutputWith(t, tableAccessOptions(), inputFile, expectedFile)
 }
 
-// compareOptOutput 运行优化器并逐行对比结果与期望输出文件。
+// compareOptOutputWith 以指定选项运行优化器并逐行对比结果与期望输出文件。
 // 适用于所有优化 pass 的集成测试。
-func compareOptOutput(t *testing.T, inputFile, expectedFile string) {
+func compareOptOutputWith(t *testing.T, opts Options, inputFile, expectedFile string) {
 	t.Helper()
 
-	*opt_table_access_threshold = 2
-
-	actual, err := runOptimizer(inputFile)
+	actual, err := runOptimizer(inputFile, opts)
 	if err != nil {
 		t.Fatalf("optimizer failed on %s: %v", inputFile, err)
 	}
@@ -0,0 +1,362 @@
+package olua
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/milochristiansen/lua"
+	"github.com/milochristiansen/lua/lmodbase"
+	"github.com/milochristiansen/lua/lmodmath"
+	"github.com/milochristiansen/lua/lmodstring"
+	"github.com/milochristiansen/lua/lmodtable"
+)
+
+// ============================================================================
+// 差分执行校验
+// ============================================================================
+//
+// 原始代码和优化后的代码分别加载到两个独立的 Lua 虚拟机中执行，
+// 比较返回值、print 输出和最终的全局变量。任何差异都说明优化改变了语义。
+//
+// 为了让两次执行可比较，虚拟机环境是确定性的：math.random 使用固定种子的
+// 伪随机数，os.time/os.clock/os.date 返回固定值。错误只比较"是否出错"，
+// 不比较错误信息，因为改写会移动行号。
+
+// VerifyOptions 控制差分执行校验。
+type VerifyOptions struct {
+	// Entry 是加载被测代码后执行的 Lua 入口脚本，为空时依次调用被测代码
+	// 新定义的每个全局函数（以及全局表中的函数，如 M.f），不传参数。
+	Entry string
+	// EntryName 只用于错误信息中标识入口脚本。
+	EntryName string
+}
+
+// VerifyError 表示原始代码和优化后的代码执行结果不一致。
+type VerifyError struct {
+	Filename string
+	Diffs    []string
+}
+
+func (e *VerifyError) Error() string {
+	return fmt.Sprintf("%v verify failed: %v", e.Filename, strings.Join(e.Diffs, "; "))
+}
+
+// Verify 分别执行 original 和 optimized，结果不一致时返回 *VerifyError。
+// filename 只用于错误信息。代码或入口脚本无法加载时返回普通错误。
+func Verify(filename string, original, optimized []byte, opts VerifyOptions) error {
+	want, err := runVerify(filename, original, opts)
+	if err != nil {
+		return err
+	}
+	got, err := runVerify(filename, optimized, opts)
+	if err != nil {
+		return fmt.Errorf("%v optimized code: %v", filename, err)
+	}
+	diffs := want.diff(got)
+	if len(diffs) > 0 {
+		return &VerifyError{Filename: filename, Diffs: diffs}
+	}
+	return nil
+}
+
+// verifyStep 是一次执行（加载代码、调用函数或入口脚本）的结果。
+type verifyStep struct {
+	name   string
+	result string
+}
+
+// verifyTrace 记录一次完整执行的可观察结果。
+type verifyTrace struct {
+	steps   []verifyStep
+	output  string
+	globals map[string]string
+}
+
+// diff 列出 want（原始代码）和 got（优化后代码）之间的差异。
+func (want *verifyTrace) diff(got *verifyTrace) []string {
+	var diffs []string
+	n := len(want.steps)
+	if len(got.steps) != n {
+		diffs = append(diffs, fmt.Sprintf("executed %d steps, want %d", len(got.steps), n))
+		if len(got.steps) < n {
+			n = len(got.steps)
+		}
+	}
+	for i := 0; i < n; i++ {
+		w, g := want.steps[i], got.steps[i]
+		if w.name != g.name {
+			diffs = append(diffs, fmt.Sprintf("step %d is %v, want %v", i+1, g.name, w.name))
+		} else if w.result != g.result {
+			diffs = append(diffs, fmt.Sprintf("%v returned %v, want %v", w.name, g.result, w.result))
+		}
+	}
+	if want.output != got.output {
+		diffs = append(diffs, fmt.Sprintf("output %q, want %q", got.output, want.output))
+	}
+	var names []string
+	for name := range want.globals {
+		names = append(names, name)
+	}
+	for name := range got.globals {
+		if _, ok := want.globals[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		w, wok := want.globals[name]
+		g, gok := got.globals[name]
+		switch {
+		case !wok:
+			diffs = append(diffs, fmt.Sprintf("unexpected global %v = %v", name, g))
+		case !gok:
+			diffs = append(diffs, fmt.Sprintf("missing global %v = %v", name, w))
+		case w != g:
+			diffs = append(diffs, fmt.Sprintf("global %v = %v, want %v", name, g, w))
+		}
+	}
+	return diffs
+}
+
+// runVerify 在一个新的虚拟机中执行 src 并记录结果。
+func runVerify(filename string, src []byte, opts VerifyOptions) (*verifyTrace, error) {
+	var out bytes.Buffer
+	l := newDeterministicState(&out)
+
+	baseline := snapshotGlobals(l)
+
+	trace := &verifyTrace{}
+	if err := l.LoadText(strings.NewReader(string(src)), filename, 0); err != nil {
+		return nil, err
+	}
+	trace.steps = append(trace.steps, verifyStep{"chunk", pcallResult(l)})
+
+	if opts.Entry != "" {
+		name := opts.EntryName
+		if name == "" {
+			name = "entry"
+		}
+		if err := l.LoadText(strings.NewReader(opts.Entry), name, 0); err != nil {
+			return nil, err
+		}
+		trace.steps = append(trace.steps, verifyStep{name, pcallResult(l)})
+	} else {
+		for _, name := range entryFunctions(l, baseline) {
+			pushPath(l, name)
+			trace.steps = append(trace.steps, verifyStep{name, pcallResult(l)})
+		}
+	}
+
+	trace.output = out.String()
+	trace.globals = snapshotGlobals(l)
+	for name, value := range baseline {
+		// 标准库本身不参与比较，除非被测代码修改了它
+		if trace.globals[name] == value {
+			delete(trace.globals, name)
+		}
+	}
+	return trace, nil
+}
+
+// pcallResult 调用栈顶的函数并把返回值（或错误）格式化为字符串，调用后栈恢复到函数入栈之前。
+func pcallResult(l *lua.State) string {
+	base := l.AbsIndex(-1) - 1
+	if err := l.PCall(0, -1); err != nil {
+		// 弹出错误值（虚拟机留在栈上时），保持栈平衡
+		if n := l.AbsIndex(-1) - base; n > 0 {
+			l.Pop(n)
+		}
+		return "error"
+	}
+	top := l.AbsIndex(-1)
+	var rets []string
+	for i := base + 1; i <= top; i++ {
+		rets = append(rets, luaValueString(l, i, nil, 0))
+	}
+	l.Pop(top - base)
+	return "(" + strings.Join(rets, ", ") + ")"
+}
+
+// entryFunctions 返回被测代码新定义的全局函数，以及新全局表中的函数，按名字排序。
+func entryFunctions(l *lua.State, baseline map[string]string) []string {
+	var names []string
+	l.PushIndex(lua.GlobalsIndex)
+	l.ForEachRaw(-1, func() bool {
+		if l.TypeOf(-2) != lua.TypString {
+			return true
+		}
+		name := l.ToString(-2)
+		if _, ok := baseline[name]; ok || name == "_G" {
+			return true
+		}
+		switch l.TypeOf(-1) {
+		case lua.TypFunction:
+			names = append(names, name)
+		case lua.TypTable:
+			l.ForEachRaw(-1, func() bool {
+				if l.TypeOf(-2) == lua.TypString && l.TypeOf(-1) == lua.TypFunction && isLuaName(l.ToString(-2)) {
+					names = append(names, name+"."+l.ToString(-2))
+				}
+				return true
+			})
+		}
+		return true
+	})
+	l.Pop(1)
+	sort.Strings(names)
+	return names
+}
+
+// pushPath 把 a 或 a.b 形式的全局路径的值压栈。
+func pushPath(l *lua.State, path string) {
+	parts := strings.SplitN(path, ".", 2)
+	l.Push(parts[0])
+	l.GetTable(lua.GlobalsIndex)
+	if len(parts) == 2 {
+		l.Push(parts[1])
+		l.GetTableRaw(-2)
+		l.Set(-2, -1)
+		l.Pop(1)
+	}
+}
+
+// snapshotGlobals 把全局变量格式化为 名字 -> 值 的映射（不含 _G 自身）。
+func snapshotGlobals(l *lua.State) map[string]string {
+	globals := map[string]string{}
+	l.PushIndex(lua.GlobalsIndex)
+	l.ForEachRaw(-1, func() bool {
+		key := luaValueString(l, -2, nil, maxVerifyDepth)
+		if l.TypeOf(-2) == lua.TypString {
+			key = l.ToString(-2)
+		}
+		if key != "_G" {
+			globals[key] = luaValueString(l, -1, nil, 0)
+		}
+		return true
+	})
+	l.Pop(1)
+	return globals
+}
+
+// maxVerifyDepth 限制格式化嵌套 table 的深度，超出部分只输出 "{...}"。
+const maxVerifyDepth = 16
+
+// luaValueString 把栈上 i 处的值格式化为与虚拟机实例无关的字符串。
+// table 按键排序递归展开，函数只输出类型，onPath 用于检测环。
+func luaValueString(l *lua.State, i int, onPath map[string]bool, depth int) string {
+	i = l.AbsIndex(i)
+	switch l.TypeOf(i) {
+	case lua.TypNil:
+		return "nil"
+	case lua.TypBool:
+		return strconv.FormatBool(l.ToBool(i))
+	case lua.TypNumber:
+		if l.SubTypeOf(i) == lua.STypInt {
+			return strconv.FormatInt(l.ToInt(i), 10)
+		}
+		s := strconv.FormatFloat(l.ToFloat(i), 'g', -1, 64)
+		if !strings.ContainsAny(s, ".eEnI") {
+			s += ".0"
+		}
+		return s
+	case lua.TypString:
+		return strconv.Quote(l.ToString(i))
+	case lua.TypTable:
+		if depth >= maxVerifyDepth {
+			return "{...}"
+		}
+		id := fmt.Sprint(l.GetRaw(i))
+		if onPath[id] {
+			return "<cycle>"
+		}
+		if onPath == nil {
+			onPath = map[string]bool{}
+		}
+		onPath[id] = true
+		var fields []string
+		l.ForEachRaw(i, func() bool {
+			fields = append(fields, luaValueString(l, -2, onPath, depth+1)+" = "+luaValueString(l, -1, onPath, depth+1))
+			return true
+		})
+		delete(onPath, id)
+		sort.Strings(fields)
+		return "{" + strings.Join(fields, ", ") + "}"
+	default:
+		return l.TypeOf(i).String()
+	}
+}
+
+// newDeterministicState 创建一个加载了标准库的确定性虚拟机，print 输出写到 out（nil 表示丢弃）。
+// 校验和基准测试都使用它，保证优化前后的代码在相同的环境中执行。
+func newDeterministicState(out io.Writer) *lua.State {
+	l := lua.NewState()
+	if out == nil {
+		out = io.Discard
+	}
+	l.Output = out
+	for _, open := range []lua.NativeFunction{lmodbase.Open, lmodstring.Open, lmodtable.Open, lmodmath.Open} {
+		l.Push(open)
+		l.Call(0, 0)
+	}
+
+	// math.random 使用每个虚拟机独立的固定种子，保证两次执行得到相同的序列
+	seed := uint64(1)
+	next := func() uint64 {
+		seed ^= seed << 13
+		seed ^= seed >> 7
+		seed ^= seed << 17
+		return seed
+	}
+	l.Push("math")
+	l.GetTable(lua.GlobalsIndex)
+	l.Push("random")
+	l.Push(func(l *lua.State) int {
+		switch l.AbsIndex(-1) {
+		case 0:
+			l.Push(float64(next()>>11) / (1 << 53))
+		case 1:
+			m := l.ToInt(1)
+			l.Push(1 + int64(next()%uint64(maxInt64(m, 1))))
+		default:
+			m, n := l.ToInt(1), l.ToInt(2)
+			l.Push(m + int64(next()%uint64(maxInt64(n-m+1, 1))))
+		}
+		return 1
+	})
+	l.SetTableRaw(-3)
+	l.Push("randomseed")
+	l.Push(func(l *lua.State) int {
+		seed = uint64(l.ToInt(1)) | 1
+		return 0
+	})
+	l.SetTableRaw(-3)
+	l.Pop(1)
+
+	// os 只提供返回固定值的时间函数
+	l.NewTable(0, 4)
+	l.Push("time")
+	l.Push(func(l *lua.State) int { l.Push(int64(0)); return 1 })
+	l.SetTableRaw(-3)
+	l.Push("clock")
+	l.Push(func(l *lua.State) int { l.Push(float64(0)); return 1 })
+	l.SetTableRaw(-3)
+	l.Push("date")
+	l.Push(func(l *lua.State) int { l.Push("1970-01-01 00:00:00"); return 1 })
+	l.SetTableRaw(-3)
+	l.Push("getenv")
+	l.Push(func(l *lua.State) int { l.Push(nil); return 1 })
+	l.SetTableRaw(-3)
+	l.SetGlobal("os")
+	return l
+}
+
+func maxInt64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
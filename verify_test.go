@@ -0,0 +1,135 @@
+package olua
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+// ============================================================================
+// 差分执行校验测试
+// ============================================================================
+
+// verifyDiffs 校验 original 和 optimized，返回差异列表（一致时为空）。
+func verifyDiffs(t *testing.T, original, optimized string, opts VerifyOptions) []string {
+	t.Helper()
+	err := Verify("test.lua", []byte(original), []byte(optimized), opts)
+	if err == nil {
+		return nil
+	}
+	var verr *VerifyError
+	if !errors.As(err, &verr) {
+		t.Fatalf("Verify returned %v, want *VerifyError", err)
+	}
+	return verr.Diffs
+}
+
+func TestVerifySame(t *testing.T) {
+	src := `
+local t = {a = {b = 1}}
+function test()
+    local x = t.a.b
+    print("x", x, 1.5, math.random(10))
+    return x, {t.a.b, k = "v"}
+end
+count = 0
+`
+	if diffs := verifyDiffs(t, src, src, VerifyOptions{}); len(diffs) != 0 {
+		t.Errorf("identical code diverged: %v", diffs)
+	}
+}
+
+func TestVerifyDetectsDivergence(t *testing.T) {
+	tests := []struct {
+		name      string
+		original  string
+		optimized string
+		want      string
+	}{
+		{"return", "function f() return 1 end", "function f() return 2 end", "f returned (2), want (1)"},
+		{"int vs float", "function f() return 1 end", "function f() return 1.0 end", "f returned (1.0), want (1)"},
+		{"output", "function f() print(1) end", "function f() print(2) end", "output"},
+		{"global", "function f() g = 1 end", "function f() g = 2 end", "global g = 2, want 1"},
+		{"error", "function f() return 1 end", "function f() error('x') end", "f returned error"},
+		{"module", "M = {}\nfunction M.f() return 1 end", "M = {}\nfunction M.f() return 2 end", "M.f returned (2)"},
+		{"stdlib", "function f() end", "function f() string.x = 1 end", "global string"},
+	}
+	for _, tt := range tests {
+		diffs := verifyDiffs(t, tt.original, tt.optimized, VerifyOptions{})
+		if !strings.Contains(strings.Join(diffs, "\n"), tt.want) {
+			t.Errorf("%s: diffs %q should contain %q", tt.name, diffs, tt.want)
+		}
+	}
+}
+
+func TestVerifyErrorMessageIgnored(t *testing.T) {
+	// 改写会移动行号，错误信息不同但都出错时视为一致
+	original := "function f()\n    error('x')\nend"
+	optimized := "function f()\n\n    error('x')\nend"
+	if diffs := verifyDiffs(t, original, optimized, VerifyOptions{}); len(diffs) != 0 {
+		t.Errorf("error location change reported as divergence: %v", diffs)
+	}
+}
+
+func TestVerifyEntry(t *testing.T) {
+	original := "function add(a, b) return a + b end"
+	optimized := "function add(a, b) return a - b end"
+	// 不带参数调用时两者都出错，只有入口脚本能发现差异
+	if diffs := verifyDiffs(t, original, optimized, VerifyOptions{}); len(diffs) != 0 {
+		t.Errorf("calls without arguments should both fail: %v", diffs)
+	}
+	opts := VerifyOptions{Entry: "return add(1, 2)", EntryName: "entry.lua"}
+	diffs := verifyDiffs(t, original, optimized, opts)
+	if len(diffs) != 1 || diffs[0] != "entry.lua returned (-1), want (3)" {
+		t.Errorf("diffs = %q, want the entry result to differ", diffs)
+	}
+}
+
+func TestVerifyLoadError(t *testing.T) {
+	err := Verify("test.lua", []byte("function f() end"), []byte("function f("), VerifyOptions{})
+	if err == nil || !strings.Contains(err.Error(), "optimized code") {
+		t.Errorf("Verify = %v, want a load error for the optimized code", err)
+	}
+	var verr *VerifyError
+	if errors.As(err, &verr) {
+		t.Error("load error should not be reported as a divergence")
+	}
+}
+
+func TestVerifyFixtures(t *testing.T) {
+	// 现有的优化结果在执行层面必须与原始代码一致
+	for _, name := range []string{"table_access_semantic", "table_access_invalidate", "table_access_loop", "table_access_condread", "table_access_ifwrite"} {
+		original, err := os.ReadFile("input/" + name + ".lua")
+		if err != nil {
+			t.Fatal(err)
+		}
+		optimized, err := os.ReadFile("output/" + name + ".lua")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := Verify(name, original, optimized, VerifyOptions{}); err != nil {
+			t.Errorf("%v", err)
+		}
+	}
+}
+
+func TestPcallResultStack(t *testing.T) {
+	// 出错和正常返回后栈都恢复到函数入栈之前，不影响之后的调用
+	l := newDeterministicState(&strings.Builder{})
+	l.Push("sentinel")
+	for _, tt := range []struct{ src, want string }{
+		{"error('x')", "error"},
+		{"return 1, 2", "(1, 2)"},
+	} {
+		if err := l.LoadText(strings.NewReader(tt.src), "test.lua", 0); err != nil {
+			t.Fatal(err)
+		}
+		if got := pcallResult(l); got != tt.want {
+			t.Errorf("pcallResult(%q) = %q, want %q", tt.src, got, tt.want)
+		}
+		if top := l.AbsIndex(-1); top != 1 || l.ToString(-1) != "sentinel" {
+			t.Errorf("%q: stack top = %d (%q), want the sentinel only", tt.src, top, l.ToString(-1))
+		}
+	}
+}